@@ -1,8 +1,10 @@
 package klevdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"iter"
 	"time"
 
 	"github.com/klev-dev/klevdb/pkg/index"
@@ -23,6 +25,9 @@ const (
 
 type Message = message.Message
 
+// Header is a key/value pair attached to a [Message]. Headers are only stored by [V3] (and later) segments.
+type Header = message.Header
+
 // InvalidMessage returned when an error has occurred
 var InvalidMessage = message.Invalid
 
@@ -35,11 +40,66 @@ var ErrNotFound = message.ErrNotFound
 // ErrNoIndex error is returned when we try to use key or timestamp, but the log doesn't include index on them
 var ErrNoIndex = errors.New("no index")
 
+// ErrMessageTooBig error is returned when publishing a message larger than the format supports
+var ErrMessageTooBig = message.ErrMessageTooBig
+
+// ErrBackupCorrupted error is returned by VerifyBackup when the backup doesn't match its manifest
+var ErrBackupCorrupted = segment.ErrBackupCorrupted
+
+// ErrOffsetMismatch error is returned by PublishIf (or PublishIfKey) when the next offset of the log
+// (or the offset of the key) is not the expected one, use [errors.As] with [OffsetMismatchError] to get the actual offset
+var ErrOffsetMismatch = errors.New("offset mismatch")
+
+// OffsetMismatchError is the error returned by PublishIf and PublishIfKey, carrying the actual offset
+type OffsetMismatchError struct {
+	Expected int64
+	Actual   int64
+}
+
+func (e *OffsetMismatchError) Error() string {
+	return fmt.Sprintf("%s: expected %d, actual %d", ErrOffsetMismatch, e.Expected, e.Actual)
+}
+
+func (e *OffsetMismatchError) Unwrap() error {
+	return ErrOffsetMismatch
+}
+
+// ErrDuplicateSequence error is returned by PublishIdempotent when the sequence of a batch
+// is older than the last one published by the producer
+var ErrDuplicateSequence = errors.New("duplicate producer sequence")
+
+// ErrOutOfOrderSequence error is returned by PublishIdempotent when the sequence of a batch
+// skips over the next one expected from the producer
+var ErrOutOfOrderSequence = errors.New("out of order producer sequence")
+
 // ErrReadonly error is returned when attempting to modify (e.g. publish or delete) from a log that is open as a readonly
 var ErrReadonly = errors.New("log opened in readonly mode")
 
+// ErrSyncFailed error is returned by all syncs and publishes, after a sync of the log has failed.
+// The log can't tell which of the published messages were persisted, so it fails until reopened (and checked).
+var ErrSyncFailed = errors.New("log sync failed")
+
 type Stats = segment.Stats
 
+// Compression is the codec used to compress blocks of messages
+type Compression = message.Compression
+
+const (
+	// CompressionNone stores messages uncompressed
+	CompressionNone = message.CompressionNone
+	// CompressionFlate compresses blocks of messages with DEFLATE
+	CompressionFlate = message.CompressionFlate
+)
+
+// KeyProvider provides the keys used to encrypt messages at rest, see [Options.Encryption]
+type KeyProvider = message.KeyProvider
+
+// Keyring is a static [KeyProvider]
+type Keyring = message.Keyring
+
+// ErrDecrypt is returned when messages cannot be decrypted, e.g. because of a wrong key
+var ErrDecrypt = message.ErrDecrypt
+
 type Options struct {
 	// When set will try to create all directories
 	CreateDirs bool
@@ -51,8 +111,15 @@ type Options struct {
 	// Index message times, enabling GetByTime and OffsetByTime.
 	// This setting must not change after the store is first created; changing it will return ErrCorrupted.
 	TimeIndex bool
-	// Force filesystem sync after each Publish
+	// Force filesystem sync after each Publish, before it returns. Concurrent publishes wait for one shared sync,
+	// instead of each syncing on its own.
 	AutoSync bool
+	// SyncInterval syncs the head segment in the background at this interval, if anything was published since
+	// the last sync. Unlike AutoSync publishes don't wait for it, so up to an interval of messages can be lost.
+	SyncInterval time.Duration
+	// SyncEveryBytes syncs the head segment in the background, once this many bytes were published since the last sync.
+	// Can be combined with SyncInterval, to also bound the time of unsynced messages.
+	SyncEveryBytes int64
 	// At what segment size it will rollover to a new segment. Defaults to 1MB.
 	Rollover int64
 	// Check the head segment for integrity, before opening it for reading/writing.
@@ -63,6 +130,45 @@ type Options struct {
 	Recover bool
 	// Upgrade specifies how to upgrade the versions
 	Version VersionOptions
+	// Compression compresses the messages of new segments in blocks, e.g. messages published
+	// together are compressed together. Requires V3 (or later) NewSegmentsVersion, which
+	// is also the default when compression is set.
+	Compression Compression
+	// Encryption encrypts the messages of new segments with the current key of this provider, the id
+	// of the key is stored in the segment so keys can be rotated between segments. It is required to
+	// read encrypted segments. Requires V3 (or later) NewSegmentsVersion, which is also the default
+	// when encryption is set. Only messages are encrypted, indexes are not: they store offsets, times
+	// and (unkeyed) hashes of the message keys in plain text, as do the unified indexes of the log.
+	Encryption KeyProvider
+	// UnifiedKeyIndex maintains an index of the last offset of each key across all segments, so
+	// GetByKey doesn't need to search every segment. It is persisted on close (and rollover) in the log
+	// directory, and rebuilt from the segments if missing. Requires KeyIndex, and is not used in readonly mode.
+	UnifiedKeyIndex bool
+	// UnifiedTimeIndex maintains the time range of each segment, so GetByTime and OffsetByTime only
+	// load the index of the segment containing the time. It is persisted on rollover (and delete) in the log
+	// directory, and rebuilt from the segments if missing. Requires TimeIndex, and is not used in readonly mode.
+	UnifiedTimeIndex bool
+	// Idempotent enables PublishIdempotent, deduplicating batches retried by producers. The producer and
+	// sequence of each batch are stored as headers of its last message. The state of the producers is persisted on
+	// close (and rollover) in the log directory, and on open only the messages after it are read. Requires V3 (or later) NewSegmentsVersion, which is also
+	// the default when idempotent is set. The head segment of an existing V1/V2 log is rolled over on the next publish.
+	Idempotent bool
+	// LazyWriter delays opening the writer of the head segment until the first publish, reading it
+	// like any other segment until then. Useful when keeping many mostly idle logs open.
+	LazyWriter bool
+	// WriterIdleTimeout closes the writer of a LazyWriter log, if there were no publishes for this
+	// duration. It is checked by GC, and the writer is opened again by the next publish. Zero keeps it open.
+	WriterIdleTimeout time.Duration
+	// Metrics receives counters and histograms of the operations of the log, like publish latency and batch sizes,
+	// rollovers, index loads, GC evictions and delete rewrites. See [NewExpvarMetrics] for an implementation.
+	Metrics Metrics
+	// Events receives the lifecycle events of the segments of the log, e.g. to upload segments once sealed.
+	// See [Events] for the events sent.
+	Events Events
+	// Retention applies retention policies (max age, size and count of messages, and compaction) in the background,
+	// instead of calling TrimBy*Multi and Compact*Multi periodically. The last run is reported by [Log.Stat], and the
+	// background stops on close. Not used in readonly mode.
+	Retention RetentionOptions
 }
 
 type Version struct {
@@ -74,11 +180,48 @@ var (
 	vUnknown = Version{}
 	V1       = Version{message.V1, index.V1}
 	V2       = Version{message.V2, index.V2}
-	VLast    = V2
+	V3       = Version{message.V3, index.V2}
+	VLast    = V3
 )
 
+var (
+	errCompressionVersion = errors.New("compression requires V3 or later version")
+	errEncryptionVersion  = errors.New("encryption requires V3 or later version")
+	errIdempotentVersion  = errors.New("idempotent producers require V3 or later version")
+)
+
+// withOptions applies the compression and encryption options to a version, checking it supports the rest
+func (v Version) withOptions(opts Options) (Version, error) {
+	blocks := v.messages == message.V3
+	if opts.Compression != CompressionNone {
+		if !blocks {
+			return vUnknown, errCompressionVersion
+		}
+		v.messages = v.messages.WithCompression(opts.Compression)
+	}
+	if opts.Encryption != nil {
+		if !blocks {
+			return vUnknown, errEncryptionVersion
+		}
+		v.messages = v.messages.WithEncryption()
+	}
+	if opts.Idempotent && !blocks {
+		return vUnknown, errIdempotentVersion
+	}
+	return v, nil
+}
+
+// versionOf returns the version used to write messages in a particular format
+func versionOf(mversion message.Version) Version {
+	if mversion == message.V1 {
+		return Version{mversion, index.V1}
+	}
+	return Version{mversion, index.V2}
+}
+
 type VersionOptions struct {
-	// NewSegmentsVersion indicates what version will new segments use
+	// NewSegmentsVersion indicates what version will new segments use. Defaults to V2,
+	// use V3 to store message headers. A head segment that can't store headers is rolled over on the next publish.
 	NewSegmentsVersion Version
 
 	// KeepRewriteVersion rewriting segments (delete) will keep the original segment version
@@ -93,8 +236,38 @@ type Log interface {
 	// It returns the offset of the next message to be appended.
 	// The offset of the message is ignored, set to the actual offset.
 	// If the time of the message is 0, it is set to the current UTC time.
+	// ProducerHeader and SequenceHeader are reserved for PublishIdempotent, messages with them are rejected.
 	Publish(messages []Message) (nextOffset int64, err error)
 
+	// PublishIf appends messages to the log, only if its next offset is expectedNextOffset,
+	// e.g. nothing else was published since it was last read.
+	// Otherwise it returns an [OffsetMismatchError] (matching ErrOffsetMismatch)
+	// with the actual next offset, and publishes nothing.
+	PublishIf(expectedNextOffset int64, messages []Message) (nextOffset int64, err error)
+
+	// PublishIfKey appends a message with this key to the log, only if the offset of
+	// the last message for the key (see OffsetByKey) is expectedOffset.
+	// Use OffsetInvalid as expectedOffset to publish only if the key doesn't exist.
+	// Otherwise it returns an [OffsetMismatchError] (matching ErrOffsetMismatch)
+	// with the actual offset of the key (or OffsetInvalid), and publishes nothing.
+	// If the log doesn't index keys, it returns ErrNoIndex.
+	PublishIfKey(key []byte, expectedOffset int64, message Message) (nextOffset int64, err error)
+
+	// PublishIdempotent appends a batch of messages from a producer to the log, requires Options.Idempotent.
+	// Each producer numbers its batches with increasing sequences, e.g. starting at 0. Publishing the same
+	// sequence again (e.g. a retry after a timeout) publishes nothing and returns the original nextOffset.
+	// Older sequences are rejected with ErrDuplicateSequence, while skipping sequences is rejected
+	// with ErrOutOfOrderSequence. The first batch of an unknown producer can have any sequence.
+	// The messages are not modified, ProducerHeader and SequenceHeader are added to the last published message.
+	// PublishAt keeps them, e.g. when replicating another log, while other publishes reject them.
+	PublishIdempotent(producerID string, sequence int64, messages []Message) (nextOffset int64, err error)
+
+	// PublishAt appends messages to the log, keeping their offsets, e.g. when replicating another log.
+	// The offsets must be increasing and at least NextOffset, otherwise it returns ErrInvalidOffset
+	// and publishes nothing. Skipped offsets are treated as deleted messages.
+	// If the time of the message is 0, it is set to the current UTC time.
+	PublishAt(messages []Message) (nextOffset int64, err error)
+
 	// NextOffset returns the offset of the next message to be published.
 	NextOffset() (nextOffset int64, err error)
 
@@ -116,9 +289,34 @@ type Log interface {
 	//   to the head of the log in which case they are equal.
 	Consume(offset int64, maxCount int64) (nextOffset int64, messages []Message, err error)
 
+	// ConsumeBackward retrieves messages before offset (exclusive) from the log,
+	//   in descending offset order, crossing segment boundaries.
+	// It returns offset, which can be used to retrieve the next (older) messages,
+	//   e.g. the offset of the oldest message returned.
+	// If offset == OffsetNewest, the first message will be the newest
+	//   message on the log.
+	// If offset is after NextOffset, it returns ErrInvalidOffset
+	// If there are no messages before offset (or offset == OffsetOldest),
+	//   it returns no messages and nextOffset equal to offset.
+	ConsumeBackward(offset int64, maxCount int64) (nextOffset int64, messages []Message, err error)
+
 	// ConsumeByKey is similar to Consume, but only returns messages matching the key
 	ConsumeByKey(key []byte, offset int64, maxCount int64) (nextOffset int64, messages []Message, err error)
 
+	// All iterates the messages in the log, starting at offset from (which can be OffsetOldest).
+	// It skips deleted messages and crosses segment boundaries, stopping once
+	//   it is caught up with the head of the log.
+	// On error (including when ctx is done) it yields InvalidMessage with the error and stops.
+	All(ctx context.Context, from int64) iter.Seq2[Message, error]
+
+	// ByKey is similar to All, but only iterates messages matching the key
+	ByKey(ctx context.Context, key []byte, from int64) iter.Seq2[Message, error]
+
+	// ByTimeRange is similar to All, but iterates the messages with time
+	//   in the [start, end) range, stopping at the first message at or after end.
+	// It uses the time index, if available, to find the first message.
+	ByTimeRange(ctx context.Context, start, end time.Time) iter.Seq2[Message, error]
+
 	// Get retrieves a single message, by its offset
 	// If offset == OffsetOldest, it returns the first message on the log
 	// If offset == OffsetNewest, it returns the last message on the log
@@ -150,19 +348,30 @@ type Log interface {
 
 	// Size returns the amount of storage a message occupies in the
 	// NewSegmentsVersion format (see VersionOptions), plus the index overhead.
-	// For logs with mixed V1/V2 segments this may differ from the actual
+	// For logs with mixed V1/V2/V3 segments this may differ from the actual
 	// on-disk size of messages stored in older segments.
 	Size(m Message) int64
 
-	// Stat returns log stats like disk space, number of messages
+	// Stat returns log stats like disk space, number of messages.
+	// The lag of the consumers of the log is returned by [StatConsumers] instead, since Stats are the stats of its segments.
 	Stat() (Stats, error)
 
-	// Backup takes a backup snapshot of this log to another location
+	// RetentionStats returns the stats of the last run of the retention policies, see [Options.Retention].
+	// They are zero until the policies are applied for the first time.
+	RetentionStats() RetentionStats
+
+	// Dir returns the directory of the log
+	Dir() string
+
+	// Backup takes a backup snapshot of this log to another location. Backups are incremental,
+	// repeating a backup to the same location only copies what has changed since the last one.
+	// The location keeps a manifest of the backup, see [VerifyBackup]. Publishing continues during the backup,
+	// which includes the messages published before it started, while deletes wait for it.
 	Backup(dir string) error
 
 	// Sync forces persisting data to the disk. It returns the nextOffset
 	// at the time of the Sync, so clients can determine what portion
-	// of the log is now durable.
+	// of the log is now durable. Concurrent calls wait for one shared sync.
 	Sync() (nextOffset int64, err error)
 
 	// GC releases any unused resources associated with this log
@@ -180,25 +389,118 @@ func Stat(dir string, opts Options) (Stats, error) {
 	})
 }
 
-// Backup backups a store directory to another location, without opening the store
+// SegmentStats are the stats of a single segment, see [Segments]
+type SegmentStats struct {
+	segment.Stats
+	// Offset is the offset the segment starts at (e.g. its file name)
+	Offset int64
+	// FirstOffset and LastOffset are the offsets of the first and last message, or OffsetInvalid if it is empty
+	FirstOffset int64
+	LastOffset  int64
+	// MessagesVersion is the format of the log file, e.g. "V3+flate"
+	MessagesVersion string
+	// IndexVersion is the format of the index file
+	IndexVersion string
+}
+
+// Segments stats each segment of a store directory, without opening the store
+func Segments(dir string, opts Options) ([]SegmentStats, error) {
+	params := index.Params{
+		Times: opts.TimeIndex,
+		Keys:  opts.KeyIndex,
+	}
+	segments, err := segment.Find(dir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]SegmentStats, 0, len(segments))
+	for _, seg := range segments {
+		segStats, err := seg.Stat(params)
+		if err != nil {
+			return nil, fmt.Errorf("stat %d: %w", seg.Offset, err)
+		}
+		mversion, err := message.GetVersion(seg.Log, seg.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("stat %d: %w", seg.Offset, err)
+		}
+		iversion, err := index.GetVersion(seg.Index, seg.Offset, params)
+		if err != nil {
+			return nil, fmt.Errorf("stat %d: %w", seg.Offset, err)
+		}
+		items, err := index.Read(seg.Index, seg.Offset, params)
+		if err != nil {
+			return nil, fmt.Errorf("stat %d: %w", seg.Offset, err)
+		}
+
+		s := SegmentStats{
+			Stats:           segStats,
+			Offset:          seg.Offset,
+			FirstOffset:     OffsetInvalid,
+			LastOffset:      OffsetInvalid,
+			MessagesVersion: mversion.String(),
+			IndexVersion:    iversion.String(),
+		}
+		if len(items) > 0 {
+			s.FirstOffset, s.LastOffset = items[0].Offset, items[len(items)-1].Offset
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// Backup backups a store directory to another location, without opening the store. See [Log.Backup]
 func Backup(src, dst string) error {
 	return segment.BackupDir(src, dst)
 }
 
+// VerifyBackup checks that the files of a backup location match the manifest of its last backup
+func VerifyBackup(dir string) error {
+	return segment.VerifyBackupDir(dir)
+}
+
+// ErrRestoreTarget error is returned by Restore when the target directory already contains a log
+var ErrRestoreTarget = segment.ErrRestoreTarget
+
+// RestoreOptions configures a [Restore]
+type RestoreOptions struct {
+	// Options of the log, its index and encryption options are used to rebuild and check the restored log
+	Options
+
+	// UpToOffset restores only the messages before this offset, when positive
+	UpToOffset int64
+	// UpToTime restores only the messages before the first message at or after this time, when not zero
+	UpToTime time.Time
+}
+
+// Restore restores a backup location (see [Backup] and [Log.Backup]) to a new store directory,
+// optionally only up to an offset or time, e.g. to discard messages published after some point.
+// Whole segments are copied, the last one is truncated at the limit and reindexed.
+// The restored log is checked, like with [Check]. If restoring fails, what was restored is removed.
+func Restore(backupDir, targetDir string, opts RestoreOptions) error {
+	return segment.RestoreDir(backupDir, targetDir, index.Params{
+		Times: opts.TimeIndex,
+		Keys:  opts.KeyIndex,
+	}, opts.Encryption, segment.RestoreLimit{
+		UpToOffset: opts.UpToOffset,
+		UpToTime:   opts.UpToTime,
+	})
+}
+
 // Check runs an integrity check, without opening the store
 func Check(dir string, opts Options) error {
-	return segment.CheckDir(dir, index.Params{
+	return segment.CheckDirKeys(dir, index.Params{
 		Times: opts.TimeIndex,
 		Keys:  opts.KeyIndex,
-	})
+	}, opts.Encryption)
 }
 
 // Recover rewrites the storage to include all messages prior the first that fails an integrity check
 func Recover(dir string, opts Options) error {
-	return segment.RecoverDir(dir, index.Params{
+	return segment.RecoverDirKeys(dir, index.Params{
 		Times: opts.TimeIndex,
 		Keys:  opts.KeyIndex,
-	})
+	}, opts.Encryption)
 }
 
 // Migrate rewrites all segments with a concrete options and version
@@ -206,8 +508,12 @@ func Migrate(dir string, opts Options, version Version) error {
 	if version == vUnknown {
 		return fmt.Errorf("migrate: version must be specified (e.g. klevdb.V2)")
 	}
-	return segment.MigrateDir(dir, version.messages, version.index, index.Params{
+	version, err := version.withOptions(opts)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	return segment.MigrateDirKeys(dir, version.messages, version.index, index.Params{
 		Times: opts.TimeIndex,
 		Keys:  opts.KeyIndex,
-	})
+	}, opts.Encryption)
 }
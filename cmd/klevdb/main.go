@@ -0,0 +1,152 @@
+// Command klevdb inspects and maintains klevdb logs.
+//
+// Usage:
+//
+//	klevdb <command> [flags] <dir>
+//
+// Run "klevdb help" for the list of commands. Commands reading messages open the log in
+// readonly mode, which fails if the log is open for writing by another process.
+// Encrypted logs are not supported, since the keys can't be passed on the command line.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/klev-dev/klevdb"
+	"github.com/klev-dev/klevdb/pkg/index"
+)
+
+type command struct {
+	name  string
+	args  string
+	help  string
+	flags func(fs *flag.FlagSet) func(args []string, e *env) error
+}
+
+// env is the environment commands run in, so they can be tested
+type env struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+var errUsage = errors.New("usage")
+
+var commands = []command{
+	{"stat", "<dir>", "print the stats of a log", statCmd},
+	{"segments", "<dir>", "list the segments of a log, with their offsets, versions and sizes", segmentsCmd},
+	{"check", "<dir>", "check the integrity of the head segment", checkCmd},
+	{"recover", "<dir>", "recover the good prefix of the head segment", recoverCmd},
+	{"migrate", "<dir>", "rewrite all segments with another version", migrateCmd},
+	{"backup", "<dir> <target>", "backup a log to another directory, copying only what changed since the last backup", backupCmd},
+	{"verify-backup", "<target>", "verify the files of a backup directory against its manifest", verifyBackupCmd},
+	{"restore", "<backup> <dir>", "restore a backup to a new log directory, optionally up to an offset or time", restoreCmd},
+	{"dump", "<dir>", "print messages, starting at an offset or time", dumpCmd},
+	{"tail", "<dir>", "print the last messages", tailCmd},
+	{"get", "<dir>", "print the last message with a key", getCmd},
+	{"publish", "<dir>", "publish messages read from stdin", publishCmd},
+}
+
+func main() {
+	err := run(os.Args[1:], &env{os.Stdin, os.Stdout, os.Stderr})
+	switch {
+	case err == nil:
+	case err == errUsage:
+		// usage was already printed
+		os.Exit(2)
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(os.Stderr, "klevdb: %v\n", err)
+		os.Exit(2)
+	case errors.Is(err, index.ErrCorrupted):
+		fmt.Fprintf(os.Stderr, "klevdb: %v (check -keys and -times match the log)\n", err)
+		os.Exit(1)
+	default:
+		fmt.Fprintf(os.Stderr, "klevdb: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, e *env) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage(e.stderr)
+		if len(args) == 0 {
+			return errUsage
+		}
+		return nil
+	}
+
+	i := slices.IndexFunc(commands, func(c command) bool { return c.name == args[0] })
+	if i < 0 {
+		fmt.Fprintf(e.stderr, "klevdb: unknown command %q\n", args[0])
+		usage(e.stderr)
+		return errUsage
+	}
+	cmd := commands[i]
+
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(e.stderr, "usage: klevdb %s [flags] %s\n\n%s\n\nflags:\n", cmd.name, cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	runCmd := cmd.flags(fs)
+	switch err := fs.Parse(args[1:]); {
+	case errors.Is(err, flag.ErrHelp):
+		return nil
+	case err != nil:
+		// the flag set already printed the error and usage
+		return errUsage
+	}
+
+	if want := len(strings.Fields(cmd.args)); fs.NArg() != want {
+		fs.Usage()
+		return errUsage
+	}
+	return runCmd(fs.Args(), e)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: klevdb <command> [flags] <dir>\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.help)
+	}
+	fmt.Fprintf(w, "\nrun \"klevdb <command> -h\" for the flags of a command\n")
+}
+
+// indexFlags adds the flags for the indexes of a log, which must match the ones it was created with
+func indexFlags(fs *flag.FlagSet) *klevdb.Options {
+	opts := &klevdb.Options{}
+	fs.BoolVar(&opts.KeyIndex, "keys", false, "the log indexes keys")
+	fs.BoolVar(&opts.TimeIndex, "times", false, "the log indexes times")
+	return opts
+}
+
+func parseVersion(s string) (klevdb.Version, error) {
+	switch strings.ToUpper(s) {
+	case "V1":
+		return klevdb.V1, nil
+	case "V2":
+		return klevdb.V2, nil
+	case "V3":
+		return klevdb.V3, nil
+	default:
+		return klevdb.Version{}, fmt.Errorf("%w: unknown version %q, expected V1, V2 or V3", errUsage, s)
+	}
+}
+
+func parseCompression(s string) (klevdb.Compression, error) {
+	switch s {
+	case klevdb.CompressionNone.String():
+		return klevdb.CompressionNone, nil
+	case klevdb.CompressionFlate.String():
+		return klevdb.CompressionFlate, nil
+	default:
+		return klevdb.CompressionNone, fmt.Errorf("%w: unknown compression %q, expected none or flate", errUsage, s)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func runCmd(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	err := run(args, &env{strings.NewReader(stdin), &stdout, &stderr})
+	return stdout.String(), err
+}
+
+func requireRun(t *testing.T, stdin string, args ...string) string {
+	t.Helper()
+	out, err := runCmd(t, stdin, args...)
+	require.NoError(t, err)
+	return out
+}
+
+func dumpValues(t *testing.T, out string) []string {
+	t.Helper()
+	var values []string
+	dec := json.NewDecoder(strings.NewReader(out))
+	for dec.More() {
+		var jmsg jsonMessage
+		require.NoError(t, dec.Decode(&jmsg))
+		values = append(values, jmsg.Value)
+	}
+	return values
+}
+
+func TestCommands(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "log")
+
+	out := requireRun(t, "a\nb\nc\n", "publish", "-create", "-keys", "-times", "-lines", "-key", "k1", dir)
+	require.Equal(t, "published 3 messages, next offset 3\n", out)
+	requireRun(t, "d", "publish", "-keys", "-times", "-key", "k2", dir)
+
+	t.Run("Dump", func(t *testing.T) {
+		out := requireRun(t, "", "dump", "-keys", "-times", "-json", dir)
+		require.Equal(t, []string{"a", "b", "c", "d"}, dumpValues(t, out))
+
+		out = requireRun(t, "", "dump", "-keys", "-times", "-json", "-offset", "1", "-count", "2", dir)
+		require.Equal(t, []string{"b", "c"}, dumpValues(t, out))
+
+		out = requireRun(t, "", "dump", "-keys", "-times", "-json", "-key", "k2", dir)
+		require.Equal(t, []string{"d"}, dumpValues(t, out))
+
+		out = requireRun(t, "", "dump", "-keys", "-times", "-json", "-time", "2000-01-01T00:00:00Z", "-count", "1", dir)
+		require.Equal(t, []string{"a"}, dumpValues(t, out))
+
+		out = requireRun(t, "", "dump", "-keys", "-times", "-json", "-time", "2100-01-01T00:00:00Z", dir)
+		require.Empty(t, out)
+
+		out = requireRun(t, "", "dump", "-keys", "-times", "-offset", "3", dir)
+		require.Contains(t, out, "3\t")
+		require.Contains(t, out, "key=\"k2\"\tvalue=\"d\"\n")
+	})
+
+	t.Run("Tail", func(t *testing.T) {
+		out := requireRun(t, "", "tail", "-keys", "-times", "-json", "-n", "2", dir)
+		require.Equal(t, []string{"c", "d"}, dumpValues(t, out))
+
+		out = requireRun(t, "", "tail", "-keys", "-times", "-json", "-n", "2", "-key", "k1", dir)
+		require.Equal(t, []string{"b", "c"}, dumpValues(t, out))
+
+		out = requireRun(t, "", "tail", "-keys", "-times", "-json", "-offset", "3", dir)
+		require.Equal(t, []string{"d"}, dumpValues(t, out))
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		out := requireRun(t, "", "get", "-times", "-json", "-key", "k1", dir)
+		require.Equal(t, []string{"c"}, dumpValues(t, out))
+
+		_, err := runCmd(t, "", "get", "-times", "-key", "missing", dir)
+		require.Error(t, err)
+
+		_, err = runCmd(t, "", "get", "-times", dir)
+		require.ErrorIs(t, err, errUsage)
+	})
+
+	t.Run("Segments", func(t *testing.T) {
+		out := requireRun(t, "", "segments", "-keys", "-times", "-json", dir)
+		var seg struct {
+			Offset          int64
+			FirstOffset     int64
+			LastOffset      int64
+			Messages        int
+			MessagesVersion string
+		}
+		require.NoError(t, json.Unmarshal([]byte(out), &seg))
+		require.Equal(t, int64(0), seg.Offset)
+		require.Equal(t, int64(3), seg.LastOffset)
+		require.Equal(t, 4, seg.Messages)
+		require.Equal(t, "V2", seg.MessagesVersion)
+	})
+
+	t.Run("Maintain", func(t *testing.T) {
+		out := requireRun(t, "", "stat", "-keys", "-times", dir)
+		require.Contains(t, out, "messages:     4\n")
+
+		require.Equal(t, "ok\n", requireRun(t, "", "check", "-keys", "-times", dir))
+		require.Equal(t, "recovered, dropped 0 messages\n", requireRun(t, "", "recover", "-keys", "-times", dir))
+		require.Equal(t, "ok\n", requireRun(t, "", "migrate", "-keys", "-times", "-version", "V3", "-compression", "flate", dir))
+
+		out = requireRun(t, "", "segments", "-keys", "-times", dir)
+		require.Contains(t, out, "V3+flate")
+
+		backup := filepath.Join(t.TempDir(), "backup")
+		require.Equal(t, "ok\n", requireRun(t, "", "backup", dir, backup))
+		require.Equal(t, "ok\n", requireRun(t, "", "verify-backup", backup))
+		out = requireRun(t, "", "dump", "-keys", "-times", "-json", backup)
+		require.Equal(t, []string{"a", "b", "c", "d"}, dumpValues(t, out))
+
+		restored := filepath.Join(t.TempDir(), "restored")
+		require.Equal(t, "ok\n", requireRun(t, "", "restore", "-keys", "-times", "-offset", "2", backup, restored))
+		out = requireRun(t, "", "dump", "-keys", "-times", "-json", restored)
+		require.Equal(t, []string{"a", "b"}, dumpValues(t, out))
+	})
+
+	t.Run("PublishJSON", func(t *testing.T) {
+		out := requireRun(t, "", "dump", "-keys", "-times", "-json", dir)
+		copyDir := filepath.Join(t.TempDir(), "copy")
+		requireRun(t, out, "publish", "-create", "-json", copyDir)
+
+		require.Equal(t, out, requireRun(t, "", "dump", "-json", copyDir))
+	})
+
+	t.Run("Usage", func(t *testing.T) {
+		_, err := runCmd(t, "")
+		require.ErrorIs(t, err, errUsage)
+
+		_, err = runCmd(t, "", "unknown")
+		require.ErrorIs(t, err, errUsage)
+
+		_, err = runCmd(t, "", "dump")
+		require.ErrorIs(t, err, errUsage)
+
+		_, err = runCmd(t, "", "migrate", "-version", "V9", dir)
+		require.ErrorIs(t, err, errUsage)
+	})
+}
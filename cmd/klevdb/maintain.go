@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/klev-dev/klevdb"
+)
+
+func statCmd(fs *flag.FlagSet) func([]string, *env) error {
+	opts := indexFlags(fs)
+	asJSON := fs.Bool("json", false, "print as json")
+
+	return func(args []string, e *env) error {
+		stats, err := klevdb.Stat(args[0], *opts)
+		if err != nil {
+			return err
+		}
+
+		if *asJSON {
+			return json.NewEncoder(e.stdout).Encode(stats)
+		}
+		fmt.Fprintf(e.stdout, "segments:     %d\n", stats.Segments)
+		fmt.Fprintf(e.stdout, "messages:     %d\n", stats.Messages)
+		fmt.Fprintf(e.stdout, "size:         %d\n", stats.Size)
+		fmt.Fprintf(e.stdout, "logical size: %d\n", stats.LogicalSize)
+		return nil
+	}
+}
+
+func segmentsCmd(fs *flag.FlagSet) func([]string, *env) error {
+	opts := indexFlags(fs)
+	asJSON := fs.Bool("json", false, "print as json, one segment per line")
+
+	return func(args []string, e *env) error {
+		segments, err := klevdb.Segments(args[0], *opts)
+		if err != nil {
+			return err
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(e.stdout)
+			for _, seg := range segments {
+				if err := enc.Encode(seg); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		w := tabwriter.NewWriter(e.stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "OFFSET\tFIRST\tLAST\tMESSAGES\tSIZE\tLOGICAL SIZE\tVERSION\tINDEX\t")
+		for _, seg := range segments {
+			fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t\n", seg.Offset, seg.FirstOffset, seg.LastOffset,
+				seg.Messages, seg.Size, seg.LogicalSize, seg.MessagesVersion, seg.IndexVersion)
+		}
+		return w.Flush()
+	}
+}
+
+func checkCmd(fs *flag.FlagSet) func([]string, *env) error {
+	opts := indexFlags(fs)
+
+	return func(args []string, e *env) error {
+		if err := klevdb.Check(args[0], *opts); err != nil {
+			return err
+		}
+		fmt.Fprintln(e.stdout, "ok")
+		return nil
+	}
+}
+
+func recoverCmd(fs *flag.FlagSet) func([]string, *env) error {
+	opts := indexFlags(fs)
+
+	return func(args []string, e *env) error {
+		before, err := klevdb.Stat(args[0], *opts)
+		if err != nil {
+			return err
+		}
+		if err := klevdb.Recover(args[0], *opts); err != nil {
+			return err
+		}
+		after, err := klevdb.Stat(args[0], *opts)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "recovered, dropped %d messages\n", before.Messages-after.Messages)
+		return nil
+	}
+}
+
+func migrateCmd(fs *flag.FlagSet) func([]string, *env) error {
+	opts := indexFlags(fs)
+	version := fs.String("version", "", "the version to migrate to: V1, V2 or V3 (required)")
+	compression := fs.String("compression", "none", "the compression of migrated segments: none or flate, requires V3")
+
+	return func(args []string, e *env) error {
+		v, err := parseVersion(*version)
+		if err != nil {
+			return err
+		}
+		if opts.Compression, err = parseCompression(*compression); err != nil {
+			return err
+		}
+
+		if err := klevdb.Migrate(args[0], *opts, v); err != nil {
+			return err
+		}
+		fmt.Fprintln(e.stdout, "ok")
+		return nil
+	}
+}
+
+func backupCmd(fs *flag.FlagSet) func([]string, *env) error {
+	return func(args []string, e *env) error {
+		if err := klevdb.Backup(args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintln(e.stdout, "ok")
+		return nil
+	}
+}
+
+func verifyBackupCmd(fs *flag.FlagSet) func([]string, *env) error {
+	return func(args []string, e *env) error {
+		if err := klevdb.VerifyBackup(args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintln(e.stdout, "ok")
+		return nil
+	}
+}
+
+func restoreCmd(fs *flag.FlagSet) func([]string, *env) error {
+	opts := indexFlags(fs)
+	upToOffset := fs.Int64("offset", 0, "restore only messages before this offset, 0 restores all")
+	upToTime := fs.String("time", "", "restore only messages before the first message at or after this time (RFC3339)")
+
+	return func(args []string, e *env) error {
+		ropts := klevdb.RestoreOptions{Options: *opts, UpToOffset: *upToOffset}
+		if *upToTime != "" {
+			ts, err := time.Parse(time.RFC3339Nano, *upToTime)
+			if err != nil {
+				return fmt.Errorf("%w: invalid time: %w", errUsage, err)
+			}
+			ropts.UpToTime = ts
+		}
+
+		if err := klevdb.Restore(args[0], args[1], ropts); err != nil {
+			return err
+		}
+		fmt.Fprintln(e.stdout, "ok")
+		return nil
+	}
+}
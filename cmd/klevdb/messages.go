@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/klev-dev/klevdb"
+)
+
+const consumeBatch = 1024
+
+// jsonMessage is how messages are printed with -json, and read by publish -json. Keys and
+// values are printed as strings, so bytes which are not valid UTF-8 are replaced.
+type jsonMessage struct {
+	Offset  int64        `json:"offset"`
+	Time    time.Time    `json:"time"`
+	Key     string       `json:"key,omitempty"`
+	Value   string       `json:"value"`
+	Headers []jsonHeader `json:"headers,omitempty"`
+}
+
+type jsonHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func toJSON(msg klevdb.Message) jsonMessage {
+	jmsg := jsonMessage{Offset: msg.Offset, Time: msg.Time, Key: string(msg.Key), Value: string(msg.Value)}
+	for _, h := range msg.Headers {
+		jmsg.Headers = append(jmsg.Headers, jsonHeader{h.Key, string(h.Value)})
+	}
+	return jmsg
+}
+
+func (jmsg jsonMessage) message() klevdb.Message {
+	msg := klevdb.Message{Time: jmsg.Time, Value: []byte(jmsg.Value)}
+	if jmsg.Key != "" {
+		msg.Key = []byte(jmsg.Key)
+	}
+	for _, h := range jmsg.Headers {
+		msg.Headers = append(msg.Headers, klevdb.Header{Key: h.Key, Value: []byte(h.Value)})
+	}
+	return msg
+}
+
+// printer prints messages as text or json lines
+type printer struct {
+	w      io.Writer
+	asJSON bool
+	enc    *json.Encoder
+}
+
+func newPrinter(w io.Writer, asJSON bool) *printer {
+	return &printer{w: w, asJSON: asJSON, enc: json.NewEncoder(w)}
+}
+
+func (p *printer) print(msg klevdb.Message) error {
+	if p.asJSON {
+		return p.enc.Encode(toJSON(msg))
+	}
+
+	if _, err := fmt.Fprintf(p.w, "%d\t%s\tkey=%q\tvalue=%q", msg.Offset, msg.Time.Format(time.RFC3339Nano), msg.Key, msg.Value); err != nil {
+		return err
+	}
+	for _, h := range msg.Headers {
+		if _, err := fmt.Fprintf(p.w, "\t%s=%q", h.Key, h.Value); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(p.w)
+	return err
+}
+
+// filter selects the messages printed by dump and tail
+type filter struct {
+	offset int64
+	time   string
+	key    string
+	json   bool
+}
+
+func filterFlags(fs *flag.FlagSet) *filter {
+	f := &filter{}
+	fs.Int64Var(&f.offset, "offset", klevdb.OffsetOldest, "start at this offset (-2 starts at the oldest)")
+	fs.StringVar(&f.time, "time", "", "start at the first message at or after this time (RFC3339), requires -times")
+	fs.StringVar(&f.key, "key", "", "only messages with this key, requires -keys")
+	fs.BoolVar(&f.json, "json", false, "print messages as json, one per line")
+	return f
+}
+
+// start returns the offset to start at, or false if there are no messages after the start time
+func (f *filter) start(l klevdb.Log) (int64, bool, error) {
+	if f.time == "" {
+		return f.offset, true, nil
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, f.time)
+	if err != nil {
+		return klevdb.OffsetInvalid, false, fmt.Errorf("%w: invalid time: %w", errUsage, err)
+	}
+	offset, _, err := l.OffsetByTime(ts)
+	switch {
+	case errors.Is(err, klevdb.ErrNotFound):
+		return klevdb.OffsetInvalid, false, nil
+	case err != nil:
+		return klevdb.OffsetInvalid, false, err
+	}
+	return max(offset, f.offset), true, nil
+}
+
+// scan calls fn with each selected message, until it returns false
+func (f *filter) scan(l klevdb.Log, fn func(klevdb.Message) (bool, error)) error {
+	offset, ok, err := f.start(l)
+	if err != nil || !ok {
+		return err
+	}
+
+	for {
+		var msgs []klevdb.Message
+		if f.key != "" {
+			offset, msgs, err = l.ConsumeByKey([]byte(f.key), offset, consumeBatch)
+		} else {
+			offset, msgs, err = l.Consume(offset, consumeBatch)
+		}
+		if err != nil || len(msgs) == 0 {
+			return err
+		}
+
+		for _, msg := range msgs {
+			if cont, err := fn(msg); err != nil || !cont {
+				return err
+			}
+		}
+	}
+}
+
+func openReadonly(dir string, opts klevdb.Options) (klevdb.Log, error) {
+	opts.Readonly = true
+	return klevdb.Open(dir, opts)
+}
+
+func dumpCmd(fs *flag.FlagSet) func([]string, *env) error {
+	opts := indexFlags(fs)
+	f := filterFlags(fs)
+	count := fs.Int64("count", 0, "print at most this many messages, 0 prints all")
+
+	return func(args []string, e *env) error {
+		l, err := openReadonly(args[0], *opts)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+
+		p := newPrinter(e.stdout, f.json)
+		var printed int64
+		return f.scan(l, func(msg klevdb.Message) (bool, error) {
+			if err := p.print(msg); err != nil {
+				return false, err
+			}
+			printed++
+			return *count <= 0 || printed < *count, nil
+		})
+	}
+}
+
+func tailCmd(fs *flag.FlagSet) func([]string, *env) error {
+	opts := indexFlags(fs)
+	f := filterFlags(fs)
+	count := fs.Int64("n", 10, "print this many of the last messages")
+
+	return func(args []string, e *env) error {
+		l, err := openReadonly(args[0], *opts)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+
+		msgs, err := f.tail(l, *count)
+		if err != nil {
+			return err
+		}
+
+		p := newPrinter(e.stdout, f.json)
+		for _, msg := range msgs {
+			if err := p.print(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// tail returns the last count selected messages
+func (f *filter) tail(l klevdb.Log, count int64) ([]klevdb.Message, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+
+	if f.key != "" {
+		// keys are scanned forward, keeping the last messages
+		var msgs []klevdb.Message
+		err := f.scan(l, func(msg klevdb.Message) (bool, error) {
+			if int64(len(msgs)) == count {
+				msgs = msgs[1:]
+			}
+			msgs = append(msgs, msg)
+			return true, nil
+		})
+		return msgs, err
+	}
+
+	start, ok, err := f.start(l)
+	if err != nil || !ok {
+		return nil, err
+	}
+	_, msgs, err := l.ConsumeBackward(klevdb.OffsetNewest, count)
+	if err != nil {
+		return nil, err
+	}
+	msgs = slices.DeleteFunc(msgs, func(msg klevdb.Message) bool { return msg.Offset < start })
+	slices.Reverse(msgs)
+	return msgs, nil
+}
+
+func getCmd(fs *flag.FlagSet) func([]string, *env) error {
+	opts := indexFlags(fs)
+	key := fs.String("key", "", "the key of the message (required)")
+	asJSON := fs.Bool("json", false, "print the message as json")
+
+	return func(args []string, e *env) error {
+		if *key == "" {
+			return fmt.Errorf("%w: -key is required", errUsage)
+		}
+		opts.KeyIndex = true // get always needs the key index
+
+		l, err := openReadonly(args[0], *opts)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+
+		msg, err := l.GetByKey([]byte(*key))
+		if err != nil {
+			return err
+		}
+		return newPrinter(e.stdout, *asJSON).print(msg)
+	}
+}
+
+func publishCmd(fs *flag.FlagSet) func([]string, *env) error {
+	opts := indexFlags(fs)
+	fs.BoolVar(&opts.CreateDirs, "create", false, "create the log directory if it doesn't exist")
+	key := fs.String("key", "", "the key of the published messages")
+	lines := fs.Bool("lines", false, "publish each line as a message, instead of all of stdin as one")
+	asJSON := fs.Bool("json", false, "read json messages (as printed by dump -json), ignoring their offsets")
+
+	return func(args []string, e *env) error {
+		var msgs []klevdb.Message
+		switch {
+		case *asJSON:
+			dec := json.NewDecoder(e.stdin)
+			for {
+				var jmsg jsonMessage
+				err := dec.Decode(&jmsg)
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					return fmt.Errorf("read json message %d: %w", len(msgs), err)
+				}
+				msgs = append(msgs, jmsg.message())
+			}
+		case *lines:
+			scanner := bufio.NewScanner(e.stdin)
+			scanner.Buffer(nil, 64*1024*1024)
+			for scanner.Scan() {
+				msgs = append(msgs, klevdb.Message{Value: slices.Clone(scanner.Bytes())})
+			}
+			if err := scanner.Err(); err != nil {
+				return fmt.Errorf("read stdin: %w", err)
+			}
+		default:
+			value, err := io.ReadAll(e.stdin)
+			if err != nil {
+				return fmt.Errorf("read stdin: %w", err)
+			}
+			msgs = append(msgs, klevdb.Message{Value: value})
+		}
+		if len(msgs) == 0 {
+			fmt.Fprintln(e.stdout, "nothing to publish")
+			return nil
+		}
+		if *key != "" {
+			for i := range msgs {
+				msgs[i].Key = []byte(*key)
+			}
+		}
+
+		l, err := klevdb.Open(args[0], *opts)
+		if err != nil {
+			return err
+		}
+		nextOffset, err := l.Publish(msgs)
+		if err != nil {
+			return errors.Join(err, l.Close())
+		}
+		if err := l.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "published %d messages, next offset %d\n", len(msgs), nextOffset)
+		return nil
+	}
+}
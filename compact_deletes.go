@@ -19,36 +19,26 @@ func FindDeletes(ctx context.Context, l Log, before time.Time) (map[int64]struct
 	var keyOffset = art.New()
 	var offsets = map[int64]struct{}{}
 
-SEARCH:
-	for offset := OffsetOldest; offset < maxOffset; {
-		nextOffset, msgs, err := l.Consume(offset, 32)
+	for msg, err := range l.All(ctx, OffsetOldest) {
 		if err != nil {
 			return nil, err
 		}
-		offset = nextOffset
-
-		for _, msg := range msgs {
-			if msg.Time.After(before) {
-				break SEARCH
-			}
-
-			// we've seen this previously, we can delete only the first instance
-			if _, ok := keyOffset.Search(msg.Key); ok {
-				continue
-			}
-
-			// not seen it (first instance) without value (e.g. delete)
-			if msg.Value == nil {
-				offsets[msg.Offset] = struct{}{}
-			}
+		if msg.Offset >= maxOffset || msg.Time.After(before) {
+			break
+		}
 
-			// add it to the set of seen keys, so later instances are not deleted
-			keyOffset.Insert(msg.Key, msg.Offset)
+		// we've seen this previously, we can delete only the first instance
+		if _, ok := keyOffset.Search(msg.Key); ok {
+			continue
 		}
 
-		if err := ctx.Err(); err != nil {
-			return nil, err
+		// not seen it (first instance) without value (e.g. delete)
+		if msg.Value == nil {
+			offsets[msg.Offset] = struct{}{}
 		}
+
+		// add it to the set of seen keys, so later instances are not deleted
+		keyOffset.Insert(msg.Key, msg.Offset)
 	}
 
 	if err := ctx.Err(); err != nil {
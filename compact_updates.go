@@ -20,26 +20,16 @@ func FindUpdates(ctx context.Context, l Log, before time.Time) (map[int64]struct
 	var keyOffset = art.New()
 	var offsets = map[int64]struct{}{}
 
-SEARCH:
-	for offset := OffsetOldest; offset < maxOffset; {
-		nextOffset, msgs, err := l.Consume(offset, 32)
+	for msg, err := range l.All(ctx, OffsetOldest) {
 		if err != nil {
 			return nil, err
 		}
-		offset = nextOffset
-
-		for _, msg := range msgs {
-			if msg.Time.After(before) {
-				break SEARCH
-			}
-
-			if prevMsgOffset, ok := keyOffset.Insert(msg.Key, msg.Offset); ok {
-				offsets[prevMsgOffset.(int64)] = struct{}{}
-			}
+		if msg.Offset >= maxOffset || msg.Time.After(before) {
+			break
 		}
 
-		if err := ctx.Err(); err != nil {
-			return nil, err
+		if prevMsgOffset, ok := keyOffset.Insert(msg.Key, msg.Offset); ok {
+			offsets[prevMsgOffset.(int64)] = struct{}{}
 		}
 	}
 
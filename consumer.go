@@ -0,0 +1,210 @@
+package klevdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/klev-dev/klevdb/pkg/kdir"
+)
+
+const (
+	consumersDir         = "consumers"
+	consumerOffsetSuffix = ".offset"
+	consumerOffsetSize   = 8 + 4 // offset + crc
+)
+
+var (
+	errConsumerName    = errors.New("invalid consumer name")
+	errConsumerOffset  = fmt.Errorf("%w: consumer offset", ErrInvalidOffset)
+	errConsumerCorrupt = errors.New("consumer offset corrupted")
+)
+
+// nameRe matches the names of consumers and store logs, used as file names
+var nameRe = regexp.MustCompile(`^[a-zA-Z0-9_-][a-zA-Z0-9._-]*$`)
+
+var consumerCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ConsumerStats are the stats of a consumer, see [StatConsumers]
+type ConsumerStats struct {
+	// Offset is the last committed offset
+	Offset int64
+	// Lag is the number of offsets the consumer is behind NextOffset
+	Lag int64
+}
+
+// Consumer tracks the offset of a named consumer of a log, persisted next to the log. Use it
+// to resume consuming from where it was last committed, e.g. after a restart.
+type Consumer struct {
+	log  Log
+	name string
+	path string
+
+	mu sync.Mutex
+}
+
+// OpenConsumer opens a named consumer of a log, creating it if it doesn't exist. Names
+// can contain letters, digits, '_', '-' and '.', but cannot start with '.'
+func OpenConsumer(l Log, name string) (*Consumer, error) {
+	if !nameRe.MatchString(name) {
+		return nil, fmt.Errorf("%w: %q", errConsumerName, name)
+	}
+
+	dir := filepath.Join(l.Dir(), consumersDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("consumer create dir: %w", err)
+	}
+
+	return &Consumer{
+		log:  l,
+		name: name,
+		path: filepath.Join(dir, name+consumerOffsetSuffix),
+	}, nil
+}
+
+// Name returns the name of this consumer
+func (c *Consumer) Name() string {
+	return c.name
+}
+
+// Commit persists the offset of this consumer, usually the nextOffset returned by Consume.
+// Committing an offset after the NextOffset of the log returns ErrInvalidOffset.
+func (c *Consumer) Commit(offset int64) error {
+	if offset < 0 {
+		return fmt.Errorf("%w: %d", errConsumerOffset, offset)
+	}
+	nextOffset, err := c.log.NextOffset()
+	if err != nil {
+		return err
+	}
+	if offset > nextOffset {
+		return fmt.Errorf("%w: %d after next offset %d", errConsumerOffset, offset, nextOffset)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return writeConsumerOffset(c.path, offset)
+}
+
+// Committed returns the last committed offset of this consumer,
+// or OffsetOldest if it never committed any
+func (c *Consumer) Committed() (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offset, err := readConsumerOffset(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return OffsetOldest, nil
+	}
+	return offset, err
+}
+
+// Delete removes this consumer and its committed offset
+func (c *Consumer) Delete() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("consumer delete: %w", err)
+	}
+	return kdir.SyncParent(c.path)
+}
+
+// ListConsumers returns the committed offsets of all consumers of a log, see [OpenConsumer]. It is a function
+// (instead of a method of Consumer) since it lists the consumers of the log, not of a consumer
+func ListConsumers(l Log) (map[string]int64, error) {
+	return listConsumers(l.Dir())
+}
+
+// StatConsumers returns the stats of all consumers of a log, with their lag behind its NextOffset.
+// They are not part of [Log.Stat], so Stats stays the stats of the segments of the log
+func StatConsumers(l Log) (map[string]ConsumerStats, error) {
+	committed, err := listConsumers(l.Dir())
+	if err != nil {
+		return nil, err
+	}
+	nextOffset, err := l.NextOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]ConsumerStats, len(committed))
+	for name, offset := range committed {
+		stats[name] = ConsumerStats{Offset: offset, Lag: max(nextOffset-offset, 0)}
+	}
+	return stats, nil
+}
+
+func listConsumers(dir string) (map[string]int64, error) {
+	dir = filepath.Join(dir, consumersDir)
+	files, err := os.ReadDir(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return map[string]int64{}, nil
+	case err != nil:
+		return nil, fmt.Errorf("consumers read dir: %w", err)
+	}
+
+	consumers := map[string]int64{}
+	for _, f := range files {
+		if name, ok := strings.CutSuffix(f.Name(), consumerOffsetSuffix); ok {
+			offset, err := readConsumerOffset(filepath.Join(dir, f.Name()))
+			if err != nil {
+				return nil, err
+			}
+			consumers[name] = offset
+		}
+	}
+	return consumers, nil
+}
+
+// writeConsumerOffset atomically replaces the offset file, so a crash leaves either the old or the new offset
+func writeConsumerOffset(path string, offset int64) (retErr error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("consumer commit create: %w", err)
+	}
+	defer func() {
+		if retErr != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	data := binary.BigEndian.AppendUint64(make([]byte, 0, consumerOffsetSize), uint64(offset))
+	data = binary.BigEndian.AppendUint32(data, crc32.Checksum(data, consumerCRCTable))
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("consumer commit write: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("consumer commit sync: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("consumer commit close: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("consumer commit rename: %w", err)
+	}
+	return kdir.SyncParent(path)
+}
+
+func readConsumerOffset(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return OffsetInvalid, fmt.Errorf("consumer read: %w", err)
+	}
+	if len(data) != consumerOffsetSize {
+		return OffsetInvalid, fmt.Errorf("%w: %s size %d", errConsumerCorrupt, path, len(data))
+	}
+	if crc32.Checksum(data[:8], consumerCRCTable) != binary.BigEndian.Uint32(data[8:]) {
+		return OffsetInvalid, fmt.Errorf("%w: %s crc mismatch", errConsumerCorrupt, path)
+	}
+	return int64(binary.BigEndian.Uint64(data[:8])), nil
+}
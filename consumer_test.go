@@ -0,0 +1,79 @@
+package klevdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+func TestConsumer(t *testing.T) {
+	msgs := message.Gen(10)
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{})
+	require.NoError(t, err)
+	publishBatched(t, l, msgs, 5)
+
+	c, err := OpenConsumer(l, "reader-1")
+	require.NoError(t, err)
+	require.Equal(t, "reader-1", c.Name())
+
+	offset, err := c.Committed()
+	require.NoError(t, err)
+	require.Equal(t, OffsetOldest, offset)
+
+	next, _, err := l.Consume(offset, 4)
+	require.NoError(t, err)
+	require.NoError(t, c.Commit(next))
+	require.ErrorIs(t, c.Commit(11), ErrInvalidOffset)
+	require.ErrorIs(t, c.Commit(-1), ErrInvalidOffset)
+
+	other, err := OpenConsumer(l, "reader-2")
+	require.NoError(t, err)
+	require.NoError(t, other.Commit(10))
+
+	stats, err := StatConsumers(l)
+	require.NoError(t, err)
+	require.Equal(t, map[string]ConsumerStats{
+		"reader-1": {Offset: 4, Lag: 6},
+		"reader-2": {Offset: 10, Lag: 0},
+	}, stats)
+	require.NoError(t, l.Close())
+
+	// survives reopen
+	l, err = Open(dir, Options{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	c, err = OpenConsumer(l, "reader-1")
+	require.NoError(t, err)
+	offset, err = c.Committed()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), offset)
+
+	consumers, err := ListConsumers(l)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"reader-1": 4, "reader-2": 10}, consumers)
+
+	require.NoError(t, c.Delete())
+	consumers, err = ListConsumers(l)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"reader-2": 10}, consumers)
+
+	t.Run("Corrupted", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, consumersDir, "reader-2"+consumerOffsetSuffix), []byte("random data!"), 0600))
+		_, err := ListConsumers(l)
+		require.ErrorIs(t, err, errConsumerCorrupt)
+	})
+
+	t.Run("Names", func(t *testing.T) {
+		for _, name := range []string{"", ".hidden", "a/b", "../up"} {
+			_, err := OpenConsumer(l, name)
+			require.ErrorIs(t, err, errConsumerName)
+		}
+	})
+}
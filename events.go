@@ -0,0 +1,74 @@
+package klevdb
+
+import "github.com/klev-dev/klevdb/pkg/segment"
+
+// Events receives the lifecycle events of the segments of a log, see [Options.Events].
+// Events are delivered synchronously, while the log might be locked, so implementations
+// should return quickly (e.g. handing them off to a goroutine) and must not call the log.
+type Events interface {
+	// Event is called with one of SegmentSealed, SegmentRewritten, SegmentRemoved, MessagesDeleted, HeadRecovered or IndexUnloaded
+	Event(ev Event)
+}
+
+// EventsFunc adapts a function to [Events]
+type EventsFunc func(ev Event)
+
+func (f EventsFunc) Event(ev Event) {
+	f(ev)
+}
+
+// Event is a lifecycle event of a segment
+type Event interface {
+	event()
+}
+
+// SegmentSealed is sent when publish rolls over to a new segment. The files of a sealed segment
+// no longer change, unless rewritten (see SegmentRewritten) or removed (see SegmentRemoved) by deletes.
+type SegmentSealed struct {
+	Segment segment.Segment
+}
+
+// SegmentRewritten is sent when delete rewrites a segment without the deleted messages.
+// The rewritten segment starts at the offset of its first message, which might differ from the previous one.
+type SegmentRewritten struct {
+	Segment  segment.Segment
+	Previous segment.Segment
+	// Deleted is the number of messages deleted from the segment
+	Deleted int
+}
+
+// SegmentRemoved is sent when delete removes a segment, since all its messages were deleted
+type SegmentRemoved struct {
+	Segment segment.Segment
+}
+
+// MessagesDeleted is sent when delete removes messages from the log, after the segments
+// are rewritten or removed. It is sent for every delete, e.g. by [Options.Retention] or [DeleteMulti].
+type MessagesDeleted struct {
+	// Offsets are the offsets of the deleted messages
+	Offsets []int64
+}
+
+// HeadRecovered is sent when open recovers a head segment failing its integrity check, see [Options.Recover]
+type HeadRecovered struct {
+	Segment segment.Segment
+	// Err is the reason the check failed
+	Err error
+}
+
+// IndexUnloaded is sent when GC unloads the index of a segment, unused for a while
+type IndexUnloaded struct {
+	Segment segment.Segment
+}
+
+func (SegmentSealed) event()    {}
+func (SegmentRewritten) event() {}
+func (SegmentRemoved) event()   {}
+func (MessagesDeleted) event()  {}
+func (HeadRecovered) event()    {}
+func (IndexUnloaded) event()    {}
+
+// noEvents is used when no events are configured
+type noEvents struct{}
+
+func (noEvents) Event(Event) {}
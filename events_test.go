@@ -0,0 +1,135 @@
+package klevdb
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+type testEvents struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (e *testEvents) Event(ev Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, ev)
+}
+
+func (e *testEvents) take() []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	evs := e.events
+	e.events = nil
+	return evs
+}
+
+func TestEvents(t *testing.T) {
+	msgs := message.Gen(6)
+
+	t.Run("Sealed", func(t *testing.T) {
+		events := &testEvents{}
+		l, err := Open(t.TempDir(), Options{Rollover: message.Size(msgs[0], message.V2), Events: events})
+		require.NoError(t, err)
+		defer l.Close()
+
+		publishBatched(t, l, msgs[:3], 1)
+		evs := events.take()
+		require.Len(t, evs, 2)
+		require.Equal(t, int64(0), evs[0].(SegmentSealed).Segment.Offset)
+		require.Equal(t, int64(1), evs[1].(SegmentSealed).Segment.Offset)
+		require.FileExists(t, evs[1].(SegmentSealed).Segment.Log)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		events := &testEvents{}
+		l, err := Open(t.TempDir(), Options{Rollover: 2 * message.Size(msgs[0], message.V2), Events: events})
+		require.NoError(t, err)
+		defer l.Close()
+
+		publishBatched(t, l, msgs, 1) // segments 0, 2 and 4, with 2 messages each
+		require.Len(t, events.take(), 2)
+
+		// rewrites a sealed segment at a new offset
+		_, _, err = l.Delete(map[int64]struct{}{0: {}})
+		require.NoError(t, err)
+		evs := events.take()
+		require.Len(t, evs, 2)
+		rewritten := evs[0].(SegmentRewritten)
+		require.Equal(t, int64(0), rewritten.Previous.Offset)
+		require.Equal(t, int64(1), rewritten.Segment.Offset)
+		require.Equal(t, 1, rewritten.Deleted)
+		require.NoFileExists(t, rewritten.Previous.Log)
+		require.FileExists(t, rewritten.Segment.Log)
+		require.Equal(t, MessagesDeleted{Offsets: []int64{0}}, evs[1])
+
+		// removes the whole sealed segment
+		_, _, err = l.Delete(map[int64]struct{}{1: {}})
+		require.NoError(t, err)
+		evs = events.take()
+		require.Equal(t, []Event{SegmentRemoved{Segment: rewritten.Segment}, MessagesDeleted{Offsets: []int64{1}}}, evs)
+
+		// rewrites the head, sealing it since its last message was deleted
+		_, _, err = l.Delete(map[int64]struct{}{5: {}})
+		require.NoError(t, err)
+		evs = events.take()
+		require.Len(t, evs, 3)
+		require.Equal(t, int64(4), evs[0].(SegmentRewritten).Segment.Offset)
+		require.Equal(t, int64(4), evs[1].(SegmentSealed).Segment.Offset)
+		require.Equal(t, MessagesDeleted{Offsets: []int64{5}}, evs[2])
+	})
+
+	t.Run("IndexUnloaded", func(t *testing.T) {
+		events := &testEvents{}
+		l, err := Open(t.TempDir(), Options{Rollover: message.Size(msgs[0], message.V2), Events: events})
+		require.NoError(t, err)
+		defer l.Close()
+
+		publishBatched(t, l, msgs[:2], 1)
+		events.take()
+
+		require.NoError(t, l.GC(0))
+		evs := events.take()
+		require.Len(t, evs, 1)
+		require.Equal(t, int64(0), evs[0].(IndexUnloaded).Segment.Offset)
+
+		require.NoError(t, l.GC(0))
+		require.Empty(t, events.take())
+	})
+
+	t.Run("HeadRecovered", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, Options{})
+		require.NoError(t, err)
+		publishBatched(t, l, msgs[:2], 1)
+		require.NoError(t, l.Close())
+
+		events := &testEvents{}
+		l, err = Open(dir, Options{Recover: true, Events: events})
+		require.NoError(t, err)
+		require.NoError(t, l.Close())
+		require.Empty(t, events.take())
+
+		head := l.(*log).newSegment(0)
+		require.NoError(t, os.Truncate(head.Log, message.HeaderSize+message.Size(msgs[0], message.V2)+1))
+
+		l, err = Open(dir, Options{Recover: true, Events: events})
+		require.NoError(t, err)
+		defer l.Close()
+
+		evs := events.take()
+		require.Len(t, evs, 1)
+		recovered := evs[0].(HeadRecovered)
+		require.Equal(t, head.Log, recovered.Segment.Log)
+		require.Error(t, recovered.Err)
+
+		noff, err := l.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, int64(1), noff)
+	})
+}
@@ -0,0 +1,557 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/klev-dev/klevdb"
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+// error codes of the kafka protocol
+const (
+	errCodeUnknownServerError      int16 = -1
+	errCodeNone                    int16 = 0
+	errCodeOffsetOutOfRange        int16 = 1
+	errCodeCorruptMessage          int16 = 2
+	errCodeUnknownTopicOrPartition int16 = 3
+	errCodeMessageTooLarge         int16 = 10
+	errCodeInvalidTopic            int16 = 17
+	errCodeUnsupportedVersion      int16 = 35
+	errCodeUnsupportedForFormat    int16 = 43
+	errCodeUnsupportedCompression  int16 = 76
+	errCodeInvalidRecord           int16 = 87
+)
+
+// errCode returns the error code of the protocol matching an error
+func errCode(err error) int16 {
+	switch {
+	case err == nil:
+		return errCodeNone
+	case errors.Is(err, klevdb.ErrInvalidOffset):
+		return errCodeOffsetOutOfRange
+	case errors.Is(err, errCorruptBatch):
+		return errCodeCorruptMessage
+	case errors.Is(err, errUnsupportedMagic):
+		return errCodeUnsupportedForFormat
+	case errors.Is(err, errUnsupportedCompression):
+		return errCodeUnsupportedCompression
+	case errors.Is(err, klevdb.ErrMessageTooBig):
+		return errCodeMessageTooLarge
+	case errors.Is(err, message.ErrHeadersUnsupported):
+		return errCodeInvalidRecord
+	default:
+		return errCodeUnknownServerError
+	}
+}
+
+const (
+	// partition is the only partition of each topic
+	partition int32 = 0
+	// nodeID is the id of the only broker
+	nodeID int32 = 0
+	// clusterID is returned by Metadata
+	clusterID = "klevdb"
+	// authorizedOperationsOmitted is returned when authorized operations are not requested (or supported)
+	authorizedOperationsOmitted = math.MinInt32
+	// consumeBatch is how many messages are consumed at once by fetch
+	consumeBatch = 256
+	// unknownOffset and unknownTimestamp are returned with errors, or when there is no such offset
+	unknownOffset    int64 = -1
+	unknownTimestamp int64 = -1
+)
+
+// topicRe matches the valid names of kafka topics
+var topicRe = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+// openTopic opens the log of a topic, creating it if needed and create is set.
+// Returns a protocol error code if the topic doesn't exist, or cannot be opened
+func (s *Server) openTopic(name string, create bool) (klevdb.Log, int16) {
+	if !topicRe.MatchString(name) || name == "." || name == ".." {
+		return nil, errCodeInvalidTopic
+	}
+	if !create {
+		exists, err := s.store.Exists(name)
+		if err != nil {
+			return nil, errCodeUnknownServerError
+		}
+		if !exists {
+			return nil, errCodeUnknownTopicOrPartition
+		}
+	}
+
+	l, err := s.store.Log(name)
+	if err != nil {
+		return nil, errCodeUnknownServerError
+	}
+	return l, errCodeNone
+}
+
+// logStartOffset returns the offset of the oldest message in the log, or its next offset if empty
+func logStartOffset(l klevdb.Log) (int64, error) {
+	msg, err := l.Get(klevdb.OffsetOldest)
+	switch {
+	case err == nil:
+		return msg.Offset, nil
+	case errors.Is(err, klevdb.ErrInvalidOffset):
+		return l.NextOffset()
+	default:
+		return klevdb.OffsetInvalid, err
+	}
+}
+
+func (s *Server) apiVersions(req request, resp *encoder, code int16) {
+	resp.int16(code)
+	resp.arrayLen(len(supportedAPIs))
+	for _, api := range supportedAPIs {
+		resp.int16(api.key)
+		resp.int16(api.min)
+		resp.int16(api.max)
+	}
+	if req.apiVersion >= 1 {
+		resp.int32(0) // throttle time
+	}
+}
+
+func (s *Server) metadata(req request, resp *encoder, broker brokerAddr) error {
+	var topics []string
+	allTopics := false
+	if n := req.nullableArrayLen(2); n < 0 || (n == 0 && req.apiVersion == 0) {
+		allTopics = true
+	} else {
+		for range n {
+			topics = append(topics, req.string())
+		}
+	}
+	allowCreate := req.apiVersion < 4
+	if req.apiVersion >= 4 {
+		allowCreate = req.bool()
+	}
+	if req.apiVersion >= 8 {
+		req.bool() // include cluster authorized operations
+		req.bool() // include topic authorized operations
+	}
+	if req.err != nil {
+		return req.err
+	}
+
+	if allTopics {
+		names, err := s.store.List()
+		if err != nil {
+			return err
+		}
+		topics = names
+	}
+
+	if req.apiVersion >= 3 {
+		resp.int32(0) // throttle time
+	}
+	resp.arrayLen(1)
+	resp.int32(nodeID)
+	resp.string(broker.host)
+	resp.int32(broker.port)
+	if req.apiVersion >= 1 {
+		resp.nullableString(nil) // rack
+	}
+	if req.apiVersion >= 2 {
+		id := clusterID
+		resp.nullableString(&id)
+	}
+	if req.apiVersion >= 1 {
+		resp.int32(nodeID) // controller
+	}
+
+	resp.arrayLen(len(topics))
+	for _, topic := range topics {
+		l, code := s.openTopic(topic, s.opts.AutoCreateTopics && allowCreate)
+		if l != nil {
+			if err := l.Close(); err != nil {
+				code = errCodeUnknownServerError
+			}
+		}
+
+		resp.int16(code)
+		resp.string(topic)
+		if req.apiVersion >= 1 {
+			resp.bool(false) // internal
+		}
+		if code != errCodeNone {
+			resp.arrayLen(0)
+		} else {
+			resp.arrayLen(1)
+			resp.int16(errCodeNone)
+			resp.int32(partition)
+			resp.int32(nodeID) // leader
+			if req.apiVersion >= 7 {
+				resp.int32(0) // leader epoch
+			}
+			resp.int32Array([]int32{nodeID}) // replicas
+			resp.int32Array([]int32{nodeID}) // in sync replicas
+			if req.apiVersion >= 5 {
+				resp.int32Array(nil) // offline replicas
+			}
+		}
+		if req.apiVersion >= 8 {
+			resp.int32(authorizedOperationsOmitted)
+		}
+	}
+	if req.apiVersion >= 8 {
+		resp.int32(authorizedOperationsOmitted)
+	}
+	return nil
+}
+
+// produce publishes the records of each partition, returns false if the client doesn't expect a response
+func (s *Server) produce(req request, resp *encoder) (bool, error) {
+	req.nullableString() // transactional id
+	acks := req.int16()
+	req.int32() // timeout
+
+	type partitionResult struct {
+		index      int32
+		code       int16
+		baseOffset int64
+		logStart   int64
+		errMessage *string
+	}
+	type topicResult struct {
+		name       string
+		partitions []partitionResult
+	}
+
+	var results []topicResult
+	produced := false
+	for range req.arrayLen(6) {
+		topic := topicResult{name: req.string()}
+		for range req.arrayLen(8) {
+			result := partitionResult{index: req.int32(), baseOffset: unknownOffset, logStart: unknownOffset}
+			records := req.bytes()
+			if req.err != nil {
+				return false, req.err
+			}
+
+			var err error
+			result.code, result.baseOffset, result.logStart, err = s.produceRecords(topic.name, result.index, records)
+			if err != nil {
+				msg := err.Error()
+				result.errMessage = &msg
+			}
+			produced = produced || result.code == errCodeNone
+			topic.partitions = append(topic.partitions, result)
+		}
+		results = append(results, topic)
+	}
+	if req.err != nil {
+		return false, req.err
+	}
+	if produced {
+		s.notifyProduced()
+	}
+	if acks == 0 {
+		return false, nil
+	}
+
+	resp.arrayLen(len(results))
+	for _, topic := range results {
+		resp.string(topic.name)
+		resp.arrayLen(len(topic.partitions))
+		for _, result := range topic.partitions {
+			resp.int32(result.index)
+			resp.int16(result.code)
+			resp.int64(result.baseOffset)
+			resp.int64(unknownTimestamp) // log append time, the times of the records are kept
+			if req.apiVersion >= 5 {
+				resp.int64(result.logStart)
+			}
+			if req.apiVersion >= 8 {
+				resp.arrayLen(0) // record errors
+				resp.nullableString(result.errMessage)
+			}
+		}
+	}
+	resp.int32(0) // throttle time
+	return true, nil
+}
+
+// produceRecords publishes the records to a partition, returning the error code, base offset and log start offset
+func (s *Server) produceRecords(topic string, index int32, records []byte) (int16, int64, int64, error) {
+	l, code := s.openTopic(topic, s.opts.AutoCreateTopics)
+	if code != errCodeNone {
+		return code, unknownOffset, unknownOffset, nil
+	}
+	defer l.Close()
+	if index != partition {
+		return errCodeUnknownTopicOrPartition, unknownOffset, unknownOffset, nil
+	}
+
+	msgs, err := decodeRecords(records)
+	if err != nil {
+		return errCode(err), unknownOffset, unknownOffset, err
+	}
+	nextOffset, err := l.Publish(msgs)
+	if err != nil {
+		return errCode(err), unknownOffset, unknownOffset, err
+	}
+	logStart, err := logStartOffset(l)
+	if err != nil {
+		return errCode(err), unknownOffset, unknownOffset, err
+	}
+	return errCodeNone, nextOffset - int64(len(msgs)), logStart, nil
+}
+
+type fetchPartition struct {
+	index    int32
+	offset   int64
+	maxBytes int32
+}
+
+type fetchTopic struct {
+	name       string
+	partitions []fetchPartition
+}
+
+func (s *Server) fetch(ctx context.Context, req request, resp *encoder) error {
+	req.int32() // replica id
+	maxWait := time.Duration(req.int32()) * time.Millisecond
+	minBytes := int(req.int32())
+	maxBytes := int(req.int32())
+	req.int8() // isolation level, there are no transactions
+	if req.apiVersion >= 7 {
+		req.int32() // session id
+		req.int32() // session epoch
+	}
+
+	var topics []fetchTopic
+	for range req.arrayLen(6) {
+		topic := fetchTopic{name: req.string()}
+		for range req.arrayLen(16) {
+			p := fetchPartition{index: req.int32()}
+			if req.apiVersion >= 9 {
+				req.int32() // current leader epoch
+			}
+			p.offset = req.int64()
+			if req.apiVersion >= 5 {
+				req.int64() // log start offset, only used by followers
+			}
+			p.maxBytes = req.int32()
+			topic.partitions = append(topic.partitions, p)
+		}
+		topics = append(topics, topic)
+	}
+	if req.apiVersion >= 7 {
+		// forgotten topics, not used without sessions
+		for range req.arrayLen(6) {
+			req.string()
+			for range req.arrayLen(4) {
+				req.int32()
+			}
+		}
+	}
+	if req.apiVersion >= 11 {
+		req.string() // rack id
+	}
+	if req.err != nil {
+		return req.err
+	}
+
+	deadline := time.Now().Add(min(maxWait, s.opts.MaxFetchWait))
+	for {
+		// take the channel before reading, so a produce in between is not missed
+		produced := s.producedCh()
+
+		body := &encoder{}
+		size, ok := s.fetchTopics(req, body, topics, maxBytes)
+		wait := time.Until(deadline)
+		if !ok || size >= minBytes || wait <= 0 {
+			resp.int32(0) // throttle time
+			if req.apiVersion >= 7 {
+				resp.int16(errCodeNone)
+				resp.int32(0) // session id, sessions are not supported
+			}
+			resp.b = append(resp.b, body.b...)
+			return nil
+		}
+
+		// messages may also be published directly to the logs, check again periodically
+		timer := time.NewTimer(min(wait, 100*time.Millisecond))
+		select {
+		case <-produced:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// fetchTopics encodes the fetched topics, returning the size of the records and
+// false if any partition failed (e.g. the response should be sent without waiting)
+func (s *Server) fetchTopics(req request, resp *encoder, topics []fetchTopic, maxBytes int) (int, bool) {
+	size, ok := 0, true
+	resp.arrayLen(len(topics))
+	for _, topic := range topics {
+		resp.string(topic.name)
+		resp.arrayLen(len(topic.partitions))
+		for _, p := range topic.partitions {
+			limit := min(int(p.maxBytes), maxBytes-size)
+			code, highWatermark, logStart, records := s.fetchPartition(topic.name, p, limit, size == 0)
+			ok = ok && code == errCodeNone
+			size += len(records)
+
+			resp.int32(p.index)
+			resp.int16(code)
+			resp.int64(highWatermark)
+			resp.int64(highWatermark) // last stable offset
+			if req.apiVersion >= 5 {
+				resp.int64(logStart)
+			}
+			resp.arrayLen(0) // aborted transactions
+			if req.apiVersion >= 11 {
+				resp.int32(-1) // preferred read replica
+			}
+			resp.bytes(records)
+		}
+	}
+	return size, ok
+}
+
+// fetchPartition reads messages from a partition as a record batch, up to limit bytes.
+// If atLeastOne is set, the first message is returned even if it is bigger than limit.
+// Returns the error code, high watermark, log start offset and the records.
+func (s *Server) fetchPartition(topic string, p fetchPartition, limit int, atLeastOne bool) (int16, int64, int64, []byte) {
+	l, code := s.openTopic(topic, false)
+	if code != errCodeNone {
+		return code, unknownOffset, unknownOffset, nil
+	}
+	defer l.Close()
+	if p.index != partition {
+		return errCodeUnknownTopicOrPartition, unknownOffset, unknownOffset, nil
+	}
+
+	highWatermark, err := l.NextOffset()
+	if err != nil {
+		return errCode(err), unknownOffset, unknownOffset, nil
+	}
+	logStart, err := logStartOffset(l)
+	if err != nil {
+		return errCode(err), unknownOffset, unknownOffset, nil
+	}
+	if p.offset < 0 || p.offset > highWatermark {
+		return errCodeOffsetOutOfRange, highWatermark, logStart, nil
+	}
+
+	var msgs []klevdb.Message
+	size := recordBatchOverhead
+	offset := p.offset
+consume:
+	for offset < highWatermark {
+		next, batch, err := l.Consume(offset, consumeBatch)
+		if err != nil {
+			return errCode(err), highWatermark, logStart, nil
+		}
+		for _, msg := range batch {
+			msgSize := batchSize(msg)
+			if size+msgSize > limit && !(atLeastOne && len(msgs) == 0) {
+				break consume
+			}
+			size += msgSize
+			msgs = append(msgs, msg)
+		}
+		if next == offset {
+			break
+		}
+		offset = next
+	}
+
+	if len(msgs) == 0 {
+		return errCodeNone, highWatermark, logStart, nil
+	}
+	records := &encoder{}
+	encodeBatch(records, msgs)
+	return errCodeNone, highWatermark, logStart, records.b
+}
+
+func (s *Server) listOffsets(req request, resp *encoder) error {
+	req.int32() // replica id
+	if req.apiVersion >= 2 {
+		req.int8() // isolation level
+	}
+
+	if req.apiVersion >= 2 {
+		resp.int32(0) // throttle time
+	}
+	topics := req.arrayLen(6)
+	if req.err != nil {
+		return req.err
+	}
+	resp.arrayLen(topics)
+	for range topics {
+		topic := req.string()
+		partitions := req.arrayLen(12)
+		if req.err != nil {
+			return req.err
+		}
+
+		resp.string(topic)
+		resp.arrayLen(partitions)
+		for range partitions {
+			index := req.int32()
+			if req.apiVersion >= 4 {
+				req.int32() // current leader epoch
+			}
+			timestamp := req.int64()
+			if req.err != nil {
+				return req.err
+			}
+
+			code, offset, offsetTime := s.listOffset(topic, index, timestamp)
+			resp.int32(index)
+			resp.int16(code)
+			resp.int64(offsetTime)
+			resp.int64(offset)
+			if req.apiVersion >= 4 {
+				resp.int32(0) // leader epoch
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	listOffsetsLatest   = -1
+	listOffsetsEarliest = -2
+)
+
+// listOffset returns the error code, offset and its timestamp for a list offsets timestamp
+func (s *Server) listOffset(topic string, index int32, timestamp int64) (int16, int64, int64) {
+	l, code := s.openTopic(topic, false)
+	if code != errCodeNone {
+		return code, unknownOffset, unknownTimestamp
+	}
+	defer l.Close()
+	if index != partition {
+		return errCodeUnknownTopicOrPartition, unknownOffset, unknownTimestamp
+	}
+
+	switch timestamp {
+	case listOffsetsLatest:
+		offset, err := l.NextOffset()
+		return errCode(err), offset, unknownTimestamp
+	case listOffsetsEarliest:
+		offset, err := logStartOffset(l)
+		return errCode(err), offset, unknownTimestamp
+	}
+
+	// the first message at or after the timestamp, using the time index if available
+	for msg, err := range l.ByTimeRange(context.Background(), time.UnixMilli(timestamp), time.UnixMilli(math.MaxInt64)) {
+		if err != nil {
+			return errCode(err), unknownOffset, unknownTimestamp
+		}
+		return errCodeNone, msg.Offset, msg.Time.UnixMilli()
+	}
+	return errCodeNone, unknownOffset, unknownTimestamp
+}
@@ -0,0 +1,238 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// errMalformed is returned when a request cannot be decoded
+var errMalformed = errors.New("malformed request")
+
+// maxRequestSize is the maximum size of a request, matching the kafka default socket.request.max.bytes
+const maxRequestSize = 100 * 1024 * 1024
+
+// readRequest reads a size prefixed request
+func readRequest(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := int32(binary.BigEndian.Uint32(size[:]))
+	if n < 0 || n > maxRequestSize {
+		return nil, fmt.Errorf("%w: size %d", errMalformed, n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// decoder reads the primitive types of the protocol. The first error is kept,
+// and all further reads return zero values, so it is checked once at the end
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = fmt.Errorf("%w: need %d bytes, have %d", errMalformed, n, len(d.b))
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) bool() bool {
+	return d.int8() != 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("%w: invalid varint", errMalformed)
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// string reads a string, null strings are read as empty
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// nullableString reads a string, which may be null
+func (d *decoder) nullableString() *string {
+	n := d.int16()
+	if n < 0 {
+		return nil
+	}
+	s := string(d.take(int(n)))
+	return &s
+}
+
+// bytes reads int32 size prefixed bytes, null bytes are returned as nil
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// varintBytes reads varint size prefixed bytes (as used in records), null bytes are returned as nil
+func (d *decoder) varintBytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	if n > math.MaxInt32 {
+		d.err = fmt.Errorf("%w: bytes size %d", errMalformed, n)
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// arrayLen reads the length of an array, null arrays have length 0.
+// The length is checked against the remaining bytes, each element needing at least minSize
+func (d *decoder) arrayLen(minSize int) int {
+	n := d.int32()
+	if n < 0 {
+		return 0
+	}
+	if int(n)*minSize > len(d.b) {
+		d.err = fmt.Errorf("%w: array of %d elements, have %d bytes", errMalformed, n, len(d.b))
+		return 0
+	}
+	return int(n)
+}
+
+// nullableArrayLen is like arrayLen, but returns -1 for null arrays
+func (d *decoder) nullableArrayLen(minSize int) int {
+	if len(d.b) >= 4 && int32(binary.BigEndian.Uint32(d.b)) < 0 {
+		d.int32()
+		return -1
+	}
+	return d.arrayLen(minSize)
+}
+
+// encoder appends the primitive types of the protocol
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) int8(v int8) {
+	e.b = append(e.b, byte(v))
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.int8(1)
+	} else {
+		e.int8(0)
+	}
+}
+
+func (e *encoder) int16(v int16) {
+	e.b = binary.BigEndian.AppendUint16(e.b, uint16(v))
+}
+
+func (e *encoder) int32(v int32) {
+	e.b = binary.BigEndian.AppendUint32(e.b, uint32(v))
+}
+
+func (e *encoder) int64(v int64) {
+	e.b = binary.BigEndian.AppendUint64(e.b, uint64(v))
+}
+
+func (e *encoder) varint(v int64) {
+	e.b = binary.AppendVarint(e.b, v)
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) nullableString(s *string) {
+	if s == nil {
+		e.int16(-1)
+		return
+	}
+	e.string(*s)
+}
+
+// bytes appends int32 size prefixed bytes, nil is appended as null
+func (e *encoder) bytes(b []byte) {
+	if b == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// varintBytes appends varint size prefixed bytes, nil is appended as null
+func (e *encoder) varintBytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *encoder) arrayLen(n int) {
+	e.int32(int32(n))
+}
+
+func (e *encoder) int32Array(vs []int32) {
+	e.arrayLen(len(vs))
+	for _, v := range vs {
+		e.int32(v)
+	}
+}
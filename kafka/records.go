@@ -0,0 +1,184 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/klev-dev/klevdb"
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	// recordBatchMagic is the only message format supported, introduced with kafka 0.11
+	recordBatchMagic = 2
+	// recordBatchOverhead is the size of a record batch without its records
+	recordBatchOverhead = 61
+	// crcOffset is where the crc of a record batch starts, it covers everything after it
+	crcOffset = 17
+
+	attrCompressionMask = 0x07
+	attrLogAppendTime   = 0x08
+	attrControl         = 0x20
+
+	compressionNone = 0
+	compressionGzip = 1
+)
+
+var (
+	errUnsupportedMagic       = errors.New("unsupported record batch magic")
+	errUnsupportedCompression = errors.New("unsupported compression")
+	errCorruptBatch           = errors.New("corrupt record batch")
+)
+
+// decodeRecords decodes the record batches of a produce request into messages.
+// Offsets are ignored (the log assigns them), as well as the times of batches with log append time.
+// The keys, values and headers of the messages reference the records.
+func decodeRecords(records []byte) ([]klevdb.Message, error) {
+	var msgs []klevdb.Message
+	d := &decoder{b: records}
+	for len(d.b) > 0 {
+		d.int64() // base offset, assigned by the log
+		batch := d.bytes()
+		if d.err != nil {
+			return nil, fmt.Errorf("%w: %w", errCorruptBatch, d.err)
+		}
+
+		batchMsgs, err := decodeBatch(batch)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, batchMsgs...)
+	}
+	return msgs, nil
+}
+
+func decodeBatch(batch []byte) ([]klevdb.Message, error) {
+	d := &decoder{b: batch}
+	d.int32() // partition leader epoch
+	if magic := d.int8(); d.err == nil && magic != recordBatchMagic {
+		return nil, fmt.Errorf("%w: %d", errUnsupportedMagic, magic)
+	}
+	crc := uint32(d.int32())
+	if d.err == nil && crc != crc32.Checksum(d.b, crc32c) {
+		return nil, fmt.Errorf("%w: crc mismatch", errCorruptBatch)
+	}
+
+	attributes := d.int16()
+	d.int32() // last offset delta
+	baseTimestamp := d.int64()
+	d.int64() // max timestamp
+	d.int64() // producer id
+	d.int16() // producer epoch
+	d.int32() // base sequence
+	count := d.int32()
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: %w", errCorruptBatch, d.err)
+	}
+	if attributes&attrControl != 0 {
+		return nil, nil // transaction markers, not actual messages
+	}
+
+	switch compression := attributes & attrCompressionMask; compression {
+	case compressionNone:
+	case compressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(d.b))
+		if err != nil {
+			return nil, fmt.Errorf("%w: gzip: %w", errCorruptBatch, err)
+		}
+		if d.b, err = io.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("%w: gzip: %w", errCorruptBatch, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %d", errUnsupportedCompression, compression)
+	}
+	if count < 0 || int(count) > len(d.b) {
+		return nil, fmt.Errorf("%w: %d records in %d bytes", errCorruptBatch, count, len(d.b))
+	}
+
+	msgs := make([]klevdb.Message, count)
+	for i := range msgs {
+		rd := &decoder{b: d.varintBytes()}
+		rd.int8() // attributes
+		timestampDelta := rd.varint()
+		rd.varint() // offset delta
+		msgs[i].Key = rd.varintBytes()
+		msgs[i].Value = rd.varintBytes()
+		headers := rd.varint()
+		if rd.err == nil && headers > int64(len(rd.b)) {
+			return nil, fmt.Errorf("%w: record %d has %d headers", errCorruptBatch, i, headers)
+		}
+		for range headers {
+			key := rd.varintBytes()
+			msgs[i].Headers = append(msgs[i].Headers, klevdb.Header{Key: string(key), Value: rd.varintBytes()})
+		}
+		if err := errors.Join(d.err, rd.err); err != nil {
+			return nil, fmt.Errorf("%w: record %d: %w", errCorruptBatch, i, err)
+		}
+
+		if attributes&attrLogAppendTime == 0 && baseTimestamp+timestampDelta > 0 {
+			msgs[i].Time = time.UnixMilli(baseTimestamp + timestampDelta).UTC()
+		}
+	}
+	return msgs, nil
+}
+
+// encodeBatch encodes messages as an uncompressed record batch. The offsets
+// of the messages must be increasing, but can have gaps (e.g. deleted messages).
+func encodeBatch(e *encoder, msgs []klevdb.Message) {
+	baseOffset, baseTimestamp := msgs[0].Offset, msgs[0].Time.UnixMilli()
+	maxTimestamp := baseTimestamp
+	for _, msg := range msgs {
+		maxTimestamp = max(maxTimestamp, msg.Time.UnixMilli())
+	}
+
+	start := len(e.b)
+	e.int64(baseOffset)
+	e.int32(0) // batch length, set below
+	e.int32(0) // partition leader epoch
+	e.int8(recordBatchMagic)
+	e.int32(0) // crc, set below
+	e.int16(compressionNone)
+	e.int32(int32(msgs[len(msgs)-1].Offset - baseOffset))
+	e.int64(baseTimestamp)
+	e.int64(maxTimestamp)
+	e.int64(-1) // producer id
+	e.int16(-1) // producer epoch
+	e.int32(-1) // base sequence
+	e.arrayLen(len(msgs))
+
+	var rec encoder
+	for _, msg := range msgs {
+		rec.b = rec.b[:0]
+		rec.int8(0) // attributes
+		rec.varint(msg.Time.UnixMilli() - baseTimestamp)
+		rec.varint(msg.Offset - baseOffset)
+		rec.varintBytes(msg.Key)
+		rec.varintBytes(msg.Value)
+		rec.varint(int64(len(msg.Headers)))
+		for _, h := range msg.Headers {
+			rec.varintBytes([]byte(h.Key))
+			rec.varintBytes(h.Value)
+		}
+		e.varintBytes(rec.b)
+	}
+
+	batch := e.b[start:]
+	binary.BigEndian.PutUint32(batch[8:], uint32(len(batch)-12))
+	binary.BigEndian.PutUint32(batch[crcOffset:], crc32.Checksum(batch[crcOffset+4:], crc32c))
+}
+
+// batchSize is an upper bound of the size of a message in a record batch, used to respect fetch max bytes
+func batchSize(msg klevdb.Message) int {
+	size := 5*binary.MaxVarintLen64 + len(msg.Key) + len(msg.Value)
+	for _, h := range msg.Headers {
+		size += 2*binary.MaxVarintLen64 + len(h.Key) + len(h.Value)
+	}
+	return size
+}
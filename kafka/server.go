@@ -0,0 +1,237 @@
+// Package kafka serves the logs of a [klevdb.Store] over a minimal subset of the Kafka protocol,
+// so existing Kafka clients can produce to and fetch from them, e.g. for local development.
+//
+// Each log of the store is a topic with a single partition 0, served by a single broker (node 0).
+// Kafka offsets are the offsets of the log and record timestamps are the message times.
+// Record keys, values and headers map to the message keys, values and headers
+// (headers require logs with V3 segments, see [klevdb.VersionOptions]).
+//
+// The supported APIs are:
+//
+//	ApiVersions  v0-v2
+//	Metadata     v0-v8
+//	Produce      v3-v8, uncompressed or gzip records, acks are ignored (except 0, which sends no response)
+//	Fetch        v4-v11, without fetch sessions, records are not compressed
+//	ListOffsets  v1-v5
+//
+// There are no consumer groups, transactions or idempotent producers, clients should
+// consume partitions directly and disable idempotent writes (if enabled by default).
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klev-dev/klevdb"
+)
+
+type Options struct {
+	// AdvertisedAddr is the host:port of the broker returned to clients by Metadata.
+	// Defaults to the local address of each connection, e.g. the address the client connected to.
+	AdvertisedAddr string
+	// AutoCreateTopics creates unknown topics on Metadata (if the client allows it) and Produce.
+	AutoCreateTopics bool
+	// MaxFetchWait is the maximum time a fetch waits for new messages, regardless of the
+	// wait requested by the client. Defaults to 30 seconds.
+	MaxFetchWait time.Duration
+}
+
+// Server serves the Kafka protocol, see [Server.Serve] and [Server.ServeConn]
+type Server struct {
+	store *klevdb.Store
+	opts  Options
+
+	// produced is closed (and replaced) after each produce, waking up waiting fetches
+	produced   chan struct{}
+	producedMu sync.Mutex
+}
+
+// New creates a server for the logs of a store
+func New(store *klevdb.Store, opts Options) *Server {
+	if opts.MaxFetchWait <= 0 {
+		opts.MaxFetchWait = 30 * time.Second
+	}
+	return &Server{store: store, opts: opts, produced: make(chan struct{})}
+}
+
+// Serve accepts connections from the listener and serves each one, until ctx is done or accept fails
+func (s *Server) Serve(ctx context.Context, lis net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { lis.Close() })
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		wg.Go(func() {
+			_ = s.ServeConn(ctx, conn)
+		})
+	}
+}
+
+// ServeConn serves requests from a single connection, until ctx is done or the connection fails.
+// Responses are sent in the order of the requests. The connection is closed when done.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	advertisedAddr := s.opts.AdvertisedAddr
+	if advertisedAddr == "" {
+		advertisedAddr = conn.LocalAddr().String()
+	}
+	host, portStr, err := net.SplitHostPort(advertisedAddr)
+	if err != nil {
+		return fmt.Errorf("advertised addr: %w", err)
+	}
+	port, err := strconv.ParseInt(portStr, 10, 32)
+	if err != nil {
+		return fmt.Errorf("advertised addr: %w", err)
+	}
+	broker := brokerAddr{host, int32(port)}
+
+	for {
+		req, err := readRequest(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		resp, err := s.handle(ctx, broker, req)
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			continue // e.g. produce with acks=0
+		}
+		if _, err := conn.Write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+type brokerAddr struct {
+	host string
+	port int32
+}
+
+const (
+	apiProduce     int16 = 0
+	apiFetch       int16 = 1
+	apiListOffsets int16 = 2
+	apiMetadata    int16 = 3
+	apiVersions    int16 = 18
+)
+
+// apiVersionRange is the range of versions supported for an api
+type apiVersionRange struct {
+	key, min, max int16
+}
+
+var supportedAPIs = []apiVersionRange{
+	{apiProduce, 3, 8},
+	{apiFetch, 4, 11},
+	{apiListOffsets, 1, 5},
+	{apiMetadata, 0, 8},
+	{apiVersions, 0, 2},
+}
+
+var errUnsupportedAPI = errors.New("unsupported api")
+
+// request is a decoded request header, with the decoder positioned at the request body
+type request struct {
+	*decoder
+	apiKey        int16
+	apiVersion    int16
+	correlationID int32
+}
+
+// handle handles a single request, returning the response (with its size) to send
+func (s *Server) handle(ctx context.Context, broker brokerAddr, b []byte) ([]byte, error) {
+	req := request{decoder: &decoder{b: b}}
+	req.apiKey = req.int16()
+	req.apiVersion = req.int16()
+	req.correlationID = req.int32()
+	req.nullableString() // client id
+	if req.err != nil {
+		return nil, req.err
+	}
+
+	resp := &encoder{}
+	resp.int32(0) // size, set below
+	resp.int32(req.correlationID)
+
+	idx := slices.IndexFunc(supportedAPIs, func(api apiVersionRange) bool { return api.key == req.apiKey })
+	switch {
+	case idx < 0:
+		return nil, fmt.Errorf("%w: %d", errUnsupportedAPI, req.apiKey)
+	case req.apiVersion < supportedAPIs[idx].min || req.apiVersion > supportedAPIs[idx].max:
+		if req.apiKey == apiVersions {
+			// clients start with their newest version, the response tells them what is supported
+			s.apiVersions(request{apiVersion: 0}, resp, errCodeUnsupportedVersion)
+			break
+		}
+		return nil, fmt.Errorf("%w: %d version %d", errUnsupportedAPI, req.apiKey, req.apiVersion)
+	default:
+		var err error
+		switch req.apiKey {
+		case apiVersions:
+			s.apiVersions(req, resp, errCodeNone)
+		case apiMetadata:
+			err = s.metadata(req, resp, broker)
+		case apiProduce:
+			var acks bool
+			if acks, err = s.produce(req, resp); err == nil && !acks {
+				return nil, nil
+			}
+		case apiFetch:
+			err = s.fetch(ctx, req, resp)
+		case apiListOffsets:
+			err = s.listOffsets(req, resp)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("api %d version %d: %w", req.apiKey, req.apiVersion, err)
+		}
+	}
+
+	binary.BigEndian.PutUint32(resp.b, uint32(len(resp.b)-4))
+	return resp.b, nil
+}
+
+// notifyProduced wakes up the fetches waiting for new messages
+func (s *Server) notifyProduced() {
+	s.producedMu.Lock()
+	defer s.producedMu.Unlock()
+
+	close(s.produced)
+	s.produced = make(chan struct{})
+}
+
+func (s *Server) producedCh() <-chan struct{} {
+	s.producedMu.Lock()
+	defer s.producedMu.Unlock()
+
+	return s.produced
+}
@@ -0,0 +1,474 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb"
+)
+
+type testClient struct {
+	conn          net.Conn
+	correlationID int32
+}
+
+func newTestClient(t *testing.T, opts Options) (*testClient, *klevdb.Store) {
+	store, err := klevdb.OpenStore(t.TempDir(), klevdb.StoreOptions{
+		LogOptions: func(string) klevdb.Options {
+			return klevdb.Options{TimeIndex: true, Version: klevdb.VersionOptions{NewSegmentsVersion: klevdb.V3}}
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, store.Close()) })
+
+	serverConn, clientConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- New(store, opts).ServeConn(context.Background(), serverConn) }()
+	t.Cleanup(func() {
+		require.NoError(t, clientConn.Close())
+		require.NoError(t, <-done)
+	})
+	return &testClient{conn: clientConn}, store
+}
+
+// send sends a request, without reading a response
+func (c *testClient) send(t *testing.T, apiKey, apiVersion int16, body func(e *encoder)) {
+	c.correlationID++
+	e := &encoder{}
+	e.int32(0)
+	e.int16(apiKey)
+	e.int16(apiVersion)
+	e.int32(c.correlationID)
+	clientID := "test"
+	e.nullableString(&clientID)
+	body(e)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+
+	_, err := c.conn.Write(e.b)
+	require.NoError(t, err)
+}
+
+// do sends a request and returns a decoder of its response body
+func (c *testClient) do(t *testing.T, apiKey, apiVersion int16, body func(e *encoder)) *decoder {
+	c.send(t, apiKey, apiVersion, body)
+
+	b, err := readRequest(c.conn)
+	require.NoError(t, err)
+	d := &decoder{b: b}
+	require.Equal(t, c.correlationID, d.int32())
+	return d
+}
+
+func (c *testClient) metadata(t *testing.T, apiVersion int16, allowCreate bool, topics ...string) map[string]int16 {
+	d := c.do(t, apiMetadata, apiVersion, func(e *encoder) {
+		if topics == nil {
+			e.int32(-1) // all topics
+		} else {
+			e.arrayLen(len(topics))
+		}
+		for _, topic := range topics {
+			e.string(topic)
+		}
+		if apiVersion >= 4 {
+			e.bool(allowCreate)
+		}
+		if apiVersion >= 8 {
+			e.bool(false)
+			e.bool(false)
+		}
+	})
+
+	codes := map[string]int16{}
+	if apiVersion >= 3 {
+		d.int32() // throttle time
+	}
+	require.Equal(t, 1, d.arrayLen(1))
+	require.Equal(t, nodeID, d.int32())
+	d.string()         // host
+	d.int32()          // port
+	d.nullableString() // rack
+	if apiVersion >= 2 {
+		require.Equal(t, clusterID, *d.nullableString())
+	}
+	require.Equal(t, nodeID, d.int32())
+	for range d.arrayLen(1) {
+		code, topic := d.int16(), d.string()
+		d.bool()
+		for range d.arrayLen(1) {
+			require.Equal(t, errCodeNone, d.int16())
+			require.Equal(t, partition, d.int32())
+			require.Equal(t, nodeID, d.int32())
+			if apiVersion >= 7 {
+				d.int32()
+			}
+			require.Equal(t, 1, d.arrayLen(4))
+			d.int32()
+			require.Equal(t, 1, d.arrayLen(4))
+			d.int32()
+			if apiVersion >= 5 {
+				require.Equal(t, 0, d.arrayLen(4))
+			}
+		}
+		if apiVersion >= 8 {
+			d.int32() // topic authorized operations
+		}
+		codes[topic] = code
+	}
+	if apiVersion >= 8 {
+		d.int32() // cluster authorized operations
+	}
+	require.NoError(t, d.err)
+	require.Empty(t, d.b)
+	return codes
+}
+
+func (c *testClient) produce(t *testing.T, apiVersion int16, topic string, records []byte) (int16, int64) {
+	d := c.do(t, apiProduce, apiVersion, func(e *encoder) {
+		e.nullableString(nil)
+		e.int16(1) // acks
+		e.int32(1000)
+		e.arrayLen(1)
+		e.string(topic)
+		e.arrayLen(1)
+		e.int32(partition)
+		e.bytes(records)
+	})
+
+	require.Equal(t, 1, d.arrayLen(1))
+	require.Equal(t, topic, d.string())
+	require.Equal(t, 1, d.arrayLen(1))
+	require.Equal(t, partition, d.int32())
+	code, baseOffset := d.int16(), d.int64()
+	d.int64() // log append time
+	if apiVersion >= 5 {
+		d.int64() // log start offset
+	}
+	if apiVersion >= 8 {
+		require.Equal(t, 0, d.arrayLen(1))
+		d.nullableString()
+	}
+	d.int32() // throttle time
+	require.NoError(t, d.err)
+	require.Empty(t, d.b)
+	return code, baseOffset
+}
+
+type fetchResult struct {
+	code          int16
+	highWatermark int64
+	logStart      int64
+	msgs          []klevdb.Message
+}
+
+func (c *testClient) fetch(t *testing.T, apiVersion int16, topic string, offset int64, maxWait time.Duration, maxBytes int32) fetchResult {
+	d := c.do(t, apiFetch, apiVersion, func(e *encoder) {
+		e.int32(-1)
+		e.int32(int32(maxWait.Milliseconds()))
+		e.int32(1) // min bytes
+		e.int32(maxBytes)
+		e.int8(0)
+		if apiVersion >= 7 {
+			e.int32(0)
+			e.int32(-1)
+		}
+		e.arrayLen(1)
+		e.string(topic)
+		e.arrayLen(1)
+		e.int32(partition)
+		if apiVersion >= 9 {
+			e.int32(-1)
+		}
+		e.int64(offset)
+		if apiVersion >= 5 {
+			e.int64(-1)
+		}
+		e.int32(maxBytes)
+		if apiVersion >= 7 {
+			e.arrayLen(0)
+		}
+		if apiVersion >= 11 {
+			e.string("")
+		}
+	})
+
+	d.int32() // throttle time
+	if apiVersion >= 7 {
+		require.Equal(t, errCodeNone, d.int16())
+		require.Equal(t, int32(0), d.int32())
+	}
+	require.Equal(t, 1, d.arrayLen(1))
+	require.Equal(t, topic, d.string())
+	require.Equal(t, 1, d.arrayLen(1))
+	require.Equal(t, partition, d.int32())
+
+	var result fetchResult
+	result.code = d.int16()
+	result.highWatermark = d.int64()
+	require.Equal(t, result.highWatermark, d.int64())
+	if apiVersion >= 5 {
+		result.logStart = d.int64()
+	}
+	require.Equal(t, 0, d.arrayLen(1))
+	if apiVersion >= 11 {
+		require.Equal(t, int32(-1), d.int32())
+	}
+	records := d.bytes()
+	require.NoError(t, d.err)
+	require.Empty(t, d.b)
+
+	if records != nil {
+		result.msgs = decodeFetched(t, records)
+	}
+	return result
+}
+
+// decodeFetched decodes fetched records, keeping their offsets
+func decodeFetched(t *testing.T, records []byte) []klevdb.Message {
+	d := &decoder{b: records}
+	baseOffset := d.int64()
+	batch := d.bytes()
+	require.NoError(t, d.err)
+	require.Empty(t, d.b)
+
+	msgs, err := decodeBatch(batch)
+	require.NoError(t, err)
+
+	bd := &decoder{b: batch[recordBatchOverhead-12:]}
+	for i := range msgs {
+		rd := &decoder{b: bd.varintBytes()}
+		rd.int8()
+		rd.varint()
+		msgs[i].Offset = baseOffset + rd.varint()
+	}
+	require.NoError(t, bd.err)
+	return msgs
+}
+
+func (c *testClient) listOffset(t *testing.T, apiVersion int16, topic string, timestamp int64) (int16, int64, int64) {
+	d := c.do(t, apiListOffsets, apiVersion, func(e *encoder) {
+		e.int32(-1)
+		if apiVersion >= 2 {
+			e.int8(0)
+		}
+		e.arrayLen(1)
+		e.string(topic)
+		e.arrayLen(1)
+		e.int32(partition)
+		if apiVersion >= 4 {
+			e.int32(-1)
+		}
+		e.int64(timestamp)
+	})
+
+	if apiVersion >= 2 {
+		d.int32() // throttle time
+	}
+	require.Equal(t, 1, d.arrayLen(1))
+	require.Equal(t, topic, d.string())
+	require.Equal(t, 1, d.arrayLen(1))
+	require.Equal(t, partition, d.int32())
+	code, ts, offset := d.int16(), d.int64(), d.int64()
+	if apiVersion >= 4 {
+		d.int32()
+	}
+	require.NoError(t, d.err)
+	require.Empty(t, d.b)
+	return code, offset, ts
+}
+
+func testMessages(n int, start time.Time) []klevdb.Message {
+	msgs := make([]klevdb.Message, n)
+	for i := range msgs {
+		msgs[i] = klevdb.Message{
+			Offset:  int64(i),
+			Time:    start.Add(time.Duration(i) * time.Second),
+			Key:     []byte{'k', byte('0' + i)},
+			Value:   []byte{'v', byte('0' + i)},
+			Headers: []klevdb.Header{{Key: "h", Value: []byte{byte('0' + i)}}},
+		}
+	}
+	return msgs
+}
+
+func encodeRecords(msgs []klevdb.Message) []byte {
+	e := &encoder{}
+	encodeBatch(e, msgs)
+	return e.b
+}
+
+// gzipRecords encodes messages as a gzip compressed record batch
+func gzipRecords(t *testing.T, msgs []klevdb.Message) []byte {
+	b := encodeRecords(msgs)
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, err := w.Write(b[recordBatchOverhead:])
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	b = append(b[:recordBatchOverhead], compressed.Bytes()...)
+	binary.BigEndian.PutUint16(b[21:], compressionGzip)
+	binary.BigEndian.PutUint32(b[8:], uint32(len(b)-12))
+	binary.BigEndian.PutUint32(b[crcOffset:], crc32.Checksum(b[crcOffset+4:], crc32c))
+	return b
+}
+
+func TestRecords(t *testing.T) {
+	msgs := testMessages(3, time.UnixMilli(1700000000000).UTC())
+	msgs[1].Key = nil
+	msgs[2].Headers = nil
+
+	t.Run("Plain", func(t *testing.T) {
+		decoded, err := decodeRecords(encodeRecords(msgs))
+		require.NoError(t, err)
+		for i := range msgs {
+			msg := msgs[i]
+			msg.Offset = 0 // offsets are assigned by the log
+			require.Equal(t, msg, decoded[i])
+		}
+	})
+
+	t.Run("Gzip", func(t *testing.T) {
+		records := append(gzipRecords(t, msgs[:1]), gzipRecords(t, msgs[1:])...)
+		decoded, err := decodeRecords(records)
+		require.NoError(t, err)
+		require.Len(t, decoded, 3)
+		require.Equal(t, msgs[2].Value, decoded[2].Value)
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		records := encodeRecords(msgs)
+		records[len(records)-1]++
+		_, err := decodeRecords(records)
+		require.ErrorIs(t, err, errCorruptBatch)
+
+		records = encodeRecords(msgs)
+		binary.BigEndian.PutUint16(records[21:], 2) // snappy
+		binary.BigEndian.PutUint32(records[crcOffset:], crc32.Checksum(records[crcOffset+4:], crc32c))
+		_, err = decodeRecords(records)
+		require.ErrorIs(t, err, errUnsupportedCompression)
+	})
+}
+
+func TestServer(t *testing.T) {
+	c, store := newTestClient(t, Options{AdvertisedAddr: "localhost:9092", AutoCreateTopics: true, MaxFetchWait: time.Second})
+	start := time.UnixMilli(1700000000000).UTC()
+	msgs := testMessages(5, start)
+
+	t.Run("ApiVersions", func(t *testing.T) {
+		for _, version := range []int16{0, 2, 3} {
+			d := c.do(t, apiVersions, version, func(*encoder) {})
+			if version == 3 {
+				require.Equal(t, errCodeUnsupportedVersion, d.int16())
+			} else {
+				require.Equal(t, errCodeNone, d.int16())
+			}
+			require.Equal(t, len(supportedAPIs), d.arrayLen(6))
+		}
+	})
+
+	t.Run("Metadata", func(t *testing.T) {
+		require.Equal(t, map[string]int16{"missing": errCodeUnknownTopicOrPartition}, c.metadata(t, 8, false, "missing"))
+		require.Equal(t, map[string]int16{"events": errCodeNone}, c.metadata(t, 8, true, "events"))
+		require.Equal(t, map[string]int16{"events": errCodeNone}, c.metadata(t, 1, false))
+		require.Equal(t, map[string]int16{"bad/name": errCodeInvalidTopic}, c.metadata(t, 5, true, "bad/name"))
+	})
+
+	t.Run("Produce", func(t *testing.T) {
+		code, baseOffset := c.produce(t, 3, "events", encodeRecords(msgs[:2]))
+		require.Equal(t, errCodeNone, code)
+		require.Equal(t, int64(0), baseOffset)
+
+		code, baseOffset = c.produce(t, 8, "events", gzipRecords(t, msgs[2:]))
+		require.Equal(t, errCodeNone, code)
+		require.Equal(t, int64(2), baseOffset)
+
+		l, err := store.Log("events")
+		require.NoError(t, err)
+		defer l.Close()
+		msg, err := l.Get(3)
+		require.NoError(t, err)
+		require.Equal(t, msgs[3], msg)
+	})
+
+	t.Run("Fetch", func(t *testing.T) {
+		result := c.fetch(t, 11, "events", 1, 0, 1024*1024)
+		require.Equal(t, errCodeNone, result.code)
+		require.Equal(t, int64(5), result.highWatermark)
+		require.Equal(t, int64(0), result.logStart)
+		require.Equal(t, msgs[1:], result.msgs)
+
+		// at least one message, even over max bytes
+		result = c.fetch(t, 4, "events", 2, 0, 1)
+		require.Equal(t, msgs[2:3], result.msgs)
+
+		result = c.fetch(t, 11, "events", 6, 0, 1024)
+		require.Equal(t, errCodeOffsetOutOfRange, result.code)
+
+		result = c.fetch(t, 11, "missing", 0, 0, 1024)
+		require.Equal(t, errCodeUnknownTopicOrPartition, result.code)
+	})
+
+	t.Run("FetchWait", func(t *testing.T) {
+		result := c.fetch(t, 7, "events", 5, 10*time.Millisecond, 1024)
+		require.Equal(t, errCodeNone, result.code)
+		require.Empty(t, result.msgs)
+
+		l, err := store.Log("events")
+		require.NoError(t, err)
+		defer l.Close()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			_, _ = l.Publish([]klevdb.Message{{Value: []byte("direct")}})
+		}()
+
+		// published directly to the log, not through the server
+		result = c.fetch(t, 11, "events", 5, 5*time.Second, 1024)
+		require.Len(t, result.msgs, 1)
+		require.Equal(t, int64(5), result.msgs[0].Offset)
+		require.Equal(t, []byte("direct"), result.msgs[0].Value)
+	})
+
+	t.Run("ListOffsets", func(t *testing.T) {
+		code, offset, _ := c.listOffset(t, 1, "events", listOffsetsEarliest)
+		require.Equal(t, errCodeNone, code)
+		require.Equal(t, int64(0), offset)
+
+		_, offset, _ = c.listOffset(t, 5, "events", listOffsetsLatest)
+		require.Equal(t, int64(6), offset)
+
+		_, offset, ts := c.listOffset(t, 5, "events", start.Add(1500*time.Millisecond).UnixMilli())
+		require.Equal(t, int64(2), offset)
+		require.Equal(t, msgs[2].Time.UnixMilli(), ts)
+
+		_, offset, _ = c.listOffset(t, 5, "events", time.Now().Add(time.Hour).UnixMilli())
+		require.Equal(t, unknownOffset, offset)
+
+		code, _, _ = c.listOffset(t, 5, "missing", listOffsetsLatest)
+		require.Equal(t, errCodeUnknownTopicOrPartition, code)
+	})
+
+	t.Run("ProduceNoAcks", func(t *testing.T) {
+		c.send(t, apiProduce, 3, func(e *encoder) {
+			e.nullableString(nil)
+			e.int16(0) // acks
+			e.int32(1000)
+			e.arrayLen(1)
+			e.string("noacks")
+			e.arrayLen(1)
+			e.int32(partition)
+			e.bytes(encodeRecords(msgs[:1]))
+		})
+
+		// the next response is for the next request
+		_, offset, _ := c.listOffset(t, 5, "noacks", listOffsetsLatest)
+		require.Equal(t, int64(1), offset)
+	})
+}
@@ -28,8 +28,28 @@ func Open(dir string, opts Options) (result Log, err error) {
 	if opts.Rollover <= 0 {
 		opts.Rollover = 1024 * 1024
 	}
+	if opts.Metrics == nil {
+		opts.Metrics = noMetrics{}
+	}
+	if opts.Events == nil {
+		opts.Events = noEvents{}
+	}
 	if opts.Version.NewSegmentsVersion == vUnknown {
 		opts.Version.NewSegmentsVersion = V2
+		if opts.Compression != CompressionNone || opts.Encryption != nil || opts.Idempotent {
+			opts.Version.NewSegmentsVersion = V3
+		}
+	}
+	if opts.UnifiedKeyIndex && !opts.KeyIndex {
+		return nil, fmt.Errorf("open: %w", errUnifiedKeyIndex)
+	}
+	if opts.UnifiedTimeIndex && !opts.TimeIndex {
+		return nil, fmt.Errorf("open: %w", errUnifiedTimeIndex)
+	}
+	if v, err := opts.Version.NewSegmentsVersion.withOptions(opts); err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	} else {
+		opts.Version.NewSegmentsVersion = v
 	}
 
 	if opts.CreateDirs {
@@ -68,18 +88,25 @@ func Open(dir string, opts Options) (result Log, err error) {
 		dir:    dir,
 		opts:   opts,
 		params: params,
+		hooks:  logHooks{metrics: opts.Metrics, events: opts.Events},
 		lock:   lock,
 	}
+	if !opts.Readonly {
+		l.syncer = newSyncer()
+	}
 
 	segments, err := segment.Find(dir, opts.AutoSync)
 	if err != nil {
 		return nil, fmt.Errorf("open find segments: %w", err)
 	}
+	for i := range segments {
+		segments[i].Keys = opts.Encryption
+	}
 
 	switch {
 	case opts.Readonly && len(segments) == 0:
 		ix := newReaderIndex(nil, params.Keys, 0, true)
-		rdr := reopenReader(segment.New(dir, 0, opts.AutoSync), params, opts.Version.NewSegmentsVersion, ix)
+		rdr := reopenReader(l.newSegment(0), params, opts.Version.NewSegmentsVersion, l.hooks, ix)
 		l.readers = []*reader{rdr}
 	case opts.Readonly:
 		if opts.Check || opts.Recover {
@@ -90,11 +117,13 @@ func Open(dir string, opts Options) (result Log, err error) {
 		}
 
 		for i, seg := range segments {
-			rdr := openReader(seg, params, opts.Version.NewSegmentsVersion, i == len(segments)-1)
+			rdr := openReader(seg, params, opts.Version.NewSegmentsVersion, l.hooks, i == len(segments)-1)
 			l.readers = append(l.readers, rdr)
 		}
+	case len(segments) == 0 && opts.LazyWriter:
+		l.readers = []*reader{l.emptyHeadReader()}
 	case len(segments) == 0:
-		w, err := openWriter(segment.New(dir, 0, opts.AutoSync), params, opts.Version.NewSegmentsVersion, 0)
+		w, err := openWriter(l.newSegment(0), params, opts.Version.NewSegmentsVersion, l.hooks, 0)
 		if err != nil {
 			return nil, fmt.Errorf("open new writer: %w", err)
 		}
@@ -104,8 +133,11 @@ func Open(dir string, opts Options) (result Log, err error) {
 		switch {
 		case opts.Recover:
 			head := segments[len(segments)-1]
-			if err := head.Recover(params); err != nil {
-				return nil, fmt.Errorf("open recover: %w", err)
+			if cerr := head.Check(params); cerr != nil {
+				if err := head.Recover(params); err != nil {
+					return nil, fmt.Errorf("open recover: %w", err)
+				}
+				l.hooks.events.Event(HeadRecovered{Segment: head, Err: cerr})
 			}
 		case opts.Check:
 			head := segments[len(segments)-1]
@@ -124,11 +156,16 @@ func Open(dir string, opts Options) (result Log, err error) {
 
 		head := segments[len(segments)-1]
 		for _, seg := range segments[:len(segments)-1] {
-			rdr := openReader(seg, params, opts.Version.NewSegmentsVersion, false)
+			rdr := openReader(seg, params, opts.Version.NewSegmentsVersion, l.hooks, false)
 			l.readers = append(l.readers, rdr)
 		}
 
-		wrt, err := openWriter(head, params, opts.Version.NewSegmentsVersion, 0)
+		if opts.LazyWriter {
+			l.readers = append(l.readers, openReader(head, params, opts.Version.NewSegmentsVersion, l.hooks, true))
+			break
+		}
+
+		wrt, err := openWriter(head, params, opts.Version.NewSegmentsVersion, l.hooks, 0)
 		if err != nil {
 			return nil, fmt.Errorf("open writer: %w", err)
 		}
@@ -136,6 +173,41 @@ func Open(dir string, opts Options) (result Log, err error) {
 		l.readers = append(l.readers, wrt.reader)
 	}
 
+	if opts.UnifiedKeyIndex && !opts.Readonly {
+		if l.keys, err = l.openKeyIndex(); err != nil {
+			if cerr := l.Close(); cerr != nil {
+				return nil, fmt.Errorf("open key index: %w: %w", err, cerr)
+			}
+			return nil, fmt.Errorf("open key index: %w", err)
+		}
+	}
+
+	if opts.UnifiedTimeIndex && !opts.Readonly {
+		if l.times, err = l.openTimeIndex(); err != nil {
+			if cerr := l.Close(); cerr != nil {
+				return nil, fmt.Errorf("open time index: %w: %w", err, cerr)
+			}
+			return nil, fmt.Errorf("open time index: %w", err)
+		}
+	}
+
+	if opts.Idempotent && !opts.Readonly {
+		if err := l.openProducers(); err != nil {
+			if cerr := l.Close(); cerr != nil {
+				return nil, fmt.Errorf("open producers: %w: %w", err, cerr)
+			}
+			return nil, fmt.Errorf("open producers: %w", err)
+		}
+	}
+
+	if !opts.Readonly {
+		l.startSyncer()
+	}
+
+	if opts.Retention.enabled() && !opts.Readonly {
+		l.startRetention()
+	}
+
 	return l, nil
 }
 
@@ -143,15 +215,106 @@ type log struct {
 	dir    string
 	opts   Options
 	params index.Params
+	hooks  logHooks
 	lock   *flock.Flock
 
-	writer   *writer
-	writerMu sync.Mutex
+	writer         *writer // nil until the first publish with LazyWriter
+	writerMu       sync.Mutex
+	writerLastUsed time.Time // guarded by writerMu
 
 	readers   []*reader
 	readersMu sync.RWMutex
 
 	deleteMu sync.Mutex
+
+	producers map[string]producerState // guarded by writerMu
+	keys      *keyIndex                // nil unless UnifiedKeyIndex
+	times     *timeIndex               // nil unless UnifiedTimeIndex
+	retention *retention               // nil unless Retention is enabled
+	syncer    *syncer                  // nil in readonly mode
+}
+
+// logHooks are the metrics and events of a log, shared with its readers and writers
+type logHooks struct {
+	metrics Metrics
+	events  Events
+}
+
+func (l *log) newSegment(offset int64) segment.Segment {
+	seg := segment.New(l.dir, offset, l.opts.AutoSync)
+	seg.Keys = l.opts.Encryption
+	return seg
+}
+
+// emptyHeadReader reads the head of a log without segments, until its writer is opened
+func (l *log) emptyHeadReader() *reader {
+	rdr := openReader(l.newSegment(0), l.params, l.opts.Version.NewSegmentsVersion, l.hooks, true)
+	rdr.index = newReaderIndex(nil, l.params.Keys, 0, true)
+	return rdr
+}
+
+// openHeadWriter opens the writer of the head segment, if not already open. Expects writerMu to be held
+func (l *log) openHeadWriter() error {
+	l.writerLastUsed = time.Now()
+	if l.writer != nil {
+		return nil
+	}
+
+	l.readersMu.Lock()
+	defer l.readersMu.Unlock()
+
+	head := l.readers[len(l.readers)-1]
+	wrt, err := openWriter(head.segment, l.params, l.opts.Version.NewSegmentsVersion, l.hooks, 0)
+	if err != nil {
+		return fmt.Errorf("open writer: %w", err)
+	}
+	if err := head.Close(); err != nil {
+		return errors.Join(err, wrt.Close())
+	}
+
+	l.writer = wrt
+	l.readers[len(l.readers)-1] = wrt.reader
+	return nil
+}
+
+// closeIdleWriter closes the writer of a LazyWriter log, if unused for WriterIdleTimeout
+func (l *log) closeIdleWriter() error {
+	if !l.opts.LazyWriter || l.opts.WriterIdleTimeout <= 0 {
+		return nil
+	}
+
+	l.writerMu.Lock()
+	defer l.writerMu.Unlock()
+
+	if l.writer == nil || time.Since(l.writerLastUsed) < l.opts.WriterIdleTimeout {
+		return nil
+	}
+
+	l.readersMu.Lock()
+	defer l.readersMu.Unlock()
+
+	if err := l.writer.Sync(); err != nil {
+		return err
+	}
+	if err := l.writer.Close(); err != nil {
+		return err
+	}
+
+	l.readers[len(l.readers)-1] = openReader(l.writer.segment, l.params, l.opts.Version.NewSegmentsVersion, l.hooks, true)
+	l.writer = nil
+	return nil
+}
+
+// headNextOffset returns the next offset of the log, from the writer if it is open. Expects writerMu to be held
+func (l *log) headNextOffset() (int64, error) {
+	if l.writer != nil {
+		return l.writer.GetNextOffset()
+	}
+
+	l.readersMu.RLock()
+	defer l.readersMu.RUnlock()
+
+	return l.readers[len(l.readers)-1].GetNextOffset()
 }
 
 func (l *log) Publish(msgs []message.Message) (int64, error) {
@@ -159,17 +322,115 @@ func (l *log) Publish(msgs []message.Message) (int64, error) {
 		return OffsetInvalid, ErrReadonly
 	}
 
-	l.writerMu.Lock()
-	defer l.writerMu.Unlock()
+	return l.publishSynced(func() (int64, error) {
+		return l.publish(msgs)
+	})
+}
+
+func (l *log) PublishIf(expectedNextOffset int64, msgs []message.Message) (int64, error) {
+	if l.opts.Readonly {
+		return OffsetInvalid, ErrReadonly
+	}
+
+	return l.publishSynced(func() (int64, error) {
+		nextOffset, err := l.headNextOffset()
+		if err != nil {
+			return OffsetInvalid, err
+		}
+		if nextOffset != expectedNextOffset {
+			return OffsetInvalid, &OffsetMismatchError{Expected: expectedNextOffset, Actual: nextOffset}
+		}
+
+		return l.publish(msgs)
+	})
+}
+
+func (l *log) PublishIfKey(key []byte, expectedOffset int64, msg message.Message) (int64, error) {
+	if l.opts.Readonly {
+		return OffsetInvalid, ErrReadonly
+	}
+	if !l.opts.KeyIndex {
+		return OffsetInvalid, errNoKeyIndex
+	}
+
+	return l.publishSynced(func() (int64, error) {
+		// the head segment is searched first, using the in-memory keys of the writer
+		actualOffset, err := l.OffsetByKey(key)
+		switch {
+		case err == nil:
+			// the key exists
+		case errors.Is(err, message.ErrNotFound):
+			actualOffset = OffsetInvalid
+		default:
+			return OffsetInvalid, err
+		}
+		if actualOffset != expectedOffset {
+			return OffsetInvalid, &OffsetMismatchError{Expected: expectedOffset, Actual: actualOffset}
+		}
+
+		msg.Key = key
+		return l.publish([]message.Message{msg})
+	})
+}
+
+func (l *log) PublishAt(msgs []message.Message) (int64, error) {
+	if l.opts.Readonly {
+		return OffsetInvalid, ErrReadonly
+	}
+
+	return l.publishSynced(func() (int64, error) {
+		nextOffset, err := l.headNextOffset()
+		if err != nil {
+			return OffsetInvalid, err
+		}
+		for _, msg := range msgs {
+			if msg.Offset < nextOffset {
+				return OffsetInvalid, fmt.Errorf("%w: publish at %d, expected at least %d", ErrInvalidOffset, msg.Offset, nextOffset)
+			}
+			nextOffset = msg.Offset + 1
+		}
+
+		nextOffset, err = l.publishMessages(msgs, true)
+		if err != nil {
+			return OffsetInvalid, err
+		}
+
+		if l.producers != nil {
+			for _, msg := range msgs {
+				if producerID, sequence, ok := parseProducer(msg); ok {
+					l.producers[producerID] = producerState{sequence, msg.Offset + 1}
+				}
+			}
+		}
+		return nextOffset, nil
+	})
+}
+
+// publish appends messages to the writer, rolling over to a new segment if needed. Messages can't have the
+// headers of idempotent batches, see PublishIdempotent. Expects writerMu to be held
+func (l *log) publish(msgs []message.Message) (int64, error) {
+	if err := checkProducerHeaders(msgs); err != nil {
+		return OffsetInvalid, err
+	}
+	return l.publishMessages(msgs, false)
+}
+
+// publishMessages is publish, optionally keeping the offsets of the messages (see PublishAt)
+func (l *log) publishMessages(msgs []message.Message, keepOffsets bool) (int64, error) {
+	start := time.Now()
+	if err := l.openHeadWriter(); err != nil {
+		return OffsetInvalid, err
+	}
 
-	if l.writer.NeedsRollover(l.opts.Rollover) {
+	if l.writer.NeedsRollover(l.opts.Rollover) || l.writer.NeedsHeaders() {
+		l.hooks.metrics.Add(MetricRollovers, 1)
 		oldWriter := l.writer
 		if err := oldWriter.Sync(); err != nil {
 			return OffsetInvalid, err
 		}
 
 		oldReader, nextOffset, nextTime := l.writer.ReopenReader()
-		newWriter, err := openWriter(segment.New(l.dir, nextOffset, l.opts.AutoSync), l.params, l.opts.Version.NewSegmentsVersion, nextTime)
+		newWriter, err := openWriter(l.newSegment(nextOffset), l.params, l.opts.Version.NewSegmentsVersion, l.hooks, nextTime)
 		if err != nil {
 			return OffsetInvalid, err
 		}
@@ -182,22 +443,50 @@ func (l *log) Publish(msgs []message.Message) (int64, error) {
 
 		l.readersMu.Unlock()
 
+		oldItems := oldWriter.index.reader().items
 		if err := oldWriter.Close(); err != nil {
 			return OffsetInvalid, err
 		}
+
+		if l.times != nil {
+			if err := l.times.rollover(oldWriter.segment, oldItems); err != nil {
+				return OffsetInvalid, err
+			}
+		}
+
+		if l.keys != nil {
+			if err := l.keys.write(nextOffset); err != nil {
+				return OffsetInvalid, err
+			}
+		}
+
+		if l.producers != nil {
+			if err := l.writeProducers(nextOffset); err != nil {
+				return OffsetInvalid, err
+			}
+		}
+
+		l.hooks.events.Event(SegmentSealed{Segment: oldWriter.segment})
 	}
 
-	nextOffset, err := l.writer.Publish(msgs)
+	publish := l.writer.Publish
+	if keepOffsets {
+		publish = l.writer.PublishAt
+	}
+	var written func([]message.Message)
+	if l.keys != nil {
+		// before the messages are visible, so GetByKey finds any message Consume does
+		written = l.keys.append
+	}
+	size := l.writer.messages.Size()
+	nextOffset, err := publish(msgs, written)
 	if err != nil {
 		return OffsetInvalid, err
 	}
+	l.published(l.writer.messages.Size() - size)
 
-	if l.opts.AutoSync {
-		if err := l.writer.Sync(); err != nil {
-			return OffsetInvalid, err
-		}
-	}
-
+	l.hooks.metrics.Observe(MetricPublishBatchSize, float64(len(msgs)))
+	l.hooks.metrics.Observe(MetricPublishSeconds, time.Since(start).Seconds())
 	return nextOffset, nil
 }
 
@@ -213,7 +502,7 @@ func (l *log) NextOffset() (int64, error) {
 	l.writerMu.Lock()
 	defer l.writerMu.Unlock()
 
-	return l.writer.GetNextOffset()
+	return l.headNextOffset()
 }
 
 func (l *log) Consume(offset int64, maxCount int64) (int64, []message.Message, error) {
@@ -232,6 +521,36 @@ func (l *log) Consume(offset int64, maxCount int64) (int64, []message.Message, e
 	return nextOffset, msgs, err
 }
 
+func (l *log) ConsumeBackward(offset int64, maxCount int64) (int64, []message.Message, error) {
+	l.readersMu.RLock()
+	defer l.readersMu.RUnlock()
+
+	headOffset, err := l.readers[len(l.readers)-1].GetNextOffset()
+	switch {
+	case err != nil:
+		return OffsetInvalid, nil, err
+	case offset == OffsetNewest:
+		offset = headOffset
+	case offset > headOffset:
+		return OffsetInvalid, nil, index.ErrOffsetAfterEnd
+	}
+
+	var msgs []message.Message
+	_, segmentIndex := segment.Consume(l.readers, offset)
+	for ; segmentIndex >= 0 && int64(len(msgs)) < maxCount; segmentIndex-- {
+		rdrMsgs, err := l.readers[segmentIndex].ConsumeBackward(offset, maxCount-int64(len(msgs)))
+		if err != nil {
+			return OffsetInvalid, nil, err
+		}
+		msgs = append(msgs, rdrMsgs...)
+	}
+
+	if len(msgs) == 0 {
+		return offset, nil, nil
+	}
+	return msgs[len(msgs)-1].Offset, msgs, nil
+}
+
 func (l *log) ConsumeByKey(key []byte, offset int64, maxCount int64) (int64, []message.Message, error) {
 	if !l.opts.KeyIndex {
 		return OffsetInvalid, nil, errNoKeyIndex
@@ -282,6 +601,12 @@ func (l *log) GetByKey(key []byte) (message.Message, error) {
 		return message.Invalid, errNoKeyIndex
 	}
 
+	if l.keys != nil {
+		if msg, final, err := l.getByKeyIndex(key); final {
+			return msg, err
+		}
+	}
+
 	hash := index.KeyHashEncoded(index.KeyHash(key))
 	tctx := time.Now().UnixMicro()
 
@@ -327,7 +652,7 @@ func (l *log) GetByTime(start time.Time) (message.Message, error) {
 	for i := len(l.readers) - 1; i >= 0; i-- {
 		rdr := l.readers[i]
 
-		switch msg, err := rdr.GetByTime(ts, tctx); err {
+		switch msg, err := l.getByTime(rdr, ts, tctx); err {
 		case nil:
 			return msg, nil
 		case index.ErrTimeBeforeStart:
@@ -370,7 +695,46 @@ func (l *log) Delete(offsets map[int64]struct{}) ([]Message, int64, error) {
 	l.deleteMu.Lock()
 	defer l.deleteMu.Unlock()
 
-	return l.delete(offsets)
+	deleted, deletedSize, err := l.delete(offsets)
+	l.hooks.metrics.Add(MetricDeletedMessages, int64(len(deleted)))
+	if len(deleted) > 0 {
+		l.hooks.events.Event(MessagesDeleted{Offsets: deletedOffsets(deleted)})
+	}
+	if err != nil || len(deleted) == 0 || (l.keys == nil && l.times == nil) {
+		return deleted, deletedSize, err
+	}
+
+	l.writerMu.Lock()
+	defer l.writerMu.Unlock()
+
+	if l.keys != nil {
+		if err := l.deletedKeyIndex(deleted); err != nil {
+			return nil, 0, err
+		}
+		nextOffset, err := l.headNextOffset()
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := l.keys.write(nextOffset); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if l.times != nil {
+		if err := l.syncTimeIndex(l.times); err != nil {
+			return nil, 0, err
+		}
+	}
+	return deleted, deletedSize, nil
+}
+
+// deletedOffsets returns the offsets of the deleted messages
+func deletedOffsets(deleted []Message) []int64 {
+	offsets := make([]int64, len(deleted))
+	for i, msg := range deleted {
+		offsets[i] = msg.Offset
+	}
+	return offsets
 }
 
 func (l *log) delete(offsets map[int64]struct{}) ([]Message, int64, error) {
@@ -379,10 +743,18 @@ func (l *log) delete(offsets map[int64]struct{}) ([]Message, int64, error) {
 		return nil, 0, err
 	}
 
-	wasWriter := false
+	var wasWriter *writer
 	l.writerMu.Lock()
-	if l.writer.reader == rdr {
-		wasWriter = true
+	if l.writer == nil && l.isHeadReader(rdr) {
+		// the head segment of a LazyWriter log is rewritten by its writer
+		if err := l.openHeadWriter(); err != nil {
+			l.writerMu.Unlock()
+			return nil, 0, err
+		}
+		rdr = l.writer.reader
+	}
+	if l.writer != nil && l.writer.reader == rdr {
+		wasWriter = l.writer
 		if err := l.writer.Sync(); err != nil {
 			l.writerMu.Unlock()
 			return nil, 0, err
@@ -394,10 +766,10 @@ func (l *log) delete(offsets map[int64]struct{}) ([]Message, int64, error) {
 	iversion := l.opts.Version.NewSegmentsVersion.index
 	if l.opts.Version.KeepRewriteVersion {
 		var detected message.Version
-		if wasWriter {
-			detected = l.writer.messages.Version()
+		if wasWriter != nil {
+			detected = wasWriter.messages.Version()
 		} else {
-			mr, err := message.OpenReader(rdr.segment.Log, rdr.segment.Offset)
+			mr, err := message.OpenReaderKeys(rdr.segment.Log, rdr.segment.Offset, rdr.segment.Keys)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -406,13 +778,10 @@ func (l *log) delete(offsets map[int64]struct{}) ([]Message, int64, error) {
 				return nil, 0, err
 			}
 		}
-		switch detected {
-		case message.V1:
-			mversion, iversion = message.V1, index.V1
-		case message.V2:
-			mversion, iversion = message.V2, index.V2
-		}
+		keep := versionOf(detected)
+		mversion, iversion = keep.messages, keep.index
 	}
+	start := time.Now()
 	rs, err := rdr.segment.Rewrite(offsets, l.params, mversion, iversion)
 	if err != nil {
 		return nil, 0, err
@@ -422,10 +791,12 @@ func (l *log) delete(offsets map[int64]struct{}) ([]Message, int64, error) {
 		// deleted nothing, just remove rewrite files
 		return nil, 0, rs.Remove()
 	}
+	l.hooks.metrics.Add(MetricDeleteRewrites, 1)
+	l.hooks.metrics.Observe(MetricDeleteRewriteSeconds, time.Since(start).Seconds())
 
 	// check if we are deleting in the writing segment
 	l.writerMu.Lock()
-	if l.writer.reader == rdr {
+	if l.writer != nil && l.writer.reader == rdr {
 		defer l.writerMu.Unlock()
 
 		l.readersMu.Lock()
@@ -440,6 +811,7 @@ func (l *log) delete(offsets map[int64]struct{}) ([]Message, int64, error) {
 		}
 
 		l.writer = newWriter
+		l.syncer.written++ // the head was rewritten
 		if newReader == nil {
 			l.readers[len(l.readers)-1] = newWriter.reader
 		} else {
@@ -447,11 +819,17 @@ func (l *log) delete(offsets map[int64]struct{}) ([]Message, int64, error) {
 			l.readers = append(l.readers, newWriter.reader)
 		}
 
+		l.hooks.events.Event(rewriteEvent(rdr.segment, rs))
+		if newReader != nil {
+			// the last message was deleted, the rewritten segment is sealed and a new one started
+			l.hooks.events.Event(SegmentSealed{Segment: newReader.segment})
+		}
+
 		return rs.DeletedMessages, rs.DeletedSize, nil
 	}
 	l.writerMu.Unlock()
 
-	if wasWriter {
+	if wasWriter != nil {
 		// A writing segment transformed into a reader, retry deleting
 		if err := rs.Remove(); err != nil {
 			return nil, 0, err
@@ -470,7 +848,7 @@ func (l *log) delete(offsets map[int64]struct{}) ([]Message, int64, error) {
 
 	var newReaders []*reader
 	for _, r := range l.readers {
-		if r.segment == rdr.segment {
+		if r.segment.Offset == rdr.segment.Offset {
 			if newReader != nil {
 				newReaders = append(newReaders, newReader)
 			}
@@ -480,9 +858,25 @@ func (l *log) delete(offsets map[int64]struct{}) ([]Message, int64, error) {
 	}
 	l.readers = newReaders
 
+	l.hooks.events.Event(rewriteEvent(rdr.segment, rs))
 	return rs.DeletedMessages, rs.DeletedSize, nil
 }
 
+// rewriteEvent returns the event for a segment rewritten by delete
+func rewriteEvent(prev segment.Segment, rs *segment.RewriteSegment) Event {
+	if len(rs.SurviveOffsets) == 0 {
+		return SegmentRemoved{Segment: prev}
+	}
+	return SegmentRewritten{Segment: rs.GetNewSegment(), Previous: prev, Deleted: len(rs.DeletedMessages)}
+}
+
+func (l *log) isHeadReader(rdr *reader) bool {
+	l.readersMu.RLock()
+	defer l.readersMu.RUnlock()
+
+	return l.readers[len(l.readers)-1] == rdr
+}
+
 func (l *log) findDeleteReader(offsets map[int64]struct{}) (*reader, error) {
 	lowestOffset := message.MinOffset(offsets)
 	if lowestOffset < 0 {
@@ -500,11 +894,11 @@ func (l *log) Size(m message.Message) int64 {
 	return message.Size(m, l.opts.Version.NewSegmentsVersion.messages) + l.params.Size()
 }
 
-func (l *log) Stat() (segment.Stats, error) {
+func (l *log) Stat() (Stats, error) {
 	l.readersMu.RLock()
 	defer l.readersMu.RUnlock()
 
-	if l.opts.Readonly && len(l.readers) == 1 {
+	if (l.opts.Readonly || l.opts.LazyWriter) && len(l.readers) == 1 {
 		segStats, err := l.readers[0].Stat()
 		if err != nil && errors.Is(err, os.ErrNotExist) {
 			return segment.Stats{}, nil
@@ -522,29 +916,52 @@ func (l *log) Stat() (segment.Stats, error) {
 		stats.Segments += segStats.Segments
 		stats.Messages += segStats.Messages
 		stats.Size += segStats.Size
+		stats.LogicalSize += segStats.LogicalSize
 	}
 	return stats, nil
 }
 
+func (l *log) Dir() string {
+	return l.dir
+}
+
 func (l *log) Backup(dir string) error {
-	l.readersMu.RLock()
-	defer l.readersMu.RUnlock()
+	if !l.opts.Readonly {
+		// deletes are the only ones removing segment files, wait for them while copying
+		l.deleteMu.Lock()
+		defer l.deleteMu.Unlock()
+	}
 
-	if l.opts.Readonly && len(l.readers) == 1 {
-		err := l.readers[0].Backup(dir)
-		if err != nil && errors.Is(err, os.ErrNotExist) {
-			return nil
+	segments := l.backupSegments()
+	if (l.opts.Readonly || l.opts.LazyWriter) && len(segments) == 1 {
+		// the head segment of an empty log might not be created yet
+		if _, err := os.Stat(segments[0].Log); errors.Is(err, os.ErrNotExist) {
+			segments = nil
 		}
-		return err
 	}
 
-	for _, reader := range l.readers {
-		if err := reader.Backup(dir); err != nil {
-			return err
-		}
+	return segment.BackupSegments(segments, dir)
+}
+
+// backupSegments snapshots the segments to backup, with the current sizes of the head segment. The locks are
+// only held while taking the snapshot, so publishing (and rolling over) continues during the backup
+func (l *log) backupSegments() []segment.BackupSegment {
+	if !l.opts.Readonly {
+		l.writerMu.Lock()
+		defer l.writerMu.Unlock()
 	}
+	l.readersMu.RLock()
+	defer l.readersMu.RUnlock()
 
-	return nil
+	segments := make([]segment.BackupSegment, 0, len(l.readers))
+	for _, rdr := range l.readers {
+		segments = append(segments, segment.BackupSegment{Segment: rdr.segment, LogSize: -1, IndexSize: -1})
+	}
+	if !l.opts.Readonly && l.writer != nil {
+		head := &segments[len(segments)-1]
+		head.LogSize, head.IndexSize = l.writer.messages.Size(), l.writer.items.Size()
+	}
+	return segments
 }
 
 func (l *log) Sync() (int64, error) {
@@ -557,15 +974,24 @@ func (l *log) Sync() (int64, error) {
 	}
 
 	l.writerMu.Lock()
-	defer l.writerMu.Unlock()
+	nextOffset, err := l.headNextOffset()
+	target := l.syncer.written
+	l.writerMu.Unlock()
+	if err != nil {
+		return OffsetInvalid, err
+	}
 
-	if err := l.writer.Sync(); err != nil {
+	if err := l.syncWritten(target); err != nil {
 		return OffsetInvalid, err
 	}
-	return l.writer.GetNextOffset()
+	return nextOffset, nil
 }
 
 func (l *log) GC(unusedFor time.Duration) error {
+	if err := l.closeIdleWriter(); err != nil {
+		return err
+	}
+
 	l.readersMu.RLock()
 	defer l.readersMu.RUnlock()
 
@@ -579,6 +1005,9 @@ func (l *log) GC(unusedFor time.Duration) error {
 }
 
 func (l *log) Close() error {
+	l.stopRetention()
+	l.stopSyncer()
+
 	if l.opts.Readonly {
 		l.readersMu.Lock()
 		defer l.readersMu.Unlock()
@@ -592,18 +1021,44 @@ func (l *log) Close() error {
 		l.writerMu.Lock()
 		defer l.writerMu.Unlock()
 
-		l.readersMu.Lock()
-		defer l.readersMu.Unlock()
+		if l.writer != nil {
+			if err := l.writer.Sync(); err != nil {
+				return err
+			}
+		}
 
-		if err := l.writer.Sync(); err != nil {
-			return err
+		if l.keys != nil {
+			nextOffset, err := l.headNextOffset()
+			if err != nil {
+				return err
+			}
+			if err := l.keys.write(nextOffset); err != nil {
+				return err
+			}
 		}
 
-		if err := l.writer.Close(); err != nil {
-			return err
+		if l.producers != nil {
+			nextOffset, err := l.headNextOffset()
+			if err != nil {
+				return err
+			}
+			if err := l.writeProducers(nextOffset); err != nil {
+				return err
+			}
 		}
 
-		for _, reader := range l.readers[:len(l.readers)-1] {
+		l.readersMu.Lock()
+		defer l.readersMu.Unlock()
+
+		readers := l.readers
+		if l.writer != nil {
+			if err := l.writer.Close(); err != nil {
+				return err
+			}
+			readers = readers[:len(readers)-1]
+		}
+
+		for _, reader := range readers {
 			if err := reader.Close(); err != nil {
 				return err
 			}
@@ -614,5 +1069,5 @@ func (l *log) Close() error {
 		return fmt.Errorf("close unlock: %w", err)
 	}
 
-	return nil
+	return l.syncFailed()
 }
@@ -2,6 +2,7 @@ package klevdb
 
 import (
 	"context"
+	"iter"
 
 	"github.com/klev-dev/klevdb/pkg/notify"
 )
@@ -15,6 +16,13 @@ type BlockingLog interface {
 
 	// ConsumeByKeyBlocking is similar to [ConsumeBlocking], but only returns messages matching the key
 	ConsumeByKeyBlocking(ctx context.Context, key []byte, offset int64, maxCount int64) (nextOffset int64, messages []Message, err error)
+
+	// AllBlocking is similar to [All], but when caught up with the head of the log it blocks until next message is published.
+	// It only stops when ctx is done, on error or when the caller stops iterating.
+	AllBlocking(ctx context.Context, from int64) iter.Seq2[Message, error]
+
+	// ByKeyBlocking is similar to [AllBlocking], but only iterates messages matching the key
+	ByKeyBlocking(ctx context.Context, key []byte, from int64) iter.Seq2[Message, error]
 }
 
 // OpenBlocking opens a [Log] and wraps it with support for blocking consume
@@ -50,6 +58,46 @@ func (l *blockingLog) Publish(messages []Message) (int64, error) {
 	return nextOffset, nil
 }
 
+func (l *blockingLog) PublishIf(expectedNextOffset int64, messages []Message) (int64, error) {
+	nextOffset, err := l.Log.PublishIf(expectedNextOffset, messages)
+	if err != nil {
+		return OffsetInvalid, err
+	}
+
+	l.notify.Set(nextOffset)
+	return nextOffset, nil
+}
+
+func (l *blockingLog) PublishIfKey(key []byte, expectedOffset int64, message Message) (int64, error) {
+	nextOffset, err := l.Log.PublishIfKey(key, expectedOffset, message)
+	if err != nil {
+		return OffsetInvalid, err
+	}
+
+	l.notify.Set(nextOffset)
+	return nextOffset, nil
+}
+
+func (l *blockingLog) PublishIdempotent(producerID string, sequence int64, messages []Message) (int64, error) {
+	nextOffset, err := l.Log.PublishIdempotent(producerID, sequence, messages)
+	if err != nil {
+		return OffsetInvalid, err
+	}
+
+	l.notify.Set(nextOffset)
+	return nextOffset, nil
+}
+
+func (l *blockingLog) PublishAt(messages []Message) (int64, error) {
+	nextOffset, err := l.Log.PublishAt(messages)
+	if err != nil {
+		return OffsetInvalid, err
+	}
+
+	l.notify.Set(nextOffset)
+	return nextOffset, nil
+}
+
 func (l *blockingLog) ConsumeBlocking(ctx context.Context, offset int64, maxCount int64) (int64, []Message, error) {
 	if err := l.notify.Wait(ctx, offset); err != nil {
 		return OffsetInvalid, nil, err
@@ -64,6 +112,18 @@ func (l *blockingLog) ConsumeByKeyBlocking(ctx context.Context, key []byte, offs
 	return l.ConsumeByKey(key, offset, maxCount)
 }
 
+func (l *blockingLog) AllBlocking(ctx context.Context, from int64) iter.Seq2[Message, error] {
+	return consumeSeq(ctx, from, true, InvalidMessage, func(offset int64, maxCount int64) (int64, []Message, error) {
+		return l.ConsumeBlocking(ctx, offset, maxCount)
+	})
+}
+
+func (l *blockingLog) ByKeyBlocking(ctx context.Context, key []byte, from int64) iter.Seq2[Message, error] {
+	return consumeSeq(ctx, from, true, InvalidMessage, func(offset int64, maxCount int64) (int64, []Message, error) {
+		return l.ConsumeByKeyBlocking(ctx, key, offset, maxCount)
+	})
+}
+
 func (l *blockingLog) Close() error {
 	if err := l.notify.Close(); err != nil {
 		return err
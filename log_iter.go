@@ -0,0 +1,92 @@
+package klevdb
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"time"
+)
+
+// iterBatchSize is how many messages iterators consume at once
+const iterBatchSize = 32
+
+// consumeSeq iterates messages returned by consume, starting at an offset. It stops when
+// it is caught up with the head of the log, unless follow is set, in which case consume is
+// expected to block until new messages are published.
+func consumeSeq[M any](ctx context.Context, from int64, follow bool, invalid M, consume func(offset int64, maxCount int64) (int64, []M, error)) iter.Seq2[M, error] {
+	return func(yield func(M, error) bool) {
+		for offset := from; ; {
+			if err := ctx.Err(); err != nil {
+				yield(invalid, err)
+				return
+			}
+
+			nextOffset, msgs, err := consume(offset, iterBatchSize)
+			if err != nil {
+				yield(invalid, err)
+				return
+			}
+
+			for _, msg := range msgs {
+				if !yield(msg, nil) {
+					return
+				}
+			}
+
+			if nextOffset == offset && !follow {
+				// caught up with the head of the log
+				return
+			}
+			offset = nextOffset
+		}
+	}
+}
+
+// timeRangeSeq iterates messages with time in [start, end), using the time index (if available) to find the first one
+func timeRangeSeq(ctx context.Context, l Log, start, end time.Time) iter.Seq2[Message, error] {
+	return func(yield func(Message, error) bool) {
+		from, _, err := l.OffsetByTime(start)
+		switch {
+		case err == nil:
+			// start iterating from the first message at start
+		case errors.Is(err, ErrNoIndex):
+			// not indexed by time, iterate everything
+			from = OffsetOldest
+		case errors.Is(err, ErrNotFound), errors.Is(err, ErrInvalidOffset):
+			// all messages are before start (or the log is empty)
+			return
+		default:
+			yield(InvalidMessage, err)
+			return
+		}
+
+		for msg, err := range l.All(ctx, from) {
+			switch {
+			case err != nil:
+				yield(InvalidMessage, err)
+				return
+			case !msg.Time.Before(end):
+				return
+			case msg.Time.Before(start):
+				continue
+			}
+			if !yield(msg, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (l *log) All(ctx context.Context, from int64) iter.Seq2[Message, error] {
+	return consumeSeq(ctx, from, false, InvalidMessage, l.Consume)
+}
+
+func (l *log) ByKey(ctx context.Context, key []byte, from int64) iter.Seq2[Message, error] {
+	return consumeSeq(ctx, from, false, InvalidMessage, func(offset int64, maxCount int64) (int64, []Message, error) {
+		return l.ConsumeByKey(key, offset, maxCount)
+	})
+}
+
+func (l *log) ByTimeRange(ctx context.Context, start, end time.Time) iter.Seq2[Message, error] {
+	return timeRangeSeq(ctx, l, start, end)
+}
@@ -0,0 +1,166 @@
+package klevdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+func collect(t *testing.T, seq func(yield func(Message, error) bool)) []Message {
+	t.Helper()
+	var msgs []Message
+	for msg, err := range seq {
+		require.NoError(t, err)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestIter(t *testing.T) {
+	msgs := message.Gen(100)
+	for i := range msgs {
+		if i%2 == 1 {
+			msgs[i].Key = msgs[i-1].Key
+		}
+	}
+
+	open := func(t *testing.T, opts Options) Log {
+		opts.Rollover = 1024
+		l, err := Open(t.TempDir(), opts)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+		publishBatched(t, l, msgs, 10)
+		return l
+	}
+
+	t.Run("All", func(t *testing.T) {
+		l := open(t, Options{})
+		ctx := context.Background()
+
+		require.Equal(t, msgs, collect(t, l.All(ctx, OffsetOldest)))
+		require.Equal(t, msgs[42:], collect(t, l.All(ctx, 42)))
+		require.Empty(t, collect(t, l.All(ctx, OffsetNewest)))
+
+		// deleted gaps, including a whole segment
+		var deleted = map[int64]struct{}{}
+		for i := 0; i < 20; i++ {
+			deleted[int64(i)] = struct{}{}
+		}
+		_, _, err := DeleteMulti(ctx, l, deleted, DeleteMultiWithWait(0))
+		require.NoError(t, err)
+		_, _, err = l.Delete(map[int64]struct{}{21: {}})
+		require.NoError(t, err)
+
+		expected := append([]Message{msgs[20]}, msgs[22:]...)
+		require.Equal(t, expected, collect(t, l.All(ctx, OffsetOldest)))
+	})
+
+	t.Run("Break", func(t *testing.T) {
+		l := open(t, Options{})
+
+		var actual []Message
+		for msg, err := range l.All(context.Background(), OffsetOldest) {
+			require.NoError(t, err)
+			if msg.Offset >= 40 {
+				break
+			}
+			actual = append(actual, msg)
+		}
+		require.Equal(t, msgs[:40], actual)
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		l := open(t, Options{})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var count int
+		var iterErr error
+		for msg, err := range l.All(ctx, OffsetOldest) {
+			if err != nil {
+				require.Equal(t, InvalidMessage, msg)
+				iterErr = err
+				continue
+			}
+			count++
+			cancel()
+		}
+		require.ErrorIs(t, iterErr, context.Canceled)
+		require.Less(t, count, len(msgs)) // stops after the current batch
+	})
+
+	t.Run("ByKey", func(t *testing.T) {
+		l := open(t, Options{KeyIndex: true})
+		ctx := context.Background()
+
+		require.Equal(t, msgs[42:44], collect(t, l.ByKey(ctx, msgs[42].Key, OffsetOldest)))
+		require.Equal(t, msgs[43:44], collect(t, l.ByKey(ctx, msgs[42].Key, 43)))
+		require.Empty(t, collect(t, l.ByKey(ctx, []byte("missing"), OffsetOldest)))
+
+		l = open(t, Options{})
+		for _, err := range l.ByKey(ctx, msgs[42].Key, OffsetOldest) {
+			require.ErrorIs(t, err, ErrNoIndex)
+		}
+	})
+
+	t.Run("ByTimeRange", func(t *testing.T) {
+		ctx := context.Background()
+		for _, opts := range []Options{{TimeIndex: true}, {}} {
+			l := open(t, opts)
+
+			require.Equal(t, msgs[10:20], collect(t, l.ByTimeRange(ctx, msgs[10].Time, msgs[20].Time)))
+			require.Equal(t, msgs, collect(t, l.ByTimeRange(ctx, msgs[0].Time.Add(-time.Hour), msgs[99].Time.Add(time.Hour))))
+			require.Empty(t, collect(t, l.ByTimeRange(ctx, msgs[99].Time.Add(time.Second), msgs[99].Time.Add(time.Hour))))
+		}
+
+		l, err := Open(t.TempDir(), Options{TimeIndex: true})
+		require.NoError(t, err)
+		defer l.Close()
+		require.Empty(t, collect(t, l.ByTimeRange(ctx, msgs[0].Time, msgs[99].Time)))
+	})
+
+	t.Run("Blocking", func(t *testing.T) {
+		l, err := OpenBlocking(t.TempDir(), Options{KeyIndex: true, Rollover: 1024})
+		require.NoError(t, err)
+		defer l.Close()
+		publishBatched(t, l, msgs[:50], 10)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			_, _ = l.Publish(msgs[50:])
+		}()
+
+		var actual []Message
+		for msg, err := range l.AllBlocking(ctx, OffsetOldest) {
+			require.NoError(t, err)
+			actual = append(actual, msg)
+			if len(actual) == len(msgs) {
+				break
+			}
+		}
+		require.Equal(t, msgs, actual)
+
+		actual = nil
+		for msg, err := range l.ByKeyBlocking(ctx, msgs[98].Key, OffsetOldest) {
+			require.NoError(t, err)
+			actual = append(actual, msg)
+			if len(actual) == 2 {
+				break
+			}
+		}
+		require.Equal(t, msgs[98:], actual)
+
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		for _, err := range l.AllBlocking(ctx, OffsetNewest) {
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+		}
+	})
+}
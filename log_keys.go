@@ -0,0 +1,362 @@
+package klevdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/klev-dev/klevdb/pkg/index"
+	"github.com/klev-dev/klevdb/pkg/kdir"
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+const (
+	keyIndexFile       = "keys.index"
+	keyIndexHeaderSize = 8 + 8 // next offset + count
+	keyIndexItemSize   = 8 + 8 // key hash + offset
+	keyIndexCRCSize    = 4     // crc of the record
+)
+
+var (
+	errUnifiedKeyIndex = fmt.Errorf("%w: unified key index requires KeyIndex", ErrNoIndex)
+	errKeyIndexCorrupt = errors.New("unified key index corrupted")
+)
+
+// snapshotCRCTable is used to check the unified indexes persisted in the log directory
+var snapshotCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// keyIndex maps the hash of each key in the log to the offset of its last message. Keys with
+// colliding hashes share the offset of the last one, so lookups must check the message key.
+// If a key is not in the index, there is no message with it in the log.
+//
+// It is persisted as a sequence of records, each with the offset it is current to. The first record
+// has all keys, and each rollover (or delete) appends a record with the keys changed since the last one,
+// where removed keys have OffsetInvalid. Once the appended keys outnumber the index, it is compacted
+// back to a single record.
+type keyIndex struct {
+	path    string
+	offsets map[uint64]int64
+	mu      sync.RWMutex
+
+	// guarded by writerMu
+	dirty      map[uint64]struct{} // the keys changed since the last write
+	deltas     int                 // the keys appended since the last compaction
+	compact    bool                // the file must be rewritten, e.g. it is missing or its tail is corrupted
+	nextOffset int64               // the offset of the last write
+}
+
+// openKeyIndex loads the index persisted by the last close (or rollover), catching up with
+// messages published after it. If it is missing or invalid it is rebuilt from the segment indexes.
+func (l *log) openKeyIndex() (*keyIndex, error) {
+	k := &keyIndex{path: filepath.Join(l.dir, keyIndexFile), dirty: map[uint64]struct{}{}}
+
+	headOffset, err := l.headNextOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	nextOffset, err := k.read()
+	switch {
+	case err == nil && nextOffset <= headOffset:
+	case err == nil, errors.Is(err, os.ErrNotExist), errors.Is(err, errKeyIndexCorrupt):
+		// missing or ahead of the log (e.g. recovered), rebuild it
+		k.offsets, k.deltas, k.compact, nextOffset = map[uint64]int64{}, 0, true, 0
+	default:
+		return nil, err
+	}
+	k.nextOffset = nextOffset
+
+	if nextOffset < headOffset {
+		if err := l.catchupKeyIndex(k, nextOffset); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// catchupKeyIndex appends the items of all messages after nextOffset
+func (l *log) catchupKeyIndex(k *keyIndex, nextOffset int64) error {
+	first := len(l.readers) - 1
+	for first > 0 && l.readers[first].segment.Offset > nextOffset {
+		first--
+	}
+
+	for _, rdr := range l.readers[first:] {
+		var items []index.Item
+		if l.writer != nil && rdr == l.writer.reader {
+			items = l.writer.index.reader().items
+		} else {
+			var err error
+			items, err = rdr.segment.ReindexAndReadIndex(rdr.params, rdr.version.index)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, item := range items {
+			if item.Offset >= nextOffset {
+				k.update(item.KeyHash, item.Offset)
+			}
+		}
+	}
+	return nil
+}
+
+func (k *keyIndex) get(keyHash uint64) (int64, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	offset, ok := k.offsets[keyHash]
+	return offset, ok
+}
+
+func (k *keyIndex) append(msgs []message.Message) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, msg := range msgs {
+		k.update(index.KeyHash(msg.Key), msg.Offset)
+	}
+}
+
+// update sets the offset of a key hash (removing it if OffsetInvalid), to be persisted by the next write.
+// Expects mu to be held, unless the index is not shared yet
+func (k *keyIndex) update(keyHash uint64, offset int64) {
+	if offset == OffsetInvalid {
+		delete(k.offsets, keyHash)
+	} else {
+		k.offsets[keyHash] = offset
+	}
+	k.dirty[keyHash] = struct{}{}
+}
+
+// deleted updates the keys of deleted messages to their previous messages, if any. It is
+// called with writerMu held, so keys are not changed by publishing at the same time.
+func (l *log) deletedKeyIndex(deleted []message.Message) error {
+	for _, msg := range deleted {
+		keyHash := index.KeyHash(msg.Key)
+		if offset, ok := l.keys.get(keyHash); !ok || offset != msg.Offset {
+			// not the last message for this key
+			continue
+		}
+
+		offset, err := l.offsetByKeyHash(keyHash)
+		l.keys.mu.Lock()
+		switch {
+		case err == nil:
+			l.keys.update(keyHash, offset)
+		case errors.Is(err, index.ErrKeyNotFound):
+			l.keys.update(keyHash, OffsetInvalid)
+		}
+		l.keys.mu.Unlock()
+		if err != nil && !errors.Is(err, index.ErrKeyNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// offsetByKeyHash finds the last offset with a key hash, by looking in every segment
+func (l *log) offsetByKeyHash(keyHash uint64) (int64, error) {
+	hash := index.KeyHashEncoded(keyHash)
+
+	l.readersMu.RLock()
+	defer l.readersMu.RUnlock()
+
+	for i := len(l.readers) - 1; i >= 0; i-- {
+		switch offset, err := l.readers[i].OffsetByKeyHash(hash); {
+		case err == nil:
+			return offset, nil
+		case !errors.Is(err, index.ErrKeyNotFound):
+			return OffsetInvalid, err
+		}
+	}
+	return OffsetInvalid, index.ErrKeyNotFound
+}
+
+// getByKeyIndex looks up the last message of a key. If the last message of its hash has another key
+// (or was deleted, or is not visible yet), it returns false and the key must be searched in all segments.
+func (l *log) getByKeyIndex(key []byte) (message.Message, bool, error) {
+	offset, ok := l.keys.get(index.KeyHash(key))
+	if !ok {
+		return message.Invalid, true, errKeyNotFound
+	}
+
+	msg, err := l.Get(offset)
+	switch {
+	case err == nil:
+		return msg, bytes.Equal(msg.Key, key), nil
+	case errors.Is(err, message.ErrNotFound), errors.Is(err, message.ErrInvalidOffset):
+		return message.Invalid, false, nil
+	default:
+		return message.Invalid, true, err
+	}
+}
+
+// write persists the keys changed since the last write, with the offset they are current to.
+// It compacts the file instead, once the appended keys outnumber the index. Expects writerMu to be held
+func (k *keyIndex) write(nextOffset int64) error {
+	if len(k.dirty) == 0 && !k.compact && nextOffset == k.nextOffset {
+		return nil
+	}
+
+	var err error
+	if k.compact || k.deltas+len(k.dirty) > len(k.offsets) {
+		err = k.writeCompacted(nextOffset)
+	} else {
+		err = k.writeDelta(nextOffset)
+	}
+	if err != nil {
+		return fmt.Errorf("write key index: %w", err)
+	}
+	clear(k.dirty)
+	k.nextOffset = nextOffset
+	return nil
+}
+
+// writeCompacted replaces the file with a single record of all keys
+func (k *keyIndex) writeCompacted(nextOffset int64) error {
+	k.mu.RLock()
+	data := make([]byte, 0, keyIndexHeaderSize+len(k.offsets)*keyIndexItemSize+keyIndexCRCSize)
+	data = binary.BigEndian.AppendUint64(data, uint64(nextOffset))
+	data = binary.BigEndian.AppendUint64(data, uint64(len(k.offsets)))
+	for keyHash, offset := range k.offsets {
+		data = binary.BigEndian.AppendUint64(data, keyHash)
+		data = binary.BigEndian.AppendUint64(data, uint64(offset))
+	}
+	k.mu.RUnlock()
+	data = binary.BigEndian.AppendUint32(data, crc32.Checksum(data, snapshotCRCTable))
+
+	if err := writeFileAtomic(k.path, data); err != nil {
+		return err
+	}
+	k.deltas, k.compact = 0, false
+	return nil
+}
+
+// writeDelta appends a record of the changed keys to the file
+func (k *keyIndex) writeDelta(nextOffset int64) error {
+	k.mu.RLock()
+	data := make([]byte, 0, keyIndexHeaderSize+len(k.dirty)*keyIndexItemSize+keyIndexCRCSize)
+	data = binary.BigEndian.AppendUint64(data, uint64(nextOffset))
+	data = binary.BigEndian.AppendUint64(data, uint64(len(k.dirty)))
+	for keyHash := range k.dirty {
+		offset, ok := k.offsets[keyHash]
+		if !ok {
+			offset = OffsetInvalid
+		}
+		data = binary.BigEndian.AppendUint64(data, keyHash)
+		data = binary.BigEndian.AppendUint64(data, uint64(offset))
+	}
+	k.mu.RUnlock()
+	data = binary.BigEndian.AppendUint32(data, crc32.Checksum(data, snapshotCRCTable))
+
+	if err := appendFileSync(k.path, data); err != nil {
+		// the record might be partially written, so the next write rewrites the file
+		k.compact = true
+		return err
+	}
+	k.deltas += len(k.dirty)
+	return nil
+}
+
+// appendFileSync appends to an existing file, syncing it before returning
+func appendFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }() // ignoring since its only applicable if an error has happened
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeFileAtomic replaces a file, so a crash leaves either the old or the new contents
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }() // ignoring since its only applicable if an error has happened
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return kdir.SyncParent(path)
+}
+
+// read loads the records of the file, returning the offset they are current to. The first record must be
+// valid, but reading stops at a corrupted (e.g. partially written) record after it, which marks the file for compaction.
+func (k *keyIndex) read() (int64, error) {
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return 0, fmt.Errorf("read key index: %w", err)
+	}
+
+	k.offsets, k.deltas = map[uint64]int64{}, 0
+	var nextOffset int64
+	for first := true; len(data) > 0; first = false {
+		recordOffset, items, size, err := readKeyIndexRecord(data)
+		if err != nil {
+			if first {
+				return 0, err
+			}
+			k.compact = true
+			break
+		}
+
+		for ; len(items) > 0; items = items[keyIndexItemSize:] {
+			keyHash, offset := binary.BigEndian.Uint64(items), int64(binary.BigEndian.Uint64(items[8:]))
+			if offset == OffsetInvalid {
+				delete(k.offsets, keyHash)
+			} else {
+				k.offsets[keyHash] = offset
+			}
+			if !first {
+				k.deltas++
+			}
+		}
+		nextOffset, data = recordOffset, data[size:]
+	}
+	return nextOffset, nil
+}
+
+// readKeyIndexRecord checks the record at the start of data, returning its offset, items and size
+func readKeyIndexRecord(data []byte) (int64, []byte, int, error) {
+	if len(data) < keyIndexHeaderSize+keyIndexCRCSize {
+		return 0, nil, 0, fmt.Errorf("%w: short header", errKeyIndexCorrupt)
+	}
+
+	count := binary.BigEndian.Uint64(data[8:])
+	if count > uint64(len(data)-keyIndexHeaderSize-keyIndexCRCSize)/keyIndexItemSize {
+		return 0, nil, 0, fmt.Errorf("%w: size mismatch", errKeyIndexCorrupt)
+	}
+	size := keyIndexHeaderSize + int(count)*keyIndexItemSize + keyIndexCRCSize
+
+	body, crc := data[:size-keyIndexCRCSize], data[size-keyIndexCRCSize:size]
+	if crc32.Checksum(body, snapshotCRCTable) != binary.BigEndian.Uint32(crc) {
+		return 0, nil, 0, fmt.Errorf("%w: crc mismatch", errKeyIndexCorrupt)
+	}
+	return int64(binary.BigEndian.Uint64(body)), body[keyIndexHeaderSize:], size, nil
+}
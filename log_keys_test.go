@@ -0,0 +1,209 @@
+package klevdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+func TestUnifiedKeyIndex(t *testing.T) {
+	msgs := message.Gen(100)
+	for i := range msgs {
+		msgs[i].Key = []byte(string(msgs[i%10].Key))
+	}
+	dir := t.TempDir()
+	opts := Options{KeyIndex: true, UnifiedKeyIndex: true, Rollover: 1024}
+
+	requireKeys := func(t *testing.T, l Log, expected map[string]Message) {
+		t.Helper()
+		for key, msg := range expected {
+			actual, err := l.GetByKey([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, msg, actual)
+		}
+		_, err := l.GetByKey([]byte("missing"))
+		require.ErrorIs(t, err, ErrNotFound)
+	}
+	latest := func(msgs []Message) map[string]Message {
+		expected := map[string]Message{}
+		for _, msg := range msgs {
+			expected[string(msg.Key)] = msg
+		}
+		return expected
+	}
+
+	l, err := Open(dir, opts)
+	require.NoError(t, err)
+	publishBatched(t, l, msgs[:50], 5)
+	requireKeys(t, l, latest(msgs[:50]))
+	require.NoError(t, l.Close())
+
+	snapshot, err := os.ReadFile(filepath.Join(dir, keyIndexFile))
+	require.NoError(t, err)
+
+	l, err = Open(dir, opts)
+	require.NoError(t, err)
+	publishBatched(t, l, msgs[50:], 5)
+	requireKeys(t, l, latest(msgs))
+
+	t.Run("Delete", func(t *testing.T) {
+		// the last message of key 9, and all messages of key 8
+		deleted := map[int64]struct{}{99: {}}
+		for i := 8; i < len(msgs); i += 10 {
+			deleted[int64(i)] = struct{}{}
+		}
+		_, _, err := DeleteMulti(t.Context(), l, deleted, DeleteMultiWithWait(0))
+		require.NoError(t, err)
+
+		expected := latest(msgs[:98])
+		delete(expected, string(msgs[8].Key))
+		expected[string(msgs[9].Key)] = msgs[89]
+		requireKeys(t, l, expected)
+
+		_, err = l.GetByKey(msgs[8].Key)
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+	require.NoError(t, l.Close())
+
+	expected := latest(msgs[:98])
+	delete(expected, string(msgs[8].Key))
+	expected[string(msgs[9].Key)] = msgs[89]
+
+	t.Run("Catchup", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, keyIndexFile), snapshot, 0600))
+
+		l, err := Open(dir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+		requireKeys(t, l, expected)
+	})
+
+	t.Run("Rebuild", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, keyIndexFile), []byte("random data characters"), 0600))
+
+		l, err := Open(dir, opts)
+		require.NoError(t, err)
+		requireKeys(t, l, expected)
+		require.NoError(t, l.Close())
+
+		require.NoError(t, os.Remove(filepath.Join(dir, keyIndexFile)))
+		l, err = Open(dir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+		requireKeys(t, l, expected)
+	})
+
+	t.Run("NoKeyIndex", func(t *testing.T) {
+		_, err := Open(t.TempDir(), Options{UnifiedKeyIndex: true})
+		require.ErrorIs(t, err, ErrNoIndex)
+	})
+}
+
+func TestUnifiedKeyIndexWrite(t *testing.T) {
+	msgs := message.Gen(20)
+	dir := t.TempDir()
+	opts := Options{KeyIndex: true, UnifiedKeyIndex: true, Rollover: 4 * message.Size(msgs[0], message.V2)}
+	path := filepath.Join(dir, keyIndexFile)
+	recordSize := func(count int) int64 {
+		return int64(keyIndexHeaderSize + count*keyIndexItemSize + keyIndexCRCSize)
+	}
+	requireKeys := func(t *testing.T, l Log, msgs []Message) {
+		t.Helper()
+		for _, msg := range msgs {
+			actual, err := l.GetByKey(msg.Key)
+			require.NoError(t, err)
+			require.Equal(t, msg.Offset, actual.Offset)
+		}
+	}
+
+	l, err := Open(dir, opts)
+	require.NoError(t, err)
+	publishBatched(t, l, msgs[:8], 1)
+
+	// the first rollover writes all keys, each next one appends only the new keys
+	written, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Len(t, written, int(recordSize(4)))
+
+	publishBatched(t, l, msgs[8:], 1)
+	appended, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, written, appended[:len(written)])
+	require.Len(t, appended, int(4*recordSize(4)))
+	require.NoError(t, l.Close())
+
+	t.Run("Compact", func(t *testing.T) {
+		l, err := Open(dir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+
+		// updating the same keys again compacts the file, once the appended keys are more than the index
+		updates := message.Gen(20)
+		publishBatched(t, l, updates, 1)
+		keys := l.(*log).keys
+		require.LessOrEqual(t, keys.deltas, len(keys.offsets))
+
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Less(t, fi.Size(), 2*recordSize(20))
+
+		for i := range updates {
+			updates[i].Offset = int64(20 + i)
+		}
+		requireKeys(t, l, updates)
+		copy(msgs, updates)
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		// a partially written record is ignored, and the file is compacted by the next write
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("partial"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		l, err := Open(dir, opts)
+		require.NoError(t, err)
+		require.True(t, l.(*log).keys.compact)
+		require.NoError(t, l.Close())
+
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, recordSize(20), fi.Size())
+
+		l, err = Open(dir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+		require.False(t, l.(*log).keys.compact)
+		requireKeys(t, l, msgs[:20])
+	})
+}
+
+func TestUnifiedKeyIndexVisible(t *testing.T) {
+	msgs := message.Gen(2)
+
+	l, err := Open(t.TempDir(), Options{KeyIndex: true, UnifiedKeyIndex: true})
+	require.NoError(t, err)
+	defer l.Close()
+
+	// the key index is updated before the messages are visible, so GetByKey finds any consumed message
+	lg := l.(*log)
+	lg.writerMu.Lock()
+	nextOffset, err := lg.writer.Publish(msgs, func(published []Message) {
+		_, consumed, err := l.Consume(OffsetOldest, 10)
+		require.NoError(t, err)
+		require.Empty(t, consumed)
+		lg.keys.append(published)
+	})
+	lg.writerMu.Unlock()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), nextOffset)
+
+	msg, err := l.GetByKey(msgs[1].Key)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), msg.Offset)
+}
@@ -0,0 +1,222 @@
+package klevdb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+const (
+	// ProducerHeader is the header storing the producer id of an idempotent batch, see [Log.PublishIdempotent]
+	ProducerHeader = "klevdb.producer"
+	// SequenceHeader is the header storing the sequence of an idempotent batch, see [Log.PublishIdempotent]
+	SequenceHeader = "klevdb.sequence"
+)
+
+const (
+	producersFile       = "producers.index"
+	producersHeaderSize = 8 + 8 // next offset + count
+	producersCRCSize    = 4     // crc of the whole file
+)
+
+var (
+	errNotIdempotent    = errors.New("log not opened with idempotent producers")
+	errInvalidProducer  = errors.New("invalid producer")
+	errInvalidSequence  = errors.New("invalid producer sequence")
+	errProducersCorrupt = errors.New("producers index corrupted")
+	errReservedHeader   = errors.New("reserved producer header")
+)
+
+// producerState is the last batch published by a producer
+type producerState struct {
+	sequence   int64
+	nextOffset int64
+}
+
+// producerHeaders returns the headers marking the last message of an idempotent batch
+func producerHeaders(producerID string, sequence int64) []message.Header {
+	return []message.Header{
+		{Key: ProducerHeader, Value: []byte(producerID)},
+		{Key: SequenceHeader, Value: binary.BigEndian.AppendUint64(nil, uint64(sequence))},
+	}
+}
+
+// parseProducer returns the producer id and sequence of a message, if it ends an idempotent batch
+func parseProducer(msg message.Message) (string, int64, bool) {
+	var producerID string
+	var sequence int64 = -1
+	for _, h := range msg.Headers {
+		switch h.Key {
+		case ProducerHeader:
+			producerID = string(h.Value)
+		case SequenceHeader:
+			if len(h.Value) == 8 {
+				sequence = int64(binary.BigEndian.Uint64(h.Value))
+			}
+		}
+	}
+	return producerID, sequence, producerID != "" && sequence >= 0
+}
+
+// checkProducerHeaders rejects messages with the headers of idempotent batches, which are only
+// set by PublishIdempotent (or copied with PublishAt), so the producers state matches the log
+func checkProducerHeaders(msgs []message.Message) error {
+	for _, msg := range msgs {
+		for _, h := range msg.Headers {
+			if h.Key == ProducerHeader || h.Key == SequenceHeader {
+				return fmt.Errorf("%w: %s", errReservedHeader, h.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// openProducers restores the state of idempotent producers persisted by the last close (or rollover), replaying
+// the messages published after it. If it is missing or invalid it is rebuilt by reading the whole log.
+func (l *log) openProducers() error {
+	headOffset, err := l.headNextOffset()
+	if err != nil {
+		return err
+	}
+
+	producers, nextOffset, err := readProducers(filepath.Join(l.dir, producersFile))
+	switch {
+	case err == nil && nextOffset <= headOffset:
+		// replay only what was published after it
+	case err == nil, errors.Is(err, os.ErrNotExist), errors.Is(err, errProducersCorrupt):
+		// missing or ahead of the log (e.g. recovered), rebuild it
+		producers, nextOffset = map[string]producerState{}, OffsetOldest
+	default:
+		return err
+	}
+
+	if nextOffset < headOffset {
+		for msg, err := range l.All(context.Background(), nextOffset) {
+			if err != nil {
+				return err
+			}
+			if producerID, sequence, ok := parseProducer(msg); ok {
+				producers[producerID] = producerState{sequence, msg.Offset + 1}
+			}
+		}
+	}
+	l.producers = producers
+	return nil
+}
+
+// writeProducers persists the state of idempotent producers, with the offset it is current to. Expects writerMu to be held
+func (l *log) writeProducers(nextOffset int64) error {
+	data := binary.BigEndian.AppendUint64(nil, uint64(nextOffset))
+	data = binary.BigEndian.AppendUint64(data, uint64(len(l.producers)))
+	for producerID, state := range l.producers {
+		data = binary.AppendUvarint(data, uint64(len(producerID)))
+		data = append(data, producerID...)
+		data = binary.BigEndian.AppendUint64(data, uint64(state.sequence))
+		data = binary.BigEndian.AppendUint64(data, uint64(state.nextOffset))
+	}
+	data = binary.BigEndian.AppendUint32(data, crc32.Checksum(data, snapshotCRCTable))
+
+	if err := writeFileAtomic(filepath.Join(l.dir, producersFile), data); err != nil {
+		return fmt.Errorf("write producers: %w", err)
+	}
+	return nil
+}
+
+func readProducers(path string) (map[string]producerState, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read producers: %w", err)
+	}
+	if len(data) < producersHeaderSize+producersCRCSize {
+		return nil, 0, fmt.Errorf("%w: short header", errProducersCorrupt)
+	}
+
+	body, crc := data[:len(data)-producersCRCSize], data[len(data)-producersCRCSize:]
+	if crc32.Checksum(body, snapshotCRCTable) != binary.BigEndian.Uint32(crc) {
+		return nil, 0, fmt.Errorf("%w: crc mismatch", errProducersCorrupt)
+	}
+
+	nextOffset := int64(binary.BigEndian.Uint64(body))
+	count := binary.BigEndian.Uint64(body[8:])
+	body = body[producersHeaderSize:]
+
+	producers := map[string]producerState{}
+	for ; count > 0; count-- {
+		idSize, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < idSize+16 {
+			return nil, 0, fmt.Errorf("%w: short producer", errProducersCorrupt)
+		}
+		body = body[n:]
+		producerID := string(body[:idSize])
+		body = body[idSize:]
+		producers[producerID] = producerState{
+			sequence:   int64(binary.BigEndian.Uint64(body)),
+			nextOffset: int64(binary.BigEndian.Uint64(body[8:])),
+		}
+		body = body[16:]
+	}
+	if len(body) > 0 {
+		return nil, 0, fmt.Errorf("%w: size mismatch", errProducersCorrupt)
+	}
+	return producers, nextOffset, nil
+}
+
+func (l *log) PublishIdempotent(producerID string, sequence int64, msgs []message.Message) (int64, error) {
+	if l.opts.Readonly {
+		return OffsetInvalid, ErrReadonly
+	}
+	if !l.opts.Idempotent {
+		return OffsetInvalid, errNotIdempotent
+	}
+	if producerID == "" {
+		return OffsetInvalid, fmt.Errorf("%w: empty id", errInvalidProducer)
+	}
+	if sequence < 0 {
+		return OffsetInvalid, fmt.Errorf("%w: %d", errInvalidSequence, sequence)
+	}
+	if len(msgs) == 0 {
+		return l.NextOffset()
+	}
+	if err := checkProducerHeaders(msgs); err != nil {
+		return OffsetInvalid, err
+	}
+
+	return l.publishSynced(func() (int64, error) {
+		return l.publishIdempotent(producerID, sequence, msgs)
+	})
+}
+
+// publishIdempotent publishes a batch of a producer, unless it is a retry. Expects writerMu to be held
+func (l *log) publishIdempotent(producerID string, sequence int64, msgs []message.Message) (int64, error) {
+	if state, ok := l.producers[producerID]; ok {
+		switch {
+		case sequence == state.sequence:
+			// a retry of the last batch, acknowledge it again
+			return state.nextOffset, nil
+		case sequence < state.sequence:
+			return OffsetInvalid, fmt.Errorf("%w: %d, last %d", ErrDuplicateSequence, sequence, state.sequence)
+		case sequence > state.sequence+1:
+			return OffsetInvalid, fmt.Errorf("%w: %d, expected %d", ErrOutOfOrderSequence, sequence, state.sequence+1)
+		}
+	}
+
+	// don't change the messages of the caller, so a retry publishes the same batch
+	msgs = slices.Clone(msgs)
+	last := &msgs[len(msgs)-1]
+	last.Headers = append(slices.Clip(last.Headers), producerHeaders(producerID, sequence)...)
+
+	nextOffset, err := l.publishMessages(msgs, false)
+	if err != nil {
+		return OffsetInvalid, err
+	}
+
+	l.producers[producerID] = producerState{sequence, nextOffset}
+	return nextOffset, nil
+}
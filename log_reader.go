@@ -18,6 +18,7 @@ type reader struct {
 	segment segment.Segment
 	params  index.Params
 	version Version
+	hooks   logHooks
 	head    bool
 
 	messages      *message.Reader
@@ -32,34 +33,37 @@ type reader struct {
 type indexer interface {
 	GetNextOffset() (int64, error)
 	Consume(offset int64) (int64, int64, int64, error)
+	ConsumeBackward(offset int64, maxCount int64) []int64
 	Get(offset int64) (int64, error)
 	Keys(hash []byte) ([]int64, error)
 	Time(ts int64) (int64, error)
 	Len() int
 }
 
-func openReader(seg segment.Segment, params index.Params, version Version, head bool) *reader {
+func openReader(seg segment.Segment, params index.Params, version Version, hooks logHooks, head bool) *reader {
 	return &reader{
 		segment: seg,
 		params:  params,
 		version: version,
+		hooks:   hooks,
 		head:    head,
 	}
 }
 
-func reopenReader(seg segment.Segment, params index.Params, version Version, ix indexer) *reader {
+func reopenReader(seg segment.Segment, params index.Params, version Version, hooks logHooks, ix indexer) *reader {
 	return &reader{
 		segment: seg,
 		params:  params,
 		version: version,
+		hooks:   hooks,
 		head:    false,
 
 		index: ix,
 	}
 }
 
-func openReaderAppend(seg segment.Segment, params index.Params, version Version, ix indexer) (*reader, error) {
-	messages, err := message.OpenReader(seg.Log, seg.Offset)
+func openReaderAppend(seg segment.Segment, params index.Params, version Version, hooks logHooks, ix indexer) (*reader, error) {
+	messages, err := message.OpenReaderKeys(seg.Log, seg.Offset, seg.Keys)
 	if err != nil {
 		return nil, err
 	}
@@ -68,6 +72,7 @@ func openReaderAppend(seg segment.Segment, params index.Params, version Version,
 		segment: seg,
 		params:  params,
 		version: version,
+		hooks:   hooks,
 		head:    true,
 
 		messages: messages,
@@ -122,6 +127,33 @@ func (r *reader) Consume(offset, maxCount int64) (int64, []message.Message, erro
 	return msgs[len(msgs)-1].Offset + 1, msgs, nil
 }
 
+func (r *reader) ConsumeBackward(offset, maxCount int64) ([]message.Message, error) {
+	index, err := r.getIndexNow()
+	if err != nil {
+		return nil, err
+	}
+
+	positions := index.ConsumeBackward(offset, maxCount)
+	if len(positions) == 0 {
+		return nil, nil
+	}
+
+	messages, err := r.getMessages()
+	if err != nil {
+		return nil, err
+	}
+	defer r.messagesInuse.Add(-1)
+
+	msgs := make([]message.Message, len(positions))
+	for i, position := range positions {
+		msgs[i], err = messages.Get(position)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
 func (r *reader) ConsumeByKey(key []byte, keyHash []byte, offset, maxCount int64) (int64, []message.Message, error) {
 	ix, err := r.getIndexNow()
 	if err != nil {
@@ -234,6 +266,31 @@ func (r *reader) GetByKey(key []byte, keyHash []byte, tctx int64) (message.Messa
 	return message.Invalid, index.ErrKeyNotFound
 }
 
+// OffsetByKeyHash returns the offset of the last message in this segment with a key hash
+func (r *reader) OffsetByKeyHash(keyHash []byte) (int64, error) {
+	ix, err := r.getIndexNow()
+	if err != nil {
+		return OffsetInvalid, err
+	}
+
+	positions, err := ix.Keys(keyHash)
+	if err != nil {
+		return OffsetInvalid, err
+	}
+
+	messages, err := r.getMessages()
+	if err != nil {
+		return OffsetInvalid, err
+	}
+	defer r.messagesInuse.Add(-1)
+
+	msg, err := messages.Get(positions[len(positions)-1])
+	if err != nil {
+		return OffsetInvalid, err
+	}
+	return msg.Offset, nil
+}
+
 func (r *reader) GetByTime(ts int64, tctx int64) (message.Message, error) {
 	index, err := r.getIndexAt(tctx)
 	if err != nil {
@@ -258,10 +315,6 @@ func (r *reader) Stat() (segment.Stats, error) {
 	return r.segment.Stat(r.params)
 }
 
-func (r *reader) Backup(dir string) error {
-	return r.segment.Backup(dir)
-}
-
 func (r *reader) Delete(rs *segment.RewriteSegment) (*reader, error) {
 	// log already has reader lock exclusively, no need to sync here
 	if err := r.Close(); err != nil {
@@ -278,7 +331,7 @@ func (r *reader) Delete(rs *segment.RewriteSegment) (*reader, error) {
 	}
 
 	nseg := rs.GetNewSegment()
-	if nseg != r.segment {
+	if nseg.Offset != r.segment.Offset {
 		// the starting offset of the new segment is different
 
 		// first move the replacement
@@ -291,7 +344,7 @@ func (r *reader) Delete(rs *segment.RewriteSegment) (*reader, error) {
 			return nil, err
 		}
 
-		return &reader{segment: nseg, params: r.params, version: r.version}, nil
+		return &reader{segment: nseg, params: r.params, version: r.version, hooks: r.hooks}, nil
 	}
 
 	// the rewritten segment has the same starting offset
@@ -327,10 +380,13 @@ func (r *reader) getIndexMarked() (indexer, error) {
 		return ix, nil
 	}
 
+	start := time.Now()
 	items, err := r.segment.ReindexAndReadIndex(r.params, r.version.index)
 	if err != nil {
 		return nil, err
 	}
+	r.hooks.metrics.Add(MetricIndexLoads, 1)
+	r.hooks.metrics.Observe(MetricIndexLoadSeconds, time.Since(start).Seconds())
 
 	r.index = newReaderIndex(items, r.params.Keys, r.segment.Offset, r.head)
 	return r.index, nil
@@ -353,7 +409,7 @@ func (r *reader) getMessages() (*message.Reader, error) {
 		return msgs, nil
 	}
 
-	msgs, err := message.OpenReaderMem(r.segment.Log, r.segment.Offset)
+	msgs, err := message.OpenReaderMemKeys(r.segment.Log, r.segment.Offset, r.segment.Keys)
 	if err != nil {
 		return nil, err
 	}
@@ -363,11 +419,14 @@ func (r *reader) getMessages() (*message.Reader, error) {
 	return msgs, nil
 }
 
-func (r *reader) closeIndex() {
+// closeIndex unloads the index, returning true if it was loaded
+func (r *reader) closeIndex() bool {
 	r.indexMu.Lock()
 	defer r.indexMu.Unlock()
 
+	loaded := r.index != nil
 	r.index = nil
+	return loaded
 }
 
 func (r *reader) GC(unusedFor time.Duration) error {
@@ -382,7 +441,10 @@ func (r *reader) GC(unusedFor time.Duration) error {
 		return nil
 	}
 
-	r.closeIndex()
+	if r.closeIndex() {
+		r.hooks.metrics.Add(MetricGCIndexEvictions, 1)
+		r.hooks.events.Event(IndexUnloaded{Segment: r.segment})
+	}
 
 	r.messagesMu.Lock()
 	defer r.messagesMu.Unlock()
@@ -395,6 +457,7 @@ func (r *reader) GC(unusedFor time.Duration) error {
 		return err
 	}
 	r.messages = nil
+	r.hooks.metrics.Add(MetricGCMessagesEvictions, 1)
 	return nil
 }
 
@@ -457,6 +520,10 @@ func (ix *readerIndex) Consume(offset int64) (int64, int64, int64, error) {
 	return position, maxPosition, offset, err
 }
 
+func (ix *readerIndex) ConsumeBackward(offset int64, maxCount int64) []int64 {
+	return index.ConsumeBackward(ix.items, offset, maxCount)
+}
+
 func (ix *readerIndex) Get(offset int64) (int64, error) {
 	position, err := index.Get(ix.items, offset)
 	if err == index.ErrOffsetAfterEnd && ix.head && offset >= ix.nextOffset {
@@ -0,0 +1,192 @@
+package klevdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// syncer batches the syncs of the head segment. Callers waiting for their writes to be persisted
+// (Sync and publishes with AutoSync) share one sync, instead of each issuing their own. The background
+// syncs at SyncInterval, or once SyncEveryBytes were published since the last sync.
+type syncer struct {
+	written  uint64 // guarded by writerMu, counts the writes to the head segment
+	unsynced int64  // guarded by writerMu, the bytes published since the last sync
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	synced  uint64 // the writes persisted by the last sync
+	syncing bool   // a sync is in progress, others wait for it
+	err     error  // the first failed sync, the log stays failed after it
+
+	kick chan struct{} // nil unless SyncEveryBytes
+	stop chan struct{} // nil unless running in the background
+	done chan struct{}
+}
+
+func newSyncer() *syncer {
+	// the head segment might not be synced when opened, so the first Sync always syncs it
+	s := &syncer{written: 1}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// startSyncer starts syncing in the background, if SyncInterval or SyncEveryBytes are set
+func (l *log) startSyncer() {
+	if l.opts.SyncInterval <= 0 && l.opts.SyncEveryBytes <= 0 {
+		return
+	}
+
+	s := l.syncer
+	if l.opts.SyncEveryBytes > 0 {
+		s.kick = make(chan struct{}, 1)
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.background(l)
+}
+
+// stopSyncer stops the background syncs and waits for them to return, before the log is closed
+func (l *log) stopSyncer() {
+	if l.syncer == nil || l.syncer.stop == nil {
+		return
+	}
+	close(l.syncer.stop)
+	<-l.syncer.done
+	l.syncer.stop = nil
+}
+
+// background syncs periodically, a failed sync is returned by the next Sync, publish and Close
+func (s *syncer) background(l *log) {
+	defer close(s.done)
+
+	var tick <-chan time.Time
+	if l.opts.SyncInterval > 0 {
+		ticker := time.NewTicker(l.opts.SyncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-tick:
+		case <-s.kick:
+		}
+
+		l.writerMu.Lock()
+		target := s.written
+		l.writerMu.Unlock()
+
+		_ = l.syncWritten(target)
+	}
+}
+
+// published counts a write of size bytes, kicking the background sync after SyncEveryBytes. Expects writerMu to be held
+func (l *log) published(size int64) {
+	s := l.syncer
+	s.written++
+	s.unsynced += size
+
+	if s.kick != nil && s.unsynced >= l.opts.SyncEveryBytes {
+		select {
+		case s.kick <- struct{}{}:
+		default: // already kicked
+		}
+	}
+}
+
+// publishSynced runs publish holding writerMu, then with AutoSync waits for the published messages to be synced
+func (l *log) publishSynced(publish func() (int64, error)) (int64, error) {
+	if err := l.syncFailed(); err != nil {
+		return OffsetInvalid, err
+	}
+
+	var target uint64
+	nextOffset, err := func() (int64, error) {
+		l.writerMu.Lock()
+		defer l.writerMu.Unlock()
+
+		nextOffset, err := publish()
+		target = l.syncer.written
+		return nextOffset, err
+	}()
+	if err != nil || !l.opts.AutoSync {
+		return nextOffset, err
+	}
+
+	if err := l.syncWritten(target); err != nil {
+		return OffsetInvalid, err
+	}
+	return nextOffset, nil
+}
+
+// syncWritten waits until the writes up to target are synced, either by joining a sync in progress
+// that covers them, or by syncing itself. Expects writerMu not to be held
+func (l *log) syncWritten(target uint64) error {
+	s := l.syncer
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.err == nil && s.synced < target {
+		if s.syncing {
+			s.cond.Wait()
+			continue
+		}
+
+		s.syncing = true
+		s.mu.Unlock()
+		synced, err := l.syncHead()
+		s.mu.Lock()
+		s.syncing = false
+		s.cond.Broadcast()
+
+		if err != nil {
+			// a retry could succeed, even though the pages of the failed sync were dropped
+			s.err = fmt.Errorf("%w: %w", ErrSyncFailed, err)
+			break
+		}
+		s.synced = max(s.synced, synced)
+	}
+	return s.err
+}
+
+// syncFailed returns the error of the first failed sync, if any
+func (l *log) syncFailed() error {
+	if l.syncer == nil {
+		return nil
+	}
+
+	l.syncer.mu.Lock()
+	defer l.syncer.mu.Unlock()
+	return l.syncer.err
+}
+
+// syncHead syncs the writer of the head segment, returning the writes it persisted. Only the writer
+// is taken holding writerMu, so publishes continue during the sync
+func (l *log) syncHead() (uint64, error) {
+	l.writerMu.Lock()
+	written, wrt := l.syncer.written, l.writer
+	l.syncer.unsynced = 0
+	l.writerMu.Unlock()
+
+	if wrt == nil {
+		return written, nil // the writer was synced when closed
+	}
+
+	start := time.Now()
+	switch err := wrt.syncWritten(); {
+	case errors.Is(err, os.ErrClosed):
+		// closed while syncing (e.g. by rollover or delete), which syncs it before closing
+		return written, nil
+	case err != nil:
+		return 0, err
+	}
+	l.hooks.metrics.Add(MetricSyncs, 1)
+	l.hooks.metrics.Observe(MetricSyncSeconds, time.Since(start).Seconds())
+	return written, nil
+}
@@ -0,0 +1,153 @@
+package klevdb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+func TestSync(t *testing.T) {
+	t.Run("Shared", testSyncShared)
+	t.Run("AutoSync", testSyncAutoSync)
+	t.Run("Interval", testSyncInterval)
+	t.Run("EveryBytes", testSyncEveryBytes)
+	t.Run("Failed", testSyncFailed)
+}
+
+func testSyncShared(t *testing.T) {
+	msgs := message.Gen(2)
+	metrics := newTestMetrics()
+
+	l, err := Open(t.TempDir(), Options{Metrics: metrics})
+	require.NoError(t, err)
+	defer l.Close()
+
+	// the head is synced on the first sync, even if nothing was published
+	nextOffset, err := l.Sync()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), nextOffset)
+	require.Equal(t, int64(1), metrics.counter(MetricSyncs))
+
+	nextOffset, err = l.Sync()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), nextOffset)
+	require.Equal(t, int64(1), metrics.counter(MetricSyncs))
+
+	publishBatched(t, l, msgs, 1)
+	nextOffset, err = l.Sync()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), nextOffset)
+	require.Equal(t, int64(2), metrics.counter(MetricSyncs))
+}
+
+func testSyncAutoSync(t *testing.T) {
+	msgs := message.Gen(8)
+	metrics := newTestMetrics()
+
+	l, err := Open(t.TempDir(), Options{AutoSync: true, Metrics: metrics})
+	require.NoError(t, err)
+	defer l.Close()
+
+	// hold a sync in progress, so the publishes queue behind it
+	s := l.(*log).syncer
+	s.mu.Lock()
+	s.syncing = true
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(msgs))
+	for i := range msgs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := l.Publish(msgs[i : i+1])
+			errs <- err
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		nextOffset, err := l.NextOffset()
+		return err == nil && nextOffset == int64(len(msgs))
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, int64(0), metrics.counter(MetricSyncs))
+
+	s.mu.Lock()
+	s.syncing = false
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(1), metrics.counter(MetricSyncs))
+}
+
+func testSyncInterval(t *testing.T) {
+	msgs := message.Gen(2)
+	metrics := newTestMetrics()
+
+	l, err := Open(t.TempDir(), Options{SyncInterval: 10 * time.Millisecond, Metrics: metrics})
+	require.NoError(t, err)
+
+	publishBatched(t, l, msgs, 1)
+	require.Eventually(t, func() bool {
+		return metrics.counter(MetricSyncs) > 0
+	}, 5*time.Second, time.Millisecond)
+
+	// the background stops with close
+	require.NoError(t, l.Close())
+	syncs := metrics.counter(MetricSyncs)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, syncs, metrics.counter(MetricSyncs))
+}
+
+func testSyncEveryBytes(t *testing.T) {
+	msgs := message.Gen(3)
+	metrics := newTestMetrics()
+
+	l, err := Open(t.TempDir(), Options{SyncEveryBytes: 2 * message.Size(msgs[0], message.V2), Metrics: metrics})
+	require.NoError(t, err)
+	defer l.Close()
+
+	publishBatched(t, l, msgs[:2], 1)
+	require.Eventually(t, func() bool {
+		return metrics.counter(MetricSyncs) == 1
+	}, 5*time.Second, time.Millisecond)
+
+	// the published bytes start over after each sync
+	publishBatched(t, l, msgs[2:], 1)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int64(1), metrics.counter(MetricSyncs))
+}
+
+func testSyncFailed(t *testing.T) {
+	msgs := message.Gen(2)
+
+	l, err := Open(t.TempDir(), Options{})
+	require.NoError(t, err)
+	publishBatched(t, l, msgs[:1], 1)
+
+	// a failed (e.g. background) sync is kept, even if the next sync would succeed
+	s := l.(*log).syncer
+	s.mu.Lock()
+	s.err = fmt.Errorf("%w: %w", ErrSyncFailed, errors.New("test"))
+	s.mu.Unlock()
+
+	_, err = l.Sync()
+	require.ErrorIs(t, err, ErrSyncFailed)
+	_, err = l.Sync()
+	require.ErrorIs(t, err, ErrSyncFailed)
+
+	_, err = l.Publish(msgs[1:])
+	require.ErrorIs(t, err, ErrSyncFailed)
+
+	require.ErrorIs(t, l.Close(), ErrSyncFailed)
+}
@@ -1,11 +1,14 @@
 package klevdb
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -946,6 +949,7 @@ func testStatSegments(t *testing.T) {
 func TestBackup(t *testing.T) {
 	t.Run("Segment", testBackupSegment)
 	t.Run("Segments", testBackupSegments)
+	t.Run("Incremental", testBackupIncremental)
 }
 
 func testBackupSegment(t *testing.T) {
@@ -1030,6 +1034,118 @@ func testBackupSegments(t *testing.T) {
 	}
 }
 
+func testBackupIncremental(t *testing.T) {
+	msgs := message.Gen(8)
+
+	l, err := Open(t.TempDir(), Options{
+		TimeIndex: true,
+		KeyIndex:  true,
+		Rollover:  2 * message.Size(msgs[0], message.V2),
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	bdir := t.TempDir()
+	publishBatched(t, l, msgs[:4], 1)
+	require.NoError(t, l.Backup(bdir))
+	require.NoError(t, VerifyBackup(bdir))
+
+	publishBatched(t, l, msgs[4:], 1)
+	_, _, err = l.Delete(map[int64]struct{}{0: {}, 1: {}})
+	require.NoError(t, err)
+	require.NoError(t, l.Backup(bdir))
+	require.NoError(t, VerifyBackup(bdir))
+
+	stat, err := l.Stat()
+	require.NoError(t, err)
+	bstat, err := Stat(bdir, Options{TimeIndex: true, KeyIndex: true})
+	require.NoError(t, err)
+	require.Equal(t, stat, bstat)
+
+	bl, err := Open(bdir, Options{TimeIndex: true, KeyIndex: true})
+	require.NoError(t, err)
+	defer bl.Close()
+
+	_, cmsgs, err := l.Consume(OffsetOldest, 8)
+	require.NoError(t, err)
+	_, bmsgs, err := bl.Consume(OffsetOldest, 8)
+	require.NoError(t, err)
+	require.Equal(t, cmsgs, bmsgs)
+}
+
+func TestRestore(t *testing.T) {
+	msgs := message.Gen(8)
+	opts := Options{
+		TimeIndex: true,
+		KeyIndex:  true,
+		Rollover:  2 * message.Size(msgs[0], message.V2),
+	}
+
+	l, err := Open(t.TempDir(), opts)
+	require.NoError(t, err)
+	defer l.Close()
+	publishBatched(t, l, msgs, 1)
+
+	bdir := t.TempDir()
+	require.NoError(t, l.Backup(bdir))
+
+	t.Run("All", func(t *testing.T) {
+		rdir := t.TempDir()
+		require.NoError(t, Restore(bdir, rdir, RestoreOptions{Options: opts}))
+
+		rl, err := Open(rdir, opts)
+		require.NoError(t, err)
+		defer rl.Close()
+
+		_, cmsgs, err := l.Consume(OffsetOldest, 8)
+		require.NoError(t, err)
+		_, rmsgs, err := rl.Consume(OffsetOldest, 8)
+		require.NoError(t, err)
+		require.Equal(t, cmsgs, rmsgs)
+
+		// the restored log doesn't change the backup
+		publishBatched(t, rl, message.Gen(2), 1)
+		require.NoError(t, VerifyBackup(bdir))
+	})
+
+	t.Run("UpToOffset", func(t *testing.T) {
+		rdir := t.TempDir()
+		require.NoError(t, Restore(bdir, rdir, RestoreOptions{Options: opts, UpToOffset: 5}))
+
+		rl, err := Open(rdir, opts)
+		require.NoError(t, err)
+		defer rl.Close()
+
+		noff, err := rl.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, int64(5), noff)
+
+		msg, err := rl.GetByKey(msgs[4].Key)
+		require.NoError(t, err)
+		require.Equal(t, int64(4), msg.Offset)
+		_, err = rl.GetByKey(msgs[5].Key)
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("UpToTime", func(t *testing.T) {
+		rdir := t.TempDir()
+		require.NoError(t, Restore(bdir, rdir, RestoreOptions{Options: opts, UpToTime: msgs[3].Time}))
+
+		rl, err := Open(rdir, opts)
+		require.NoError(t, err)
+		defer rl.Close()
+
+		noff, err := rl.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, int64(3), noff)
+	})
+
+	t.Run("NotEmpty", func(t *testing.T) {
+		err := Restore(bdir, l.Dir(), RestoreOptions{Options: opts})
+		require.ErrorIs(t, err, ErrRestoreTarget)
+	})
+}
+
 func TestReindex(t *testing.T) {
 	msgs := message.Gen(4)
 
@@ -2076,3 +2192,905 @@ func TestMigrateAPI(t *testing.T) {
 
 	require.Equal(t, msgs, consumeAll(t, l))
 }
+
+func TestHeaders(t *testing.T) {
+	msgs := message.Gen(4)
+	for i := range msgs {
+		msgs[i].Headers = []Header{
+			{Key: "trace-id", Value: fmt.Appendf(nil, "trace-%d", i)},
+			{Key: "schema-id", Value: []byte("1")},
+		}
+	}
+	opts := Options{
+		KeyIndex:  true,
+		TimeIndex: true,
+		Rollover:  2 * message.Size(msgs[0], message.V3),
+		Version:   VersionOptions{NewSegmentsVersion: V3},
+	}
+
+	t.Run("Publish", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, opts)
+		require.NoError(t, err)
+		publishBatched(t, l, msgs, 1)
+
+		require.Equal(t, msgs, consumeAll(t, l))
+
+		msg, err := l.Get(1)
+		require.NoError(t, err)
+		require.Equal(t, msgs[1], msg)
+
+		msg, err = l.GetByKey(msgs[2].Key)
+		require.NoError(t, err)
+		require.Equal(t, msgs[2], msg)
+
+		_, _, err = l.Delete(map[int64]struct{}{0: {}})
+		require.NoError(t, err)
+		require.Equal(t, msgs[1:], consumeAll(t, l))
+		require.NoError(t, l.Close())
+
+		l, err = Open(dir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+		require.Equal(t, msgs[1:], consumeAll(t, l))
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		l, err := Open(t.TempDir(), Options{})
+		require.NoError(t, err)
+		defer l.Close()
+
+		_, err = l.Publish(msgs[:1])
+		require.ErrorIs(t, err, message.ErrHeadersUnsupported)
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		dir := t.TempDir()
+		plain := message.Gen(2)
+
+		l, err := Open(dir, Options{KeyIndex: true, TimeIndex: true})
+		require.NoError(t, err)
+		publishBatched(t, l, plain, 1)
+		require.NoError(t, l.Close())
+
+		require.NoError(t, Migrate(dir, opts, V3))
+		require.Equal(t, []message.Version{message.V3}, segmentLogVersions(t, dir))
+
+		l, err = Open(dir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+
+		publishBatched(t, l, msgs[2:], 1)
+		require.Equal(t, append(plain, msgs[2:]...), consumeAll(t, l))
+	})
+}
+
+func TestCompression(t *testing.T) {
+	msgs := message.Gen(100)
+	opts := Options{
+		KeyIndex:    true,
+		TimeIndex:   true,
+		Compression: CompressionFlate,
+		Rollover:    1024,
+	}
+
+	t.Run("Publish", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, opts)
+		require.NoError(t, err)
+		publishBatched(t, l, msgs, 10)
+
+		require.Equal(t, msgs, consumeAll(t, l))
+
+		for _, v := range segmentLogVersions(t, dir) {
+			require.Equal(t, CompressionFlate, v.Compression())
+		}
+
+		msg, err := l.Get(42)
+		require.NoError(t, err)
+		require.Equal(t, msgs[42], msg)
+
+		msg, err = l.GetByKey(msgs[57].Key)
+		require.NoError(t, err)
+		require.Equal(t, msgs[57], msg)
+
+		msg, err = l.GetByTime(msgs[33].Time)
+		require.NoError(t, err)
+		require.Equal(t, msgs[33], msg)
+
+		stat, err := l.Stat()
+		require.NoError(t, err)
+		require.Equal(t, len(msgs), stat.Messages)
+		require.Less(t, stat.Size, stat.LogicalSize)
+
+		_, _, err = l.Delete(map[int64]struct{}{0: {}, 2: {}})
+		require.NoError(t, err)
+		expected := append([]Message{msgs[1]}, msgs[3:]...)
+		require.Equal(t, expected, consumeAll(t, l))
+		require.NoError(t, l.Close())
+
+		require.NoError(t, Check(dir, opts))
+
+		l, err = Open(dir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+		require.Equal(t, expected, consumeAll(t, l))
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, Options{KeyIndex: true, TimeIndex: true, Rollover: 1024})
+		require.NoError(t, err)
+		publishBatched(t, l, msgs, 10)
+		require.NoError(t, l.Close())
+
+		require.NoError(t, Migrate(dir, opts, V3))
+		for _, v := range segmentLogVersions(t, dir) {
+			require.Equal(t, message.V3.WithCompression(CompressionFlate), v)
+		}
+
+		l, err = Open(dir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+		require.Equal(t, msgs, consumeAll(t, l))
+	})
+
+	t.Run("Version", func(t *testing.T) {
+		_, err := Open(t.TempDir(), Options{
+			Compression: CompressionFlate,
+			Version:     VersionOptions{NewSegmentsVersion: V2},
+		})
+		require.ErrorIs(t, err, errCompressionVersion)
+	})
+}
+
+// segmentKeyIDs returns the encryption key id of every on-disk segment, in offset order.
+func segmentKeyIDs(t *testing.T, dir string) []string {
+	t.Helper()
+	segs, err := segment.Find(dir, false)
+	require.NoError(t, err)
+	var ids []string
+	for _, seg := range segs {
+		data, err := os.ReadFile(seg.Log)
+		require.NoError(t, err)
+		idLen := int(data[message.HeaderSize])
+		ids = append(ids, string(data[message.HeaderSize+1:int(message.HeaderSize)+1+idLen]))
+	}
+	return ids
+}
+
+func TestEncryption(t *testing.T) {
+	msgs := message.Gen(100)
+	keys := Keyring{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 32),
+		},
+	}
+	opts := Options{
+		KeyIndex:   true,
+		TimeIndex:  true,
+		Encryption: keys,
+		Rollover:   1024,
+	}
+
+	t.Run("Rotate", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, opts)
+		require.NoError(t, err)
+		publishBatched(t, l, msgs[:50], 10)
+		require.NoError(t, l.Close())
+
+		rotated := opts
+		rotated.Encryption = Keyring{Current: "k2", Keys: keys.Keys}
+		l, err = Open(dir, rotated)
+		require.NoError(t, err)
+		publishBatched(t, l, msgs[50:], 10)
+		require.Equal(t, msgs, consumeAll(t, l))
+
+		msg, err := l.GetByKey(msgs[57].Key)
+		require.NoError(t, err)
+		require.Equal(t, msgs[57], msg)
+
+		_, _, err = l.Delete(map[int64]struct{}{0: {}})
+		require.NoError(t, err)
+		require.NoError(t, l.Close())
+
+		ids := segmentKeyIDs(t, dir)
+		require.Equal(t, "k2", ids[0]) // rewritten by delete with the current key
+		require.Contains(t, ids, "k1")
+		require.Equal(t, "k2", ids[len(ids)-1])
+
+		require.NoError(t, Check(dir, rotated))
+		require.NoError(t, Recover(dir, rotated))
+
+		l, err = Open(dir, rotated)
+		require.NoError(t, err)
+		defer l.Close()
+		require.Equal(t, msgs[1:], consumeAll(t, l))
+	})
+
+	t.Run("Backup", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, opts)
+		require.NoError(t, err)
+		publishBatched(t, l, msgs, 10)
+
+		backupDir := t.TempDir()
+		require.NoError(t, l.Backup(backupDir))
+		require.NoError(t, l.Close())
+
+		l, err = Open(backupDir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+		require.Equal(t, msgs, consumeAll(t, l))
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, Options{KeyIndex: true, TimeIndex: true, Rollover: 1024})
+		require.NoError(t, err)
+		publishBatched(t, l, msgs, 10)
+		require.NoError(t, l.Close())
+
+		require.NoError(t, Migrate(dir, opts, V3))
+		for _, id := range segmentKeyIDs(t, dir) {
+			require.Equal(t, "k1", id)
+		}
+
+		l, err = Open(dir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+		require.Equal(t, msgs, consumeAll(t, l))
+	})
+
+	t.Run("Keys", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, opts)
+		require.NoError(t, err)
+		publishBatched(t, l, msgs, 10)
+		require.NoError(t, l.Close())
+
+		data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%020d.log", 0)))
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(data, msgs[0].Value))
+
+		_, err = Open(dir, Options{KeyIndex: true, TimeIndex: true, Version: VersionOptions{NewSegmentsVersion: V3}})
+		require.ErrorIs(t, err, message.ErrNoKeyProvider)
+
+		wrong := opts
+		wrong.Readonly = true
+		wrong.Encryption = Keyring{Current: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{3}, 32)}}
+		l, err = Open(dir, wrong)
+		require.NoError(t, err)
+		defer l.Close()
+		_, err = l.Get(0)
+		require.ErrorIs(t, err, ErrDecrypt)
+	})
+
+	t.Run("Version", func(t *testing.T) {
+		_, err := Open(t.TempDir(), Options{
+			Encryption: keys,
+			Version:    VersionOptions{NewSegmentsVersion: V2},
+		})
+		require.ErrorIs(t, err, errEncryptionVersion)
+	})
+}
+
+func TestConsumeBackward(t *testing.T) {
+	msgs := message.Gen(100)
+
+	l, err := Open(t.TempDir(), Options{Rollover: 1024})
+	require.NoError(t, err)
+	defer l.Close()
+
+	next, actual, err := l.ConsumeBackward(OffsetNewest, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), next)
+	require.Empty(t, actual)
+
+	publishBatched(t, l, msgs, 10)
+
+	t.Run("Newest", func(t *testing.T) {
+		next, actual, err := l.ConsumeBackward(OffsetNewest, 3)
+		require.NoError(t, err)
+		require.Equal(t, int64(97), next)
+		require.Equal(t, []Message{msgs[99], msgs[98], msgs[97]}, actual)
+	})
+
+	t.Run("All", func(t *testing.T) {
+		var all []Message
+		for offset := OffsetNewest; ; {
+			next, actual, err := l.ConsumeBackward(offset, 7)
+			require.NoError(t, err)
+			if len(actual) == 0 {
+				require.Equal(t, offset, next)
+				break
+			}
+			require.True(t, offset == OffsetNewest || next < offset)
+			all = append(all, actual...)
+			offset = next
+		}
+		slices.Reverse(all)
+		require.Equal(t, msgs, all)
+	})
+
+	t.Run("Segments", func(t *testing.T) {
+		stats, err := l.Stat()
+		require.NoError(t, err)
+		require.Greater(t, stats.Segments, 2)
+
+		next, actual, err := l.ConsumeBackward(50, 40)
+		require.NoError(t, err)
+		require.Equal(t, int64(10), next)
+		require.Len(t, actual, 40)
+		for i, msg := range actual {
+			require.Equal(t, msgs[49-i], msg)
+		}
+	})
+
+	t.Run("Bounds", func(t *testing.T) {
+		next, actual, err := l.ConsumeBackward(OffsetOldest, 10)
+		require.NoError(t, err)
+		require.Equal(t, OffsetOldest, next)
+		require.Empty(t, actual)
+
+		next, actual, err = l.ConsumeBackward(0, 10)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), next)
+		require.Empty(t, actual)
+
+		next, actual, err = l.ConsumeBackward(100, 1)
+		require.NoError(t, err)
+		require.Equal(t, int64(99), next)
+		require.Equal(t, msgs[99:], actual)
+
+		_, _, err = l.ConsumeBackward(101, 1)
+		require.ErrorIs(t, err, ErrInvalidOffset)
+	})
+
+	t.Run("Deleted", func(t *testing.T) {
+		_, _, err := l.Delete(map[int64]struct{}{98: {}, 96: {}})
+		require.NoError(t, err)
+
+		next, actual, err := l.ConsumeBackward(OffsetNewest, 3)
+		require.NoError(t, err)
+		require.Equal(t, int64(95), next)
+		require.Equal(t, []Message{msgs[99], msgs[97], msgs[95]}, actual)
+	})
+}
+
+func TestPublishRollback(t *testing.T) {
+	msgs := message.Gen(6)
+
+	fileSizes := func(t *testing.T, l Log) (int64, int64) {
+		seg := l.(*log).writer.segment
+		logStat, err := os.Stat(seg.Log)
+		require.NoError(t, err)
+		indexStat, err := os.Stat(seg.Index)
+		require.NoError(t, err)
+		return logStat.Size(), indexStat.Size()
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, opts := range []Options{
+			{KeyIndex: true},
+			{KeyIndex: true, Compression: CompressionFlate},
+		} {
+			l, err := Open(t.TempDir(), opts)
+			require.NoError(t, err)
+			defer l.Close()
+
+			publishBatched(t, l, msgs[:2], 2)
+			logSize, indexSize := fileSizes(t, l)
+
+			_, err = l.Publish([]Message{msgs[2], {Value: make([]byte, 64*1024*1024+1)}})
+			require.ErrorIs(t, err, ErrMessageTooBig)
+
+			nextOffset, err := l.NextOffset()
+			require.NoError(t, err)
+			require.Equal(t, int64(2), nextOffset)
+			actualLogSize, actualIndexSize := fileSizes(t, l)
+			require.Equal(t, logSize, actualLogSize)
+			require.Equal(t, indexSize, actualIndexSize)
+		}
+
+		l, err := Open(t.TempDir(), Options{Version: VersionOptions{NewSegmentsVersion: V2}})
+		require.NoError(t, err)
+		defer l.Close()
+
+		_, err = l.Publish([]Message{msgs[0], {Key: []byte("k"), Headers: []Header{{Key: "h"}}}})
+		require.ErrorIs(t, err, message.ErrHeadersUnsupported)
+		nextOffset, err := l.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, int64(0), nextOffset)
+	})
+
+	t.Run("WriteFailure", func(t *testing.T) {
+		dir := t.TempDir()
+		opts := Options{KeyIndex: true, TimeIndex: true}
+		l, err := Open(dir, opts)
+		require.NoError(t, err)
+
+		publishBatched(t, l, msgs[:2], 2)
+		logSize, indexSize := fileSizes(t, l)
+
+		// fail writing the index, after the messages are written
+		w := l.(*log).writer
+		require.NoError(t, w.items.Close())
+
+		_, err = l.Publish(msgs[2:4])
+		require.Error(t, err)
+
+		nextOffset, err := l.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, int64(2), nextOffset)
+		actualLogSize, actualIndexSize := fileSizes(t, l)
+		require.Equal(t, logSize, actualLogSize)
+		require.Equal(t, indexSize, actualIndexSize)
+
+		w.items, err = index.OpenWriter(w.segment.Index, w.segment.Offset, w.version.index, w.params)
+		require.NoError(t, err)
+		publishBatched(t, l, msgs[4:], 2)
+		require.NoError(t, l.Close())
+
+		// reindexing should not find the failed messages
+		require.NoError(t, os.Remove(w.segment.Index))
+		l, err = Open(dir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+
+		_, actual, err := l.Consume(OffsetOldest, 10)
+		require.NoError(t, err)
+		require.Equal(t, []Message{msgs[0], msgs[1], msgs[4], msgs[5]}, actual)
+	})
+}
+
+func TestPublishIf(t *testing.T) {
+	msgs := message.Gen(4)
+
+	l, err := Open(t.TempDir(), Options{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	nextOffset, err := l.PublishIf(0, msgs[:2])
+	require.NoError(t, err)
+	require.Equal(t, int64(2), nextOffset)
+
+	_, err = l.PublishIf(1, msgs[2:])
+	require.ErrorIs(t, err, ErrOffsetMismatch)
+	var mismatch *OffsetMismatchError
+	require.ErrorAs(t, err, &mismatch)
+	require.Equal(t, int64(1), mismatch.Expected)
+	require.Equal(t, int64(2), mismatch.Actual)
+
+	nextOffset, err = l.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), nextOffset)
+
+	nextOffset, err = l.PublishIf(mismatch.Actual, msgs[2:])
+	require.NoError(t, err)
+	require.Equal(t, int64(4), nextOffset)
+
+	t.Run("Concurrent", func(t *testing.T) {
+		l, err := Open(t.TempDir(), Options{Rollover: 1024})
+		require.NoError(t, err)
+		defer l.Close()
+
+		const writers, perWriter = 4, 25
+		var g errgroup.Group
+		for w := 0; w < writers; w++ {
+			g.Go(func() error {
+				expected, err := l.NextOffset()
+				if err != nil {
+					return err
+				}
+				for published := 0; published < perWriter; {
+					next, err := l.PublishIf(expected, message.Gen(1))
+					var mismatch *OffsetMismatchError
+					switch {
+					case errors.As(err, &mismatch):
+						expected = mismatch.Actual
+					case err != nil:
+						return err
+					default:
+						expected = next
+						published++
+					}
+				}
+				return nil
+			})
+		}
+		require.NoError(t, g.Wait())
+
+		nextOffset, err := l.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, int64(writers*perWriter), nextOffset)
+	})
+
+	t.Run("Readonly", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, Options{})
+		require.NoError(t, err)
+		require.NoError(t, l.Close())
+
+		l, err = Open(dir, Options{Readonly: true})
+		require.NoError(t, err)
+		defer l.Close()
+
+		_, err = l.PublishIf(0, msgs)
+		require.ErrorIs(t, err, ErrReadonly)
+	})
+}
+
+func TestPublishAt(t *testing.T) {
+	msgs := message.Gen(3)
+	msgs[0].Offset, msgs[1].Offset, msgs[2].Offset = 2, 3, 7
+
+	l, err := Open(t.TempDir(), Options{Rollover: 128})
+	require.NoError(t, err)
+	defer l.Close()
+
+	nextOffset, err := l.PublishAt(msgs)
+	require.NoError(t, err)
+	require.Equal(t, int64(8), nextOffset)
+
+	_, err = l.Get(5)
+	require.ErrorIs(t, err, ErrNotFound)
+	msg, err := l.Get(7)
+	require.NoError(t, err)
+	require.Equal(t, msgs[2], msg)
+
+	_, err = l.PublishAt([]Message{{Offset: 7}})
+	require.ErrorIs(t, err, ErrInvalidOffset)
+	_, err = l.PublishAt([]Message{{Offset: 9}, {Offset: 9}})
+	require.ErrorIs(t, err, ErrInvalidOffset)
+
+	nextOffset, err = l.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, int64(8), nextOffset)
+
+	// a gap across a rollover
+	nextOffset, err = l.PublishAt([]Message{{Offset: 20, Value: []byte("v")}})
+	require.NoError(t, err)
+	require.Equal(t, int64(21), nextOffset)
+
+	nextOffset, msgs, err = l.Consume(8, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(21), nextOffset)
+	require.Len(t, msgs, 1)
+	require.Equal(t, int64(20), msgs[0].Offset)
+}
+
+func TestPublishIfKey(t *testing.T) {
+	l, err := Open(t.TempDir(), Options{KeyIndex: true, Rollover: 1024})
+	require.NoError(t, err)
+	defer l.Close()
+
+	key := []byte("key")
+	nextOffset, err := l.PublishIfKey(key, OffsetInvalid, Message{Value: []byte("v1")})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), nextOffset)
+
+	_, err = l.PublishIfKey(key, OffsetInvalid, Message{Value: []byte("v1")})
+	var mismatch *OffsetMismatchError
+	require.ErrorAs(t, err, &mismatch)
+	require.Equal(t, OffsetInvalid, mismatch.Expected)
+	require.Equal(t, int64(0), mismatch.Actual)
+
+	// move the key to an older segment
+	publishBatched(t, l, message.Gen(100), 10)
+
+	_, err = l.PublishIfKey(key, 1, Message{Value: []byte("v2")})
+	require.ErrorIs(t, err, ErrOffsetMismatch)
+
+	nextOffset, err = l.PublishIfKey(key, 0, Message{Value: []byte("v2")})
+	require.NoError(t, err)
+	require.Equal(t, int64(102), nextOffset)
+
+	msg, err := l.GetByKey(key)
+	require.NoError(t, err)
+	require.Equal(t, int64(101), msg.Offset)
+	require.Equal(t, []byte("v2"), msg.Value)
+
+	t.Run("Concurrent", func(t *testing.T) {
+		const writers, perWriter = 4, 25
+		counter := []byte("counter")
+
+		var g errgroup.Group
+		for w := 0; w < writers; w++ {
+			g.Go(func() error {
+				for incremented := 0; incremented < perWriter; {
+					expected, value := OffsetInvalid, 0
+					switch msg, err := l.GetByKey(counter); {
+					case err == nil:
+						expected = msg.Offset
+						value, err = strconv.Atoi(string(msg.Value))
+						if err != nil {
+							return err
+						}
+					case !errors.Is(err, ErrNotFound):
+						return err
+					}
+
+					_, err := l.PublishIfKey(counter, expected, Message{Value: []byte(strconv.Itoa(value + 1))})
+					switch {
+					case errors.Is(err, ErrOffsetMismatch):
+						// somebody else incremented, try again
+					case err != nil:
+						return err
+					default:
+						incremented++
+					}
+				}
+				return nil
+			})
+		}
+		require.NoError(t, g.Wait())
+
+		msg, err := l.GetByKey(counter)
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(writers*perWriter), string(msg.Value))
+	})
+
+	t.Run("NoIndex", func(t *testing.T) {
+		l, err := Open(t.TempDir(), Options{})
+		require.NoError(t, err)
+		defer l.Close()
+
+		_, err = l.PublishIfKey(key, OffsetInvalid, Message{})
+		require.ErrorIs(t, err, ErrNoIndex)
+	})
+}
+
+func TestPublishIdempotent(t *testing.T) {
+	msgs := message.Gen(6)
+	dir := t.TempDir()
+	opts := Options{Idempotent: true, Rollover: 1024}
+
+	l, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	nextOffset, err := l.PublishIdempotent("p1", 0, msgs[:2])
+	require.NoError(t, err)
+	require.Equal(t, int64(2), nextOffset)
+	require.Empty(t, msgs[1].Headers)
+
+	// retry is acknowledged with the original offset
+	nextOffset, err = l.PublishIdempotent("p1", 0, msgs[:2])
+	require.NoError(t, err)
+	require.Equal(t, int64(2), nextOffset)
+
+	nextOffset, err = l.PublishIdempotent("p2", 5, msgs[2:3])
+	require.NoError(t, err)
+	require.Equal(t, int64(3), nextOffset)
+
+	nextOffset, err = l.PublishIdempotent("p1", 1, msgs[3:4])
+	require.NoError(t, err)
+	require.Equal(t, int64(4), nextOffset)
+
+	_, err = l.PublishIdempotent("p1", 0, msgs[4:5])
+	require.ErrorIs(t, err, ErrDuplicateSequence)
+	_, err = l.PublishIdempotent("p1", 3, msgs[4:5])
+	require.ErrorIs(t, err, ErrOutOfOrderSequence)
+
+	_, actual, err := l.Consume(OffsetOldest, 10)
+	require.NoError(t, err)
+	require.Len(t, actual, 4)
+	require.Empty(t, actual[0].Headers)
+	require.Equal(t, producerHeaders("p1", 0), actual[1].Headers)
+	require.Equal(t, producerHeaders("p2", 5), actual[2].Headers)
+
+	// push the producer batches to older segments
+	publishBatched(t, l, message.Gen(50), 10)
+	require.NoError(t, l.Close())
+
+	l, err = Open(dir, opts)
+	require.NoError(t, err)
+	defer l.Close()
+
+	nextOffset, err = l.PublishIdempotent("p1", 1, msgs[3:4])
+	require.NoError(t, err)
+	require.Equal(t, int64(4), nextOffset)
+	_, err = l.PublishIdempotent("p2", 4, msgs[4:5])
+	require.ErrorIs(t, err, ErrDuplicateSequence)
+
+	nextOffset, err = l.PublishIdempotent("p1", 2, msgs[4:])
+	require.NoError(t, err)
+	require.Equal(t, int64(56), nextOffset)
+
+	t.Run("Disabled", func(t *testing.T) {
+		l, err := Open(t.TempDir(), Options{})
+		require.NoError(t, err)
+		defer l.Close()
+
+		_, err = l.PublishIdempotent("p1", 0, msgs)
+		require.Error(t, err)
+
+		_, err = Open(t.TempDir(), Options{Idempotent: true, Version: VersionOptions{NewSegmentsVersion: V2}})
+		require.ErrorIs(t, err, errIdempotentVersion)
+	})
+
+	t.Run("V2", func(t *testing.T) {
+		for name, published := range map[string][]Message{"Empty": nil, "Messages": msgs[:2]} {
+			t.Run(name, func(t *testing.T) {
+				dir := t.TempDir()
+				l, err := Open(dir, Options{Version: VersionOptions{NewSegmentsVersion: V2}})
+				require.NoError(t, err)
+				if len(published) > 0 {
+					publishBatched(t, l, published, 1)
+				}
+				require.NoError(t, l.Close())
+
+				// the V2 head can't store the producer headers, so it is rolled over (or recreated if empty)
+				l, err = Open(dir, Options{Idempotent: true})
+				require.NoError(t, err)
+				defer l.Close()
+
+				nextOffset, err := l.PublishIdempotent("p1", 0, msgs[2:3])
+				require.NoError(t, err)
+				require.Equal(t, int64(len(published)+1), nextOffset)
+
+				msg, err := l.Get(nextOffset - 1)
+				require.NoError(t, err)
+				require.Equal(t, producerHeaders("p1", 0), msg.Headers)
+			})
+		}
+	})
+
+	t.Run("ReservedHeaders", func(t *testing.T) {
+		l, err := Open(t.TempDir(), opts)
+		require.NoError(t, err)
+		defer l.Close()
+
+		reserved := []Message{{Key: []byte("k"), Headers: producerHeaders("p1", 0)}}
+		_, err = l.Publish(reserved)
+		require.ErrorIs(t, err, errReservedHeader)
+		_, err = l.PublishIf(0, reserved)
+		require.ErrorIs(t, err, errReservedHeader)
+		_, err = l.PublishIdempotent("p2", 0, reserved)
+		require.ErrorIs(t, err, errReservedHeader)
+
+		// copied by PublishAt, updating the producer
+		nextOffset, err := l.PublishAt(reserved)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), nextOffset)
+		nextOffset, err = l.PublishIdempotent("p1", 0, msgs[:1])
+		require.NoError(t, err)
+		require.Equal(t, int64(1), nextOffset)
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, opts)
+		require.NoError(t, err)
+		_, err = l.PublishIdempotent("p1", 0, msgs[:2])
+		require.NoError(t, err)
+		require.NoError(t, l.Close())
+		require.FileExists(t, filepath.Join(dir, producersFile))
+
+		// only the messages after the snapshot are read, so p0 is kept and p1 is replayed
+		snapshot := &log{dir: dir, producers: map[string]producerState{"p0": {7, 1}}}
+		require.NoError(t, snapshot.writeProducers(1))
+
+		l, err = Open(dir, opts)
+		require.NoError(t, err)
+		nextOffset, err := l.PublishIdempotent("p0", 7, msgs[2:3])
+		require.NoError(t, err)
+		require.Equal(t, int64(1), nextOffset)
+		nextOffset, err = l.PublishIdempotent("p1", 0, msgs[:2])
+		require.NoError(t, err)
+		require.Equal(t, int64(2), nextOffset)
+		require.NoError(t, l.Close())
+
+		// a snapshot ahead of the log is rebuilt from the whole log
+		require.NoError(t, snapshot.writeProducers(10))
+
+		l, err = Open(dir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+		nextOffset, err = l.PublishIdempotent("p0", 7, msgs[2:3])
+		require.NoError(t, err)
+		require.Equal(t, int64(3), nextOffset)
+	})
+}
+
+func TestLazyWriter(t *testing.T) {
+	msgs := message.Gen(20)
+	dir := t.TempDir()
+	opts := Options{KeyIndex: true, TimeIndex: true, LazyWriter: true, WriterIdleTimeout: time.Millisecond, Rollover: 1024}
+
+	requireMessages := func(t *testing.T, l Log, expected []Message) {
+		t.Helper()
+		nextOffset, err := l.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, expected[len(expected)-1].Offset+1, nextOffset)
+
+		next, actual, err := l.Consume(OffsetOldest, int64(len(msgs)))
+		for next < nextOffset && err == nil {
+			var more []Message
+			next, more, err = l.Consume(next, int64(len(msgs)))
+			actual = append(actual, more...)
+		}
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+
+		next, actual, err = l.Consume(nextOffset, 1)
+		require.NoError(t, err)
+		require.Equal(t, nextOffset, next)
+		require.Empty(t, actual)
+
+		last := expected[len(expected)-1]
+		actual1, err := l.GetByKey(last.Key)
+		require.NoError(t, err)
+		require.Equal(t, last, actual1)
+	}
+
+	l, err := Open(dir, opts)
+	require.NoError(t, err)
+	require.Nil(t, l.(*log).writer)
+
+	nextOffset, err := l.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), nextOffset)
+	next, actual, err := l.Consume(OffsetOldest, 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), next)
+	require.Empty(t, actual)
+	stats, err := l.Stat()
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.Segments)
+
+	publishBatched(t, l, msgs[:10], 5)
+	require.NotNil(t, l.(*log).writer)
+	requireMessages(t, l, msgs[:10])
+	require.NoError(t, l.Close())
+
+	l, err = Open(dir, opts)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Nil(t, l.(*log).writer)
+	requireMessages(t, l, msgs[:10])
+
+	publishBatched(t, l, msgs[10:], 5)
+	requireMessages(t, l, msgs)
+
+	t.Run("Idle", func(t *testing.T) {
+		time.Sleep(2 * time.Millisecond)
+		require.NoError(t, l.GC(0))
+		require.Nil(t, l.(*log).writer)
+		requireMessages(t, l, msgs)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		require.Nil(t, l.(*log).writer)
+		deleted, _, err := l.Delete(map[int64]struct{}{19: {}})
+		require.NoError(t, err)
+		require.Equal(t, []Message{msgs[19]}, deleted)
+
+		nextOffset, err := l.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, int64(20), nextOffset)
+
+		next, actual, err := l.Consume(18, 2)
+		require.NoError(t, err)
+		require.Equal(t, int64(19), next)
+		require.Equal(t, []Message{msgs[18]}, actual)
+	})
+
+	t.Run("Republish", func(t *testing.T) {
+		time.Sleep(2 * time.Millisecond)
+		require.NoError(t, l.GC(0))
+		require.Nil(t, l.(*log).writer)
+
+		msg := Message{Key: []byte("new"), Value: []byte("value")}
+		nextOffset, err := l.Publish([]Message{msg})
+		require.NoError(t, err)
+		require.Equal(t, int64(21), nextOffset)
+
+		actual, err := l.GetByKey(msg.Key)
+		require.NoError(t, err)
+		require.Equal(t, int64(20), actual.Offset)
+	})
+}
@@ -0,0 +1,213 @@
+package klevdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/klev-dev/klevdb/pkg/index"
+	"github.com/klev-dev/klevdb/pkg/message"
+	"github.com/klev-dev/klevdb/pkg/segment"
+)
+
+const (
+	timeIndexFile       = "times.index"
+	timeIndexHeaderSize = 8                 // count
+	timeIndexItemSize   = 8 + 8 + 8 + 8 + 8 // segment offset + index size + messages + first time + last time
+	timeIndexCRCSize    = 4                 // crc of the whole file
+)
+
+var (
+	errUnifiedTimeIndex = fmt.Errorf("%w: unified time index requires TimeIndex", ErrNoIndex)
+	errTimeIndexCorrupt = errors.New("unified time index corrupted")
+)
+
+// timeSegment is the time range of a segment
+type timeSegment struct {
+	indexSize int64 // to detect the segment was rewritten
+	messages  int64
+	first     int64
+	last      int64
+}
+
+// timeIndex keeps the time range of each segment (except the head), so looking up
+// a time only loads the index of the segment containing it
+type timeIndex struct {
+	path     string
+	segments map[int64]timeSegment
+	mu       sync.RWMutex
+}
+
+// openTimeIndex loads the persisted time index, updating it with any changed segments
+func (l *log) openTimeIndex() (*timeIndex, error) {
+	t := &timeIndex{path: filepath.Join(l.dir, timeIndexFile)}
+
+	segments, err := readTimeIndex(t.path)
+	switch {
+	case err == nil:
+		t.segments = segments
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, errTimeIndexCorrupt):
+		// missing or corrupted, rebuild it
+		t.segments = map[int64]timeSegment{}
+	default:
+		return nil, err
+	}
+
+	if err := l.syncTimeIndex(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// syncTimeIndex updates the ranges of segments added or rewritten (e.g. by delete),
+// and persists the index if anything changed
+func (l *log) syncTimeIndex(t *timeIndex) error {
+	changed, err := l.updateTimeIndex(t)
+	if err != nil || !changed {
+		return err
+	}
+	return t.write()
+}
+
+func (l *log) updateTimeIndex(t *timeIndex) (bool, error) {
+	l.readersMu.RLock()
+	defer l.readersMu.RUnlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	changed := false
+	readers := l.readers[:len(l.readers)-1] // the head segment is always searched in memory
+	current := make(map[int64]struct{}, len(readers))
+	for _, rdr := range readers {
+		current[rdr.segment.Offset] = struct{}{}
+
+		switch stat, err := os.Stat(rdr.segment.Index); {
+		case err == nil:
+			if seg, ok := t.segments[rdr.segment.Offset]; ok && seg.indexSize == stat.Size() {
+				continue
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return false, fmt.Errorf("time index stat: %w", err)
+		}
+
+		items, err := rdr.segment.ReindexAndReadIndex(rdr.params, rdr.version.index)
+		if err != nil {
+			return false, err
+		}
+		stat, err := os.Stat(rdr.segment.Index)
+		if err != nil {
+			return false, fmt.Errorf("time index stat: %w", err)
+		}
+		t.segments[rdr.segment.Offset] = newTimeSegment(items, stat.Size())
+		changed = true
+	}
+
+	for offset := range t.segments {
+		if _, ok := current[offset]; !ok {
+			delete(t.segments, offset)
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+func newTimeSegment(items []index.Item, indexSize int64) timeSegment {
+	ts := timeSegment{indexSize: indexSize, messages: int64(len(items))}
+	if len(items) > 0 {
+		ts.first, ts.last = items[0].Timestamp, items[len(items)-1].Timestamp
+	}
+	return ts
+}
+
+// rollover adds the range of a segment which is no longer written to
+func (t *timeIndex) rollover(seg segment.Segment, items []index.Item) error {
+	stat, err := os.Stat(seg.Index)
+	if err != nil {
+		return fmt.Errorf("time index stat: %w", err)
+	}
+
+	t.mu.Lock()
+	t.segments[seg.Offset] = newTimeSegment(items, stat.Size())
+	t.mu.Unlock()
+
+	return t.write()
+}
+
+// getByTime looks up a time in a segment, returning ErrTimeBeforeStart (or ErrTimeAfterEnd)
+// from the unified time index (if enabled), without loading the index of the segment
+func (l *log) getByTime(rdr *reader, ts int64, tctx int64) (message.Message, error) {
+	if l.times != nil {
+		l.times.mu.RLock()
+		seg, ok := l.times.segments[rdr.segment.Offset]
+		l.times.mu.RUnlock()
+
+		// the range might be stale (e.g. before a delete), but it can only be wider than the actual one
+		switch {
+		case !ok || seg.messages == 0:
+			// unknown segment, search it
+		case ts < seg.first:
+			return message.Invalid, index.ErrTimeBeforeStart
+		case ts > seg.last:
+			return message.Invalid, index.ErrTimeAfterEnd
+		}
+	}
+	return rdr.GetByTime(ts, tctx)
+}
+
+// write persists the time index
+func (t *timeIndex) write() error {
+	t.mu.RLock()
+	data := make([]byte, 0, timeIndexHeaderSize+len(t.segments)*timeIndexItemSize+timeIndexCRCSize)
+	data = binary.BigEndian.AppendUint64(data, uint64(len(t.segments)))
+	for offset, ts := range t.segments {
+		data = binary.BigEndian.AppendUint64(data, uint64(offset))
+		data = binary.BigEndian.AppendUint64(data, uint64(ts.indexSize))
+		data = binary.BigEndian.AppendUint64(data, uint64(ts.messages))
+		data = binary.BigEndian.AppendUint64(data, uint64(ts.first))
+		data = binary.BigEndian.AppendUint64(data, uint64(ts.last))
+	}
+	t.mu.RUnlock()
+	data = binary.BigEndian.AppendUint32(data, crc32.Checksum(data, snapshotCRCTable))
+
+	if err := writeFileAtomic(t.path, data); err != nil {
+		return fmt.Errorf("write time index: %w", err)
+	}
+	return nil
+}
+
+func readTimeIndex(path string) (map[int64]timeSegment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read time index: %w", err)
+	}
+	if len(data) < timeIndexHeaderSize+timeIndexCRCSize {
+		return nil, fmt.Errorf("%w: short header", errTimeIndexCorrupt)
+	}
+
+	body, crc := data[:len(data)-timeIndexCRCSize], data[len(data)-timeIndexCRCSize:]
+	if crc32.Checksum(body, snapshotCRCTable) != binary.BigEndian.Uint32(crc) {
+		return nil, fmt.Errorf("%w: crc mismatch", errTimeIndexCorrupt)
+	}
+
+	count := binary.BigEndian.Uint64(body)
+	body = body[timeIndexHeaderSize:]
+	if uint64(len(body)) != count*timeIndexItemSize {
+		return nil, fmt.Errorf("%w: size mismatch", errTimeIndexCorrupt)
+	}
+
+	segments := make(map[int64]timeSegment, count)
+	for ; len(body) > 0; body = body[timeIndexItemSize:] {
+		segments[int64(binary.BigEndian.Uint64(body))] = timeSegment{
+			indexSize: int64(binary.BigEndian.Uint64(body[8:])),
+			messages:  int64(binary.BigEndian.Uint64(body[16:])),
+			first:     int64(binary.BigEndian.Uint64(body[24:])),
+			last:      int64(binary.BigEndian.Uint64(body[32:])),
+		}
+	}
+	return segments, nil
+}
@@ -0,0 +1,90 @@
+package klevdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+func TestUnifiedTimeIndex(t *testing.T) {
+	msgs := message.Gen(100)
+	dir := t.TempDir()
+	opts := Options{TimeIndex: true, UnifiedTimeIndex: true, Rollover: 1024}
+
+	requireTimes := func(t *testing.T, l Log, expected []Message) {
+		t.Helper()
+		for _, msg := range expected {
+			actual, err := l.GetByTime(msg.Time)
+			require.NoError(t, err)
+			require.Equal(t, msg, actual)
+
+			actual, err = l.GetByTime(msg.Time.Add(-time.Millisecond))
+			require.NoError(t, err)
+			require.Equal(t, msg, actual)
+		}
+
+		actual, err := l.GetByTime(msgs[0].Time.Add(-time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, expected[0], actual)
+
+		_, err = l.GetByTime(msgs[len(msgs)-1].Time.Add(time.Hour))
+		require.ErrorIs(t, err, ErrNotFound)
+	}
+
+	l, err := Open(dir, opts)
+	require.NoError(t, err)
+	publishBatched(t, l, msgs, 5)
+	requireTimes(t, l, msgs)
+
+	stats, err := l.Stat()
+	require.NoError(t, err)
+	require.Greater(t, stats.Segments, 2)
+
+	t.Run("Delete", func(t *testing.T) {
+		// the first and last messages of the first segment
+		deleted := map[int64]struct{}{0: {}, 1: {}}
+		_, _, err := DeleteMulti(t.Context(), l, deleted, DeleteMultiWithWait(0))
+		require.NoError(t, err)
+
+		actual, err := l.GetByTime(msgs[0].Time)
+		require.NoError(t, err)
+		require.Equal(t, msgs[2], actual)
+		requireTimes(t, l, msgs[2:])
+	})
+	require.NoError(t, l.Close())
+
+	t.Run("Reopen", func(t *testing.T) {
+		l, err := Open(dir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+		requireTimes(t, l, msgs[2:])
+	})
+
+	t.Run("Rebuild", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, timeIndexFile), []byte("random data characters"), 0600))
+
+		l, err := Open(dir, opts)
+		require.NoError(t, err)
+		requireTimes(t, l, msgs[2:])
+		require.NoError(t, l.Close())
+
+		require.NoError(t, os.Remove(filepath.Join(dir, timeIndexFile)))
+		l, err = Open(dir, opts)
+		require.NoError(t, err)
+		defer l.Close()
+		requireTimes(t, l, msgs[2:])
+
+		_, err = os.Stat(filepath.Join(dir, timeIndexFile))
+		require.NoError(t, err)
+	})
+
+	t.Run("NoTimeIndex", func(t *testing.T) {
+		_, err := Open(t.TempDir(), Options{UnifiedTimeIndex: true})
+		require.ErrorIs(t, err, ErrNoIndex)
+	})
+}
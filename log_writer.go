@@ -2,6 +2,8 @@ package klevdb
 
 import (
 	"errors"
+	"fmt"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,6 +19,7 @@ type writer struct {
 	segment segment.Segment
 	params  index.Params
 	version Version
+	hooks   logHooks
 
 	messages *message.Writer
 	items    *index.Writer
@@ -24,14 +27,26 @@ type writer struct {
 	reader   *reader
 }
 
-func openWriter(seg segment.Segment, params index.Params, version Version, nextTime int64) (*writer, error) {
-	messages, err := message.OpenWriter(seg.Log, seg.Offset, version.messages)
+func openWriter(seg segment.Segment, params index.Params, version Version, hooks logHooks, nextTime int64) (*writer, error) {
+	messages, err := message.OpenWriterKeys(seg.Log, seg.Offset, version.messages, seg.Keys)
 	if err != nil {
 		return nil, err
 	}
+	if messages.Empty() && !messages.Version().Headers() && version.messages.Headers() {
+		// an empty head can't be rolled over, so it is recreated to store headers (e.g. after enabling Idempotent)
+		if err := messages.Close(); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(seg.Log); err != nil {
+			return nil, err
+		}
+		if messages, err = message.OpenWriterKeys(seg.Log, seg.Offset, version.messages, seg.Keys); err != nil {
+			return nil, err
+		}
+	}
 
 	var ix *writerIndex
-	if messages.Size() > message.HeaderSize {
+	if !messages.Empty() {
 		indexItems, err := seg.ReindexAndReadIndex(params, version.index)
 		if err != nil {
 			return nil, err
@@ -46,7 +61,7 @@ func openWriter(seg segment.Segment, params index.Params, version Version, nextT
 		return nil, err
 	}
 
-	reader, err := openReaderAppend(seg, params, version, ix)
+	reader, err := openReaderAppend(seg, params, version, hooks, ix)
 	if err != nil {
 		return nil, err
 	}
@@ -55,6 +70,7 @@ func openWriter(seg segment.Segment, params index.Params, version Version, nextT
 		segment: seg,
 		params:  params,
 		version: version,
+		hooks:   hooks,
 
 		messages: messages,
 		items:    items,
@@ -74,33 +90,83 @@ func (w *writer) NeedsRollover(rollover int64) bool {
 	return w.messages.Size() > rollover
 }
 
-func (w *writer) Publish(msgs []message.Message) (int64, error) {
+// NeedsHeaders returns whether the segment can't store message headers, while new segments can.
+// Such segments are rolled over on publish, so publishing messages with headers (e.g. after
+// enabling Idempotent on a V2 log) doesn't fail until the segment is large enough
+func (w *writer) NeedsHeaders() bool {
+	return !w.messages.Version().Headers() && w.version.messages.Headers()
+}
+
+// Publish writes the messages, calling written (if not nil) once they are written,
+// but before they are visible to readers, e.g. to update the unified key index
+func (w *writer) Publish(msgs []message.Message, written func([]message.Message)) (int64, error) {
+	return w.publish(msgs, false, written)
+}
+
+// PublishAt is similar to Publish, but keeps the offsets of the messages. Expects them to be
+// increasing and at least the next offset of the writer
+func (w *writer) PublishAt(msgs []message.Message, written func([]message.Message)) (int64, error) {
+	return w.publish(msgs, true, written)
+}
+
+func (w *writer) publish(msgs []message.Message, keepOffsets bool, written func([]message.Message)) (int64, error) {
+	for _, msg := range msgs {
+		if err := w.messages.Validate(msg); err != nil {
+			return OffsetInvalid, err
+		}
+	}
+
 	nextOffset, indexTime := w.index.getNext()
+	messagesSize, itemsSize := w.messages.Size(), w.items.Size()
 
 	items := make([]index.Item, len(msgs))
 	for i := range msgs {
-		msgs[i].Offset = nextOffset + int64(i)
+		if !keepOffsets {
+			msgs[i].Offset = nextOffset + int64(i)
+		}
 		if msgs[i].Time.IsZero() {
 			msgs[i].Time = time.Now().UTC()
 		}
 
 		position, err := w.messages.Write(msgs[i])
 		if err != nil {
-			return OffsetInvalid, err
+			return OffsetInvalid, w.rollback(err, messagesSize, itemsSize)
 		}
 
 		items[i] = w.params.NewItem(msgs[i], position, indexTime)
-		if err := w.items.Write(items[i]); err != nil {
-			return OffsetInvalid, err
-		}
 		indexTime = items[i].Timestamp
 	}
 
+	// messages might be buffered in a compressed block, make sure they are written before the index
+	if err := w.messages.Flush(); err != nil {
+		return OffsetInvalid, w.rollback(err, messagesSize, itemsSize)
+	}
+
+	for _, item := range items {
+		if err := w.items.Write(item); err != nil {
+			return OffsetInvalid, w.rollback(err, messagesSize, itemsSize)
+		}
+	}
+
+	w.hooks.metrics.Add(MetricPublishedMessages, int64(len(msgs)))
+	w.hooks.metrics.Add(MetricPublishedBytes, w.messages.Size()-messagesSize)
+	if written != nil {
+		written(msgs)
+	}
 	return w.index.append(items), nil
 }
 
+// rollback truncates the log and index files to their sizes before a failed publish,
+// so partially written messages are never picked up (e.g. when reindexing)
+func (w *writer) rollback(err error, messagesSize, itemsSize int64) error {
+	if rerr := errors.Join(w.items.Truncate(itemsSize), w.messages.Truncate(messagesSize)); rerr != nil {
+		return fmt.Errorf("%w: rollback: %w", err, rerr)
+	}
+	return err
+}
+
 func (w *writer) ReopenReader() (*reader, int64, int64) {
-	rdr := reopenReader(w.segment, w.params, w.version, w.index.reader())
+	rdr := reopenReader(w.segment, w.params, w.version, w.hooks, w.index.reader())
 	nextOffset, nextTime := w.index.getNext()
 	return rdr, nextOffset, nextTime
 }
@@ -130,7 +196,7 @@ func (w *writer) Delete(rs *segment.RewriteSegment) (*writer, *reader, error) {
 		}
 
 		nextOffset, nextTime := w.index.getNext()
-		nwrt, err := openWriter(w.segment.NewAt(nextOffset), w.params, w.version, nextTime)
+		nwrt, err := openWriter(w.segment.NewAt(nextOffset), w.params, w.version, w.hooks, nextTime)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -143,7 +209,7 @@ func (w *writer) Delete(rs *segment.RewriteSegment) (*writer, *reader, error) {
 	}
 
 	nseg := rs.GetNewSegment()
-	if nseg != w.segment {
+	if nseg.Offset != w.segment.Offset {
 		// the starting offset of the new segment is different
 		if err := rs.Rename(nseg); err != nil {
 			return nil, nil, err
@@ -156,11 +222,11 @@ func (w *writer) Delete(rs *segment.RewriteSegment) (*writer, *reader, error) {
 		// first move the replacement
 		nextOffset, nextTime := w.index.getNext()
 		if rs.DeletedMessages[len(rs.DeletedMessages)-1].Offset == w.index.getLastOffset() {
-			rdr := openReader(nseg, w.params, w.version, false)
-			wrt, err := openWriter(w.segment.NewAt(nextOffset), w.params, w.version, nextTime)
+			rdr := openReader(nseg, w.params, w.version, w.hooks, false)
+			wrt, err := openWriter(w.segment.NewAt(nextOffset), w.params, w.version, w.hooks, nextTime)
 			return wrt, rdr, err
 		} else {
-			wrt, err := openWriter(nseg, w.params, w.version, nextTime)
+			wrt, err := openWriter(nseg, w.params, w.version, w.hooks, nextTime)
 			return wrt, nil, err
 		}
 	}
@@ -171,11 +237,11 @@ func (w *writer) Delete(rs *segment.RewriteSegment) (*writer, *reader, error) {
 
 	nextOffset, nextTime := w.index.getNext()
 	if rs.DeletedMessages[len(rs.DeletedMessages)-1].Offset == w.index.getLastOffset() {
-		rdr := openReader(w.segment, w.params, w.version, false)
-		wrt, err := openWriter(w.segment.NewAt(nextOffset), w.params, w.version, nextTime)
+		rdr := openReader(w.segment, w.params, w.version, w.hooks, false)
+		wrt, err := openWriter(w.segment.NewAt(nextOffset), w.params, w.version, w.hooks, nextTime)
 		return wrt, rdr, err
 	} else {
-		wrt, err := openWriter(w.segment, w.params, w.version, nextTime)
+		wrt, err := openWriter(w.segment, w.params, w.version, w.hooks, nextTime)
 		return wrt, nil, err
 	}
 }
@@ -190,6 +256,18 @@ func (w *writer) Sync() error {
 	return nil
 }
 
+// syncWritten syncs what publishes have written, without flushing (publishes flush their messages).
+// It is safe to call concurrently with publishes
+func (w *writer) syncWritten() error {
+	if err := w.messages.SyncWritten(); err != nil {
+		return err
+	}
+	if err := w.items.Sync(); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (w *writer) Close() error {
 	if err := w.messages.Close(); err != nil {
 		return err
@@ -284,6 +362,13 @@ func (ix *writerIndex) Consume(offset int64) (int64, int64, int64, error) {
 	return position, maxPosition, offset, err
 }
 
+func (ix *writerIndex) ConsumeBackward(offset int64, maxCount int64) []int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	return index.ConsumeBackward(ix.items, offset, maxCount)
+}
+
 func (ix *writerIndex) Get(offset int64) (int64, error) {
 	ix.mu.RLock()
 	defer ix.mu.RUnlock()
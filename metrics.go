@@ -0,0 +1,48 @@
+package klevdb
+
+// Metrics receives counters and histograms of the operations of a log, see [Options.Metrics].
+// Metrics are identified by their names, see the Metric constants. Implementations must be
+// safe for concurrent use, and fast, since they are called while publishing and reading.
+type Metrics interface {
+	// Add adds delta to the counter name
+	Add(name string, delta int64)
+	// Observe records a value in the histogram name
+	Observe(name string, value float64)
+}
+
+const (
+	// MetricPublishSeconds is a histogram of the duration of publishes, including rollovers
+	MetricPublishSeconds = "publish_seconds"
+	// MetricPublishBatchSize is a histogram of the number of messages in each publish
+	MetricPublishBatchSize = "publish_batch_size"
+	// MetricPublishedMessages counts the published messages
+	MetricPublishedMessages = "published_messages"
+	// MetricPublishedBytes counts the bytes written to segments by publishes (after compression)
+	MetricPublishedBytes = "published_bytes"
+	// MetricRollovers counts the rollovers to new segments
+	MetricRollovers = "rollovers"
+	// MetricIndexLoads counts the loads of segment indexes, e.g. after they were unloaded by GC
+	MetricIndexLoads = "index_loads"
+	// MetricIndexLoadSeconds is a histogram of the duration of index loads, including reindexing
+	MetricIndexLoadSeconds = "index_load_seconds"
+	// MetricGCIndexEvictions counts the indexes unloaded by GC
+	MetricGCIndexEvictions = "gc_index_evictions"
+	// MetricGCMessagesEvictions counts the segment files closed by GC
+	MetricGCMessagesEvictions = "gc_messages_evictions"
+	// MetricDeleteRewrites counts the segments rewritten by deletes
+	MetricDeleteRewrites = "delete_rewrites"
+	// MetricDeleteRewriteSeconds is a histogram of the duration of segment rewrites by deletes
+	MetricDeleteRewriteSeconds = "delete_rewrite_seconds"
+	// MetricDeletedMessages counts the deleted messages
+	MetricDeletedMessages = "deleted_messages"
+	// MetricSyncs counts the syncs of the head segment, by Sync, AutoSync publishes and the background (see Options.SyncInterval)
+	MetricSyncs = "syncs"
+	// MetricSyncSeconds is a histogram of the duration of syncs of the head segment
+	MetricSyncSeconds = "sync_seconds"
+)
+
+// noMetrics is used when no metrics are configured
+type noMetrics struct{}
+
+func (noMetrics) Add(string, int64)       {}
+func (noMetrics) Observe(string, float64) {}
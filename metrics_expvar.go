@@ -0,0 +1,134 @@
+package klevdb
+
+import (
+	"encoding/json"
+	"expvar"
+	"math"
+	"sort"
+	"sync"
+)
+
+// expvarMu guards creating the maps and histograms of ExpvarMetrics, which can be shared
+var expvarMu sync.Mutex
+
+// ExpvarMetrics is a [Metrics] publishing to an [expvar.Map], e.g. served by the expvar handler at /debug/vars.
+// Counters are [expvar.Int] and histograms are JSON objects with their count, sum, min, max and
+// cumulative counts of the values less or equal to each bucket bound.
+type ExpvarMetrics struct {
+	vars *expvar.Map
+}
+
+// NewExpvarMetrics creates metrics published under name, e.g. "klevdb". Metrics created with the same
+// name share their values. Panics if name is already used by another (non map) expvar, like [expvar.Publish].
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	vars, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		vars = expvar.NewMap(name)
+	}
+	return &ExpvarMetrics{vars: vars}
+}
+
+// Vars returns the map the metrics are published to
+func (m *ExpvarMetrics) Vars() *expvar.Map {
+	return m.vars
+}
+
+func (m *ExpvarMetrics) Add(name string, delta int64) {
+	m.vars.Add(name, delta)
+}
+
+func (m *ExpvarMetrics) Observe(name string, value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	m.histogram(name).observe(value)
+}
+
+func (m *ExpvarMetrics) histogram(name string) *expvarHistogram {
+	if h, ok := m.vars.Get(name).(*expvarHistogram); ok {
+		return h
+	}
+
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	if h, ok := m.vars.Get(name).(*expvarHistogram); ok {
+		return h
+	}
+	h := &expvarHistogram{buckets: make([]uint64, len(expvarBuckets))}
+	m.vars.Set(name, h)
+	return h
+}
+
+// expvarBuckets are the bucket bounds of histograms, covering both durations (in seconds) and sizes
+var expvarBuckets = func() []float64 {
+	var bounds []float64
+	for exp := -6; exp <= 6; exp++ {
+		for _, m := range []float64{1, 2.5, 5} {
+			bounds = append(bounds, m*math.Pow10(exp))
+		}
+	}
+	return bounds
+}()
+
+type expvarHistogram struct {
+	mu       sync.Mutex
+	count    uint64
+	sum      float64
+	min, max float64
+	// buckets are not cumulative, the counts of values in (bound[i-1], bound[i]]
+	buckets []uint64
+}
+
+func (h *expvarHistogram) observe(value float64) {
+	i := sort.SearchFloat64s(expvarBuckets, value)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count == 0 || value < h.min {
+		h.min = value
+	}
+	if h.count == 0 || value > h.max {
+		h.max = value
+	}
+	h.count++
+	h.sum += value
+	if i < len(h.buckets) {
+		h.buckets[i]++
+	}
+}
+
+type expvarBucket struct {
+	Le    float64 `json:"le"`
+	Count uint64  `json:"count"`
+}
+
+// String returns the histogram as JSON, implementing [expvar.Var]
+func (h *expvarHistogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	v := struct {
+		Count   uint64         `json:"count"`
+		Sum     float64        `json:"sum"`
+		Min     float64        `json:"min"`
+		Max     float64        `json:"max"`
+		Buckets []expvarBucket `json:"buckets"`
+	}{Count: h.count, Sum: h.sum, Min: h.min, Max: h.max}
+
+	var cumulative uint64
+	for i, bound := range expvarBuckets {
+		cumulative += h.buckets[i]
+		v.Buckets = append(v.Buckets, expvarBucket{bound, cumulative})
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
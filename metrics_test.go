@@ -0,0 +1,128 @@
+package klevdb
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+type testMetrics struct {
+	mu           sync.Mutex
+	counters     map[string]int64
+	observations map[string][]float64
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{counters: map[string]int64{}, observations: map[string][]float64{}}
+}
+
+func (m *testMetrics) Add(name string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += delta
+}
+
+func (m *testMetrics) Observe(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observations[name] = append(m.observations[name], value)
+}
+
+func (m *testMetrics) counter(name string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[name]
+}
+
+func (m *testMetrics) observed(name string) []float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.observations[name]
+}
+
+func TestMetrics(t *testing.T) {
+	msgs := message.Gen(4)
+	metrics := newTestMetrics()
+
+	l, err := Open(t.TempDir(), Options{
+		KeyIndex: true,
+		Rollover: message.Size(msgs[0], message.V2),
+		Metrics:  metrics,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	publishBatched(t, l, msgs[:2], 1)
+	publishBatched(t, l, msgs[2:], 2)
+	require.Equal(t, int64(4), metrics.counter(MetricPublishedMessages))
+	require.Equal(t, 4*message.Size(msgs[0], message.V2), metrics.counter(MetricPublishedBytes))
+	require.Equal(t, []float64{1, 1, 2}, metrics.observed(MetricPublishBatchSize))
+	require.Len(t, metrics.observed(MetricPublishSeconds), 3)
+	require.Equal(t, int64(2), metrics.counter(MetricRollovers))
+
+	// the indexes of rolled over segments are kept, until evicted
+	require.NoError(t, l.GC(0))
+	require.Equal(t, int64(2), metrics.counter(MetricGCIndexEvictions))
+	require.Equal(t, int64(0), metrics.counter(MetricGCMessagesEvictions))
+
+	_, _, err = l.Consume(OffsetOldest, 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), metrics.counter(MetricIndexLoads))
+	require.Len(t, metrics.observed(MetricIndexLoadSeconds), 1)
+
+	require.NoError(t, l.GC(0))
+	require.Equal(t, int64(3), metrics.counter(MetricGCIndexEvictions))
+	require.Equal(t, int64(1), metrics.counter(MetricGCMessagesEvictions))
+
+	_, _, err = l.Delete(map[int64]struct{}{3: {}})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), metrics.counter(MetricDeleteRewrites))
+	require.Len(t, metrics.observed(MetricDeleteRewriteSeconds), 1)
+	require.Equal(t, int64(1), metrics.counter(MetricDeletedMessages))
+}
+
+func TestExpvarMetrics(t *testing.T) {
+	m := NewExpvarMetrics("klevdb_test")
+	m.Add(MetricRollovers, 2)
+	m.Observe(MetricPublishBatchSize, 1)
+	m.Observe(MetricPublishBatchSize, 3)
+	m.Observe(MetricPublishBatchSize, 100)
+
+	shared := NewExpvarMetrics("klevdb_test")
+	shared.Add(MetricRollovers, 1)
+	require.Equal(t, "3", m.Vars().Get(MetricRollovers).String())
+
+	var h struct {
+		Count   uint64
+		Sum     float64
+		Min     float64
+		Max     float64
+		Buckets []struct {
+			Le    float64
+			Count uint64
+		}
+	}
+	require.NoError(t, json.Unmarshal([]byte(m.Vars().Get(MetricPublishBatchSize).String()), &h))
+	require.Equal(t, uint64(3), h.Count)
+	require.Equal(t, float64(104), h.Sum)
+	require.Equal(t, float64(1), h.Min)
+	require.Equal(t, float64(100), h.Max)
+
+	counts := map[float64]uint64{}
+	for _, b := range h.Buckets {
+		counts[b.Le] = b.Count
+	}
+	require.Equal(t, uint64(0), counts[0.5])
+	require.Equal(t, uint64(1), counts[1])
+	require.Equal(t, uint64(1), counts[2.5])
+	require.Equal(t, uint64(2), counts[5])
+	require.Equal(t, uint64(3), counts[100])
+	require.Equal(t, uint64(3), counts[1e6])
+
+	// the whole map is valid json, as served by expvar
+	require.True(t, json.Valid([]byte(m.Vars().String())))
+}
@@ -0,0 +1,240 @@
+package klevdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/klev-dev/klevdb/pkg/index"
+)
+
+const partitionsFile = "partitions"
+
+var (
+	// ErrPartitionsMismatch is returned when opening a partitioned log with a different number of partitions
+	ErrPartitionsMismatch = errors.New("partitions mismatch")
+	errInvalidPartition   = errors.New("invalid partition")
+)
+
+// PartitionedLog spreads messages across a number of logs (partitions), by the hash of their keys.
+// Messages with the same key are always in the same partition, and keep their relative order.
+// Each partition has its own offsets, so messages are consumed per partition.
+type PartitionedLog interface {
+	// Publish appends messages to their partitions, concurrently. It returns the next offset
+	// of each partition, or OffsetInvalid for partitions without published messages.
+	// Publishing to each partition is atomic, but a failure in one does not roll back the rest.
+	// Unlike [Log.Publish], the offsets of the messages are not updated.
+	Publish(messages []Message) (nextOffsets []int64, err error)
+
+	// Consume see [Log.Consume], for a single partition
+	Consume(partition int, offset int64, maxCount int64) (nextOffset int64, messages []Message, err error)
+
+	// GetByKey see [Log.GetByKey], looking in the partition of the key
+	GetByKey(key []byte) (message Message, err error)
+
+	// NextOffsets returns the next offset of each partition
+	NextOffsets() (nextOffsets []int64, err error)
+
+	// Partitions returns the number of partitions
+	Partitions() int
+
+	// PartitionOf returns the partition of a key
+	PartitionOf(key []byte) int
+
+	// Partition returns the log of a partition, e.g. to use the full [Log] api. Panics for invalid partitions.
+	Partition(partition int) Log
+
+	// Stat returns the combined stats of the segments of all partitions,
+	// use the Stat of a partition for its consumers
+	Stat() (Stats, error)
+
+	// Sync see [Log.Sync], for all partitions
+	Sync() (nextOffsets []int64, err error)
+
+	// GC see [Log.GC], for all partitions
+	GC(unusedFor time.Duration) error
+
+	// Close closes all partitions
+	Close() error
+}
+
+// OpenPartitioned opens a log with a number of partitions, each in its own sub directory. The
+// number of partitions is stored when the log is created, opening it with another number
+// returns ErrPartitionsMismatch.
+func OpenPartitioned(dir string, partitions int, opts Options) (result PartitionedLog, err error) {
+	if partitions <= 0 {
+		return nil, fmt.Errorf("%w: %d partitions", errInvalidPartition, partitions)
+	}
+
+	if opts.CreateDirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("open create dirs: %w", err)
+		}
+	}
+
+	switch stored, err := readPartitions(dir); {
+	case err == nil:
+		if stored != partitions {
+			return nil, fmt.Errorf("%w: stored %d, opening with %d", ErrPartitionsMismatch, stored, partitions)
+		}
+	case errors.Is(err, os.ErrNotExist) && !opts.Readonly:
+		if err := writePartitions(dir, partitions); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	pl := &partitionedLog{logs: make([]Log, 0, partitions)}
+	defer func() {
+		if err != nil {
+			for _, l := range pl.logs {
+				_ = l.Close()
+			}
+		}
+	}()
+
+	popts := opts
+	popts.CreateDirs = true
+	for p := range partitions {
+		l, err := Open(filepath.Join(dir, strconv.Itoa(p)), popts)
+		if err != nil {
+			return nil, fmt.Errorf("open partition %d: %w", p, err)
+		}
+		pl.logs = append(pl.logs, l)
+	}
+	return pl, nil
+}
+
+func readPartitions(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, partitionsFile))
+	if err != nil {
+		return 0, fmt.Errorf("read partitions: %w", err)
+	}
+	partitions, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("read partitions: %w", err)
+	}
+	return partitions, nil
+}
+
+func writePartitions(dir string, partitions int) error {
+	if err := writeFileAtomic(filepath.Join(dir, partitionsFile), []byte(strconv.Itoa(partitions)+"\n")); err != nil {
+		return fmt.Errorf("write partitions: %w", err)
+	}
+	return nil
+}
+
+type partitionedLog struct {
+	logs []Log
+}
+
+func (pl *partitionedLog) Publish(msgs []Message) ([]int64, error) {
+	batches := make([][]Message, len(pl.logs))
+	for _, msg := range msgs {
+		p := pl.PartitionOf(msg.Key)
+		batches[p] = append(batches[p], msg)
+	}
+
+	nextOffsets := make([]int64, len(pl.logs))
+	var g errgroup.Group
+	for p, batch := range batches {
+		nextOffsets[p] = OffsetInvalid
+		if len(batch) == 0 {
+			continue
+		}
+		g.Go(func() error {
+			nextOffset, err := pl.logs[p].Publish(batch)
+			if err != nil {
+				return fmt.Errorf("partition %d: %w", p, err)
+			}
+			nextOffsets[p] = nextOffset
+			return nil
+		})
+	}
+	return nextOffsets, g.Wait()
+}
+
+func (pl *partitionedLog) Consume(partition int, offset int64, maxCount int64) (int64, []Message, error) {
+	if partition < 0 || partition >= len(pl.logs) {
+		return OffsetInvalid, nil, fmt.Errorf("%w: %d", errInvalidPartition, partition)
+	}
+	return pl.logs[partition].Consume(offset, maxCount)
+}
+
+func (pl *partitionedLog) GetByKey(key []byte) (Message, error) {
+	return pl.logs[pl.PartitionOf(key)].GetByKey(key)
+}
+
+func (pl *partitionedLog) NextOffsets() ([]int64, error) {
+	return pl.each(Log.NextOffset)
+}
+
+func (pl *partitionedLog) Partitions() int {
+	return len(pl.logs)
+}
+
+func (pl *partitionedLog) PartitionOf(key []byte) int {
+	return int(index.KeyHash(key) % uint64(len(pl.logs)))
+}
+
+func (pl *partitionedLog) Partition(partition int) Log {
+	return pl.logs[partition]
+}
+
+func (pl *partitionedLog) Stat() (Stats, error) {
+	var stats Stats
+	for p, l := range pl.logs {
+		pstats, err := l.Stat()
+		if err != nil {
+			return Stats{}, fmt.Errorf("partition %d: %w", p, err)
+		}
+		stats.Segments += pstats.Segments
+		stats.Messages += pstats.Messages
+		stats.Size += pstats.Size
+		stats.LogicalSize += pstats.LogicalSize
+	}
+	return stats, nil
+}
+
+func (pl *partitionedLog) Sync() ([]int64, error) {
+	return pl.each(Log.Sync)
+}
+
+func (pl *partitionedLog) GC(unusedFor time.Duration) error {
+	for p, l := range pl.logs {
+		if err := l.GC(unusedFor); err != nil {
+			return fmt.Errorf("partition %d: %w", p, err)
+		}
+	}
+	return nil
+}
+
+func (pl *partitionedLog) Close() error {
+	var errs []error
+	for p, l := range pl.logs {
+		if err := l.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("partition %d: %w", p, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// each calls fn for each partition, collecting the returned offsets
+func (pl *partitionedLog) each(fn func(Log) (int64, error)) ([]int64, error) {
+	offsets := make([]int64, len(pl.logs))
+	for p, l := range pl.logs {
+		offset, err := fn(l)
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %w", p, err)
+		}
+		offsets[p] = offset
+	}
+	return offsets, nil
+}
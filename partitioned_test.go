@@ -0,0 +1,65 @@
+package klevdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+func TestPartitioned(t *testing.T) {
+	msgs := message.Gen(100)
+	dir := t.TempDir()
+	opts := Options{KeyIndex: true}
+
+	pl, err := OpenPartitioned(dir, 4, opts)
+	require.NoError(t, err)
+
+	nextOffsets, err := pl.Publish(msgs)
+	require.NoError(t, err)
+
+	var total int64
+	for p := range pl.Partitions() {
+		_, consumed, err := pl.Consume(p, OffsetOldest, int64(len(msgs)))
+		require.NoError(t, err)
+		require.Equal(t, nextOffsets[p], int64(len(consumed)))
+		total += nextOffsets[p]
+
+		// same order within the partition
+		var expected []Message
+		for _, msg := range msgs {
+			if pl.PartitionOf(msg.Key) == p {
+				expected = append(expected, msg)
+			}
+		}
+		for i := range consumed {
+			require.Equal(t, expected[i].Key, consumed[i].Key)
+			require.Equal(t, expected[i].Value, consumed[i].Value)
+		}
+	}
+	require.Equal(t, int64(len(msgs)), total)
+
+	msg, err := pl.GetByKey(msgs[42].Key)
+	require.NoError(t, err)
+	require.Equal(t, msgs[42].Value, msg.Value)
+
+	stats, err := pl.Stat()
+	require.NoError(t, err)
+	require.Equal(t, len(msgs), stats.Messages)
+	require.NoError(t, pl.Close())
+
+	_, err = OpenPartitioned(dir, 3, opts)
+	require.ErrorIs(t, err, ErrPartitionsMismatch)
+
+	pl, err = OpenPartitioned(dir, 4, opts)
+	require.NoError(t, err)
+	defer pl.Close()
+
+	reopened, err := pl.NextOffsets()
+	require.NoError(t, err)
+	require.Equal(t, nextOffsets, reopened)
+
+	_, _, err = pl.Consume(4, OffsetOldest, 1)
+	require.ErrorIs(t, err, errInvalidPartition)
+}
@@ -34,6 +34,17 @@ var (
 	VLast    Version = V2 // always last version
 )
 
+func (v Version) String() string {
+	switch v {
+	case V1:
+		return "V1"
+	case V2:
+		return "V2"
+	default:
+		return fmt.Sprintf("Version(unknown:%d)", v.marker)
+	}
+}
+
 func (v Version) newHeader(opts Params) ([]byte, error) {
 	switch v {
 	case V1:
@@ -222,6 +233,15 @@ func (w *Writer) Size() int64 {
 	return w.pos
 }
 
+// Truncate truncates the index back to a previous size, e.g. to roll back partially written items
+func (w *Writer) Truncate(size int64) error {
+	if err := w.f.Truncate(size); err != nil {
+		return fmt.Errorf("write index truncate: %w", err)
+	}
+	w.pos = size
+	return nil
+}
+
 func (w *Writer) Sync() error {
 	if err := w.f.Sync(); err != nil {
 		return fmt.Errorf("write index sync: %w", err)
@@ -121,3 +121,36 @@ func TestStat(t *testing.T) {
 		require.Equal(t, indexSz, count)
 	})
 }
+
+func TestTruncate(t *testing.T) {
+	var items = make([]Item, 6)
+	for i := range items {
+		items[i] = Item{Offset: int64(i), Position: int64(i), Timestamp: int64(i), KeyHash: uint64(i)}
+	}
+
+	for name, v := range map[string]Version{"V1": V1, "V2": V2} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "index")
+			w, err := OpenWriter(path, 0, v, iopts)
+			require.NoError(t, err)
+
+			for _, it := range items[:3] {
+				require.NoError(t, w.Write(it))
+			}
+			size := w.Size()
+
+			for _, it := range items[3:5] {
+				require.NoError(t, w.Write(it))
+			}
+			require.NoError(t, w.Truncate(size))
+			require.Equal(t, size, w.Size())
+
+			require.NoError(t, w.Write(items[5]))
+			require.NoError(t, w.Close())
+
+			actual, err := Read(path, 0, iopts)
+			require.NoError(t, err)
+			require.Equal(t, []Item{items[0], items[1], items[2], items[5]}, actual)
+		})
+	}
+}
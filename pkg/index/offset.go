@@ -1,7 +1,9 @@
 package index
 
 import (
+	"cmp"
 	"fmt"
+	"slices"
 
 	"github.com/klev-dev/klevdb/pkg/message"
 )
@@ -56,6 +58,24 @@ func Consume(items []Item, offset int64) (int64, int64, error) {
 	return items[beginIndex].Position, endItem.Position, nil
 }
 
+// ConsumeBackward returns the positions of up to maxCount items before offset (exclusive),
+// in descending offset order. OffsetNewest includes all items.
+func ConsumeBackward(items []Item, offset int64, maxCount int64) []int64 {
+	end := len(items)
+	if offset != message.OffsetNewest {
+		end, _ = slices.BinarySearchFunc(items, offset, func(it Item, offset int64) int {
+			return cmp.Compare(it.Offset, offset)
+		})
+	}
+
+	begin := max(end-int(maxCount), 0)
+	positions := make([]int64, 0, end-begin)
+	for i := end - 1; i >= begin; i-- {
+		positions = append(positions, items[i].Position)
+	}
+	return positions
+}
+
 func Get(items []Item, offset int64) (int64, error) {
 	if len(items) == 0 {
 		return 0, ErrOffsetIndexEmpty
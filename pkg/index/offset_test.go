@@ -69,6 +69,38 @@ func TestConsume(t *testing.T) {
 	}
 }
 
+func TestConsumeBackward(t *testing.T) {
+	var tests = []struct {
+		items     []int64
+		offset    int64
+		count     int64
+		positions []int64
+	}{
+		// empty tests
+		{items: nil, offset: 0, count: 2, positions: []int64{}},
+		{items: nil, offset: message.OffsetNewest, count: 2, positions: []int64{}},
+		// continuous tests
+		{items: []int64{1, 2, 3}, offset: message.OffsetOldest, count: 2, positions: []int64{}},
+		{items: []int64{1, 2, 3}, offset: message.OffsetNewest, count: 2, positions: []int64{3, 2}},
+		{items: []int64{1, 2, 3}, offset: message.OffsetNewest, count: 5, positions: []int64{3, 2, 1}},
+		{items: []int64{1, 2, 3}, offset: 1, count: 2, positions: []int64{}},
+		{items: []int64{1, 2, 3}, offset: 3, count: 5, positions: []int64{2, 1}},
+		{items: []int64{1, 2, 3}, offset: 4, count: 1, positions: []int64{3}},
+		{items: []int64{1, 2, 3}, offset: 9, count: 5, positions: []int64{3, 2, 1}},
+		// gaps tests
+		{items: []int64{1, 3, 5}, offset: 4, count: 5, positions: []int64{3, 1}},
+		{items: []int64{1, 3, 5}, offset: 5, count: 1, positions: []int64{3}},
+		{items: []int64{1, 3, 5}, offset: 6, count: 2, positions: []int64{5, 3}},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%v:%d:%d", tc.items, tc.offset, tc.count), func(t *testing.T) {
+			positions := ConsumeBackward(genItems(tc.items...), tc.offset, tc.count)
+			require.Equal(t, tc.positions, positions)
+		})
+	}
+}
+
 func TestGet(t *testing.T) {
 	var tests = []struct {
 		items    []int64
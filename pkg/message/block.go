@@ -0,0 +1,398 @@
+package message
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	errInvalidBlock = fmt.Errorf("%w: invalid block", ErrCorrupted)
+	errDecompress   = fmt.Errorf("%w: decompress block", ErrCorrupted)
+)
+
+// Compression is the codec used to compress blocks of messages
+type Compression byte
+
+const (
+	// CompressionNone stores messages uncompressed
+	CompressionNone Compression = 0
+	// CompressionFlate compresses blocks of messages with DEFLATE (see compress/flate)
+	CompressionFlate Compression = 1
+)
+
+const compressionMask byte = 0b00001111
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionFlate:
+		return "flate"
+	default:
+		return fmt.Sprintf("Compression(unknown:%d)", byte(c))
+	}
+}
+
+func (c Compression) valid() bool {
+	switch c {
+	case CompressionNone, CompressionFlate:
+		return true
+	default:
+		return false
+	}
+}
+
+// A block groups a number of V3 encoded messages, that are compressed together:
+//
+//	crc + count + rawlen + datalen + data + trailer
+//
+// Messages in blocks are addressed by a virtual position, combining the file
+// position of the block (upper bits) and the index of the message in the block (lower bits)
+const (
+	blockShift       = 16
+	maxBlockMessages = 1 << blockShift
+	blockIndexMask   = maxBlockMessages - 1
+	blockTargetSize  = 64 * 1024 // try to keep uncompressed blocks around this size
+
+	blockHeaderSize = 4 + 4 + 4 + 4 // 16: crc + count + rawlen + datalen
+	blockFixedSize  = blockHeaderSize + trailerSize
+
+	maxBlockRawSize  = blockTargetSize + v3FixedSize + maxMessageBodySize
+	maxBlockDataSize = maxBlockRawSize + maxBlockRawSize/64 + blockSealSize // leaves room for incompressible data
+)
+
+func blockPosition(position int64, index int) int64 {
+	return position<<blockShift | int64(index)
+}
+
+func splitBlockPosition(position int64) (int64, int) {
+	return position >> blockShift, int(position & blockIndexMask)
+}
+
+type blockWriter struct {
+	compression Compression
+	offset      int64 // of the segment, which encrypted blocks are bound to
+	raw         []byte
+	count       int
+	position    int64
+
+	out  bytes.Buffer
+	fw   *flate.Writer
+	aead cipher.AEAD
+}
+
+func newBlockWriter(c Compression, aead cipher.AEAD, offset int64) *blockWriter {
+	return &blockWriter{compression: c, aead: aead, offset: offset}
+}
+
+func (b *blockWriter) encode() ([]byte, error) {
+	b.out.Reset()
+	b.out.Write(make([]byte, blockHeaderSize))
+
+	switch b.compression {
+	case CompressionNone:
+		b.out.Write(b.raw)
+	case CompressionFlate:
+		if b.fw == nil {
+			fw, err := flate.NewWriter(&b.out, flate.DefaultCompression)
+			if err != nil {
+				return nil, fmt.Errorf("compress init: %w", err)
+			}
+			b.fw = fw
+		} else {
+			b.fw.Reset(&b.out)
+		}
+		if _, err := b.fw.Write(b.raw); err != nil {
+			return nil, fmt.Errorf("compress: %w", err)
+		}
+		if err := b.fw.Close(); err != nil {
+			return nil, fmt.Errorf("compress: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression: %v", b.compression)
+	}
+	if b.aead != nil {
+		if err := b.seal(); err != nil {
+			return nil, err
+		}
+	}
+	b.out.Write(trailerMagicData)
+
+	data := b.out.Bytes()
+	binary.BigEndian.PutUint32(data[4:], uint32(b.count))
+	binary.BigEndian.PutUint32(data[8:], uint32(len(b.raw)))
+	binary.BigEndian.PutUint32(data[12:], uint32(len(data)-blockFixedSize))
+
+	// CRC covers everything after CRC field
+	crc := crc32.Checksum(data[4:], crc32cTable)
+	binary.BigEndian.PutUint32(data[0:], crc)
+
+	return data, nil
+}
+
+func (b *blockWriter) reset() {
+	b.raw = b.raw[:0]
+	b.count = 0
+}
+
+func (w *Writer) writeBlock(m Message) (int64, error) {
+	b := w.blocks
+	if b.count == 0 {
+		b.position = w.pos
+	}
+
+	raw, err := appendV3(b.raw, m)
+	if err != nil {
+		return 0, err
+	}
+	position := blockPosition(b.position, b.count)
+	b.raw = raw
+	b.count++
+
+	if len(b.raw) >= blockTargetSize || b.count >= maxBlockMessages {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return position, nil
+}
+
+// Flush writes any buffered messages to the file
+func (w *Writer) Flush() error {
+	if w.blocks == nil || w.blocks.count == 0 {
+		return nil
+	}
+
+	data, err := w.blocks.encode()
+	if err != nil {
+		return err
+	}
+	w.blocks.reset()
+
+	if n, err := w.f.Write(data); err != nil {
+		return fmt.Errorf("write log: %w", err)
+	} else {
+		w.pos += int64(n)
+	}
+	return nil
+}
+
+type blockReader struct {
+	compression Compression
+	offset      int64 // of the segment, which encrypted blocks are bound to
+
+	mu       sync.Mutex
+	position int64 // file position of the cached block
+	next     int64 // file position of the block after the cached one
+	raw      []byte
+	starts   []int // start of each message in raw, plus the end
+
+	fr   io.ReadCloser
+	aead cipher.AEAD
+}
+
+func newBlockReader(c Compression, aead cipher.AEAD, offset int64) *blockReader {
+	return &blockReader{compression: c, offset: offset, position: -1, aead: aead}
+}
+
+func (r *Reader) readAt(b []byte, position int64) error {
+	var err error
+	if r.ra != nil {
+		_, err = r.ra.ReadAt(b, position)
+	} else {
+		_, err = r.r.ReadAt(b, position)
+	}
+	return err
+}
+
+func readBlockHeader(h []byte) (count int, rawSize int, dataSize int, err error) {
+	count = int(binary.BigEndian.Uint32(h[4:]))
+	rawSize = int(binary.BigEndian.Uint32(h[8:]))
+	dataSize = int(binary.BigEndian.Uint32(h[12:]))
+	if count <= 0 || count > maxBlockMessages || rawSize > maxBlockRawSize || dataSize > maxBlockDataSize {
+		return 0, 0, 0, errInvalidBlock
+	}
+	return count, rawSize, dataSize, nil
+}
+
+func (b *blockReader) load(r *Reader, position int64) error {
+	var header [blockHeaderSize]byte
+	switch err := r.readAt(header[:], position); {
+	case err == nil:
+		// all good, continue
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errShortHeader
+	default:
+		return fmt.Errorf("read header: %w", err)
+	}
+
+	count, rawSize, dataSize, err := readBlockHeader(header[:])
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, blockFixedSize+dataSize)
+	copy(frame, header[:])
+	switch err := r.readAt(frame[blockHeaderSize:], position+blockHeaderSize); {
+	case err == nil:
+		// all good, continue
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return errShortData
+	default:
+		return fmt.Errorf("read data: %w", err)
+	}
+
+	expectedCRC := binary.BigEndian.Uint32(frame[0:])
+	actualCRC := crc32.Checksum(frame[4:], crc32cTable)
+	if expectedCRC != actualCRC {
+		return errCrcFailed
+	}
+	if !bytes.Equal(frame[blockHeaderSize+dataSize:], trailerMagicData) {
+		return errBadTrailer
+	}
+
+	data := frame[blockHeaderSize : blockHeaderSize+dataSize]
+	if b.aead != nil {
+		if data, err = b.open(data, position, count, rawSize); err != nil {
+			return err
+		}
+	}
+	var raw []byte
+	switch b.compression {
+	case CompressionNone:
+		raw = data
+	case CompressionFlate:
+		if b.fr == nil {
+			b.fr = flate.NewReader(bytes.NewReader(data))
+		} else if err := b.fr.(flate.Resetter).Reset(bytes.NewReader(data), nil); err != nil {
+			return fmt.Errorf("%w: %w", errDecompress, err)
+		}
+		raw = make([]byte, rawSize)
+		if _, err := io.ReadFull(b.fr, raw); err != nil {
+			return fmt.Errorf("%w: %w", errDecompress, err)
+		}
+	default:
+		return fmt.Errorf("unknown compression: %v", b.compression)
+	}
+	if len(raw) != rawSize {
+		return errInvalidBlock
+	}
+
+	starts := make([]int, 0, count+1)
+	for pos := 0; pos < len(raw); {
+		if len(raw)-pos < v3HeaderSize {
+			return errInvalidBlock
+		}
+		size, err := sizeV3(raw[pos:])
+		if err != nil {
+			return err
+		}
+		starts = append(starts, pos)
+		pos += size
+		if pos > len(raw) {
+			return errInvalidBlock
+		}
+	}
+	if len(starts) != count {
+		return errInvalidBlock
+	}
+	starts = append(starts, len(raw))
+
+	b.position = position
+	b.next = position + int64(len(frame))
+	b.raw = raw
+	b.starts = starts
+	return nil
+}
+
+func (r *Reader) readBlock(position int64, msg *Message) (int64, error) {
+	blockPos, index := splitBlockPosition(position)
+
+	b := r.blocks
+	b.mu.Lock()
+	if b.position != blockPos {
+		if err := b.load(r, blockPos); err != nil {
+			b.position = -1
+			b.mu.Unlock()
+			return -1, err
+		}
+	}
+	count := len(b.starts) - 1
+	if index >= count {
+		b.mu.Unlock()
+		return -1, errInvalidBlock
+	}
+	// copy, the cached block is shared between reads
+	data := bytes.Clone(b.raw[b.starts[index]:b.starts[index+1]])
+	next := b.next
+	b.mu.Unlock()
+
+	if err := decodeV3(data, msg); err != nil {
+		return -1, err
+	}
+
+	if index+1 < count {
+		return position + 1, nil
+	}
+	return blockPosition(next, 0), nil
+}
+
+// Stat returns the on-disk size of a log and its logical size, e.g. the size of its messages before compression
+func Stat(path string, offset int64) (int64, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return -1, -1, fmt.Errorf("stat log open: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return -1, -1, fmt.Errorf("stat log: %w", err)
+	}
+	size := stat.Size()
+	if size < HeaderSize {
+		return size, size, nil
+	}
+
+	var h [HeaderSize]byte
+	if _, err := f.ReadAt(h[:], 0); err != nil {
+		return -1, -1, fmt.Errorf("stat log read header: %w", err)
+	}
+	v, err := headerParse(h[:], offset)
+	if err != nil {
+		return -1, -1, fmt.Errorf("stat log parse header: %w", err)
+	}
+	if !v.blocks() {
+		return size, size, nil
+	}
+
+	start := HeaderSize
+	if v.Encrypted() {
+		if _, start, err = readKeyID(f); err != nil {
+			return -1, -1, fmt.Errorf("stat log read key id: %w", err)
+		}
+	}
+
+	logical := start
+	var header [blockHeaderSize]byte
+	for position := start; position+blockFixedSize <= size; {
+		if _, err := f.ReadAt(header[:], position); err != nil {
+			return -1, -1, fmt.Errorf("stat log read block: %w", err)
+		}
+		_, rawSize, dataSize, err := readBlockHeader(header[:])
+		if err != nil {
+			return -1, -1, err
+		}
+		logical += int64(rawSize)
+		position += int64(blockFixedSize + dataSize)
+	}
+	return size, logical, nil
+}
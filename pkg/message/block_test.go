@@ -0,0 +1,141 @@
+package message
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteReadBlocks(t *testing.T) {
+	msgs := Gen(1000)
+	for i := range msgs {
+		msgs[i].Offset = int64(i)
+	}
+	msgs[3].Headers = []Header{{Key: "trace-id", Value: []byte("abc")}}
+
+	v := V3.WithCompression(CompressionFlate)
+	require.Equal(t, "V3+flate", v.String())
+
+	path := filepath.Join(t.TempDir(), "test.log")
+	w, err := OpenWriter(path, 0, v)
+	require.NoError(t, err)
+	require.Equal(t, v, w.Version())
+
+	var positions []int64
+	for _, msg := range msgs[:10] {
+		pos, err := w.Write(msg)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	require.NoError(t, w.Flush())
+	for _, msg := range msgs[10:] {
+		pos, err := w.Write(msg)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	require.NoError(t, w.SyncAndClose())
+
+	// first block starts right after the header
+	require.Equal(t, blockPosition(HeaderSize, 0), positions[0])
+	require.Equal(t, blockPosition(HeaderSize, 9), positions[9])
+	require.Less(t, blockPosition(HeaderSize, 9), positions[10])
+
+	t.Run("Direct", func(t *testing.T) {
+		r, err := OpenReader(path, 0)
+		require.NoError(t, err)
+		defer r.Close()
+		require.Equal(t, v, r.Version())
+
+		for i := len(positions) - 1; i >= 0; i-- {
+			msg, err := r.Get(positions[i])
+			require.NoError(t, err)
+			require.Equal(t, msgs[i], msg)
+		}
+	})
+
+	t.Run("Mem", func(t *testing.T) {
+		r, err := OpenReaderMem(path, 0)
+		require.NoError(t, err)
+		defer r.Close()
+
+		actual, err := r.Consume(positions[5], positions[len(positions)-1], int64(len(msgs)))
+		require.NoError(t, err)
+		require.Equal(t, msgs[5:], actual)
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		size, logical, err := Stat(path, 0)
+		require.NoError(t, err)
+
+		var expected = HeaderSize
+		for _, msg := range msgs {
+			expected += Size(msg, v)
+		}
+		require.Equal(t, expected, logical)
+		require.Less(t, size, logical)
+	})
+}
+
+func TestBlocksCorrupted(t *testing.T) {
+	msgs := Gen(10)
+	v := V3.WithCompression(CompressionFlate)
+
+	path := filepath.Join(t.TempDir(), "test.log")
+	w, err := OpenWriter(path, 0, v)
+	require.NoError(t, err)
+	for _, msg := range msgs {
+		_, err := w.Write(msg)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.SyncAndClose())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-trailerSize-1] ^= 0xFF
+	require.NoError(t, os.WriteFile(path, data, 0600))
+
+	r, err := OpenReader(path, 0)
+	require.NoError(t, err)
+	defer r.Close()
+
+	_, _, err = r.Read(r.InitialPosition())
+	require.ErrorIs(t, err, ErrCorrupted)
+}
+
+func TestBlocksLargeMessage(t *testing.T) {
+	msg := Message{
+		Key:   []byte("key"),
+		Value: []byte(strings.Repeat("large", blockTargetSize)),
+	}
+	v := V3.WithCompression(CompressionFlate)
+
+	path := filepath.Join(t.TempDir(), "test.log")
+	w, err := OpenWriter(path, 0, v)
+	require.NoError(t, err)
+	pos, err := w.Write(msg)
+	require.NoError(t, err)
+	require.NoError(t, w.SyncAndClose())
+
+	r, err := OpenReader(path, 0)
+	require.NoError(t, err)
+	defer r.Close()
+
+	actual, err := r.Get(pos)
+	require.NoError(t, err)
+	require.Equal(t, msg, actual)
+}
+
+func TestBlocksHeaderParse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	_, err := OpenWriter(path, 0, V2.WithCompression(CompressionFlate))
+	require.Error(t, err)
+
+	h, err := V3.newHeader()
+	require.NoError(t, err)
+	h[len(h)-1] = 0b00001111 // unknown compression
+	_, err = headerParse(h, 0)
+	require.ErrorIs(t, err, ErrCorrupted)
+}
@@ -0,0 +1,162 @@
+package message
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrDecrypt is returned when an encrypted block cannot be decrypted, e.g. with a wrong key
+	ErrDecrypt = errors.New("decrypt failed")
+	// ErrNoKeyProvider is returned when opening an encrypted log without a key provider
+	ErrNoKeyProvider = errors.New("encrypted log requires a key provider")
+
+	errShortKeyID = fmt.Errorf("%w: short key id", ErrCorrupted)
+)
+
+// KeyProvider provides the keys used to encrypt and decrypt messages.
+// Keys must be 16, 24 or 32 bytes long, selecting AES-128, AES-192 or AES-256 (in GCM mode).
+type KeyProvider interface {
+	// CurrentKey returns the key (and its id) used to encrypt new segments
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key by its id, as recorded in an existing segment
+	Key(id string) (key []byte, err error)
+}
+
+// Keyring is a static [KeyProvider], rotate keys by adding a new one and changing Current
+type Keyring struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k Keyring) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k Keyring) Key(id string) ([]byte, error) {
+	if key, ok := k.Keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key %q not found", id)
+}
+
+const encryptedBit byte = 0b10000000
+const maxKeyIDSize = 255
+
+// Encrypted blocks store a random nonce in front of the sealed data, which includes the GCM tag
+const (
+	blockNonceSize = 12
+	blockSealSize  = blockNonceSize + 16
+)
+
+// WithEncryption returns a version storing messages in encrypted blocks.
+// Only V3 (and later) versions support encryption.
+func (v Version) WithEncryption() Version {
+	v.flags |= encryptedBit
+	return v
+}
+
+// Encrypted returns true if this version encrypts messages
+func (v Version) Encrypted() bool {
+	return v.flags&encryptedBit != 0
+}
+
+func newCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cipher: %w", err)
+	}
+	return aead, nil
+}
+
+func currentCipher(keys KeyProvider) (string, cipher.AEAD, error) {
+	if keys == nil {
+		return "", nil, ErrNoKeyProvider
+	}
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(id) > maxKeyIDSize {
+		return "", nil, fmt.Errorf("key id too long: %d", len(id))
+	}
+	aead, err := newCipher(key)
+	return id, aead, err
+}
+
+func cipherFor(keys KeyProvider, id string) (cipher.AEAD, error) {
+	if keys == nil {
+		return nil, ErrNoKeyProvider
+	}
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	return newCipher(key)
+}
+
+// appendKeyID appends the key id after the header of encrypted logs
+func appendKeyID(h []byte, id string) []byte {
+	h = append(h, byte(len(id)))
+	return append(h, id...)
+}
+
+// readKeyID reads the key id of encrypted logs, returning it together with the full header size
+func readKeyID(r io.ReaderAt) (string, int64, error) {
+	var sz [1]byte
+	if _, err := r.ReadAt(sz[:], HeaderSize); err != nil {
+		return "", -1, errShortKeyID
+	}
+	id := make([]byte, sz[0])
+	if _, err := r.ReadAt(id, HeaderSize+1); err != nil {
+		return "", -1, errShortKeyID
+	}
+	return string(id), HeaderSize + 1 + int64(len(id)), nil
+}
+
+// blockAAD binds the sealed data to its block, so blocks cannot be moved (within or between segments)
+// or their header changed. Segments are bound by their offset, so rewrites must write them at their final offset.
+func blockAAD(offset int64, position int64, count int, rawSize int) []byte {
+	aad := make([]byte, 0, 24)
+	aad = binary.BigEndian.AppendUint64(aad, uint64(offset))
+	aad = binary.BigEndian.AppendUint64(aad, uint64(position))
+	aad = binary.BigEndian.AppendUint32(aad, uint32(count))
+	return binary.BigEndian.AppendUint32(aad, uint32(rawSize))
+}
+
+// seal encrypts the data following the block header in the output buffer
+func (b *blockWriter) seal() error {
+	nonce := make([]byte, blockNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("encrypt nonce: %w", err)
+	}
+	plain := b.out.Bytes()[blockHeaderSize:]
+	sealed := b.aead.Seal(nonce, nonce, plain, blockAAD(b.offset, b.position, b.count, len(b.raw)))
+
+	b.out.Truncate(blockHeaderSize)
+	b.out.Write(sealed)
+	return nil
+}
+
+// open decrypts the data of a block
+func (b *blockReader) open(data []byte, position int64, count int, rawSize int) ([]byte, error) {
+	if len(data) < blockSealSize {
+		return nil, errInvalidBlock
+	}
+	nonce, sealed := data[:blockNonceSize], data[blockNonceSize:]
+	plain, err := b.aead.Open(nil, nonce, sealed, blockAAD(b.offset, position, count, rawSize))
+	if err != nil {
+		return nil, fmt.Errorf("%w: block at %d", ErrDecrypt, position)
+	}
+	return plain, nil
+}
@@ -0,0 +1,126 @@
+package message
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyring(current string) Keyring {
+	return Keyring{
+		Current: current,
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 16),
+		},
+	}
+}
+
+func TestWriteReadEncrypted(t *testing.T) {
+	msgs := Gen(100)
+	for i := range msgs {
+		msgs[i].Offset = int64(i)
+	}
+	msgs[3].Headers = []Header{{Key: "trace-id", Value: []byte("abc")}}
+
+	for _, v := range []Version{V3.WithEncryption(), V3.WithCompression(CompressionFlate).WithEncryption()} {
+		t.Run(v.String(), func(t *testing.T) {
+			require.True(t, v.Encrypted())
+
+			path := filepath.Join(t.TempDir(), "test.log")
+			w, err := OpenWriterKeys(path, 0, v, testKeyring("k1"))
+			require.NoError(t, err)
+
+			var positions []int64
+			for _, msg := range msgs[:50] {
+				pos, err := w.Write(msg)
+				require.NoError(t, err)
+				positions = append(positions, pos)
+			}
+			require.NoError(t, w.Close())
+
+			// reopen with a rotated key, continues with the key of the log
+			w, err = OpenWriterKeys(path, 0, v, testKeyring("k2"))
+			require.NoError(t, err)
+			for _, msg := range msgs[50:] {
+				pos, err := w.Write(msg)
+				require.NoError(t, err)
+				positions = append(positions, pos)
+			}
+			require.NoError(t, w.SyncAndClose())
+
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			require.False(t, bytes.Contains(data, msgs[0].Value))
+
+			r, err := OpenReaderMemKeys(path, 0, testKeyring("k2"))
+			require.NoError(t, err)
+			defer r.Close()
+			require.Equal(t, v, r.Version())
+			require.Equal(t, positions[0], r.InitialPosition())
+
+			actual, err := r.Consume(r.InitialPosition(), positions[len(positions)-1], int64(len(msgs)))
+			require.NoError(t, err)
+			require.Equal(t, msgs, actual)
+
+			_, logical, err := Stat(path, 0)
+			require.NoError(t, err)
+			expected := r.start
+			for _, msg := range msgs {
+				expected += Size(msg, v)
+			}
+			require.Equal(t, expected, logical)
+		})
+	}
+}
+
+func TestEncryptedKeys(t *testing.T) {
+	v := V3.WithEncryption()
+	path := filepath.Join(t.TempDir(), "test.log")
+
+	_, err := OpenWriter(path, 0, v)
+	require.ErrorIs(t, err, ErrNoKeyProvider)
+	require.NoError(t, os.Remove(path))
+
+	w, err := OpenWriterKeys(path, 0, v, testKeyring("k1"))
+	require.NoError(t, err)
+	pos, err := w.Write(Gen(1)[0])
+	require.NoError(t, err)
+	require.NoError(t, w.SyncAndClose())
+
+	t.Run("Missing", func(t *testing.T) {
+		_, err := OpenReader(path, 0)
+		require.ErrorIs(t, err, ErrNoKeyProvider)
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		_, err := OpenReaderKeys(path, 0, Keyring{Current: "k1"})
+		require.Error(t, err)
+	})
+
+	t.Run("Moved", func(t *testing.T) {
+		// blocks are bound to the offset of their segment, so they can't be moved to another segment
+		r, err := OpenReaderKeys(path, 10, testKeyring("k1"))
+		require.NoError(t, err)
+		defer r.Close()
+
+		_, err = r.Get(pos)
+		require.ErrorIs(t, err, ErrDecrypt)
+	})
+
+	t.Run("Wrong", func(t *testing.T) {
+		keys := testKeyring("k1")
+		keys.Keys["k1"] = bytes.Repeat([]byte{3}, 32)
+
+		r, err := OpenReaderKeys(path, 0, keys)
+		require.NoError(t, err)
+		defer r.Close()
+
+		_, err = r.Get(pos)
+		require.ErrorIs(t, err, ErrDecrypt)
+		require.NotErrorIs(t, err, ErrCorrupted)
+	})
+}
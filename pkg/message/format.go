@@ -2,12 +2,14 @@ package message
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
+	"slices"
 	"time"
 
 	"golang.org/x/exp/mmap"
@@ -25,8 +27,15 @@ var (
 	errMagicNotFound  = fmt.Errorf("%w: magic prefix not found", ErrCorrupted)
 	errUnknownVersion = fmt.Errorf("%w: unknown version", ErrCorrupted)
 	errReservedData   = fmt.Errorf("%w: invalid reserved data", ErrCorrupted)
+	errInvalidHeaders = fmt.Errorf("%w: invalid headers", ErrCorrupted)
 )
 
+// ErrHeadersUnsupported is returned when writing a message with headers in a format that cannot store them
+var ErrHeadersUnsupported = errors.New("message headers not supported by format version")
+
+// ErrMessageTooBig is returned when writing a message larger than the format supports
+var ErrMessageTooBig = errors.New("message too big")
+
 var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 
 var magic = [6]byte{0xFF, 'k', 'l', 'e', 'v', 's'}
@@ -36,36 +45,88 @@ const maxMessageBodySize = 64 * 1024 * 1024 // 64 MiB: guard against corrupt siz
 
 type Version struct {
 	marker byte
+	flags  byte
 }
 
 var (
 	VUnknown         = Version{}
 	V1               = Version{marker: 255}
 	V2               = Version{marker: 1}
-	VLast    Version = V2 // always last version
+	V3               = Version{marker: 2}
+	VLast    Version = V3 // always last version
 )
 
 func (v Version) String() string {
-	switch v {
+	var name string
+	switch v.base() {
 	case V1:
-		return "V1"
+		name = "V1"
 	case V2:
-		return "V2"
+		name = "V2"
+	case V3:
+		name = "V3"
 	default:
 		return fmt.Sprintf("Version(unknown:%d)", v.marker)
 	}
+	if c := v.Compression(); c != CompressionNone {
+		name += "+" + c.String()
+	}
+	if v.Encrypted() {
+		name += "+encrypted"
+	}
+	return name
+}
+
+// WithCompression returns a version storing messages in compressed blocks.
+// Only V3 (and later) versions support compression.
+func (v Version) WithCompression(c Compression) Version {
+	v.flags = (v.flags &^ compressionMask) | (byte(c) & compressionMask)
+	return v
+}
+
+// Compression returns the compression used by this version
+func (v Version) Compression() Compression {
+	return Compression(v.flags & compressionMask)
+}
+
+func (v Version) base() Version {
+	return Version{marker: v.marker}
+}
+
+// Headers returns whether messages in this version can have headers
+func (v Version) Headers() bool {
+	return v.base() != V1 && v.base() != V2
+}
+
+func (v Version) blocks() bool {
+	return v.flags != 0
 }
 
 func (v Version) newHeader() ([]byte, error) {
-	switch v {
+	switch v.base() {
 	case V1:
+		if v.flags != 0 {
+			return nil, fmt.Errorf("unsupported version: %v", v)
+		}
 		return nil, nil
 	case V2:
+		if v.flags != 0 {
+			return nil, fmt.Errorf("unsupported version: %v", v)
+		}
 		h := make([]byte, HeaderSize)
 		copy(h, magic[:])
 		h[len(magic)] = byte(v.marker)
 		h[len(magic)+1] = 0
 		return h, nil
+	case V3:
+		if v.flags&^(compressionMask|encryptedBit) != 0 || !v.Compression().valid() {
+			return nil, fmt.Errorf("unknown compression: %v", v.Compression())
+		}
+		h := make([]byte, HeaderSize)
+		copy(h, magic[:])
+		h[len(magic)] = byte(v.marker)
+		h[len(magic)+1] = v.flags
+		return h, nil
 	default:
 		return nil, fmt.Errorf("unknown version: %v", v)
 	}
@@ -81,21 +142,32 @@ func headerParse(h []byte, offset int64) (Version, error) {
 		return VUnknown, errMagicNotFound
 	case data[0] > byte(VLast.marker):
 		return VUnknown, fmt.Errorf("%w %d", errUnknownVersion, data[0])
-	case data[1] != 0:
-		return VUnknown, errReservedData
 	case data[0] == V2.marker:
+		if data[1] != 0 {
+			return VUnknown, errReservedData
+		}
 		return V2, nil
+	case data[0] == V3.marker:
+		v := Version{marker: V3.marker, flags: data[1]}
+		if (data[1]&^(compressionMask|encryptedBit)) != 0 || !v.Compression().valid() {
+			return VUnknown, errReservedData
+		}
+		return v, nil
 	default:
 		return VUnknown, fmt.Errorf("%w %d", errUnknownVersion, data[0])
 	}
 }
 
+// Size returns the amount of storage a message occupies in this version. For
+// versions with compression this is the size before compressing.
 func Size(m Message, v Version) int64 {
-	switch v {
+	switch v.base() {
 	case V1:
 		return int64(28 + len(m.Key) + len(m.Value))
 	case V2:
 		return int64(fixedSize + len(m.Key) + len(m.Value))
+	case V3:
+		return int64(v3FixedSize + len(m.Key) + len(m.Value) + headersSize(m.Headers))
 	default:
 		return 0
 	}
@@ -105,12 +177,20 @@ type Writer struct {
 	Path    string
 	f       *os.File
 	pos     int64
+	start   int64 // position after the file header
 	buff    []byte
 	version Version
 	writer  func(m Message) (int64, error)
+	blocks  *blockWriter
+}
+
+func OpenWriter(path string, offset int64, newVersion Version) (*Writer, error) {
+	return OpenWriterKeys(path, offset, newVersion, nil)
 }
 
-func OpenWriter(path string, offset int64, newVersion Version) (w *Writer, retErr error) {
+// OpenWriterKeys opens a writer, using keys to encrypt messages when the version is encrypted.
+// New logs are encrypted with the current key, existing logs continue with the key they were started with.
+func OpenWriterKeys(path string, offset int64, newVersion Version, keys KeyProvider) (w *Writer, retErr error) {
 	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 	if err != nil {
 		return nil, fmt.Errorf("write log open: %w", err)
@@ -127,16 +207,27 @@ func OpenWriter(path string, offset int64, newVersion Version) (w *Writer, retEr
 	}
 
 	pos := stat.Size()
+	var start int64
 	var v Version
+	var aead cipher.AEAD
 	if pos == 0 {
 		h, err := newVersion.newHeader()
 		if err != nil {
 			return nil, fmt.Errorf("write log header: %w", err)
 		}
+		if newVersion.Encrypted() {
+			var id string
+			id, aead, err = currentCipher(keys)
+			if err != nil {
+				return nil, fmt.Errorf("write log key: %w", err)
+			}
+			h = appendKeyID(h, id)
+		}
 		if _, err := f.Write(h[:]); err != nil {
 			return nil, fmt.Errorf("write log header: %w", err)
 		}
 		pos = int64(len(h))
+		start = pos
 		v = newVersion
 	} else {
 		fr, err := os.Open(path)
@@ -153,14 +244,33 @@ func OpenWriter(path string, offset int64, newVersion Version) (w *Writer, retEr
 		if err != nil {
 			return nil, fmt.Errorf("write log parse header: %w", err)
 		}
+		if v != V1 {
+			start = HeaderSize
+		}
+		if v.Encrypted() {
+			var id string
+			id, start, err = readKeyID(fr)
+			if err != nil {
+				return nil, fmt.Errorf("write log read key id: %w", err)
+			}
+			aead, err = cipherFor(keys, id)
+			if err != nil {
+				return nil, fmt.Errorf("write log key: %w", err)
+			}
+		}
 	}
 
-	w = &Writer{Path: path, f: f, pos: pos, version: v}
-	switch v {
-	case V1:
+	w = &Writer{Path: path, f: f, pos: pos, start: start, version: v}
+	switch {
+	case v == V1:
 		w.writer = w.writeV1
-	case V2:
+	case v == V2:
 		w.writer = w.writeV2
+	case v == V3:
+		w.writer = w.writeV3
+	case v.base() == V3 && v.blocks():
+		w.blocks = newBlockWriter(v.Compression(), aead, offset)
+		w.writer = w.writeBlock
 	default:
 		return nil, fmt.Errorf("unknown version: %v", v)
 	}
@@ -171,6 +281,26 @@ func (w *Writer) Version() Version {
 	return w.version
 }
 
+// Validate checks if a message can be written by this writer, without writing it
+func (w *Writer) Validate(m Message) error {
+	var messageSize int
+	switch w.version.base() {
+	case V1, V2:
+		if len(m.Headers) > 0 {
+			return fmt.Errorf("%w: %v", ErrHeadersUnsupported, w.version)
+		}
+		messageSize = len(m.Key) + len(m.Value)
+	default:
+		messageSize = len(m.Key) + len(m.Value) + headersSize(m.Headers)
+	}
+	if messageSize > maxMessageBodySize {
+		return fmt.Errorf("%w: %d bytes", ErrMessageTooBig, messageSize)
+	}
+	return nil
+}
+
+// Write writes a message, returning its position. For versions with compression
+// the message might be buffered until Flush (or Sync/Close) is called.
 func (w *Writer) Write(m Message) (int64, error) {
 	return w.writer(m)
 }
@@ -180,9 +310,12 @@ const (
 )
 
 func (w *Writer) writeV1(m Message) (int64, error) {
+	if len(m.Headers) > 0 {
+		return 0, fmt.Errorf("%w: %v", ErrHeadersUnsupported, V1)
+	}
 	var messageSize = len(m.Key) + len(m.Value)
 	if messageSize > maxMessageBodySize {
-		return 0, fmt.Errorf("message too big")
+		return 0, fmt.Errorf("%w: %d bytes", ErrMessageTooBig, messageSize)
 	}
 	var fullSize = v1HeaderSize + messageSize
 
@@ -225,9 +358,12 @@ const (
 )
 
 func (w *Writer) writeV2(m Message) (int64, error) {
+	if len(m.Headers) > 0 {
+		return 0, fmt.Errorf("%w: %v", ErrHeadersUnsupported, V2)
+	}
 	messageSize := len(m.Key) + len(m.Value)
 	if messageSize > maxMessageBodySize {
-		return 0, fmt.Errorf("message too big")
+		return 0, fmt.Errorf("%w: %d bytes", ErrMessageTooBig, messageSize)
 	}
 	fullSize := fixedSize + messageSize
 
@@ -259,11 +395,142 @@ func (w *Writer) writeV2(m Message) (int64, error) {
 	return pos, nil
 }
 
+const (
+	v3HeaderSize = 4 + 8 + 8 + 4 + 4 + 4      // 32: crc + offset + unixmicro + keylen + valuelen + headerslen
+	v3FixedSize  = v3HeaderSize + trailerSize // 40 total overhead
+)
+
+func headersSize(hs []Header) int {
+	var sz int
+	for _, h := range hs {
+		sz += 4 + len(h.Key) + 4 + len(h.Value)
+	}
+	return sz
+}
+
+func appendHeaders(b []byte, hs []Header) []byte {
+	for _, h := range hs {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(h.Key)))
+		b = append(b, h.Key...)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(h.Value)))
+		b = append(b, h.Value...)
+	}
+	return b
+}
+
+func parseHeaders(b []byte) ([]Header, error) {
+	var hs []Header
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errInvalidHeaders
+		}
+		keySize := int(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		if keySize > len(b) {
+			return nil, errInvalidHeaders
+		}
+		key := string(b[:keySize])
+		b = b[keySize:]
+
+		if len(b) < 4 {
+			return nil, errInvalidHeaders
+		}
+		valueSize := int(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		if valueSize > len(b) {
+			return nil, errInvalidHeaders
+		}
+		var value []byte
+		if valueSize > 0 {
+			value = b[:valueSize]
+		}
+		b = b[valueSize:]
+
+		hs = append(hs, Header{Key: key, Value: value})
+	}
+	return hs, nil
+}
+
+// appendV3 encodes a message in V3 format at the end of b
+func appendV3(b []byte, m Message) ([]byte, error) {
+	hsSize := headersSize(m.Headers)
+	messageSize := len(m.Key) + len(m.Value) + hsSize
+	if messageSize > maxMessageBodySize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMessageTooBig, messageSize)
+	}
+
+	start := len(b)
+	b = slices.Grow(b, v3FixedSize+messageSize)
+
+	b = binary.BigEndian.AppendUint32(b, 0) // left for CRC (written last)
+	b = binary.BigEndian.AppendUint64(b, uint64(m.Offset))
+	b = binary.BigEndian.AppendUint64(b, uint64(m.Time.UnixMicro()))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(m.Key)))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(m.Value)))
+	b = binary.BigEndian.AppendUint32(b, uint32(hsSize))
+	b = append(b, m.Key...)
+	b = append(b, m.Value...)
+	b = appendHeaders(b, m.Headers)
+	b = append(b, trailerMagicData...)
+
+	// CRC covers everything after CRC field
+	crc := crc32.Checksum(b[start+4:], crc32cTable)
+	binary.BigEndian.PutUint32(b[start:], crc)
+
+	return b, nil
+}
+
+func (w *Writer) writeV3(m Message) (int64, error) {
+	buff, err := appendV3(w.buff[:0], m)
+	if err != nil {
+		return 0, err
+	}
+	w.buff = buff
+
+	pos := w.pos
+	if n, err := w.f.Write(w.buff); err != nil {
+		return 0, fmt.Errorf("write log: %w", err)
+	} else {
+		w.pos += int64(n)
+	}
+	return pos, nil
+}
+
 func (w *Writer) Size() int64 {
 	return w.pos
 }
 
+// Empty returns true when the log contains no messages
+func (w *Writer) Empty() bool {
+	return w.pos <= w.start && (w.blocks == nil || w.blocks.count == 0)
+}
+
+// Truncate discards any buffered messages and truncates the log back to a previous size,
+// e.g. to roll back partially written messages
+func (w *Writer) Truncate(size int64) error {
+	if w.blocks != nil {
+		w.blocks.reset()
+	}
+	if err := w.f.Truncate(size); err != nil {
+		return fmt.Errorf("write log truncate: %w", err)
+	}
+	w.pos = size
+	return nil
+}
+
 func (w *Writer) Sync() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("write log sync: %w", err)
+	}
+	return nil
+}
+
+// SyncWritten syncs the messages already written to the file, without flushing the buffered ones.
+// Unlike Sync it is safe to call concurrently with writes, or Close (returning [os.ErrClosed]).
+func (w *Writer) SyncWritten() error {
 	if err := w.f.Sync(); err != nil {
 		return fmt.Errorf("write log sync: %w", err)
 	}
@@ -271,10 +538,11 @@ func (w *Writer) Sync() error {
 }
 
 func (w *Writer) Close() error {
+	ferr := w.Flush()
 	if err := w.f.Close(); err != nil {
 		return fmt.Errorf("write log close: %w", err)
 	}
-	return nil
+	return ferr
 }
 
 func (w *Writer) SyncAndClose() error {
@@ -290,9 +558,16 @@ type Reader struct {
 	ra     *mmap.ReaderAt
 	v      Version
 	reader func(position int64, msg *Message) (nextPosition int64, err error)
+	blocks *blockReader
+	start  int64 // position after the file header
 }
 
-func OpenReader(path string, offset int64) (r *Reader, retErr error) {
+func OpenReader(path string, offset int64) (*Reader, error) {
+	return OpenReaderKeys(path, offset, nil)
+}
+
+// OpenReaderKeys opens a reader, using keys to decrypt messages of encrypted logs
+func OpenReaderKeys(path string, offset int64, keys KeyProvider) (r *Reader, retErr error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("read log open: %w", err)
@@ -303,34 +578,19 @@ func OpenReader(path string, offset int64) (r *Reader, retErr error) {
 		}
 	}()
 
-	var h [HeaderSize]byte
-	var v Version
-	if n, err := f.ReadAt(h[:], 0); err != nil {
-		if !errors.Is(err, io.EOF) || n != 0 {
-			return nil, fmt.Errorf("%w: reading header: %w", ErrCorrupted, err)
-		}
-		v = V1 // empty file: V1 has no file header
-	} else {
-		var err error
-		v, err = headerParse(h[:], offset)
-		if err != nil {
-			return nil, fmt.Errorf("parse log header: %w", err)
-		}
-	}
-
-	r = &Reader{Path: path, r: f, v: v}
-	switch v {
-	case V1:
-		r.reader = r.readV1
-	case V2:
-		r.reader = r.readV2
-	default:
-		return nil, fmt.Errorf("read log invalid version: %v", v)
+	r = &Reader{Path: path, r: f}
+	if err := r.init(f, offset, keys); err != nil {
+		return nil, err
 	}
 	return r, nil
 }
 
-func OpenReaderMem(path string, offset int64) (r *Reader, retErr error) {
+func OpenReaderMem(path string, offset int64) (*Reader, error) {
+	return OpenReaderMemKeys(path, offset, nil)
+}
+
+// OpenReaderMemKeys opens a memory mapped reader, using keys to decrypt messages of encrypted logs
+func OpenReaderMemKeys(path string, offset int64, keys KeyProvider) (r *Reader, retErr error) {
 	f, err := mmap.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("read mem log open: %w", err)
@@ -341,31 +601,76 @@ func OpenReaderMem(path string, offset int64) (r *Reader, retErr error) {
 		}
 	}()
 
+	r = &Reader{Path: path, ra: f}
+	if err := r.init(f, offset, keys); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetVersion reads the version of a log file from its header. Unlike opening
+// a reader, it doesn't need the keys of encrypted logs.
+func GetVersion(path string, offset int64) (Version, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return VUnknown, fmt.Errorf("read log open: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	return readVersion(f, offset)
+}
+
+func readVersion(f io.ReaderAt, offset int64) (Version, error) {
 	var h [HeaderSize]byte
-	var v Version
 	if n, err := f.ReadAt(h[:], 0); err != nil {
 		if !errors.Is(err, io.EOF) || n != 0 {
-			return nil, fmt.Errorf("%w: reading header: %w", ErrCorrupted, err)
+			return VUnknown, fmt.Errorf("%w: reading header: %w", ErrCorrupted, err)
 		}
-		v = V1 // empty file: V1 has no file header
-	} else {
-		var err error
-		v, err = headerParse(h[:], offset)
+		return V1, nil // empty file: V1 has no file header
+	}
+
+	v, err := headerParse(h[:], offset)
+	if err != nil {
+		return VUnknown, fmt.Errorf("parse log header: %w", err)
+	}
+	return v, nil
+}
+
+func (r *Reader) init(f io.ReaderAt, offset int64, keys KeyProvider) error {
+	var err error
+	r.v, err = readVersion(f, offset)
+	if err != nil {
+		return err
+	}
+
+	var aead cipher.AEAD
+	r.start = HeaderSize
+	if r.v.Encrypted() {
+		id, start, err := readKeyID(f)
 		if err != nil {
-			return nil, fmt.Errorf("parse log header: %w", err)
+			return fmt.Errorf("parse log key id: %w", err)
 		}
+		aead, err = cipherFor(keys, id)
+		if err != nil {
+			return fmt.Errorf("read log key: %w", err)
+		}
+		r.start = start
 	}
 
-	r = &Reader{Path: path, ra: f, v: v}
-	switch v {
-	case V1:
+	switch v := r.v; {
+	case v == V1:
 		r.reader = r.readV1
-	case V2:
+	case v == V2:
 		r.reader = r.readV2
+	case v == V3:
+		r.reader = r.readV3
+	case v.base() == V3 && v.blocks():
+		r.blocks = newBlockReader(v.Compression(), aead, offset)
+		r.reader = r.readBlock
 	default:
-		return nil, fmt.Errorf("read log invalid version: %v", v)
+		return fmt.Errorf("read log invalid version: %v", v)
 	}
-	return r, nil
+	return nil
 }
 
 func (r *Reader) Version() Version {
@@ -373,10 +678,12 @@ func (r *Reader) Version() Version {
 }
 
 func (r *Reader) InitialPosition() int64 {
-	switch r.v {
-	case V1:
+	switch {
+	case r.v.blocks():
+		return blockPosition(r.start, 0)
+	case r.v == V1:
 		return 0
-	case V2:
+	case r.v == V2, r.v == V3:
 		return int64(HeaderSize)
 	default:
 		panic(fmt.Sprintf("unknown version: %v", r.v))
@@ -557,6 +864,115 @@ func (r *Reader) readV2(position int64, msg *Message) (nextPosition int64, err e
 	return position + int64(int(keySize)+int(valueSize)+trailerSize), nil
 }
 
+// sizeV3 parses the V3 header and returns the size of the whole message
+func sizeV3(headerBytes []byte) (int, error) {
+	keySize := int32(binary.BigEndian.Uint32(headerBytes[20:]))
+	valueSize := int32(binary.BigEndian.Uint32(headerBytes[24:]))
+	hsSize := int32(binary.BigEndian.Uint32(headerBytes[28:]))
+
+	if keySize < 0 || valueSize < 0 || hsSize < 0 {
+		return -1, errInvalidHeader
+	}
+	bodySize := int(keySize) + int(valueSize) + int(hsSize)
+	if bodySize > maxMessageBodySize {
+		return -1, errInvalidHeader
+	}
+	return v3FixedSize + bodySize, nil
+}
+
+// decodeV3 decodes a whole V3 message, as returned by sizeV3. Key, value
+// and headers of the message reference the data slice.
+func decodeV3(data []byte, msg *Message) error {
+	// Verify CRC over everything after the CRC field
+	expectedCRC := binary.BigEndian.Uint32(data[0:])
+	actualCRC := crc32.Checksum(data[4:], crc32cTable)
+	if expectedCRC != actualCRC {
+		return errCrcFailed
+	}
+
+	// Verify trailer
+	trailerOff := len(data) - trailerSize
+	if !bytes.Equal(data[trailerOff:], trailerMagicData) {
+		return errBadTrailer
+	}
+
+	// Parse header, sizes were already validated
+	msg.Offset = int64(binary.BigEndian.Uint64(data[4:]))
+	msg.Time = time.UnixMicro(int64(binary.BigEndian.Uint64(data[12:]))).UTC()
+	keySize := int(binary.BigEndian.Uint32(data[20:]))
+	valueSize := int(binary.BigEndian.Uint32(data[24:]))
+	hsSize := int(binary.BigEndian.Uint32(data[28:]))
+
+	// Assign key/value/headers
+	keyOff := v3HeaderSize
+	valueOff := keyOff + keySize
+	hsOff := valueOff + valueSize
+	if hsOff+hsSize != trailerOff {
+		return errInvalidHeader
+	}
+	if keySize > 0 {
+		msg.Key = data[keyOff:valueOff]
+	}
+	if valueSize > 0 {
+		msg.Value = data[valueOff:hsOff]
+	}
+	if hsSize > 0 {
+		hs, err := parseHeaders(data[hsOff:trailerOff])
+		if err != nil {
+			return err
+		}
+		msg.Headers = hs
+	}
+	return nil
+}
+
+func (r *Reader) readV3(position int64, msg *Message) (nextPosition int64, err error) {
+	// Read header
+	var headerBytes [v3HeaderSize]byte
+	if r.ra != nil {
+		_, err = r.ra.ReadAt(headerBytes[:], position)
+	} else {
+		_, err = r.r.ReadAt(headerBytes[:], position)
+	}
+	switch {
+	case err == nil:
+		// all good, continue
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return -1, errShortHeader
+	default:
+		return -1, fmt.Errorf("read header: %w", err)
+	}
+
+	fullSize, err := sizeV3(headerBytes[:])
+	if err != nil {
+		return -1, err
+	}
+
+	// Read the whole message (header included) in a single allocation
+	data := make([]byte, fullSize)
+	copy(data, headerBytes[:])
+	if r.ra != nil {
+		_, err = r.ra.ReadAt(data[v3HeaderSize:], position+v3HeaderSize)
+	} else {
+		_, err = r.r.ReadAt(data[v3HeaderSize:], position+v3HeaderSize)
+	}
+	switch {
+	case err == nil:
+		// all good, continue
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return -1, errShortData
+	case errors.Is(err, io.EOF):
+		return -1, errShortData
+	default:
+		return -1, fmt.Errorf("read data: %w", err)
+	}
+
+	if err := decodeV3(data, msg); err != nil {
+		return -1, err
+	}
+	return position + int64(fullSize), nil
+}
+
 func (r *Reader) Close() error {
 	if r.ra != nil {
 		if err := r.ra.Close(); err != nil {
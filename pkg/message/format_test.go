@@ -231,3 +231,152 @@ func TestSizeV2(t *testing.T) {
 
 	require.Equal(t, w.pos, HeaderSize+Size(msg, V2))
 }
+
+func TestWriteReadV3(t *testing.T) {
+	msgs := Gen(3)
+	for i := range msgs {
+		msgs[i].Offset = int64(i + 5)
+	}
+	msgs[0].Headers = []Header{
+		{Key: "trace-id", Value: []byte("abc")},
+		{Key: "content-type", Value: []byte("application/json")},
+	}
+	msgs[1].Headers = []Header{{Key: "empty"}}
+
+	path := filepath.Join(t.TempDir(), "test.log")
+	w, err := OpenWriter(path, 0, V3)
+	require.NoError(t, err)
+
+	var positions []int64
+	for _, msg := range msgs {
+		pos, err := w.Write(msg)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	require.Equal(t, HeaderSize, positions[0])
+	require.Equal(t, HeaderSize+Size(msgs[0], V3), positions[1])
+	require.Equal(t, HeaderSize+Size(msgs[0], V3)+Size(msgs[1], V3), positions[2])
+
+	err = w.SyncAndClose()
+	require.NoError(t, err)
+
+	t.Run("Direct", func(t *testing.T) {
+		r, err := OpenReader(path, 0)
+		require.NoError(t, err)
+		require.Equal(t, V3, r.Version())
+		for i, pos := range positions {
+			msg, err := r.Get(pos)
+			require.NoError(t, err)
+			require.Equal(t, msgs[i], msg)
+		}
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("Mem", func(t *testing.T) {
+		r, err := OpenReaderMem(path, 0)
+		require.NoError(t, err)
+		actual, err := r.Consume(r.InitialPosition(), positions[2], 10)
+		require.NoError(t, err)
+		require.Equal(t, msgs, actual)
+		require.NoError(t, r.Close())
+	})
+}
+
+func TestHeadersUnsupported(t *testing.T) {
+	msg := Message{
+		Key:     []byte("abc"),
+		Headers: []Header{{Key: "a", Value: []byte("b")}},
+	}
+
+	for _, v := range []Version{V1, V2} {
+		t.Run(v.String(), func(t *testing.T) {
+			w, err := OpenWriter(filepath.Join(t.TempDir(), "test.log"), 0, v)
+			require.NoError(t, err)
+			defer w.Close()
+
+			_, err = w.Write(msg)
+			require.ErrorIs(t, err, ErrHeadersUnsupported)
+		})
+	}
+}
+
+func TestSizeV3(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	w, err := OpenWriter(path, 0, V3)
+	require.NoError(t, err)
+
+	msg := Message{
+		Key:     []byte("abc"),
+		Value:   []byte("abcde"),
+		Headers: []Header{{Key: "h", Value: []byte("v")}},
+	}
+	pos, err := w.Write(msg)
+	require.NoError(t, err)
+	require.Equal(t, HeaderSize, pos)
+
+	require.Equal(t, w.pos, HeaderSize+Size(msg, V3))
+}
+
+func TestValidate(t *testing.T) {
+	headers := Message{Key: []byte("abc"), Headers: []Header{{Key: "a", Value: []byte("b")}}}
+	big := Message{Value: make([]byte, maxMessageBodySize+1)}
+
+	for _, v := range []Version{V1, V2, V3} {
+		t.Run(v.String(), func(t *testing.T) {
+			w, err := OpenWriter(filepath.Join(t.TempDir(), "test.log"), 0, v)
+			require.NoError(t, err)
+			defer w.Close()
+
+			require.NoError(t, w.Validate(Message{Key: []byte("abc")}))
+			require.ErrorIs(t, w.Validate(big), ErrMessageTooBig)
+			if v == V3 {
+				require.NoError(t, w.Validate(headers))
+			} else {
+				require.ErrorIs(t, w.Validate(headers), ErrHeadersUnsupported)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	msgs := Gen(6)
+
+	for _, v := range []Version{V2, V3, V3.WithCompression(CompressionFlate)} {
+		t.Run(v.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.log")
+			w, err := OpenWriter(path, 0, v)
+			require.NoError(t, err)
+
+			for _, msg := range msgs[:3] {
+				_, err := w.Write(msg)
+				require.NoError(t, err)
+			}
+			require.NoError(t, w.Flush())
+			size := w.Size()
+
+			// partially written batch, some of it still buffered
+			for _, msg := range msgs[3:5] {
+				_, err := w.Write(msg)
+				require.NoError(t, err)
+			}
+			require.NoError(t, w.Flush())
+			_, err = w.Write(msgs[5])
+			require.NoError(t, err)
+
+			require.NoError(t, w.Truncate(size))
+			require.Equal(t, size, w.Size())
+
+			last, err := w.Write(msgs[5])
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			r, err := OpenReader(path, 0)
+			require.NoError(t, err)
+			defer r.Close()
+
+			actual, err := r.Consume(r.InitialPosition(), last, 10)
+			require.NoError(t, err)
+			require.Equal(t, []Message{msgs[0], msgs[1], msgs[2], msgs[5]}, actual)
+		})
+	}
+}
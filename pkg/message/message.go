@@ -22,10 +22,17 @@ var ErrInvalidOffset = errors.New("invalid offset")
 var ErrNotFound = errors.New("not found")
 
 type Message struct {
-	Offset int64
-	Time   time.Time
-	Key    []byte
-	Value  []byte
+	Offset  int64
+	Time    time.Time
+	Key     []byte
+	Value   []byte
+	Headers []Header
+}
+
+// Header is a key/value pair attached to a message, only stored by V3 (and later) formats
+type Header struct {
+	Key   string
+	Value []byte
 }
 
 var Invalid = Message{Offset: OffsetInvalid}
@@ -0,0 +1,430 @@
+package segment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klev-dev/klevdb/pkg/kdir"
+)
+
+// BackupManifest is the name of the file, kept in the backup directory, recording the backed up files
+const BackupManifest = "backup.manifest"
+
+// ErrBackupCorrupted is returned when the files of a backup directory do not match its manifest
+var ErrBackupCorrupted = errors.New("backup corrupted")
+
+// backupTailSize is the size of the window at the end of a file, checked to detect changes without reading the whole file
+const backupTailSize = 4096
+
+// backupTmpSuffix is added to the files being copied, until they are complete
+const backupTmpSuffix = ".tmp"
+
+var backupCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+type backupManifest struct {
+	Files []backupFile `json:"files"`
+}
+
+type backupFile struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// CRC is the checksum of the whole file
+	CRC uint32 `json:"crc"`
+	// TailCRC is the checksum of the last backupTailSize bytes of the file
+	TailCRC uint32 `json:"tail_crc"`
+}
+
+// BackupSegment is a segment to backup, with the sizes of its files to copy.
+// Negative sizes copy the whole files, as they are when their backup starts.
+type BackupSegment struct {
+	Segment
+	LogSize   int64
+	IndexSize int64
+}
+
+// BackupSegments incrementally backups segments to the target directory. The files of unchanged
+// segments are skipped, files which have grown since the last backup (e.g. the head segment) are appended to,
+// and anything else is copied. Segments in the target which are not backed up anymore (e.g. deleted or
+// rewritten under a new offset) are removed. The manifest of the target is updated last, see [VerifyBackupDir].
+func BackupSegments(segments []BackupSegment, target string) error {
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return fmt.Errorf("backup dir create: %w", err)
+	}
+
+	prev, err := readBackupManifest(target)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		prev = backupManifest{}
+	case err != nil:
+		return err
+	}
+	prevFiles := map[string]backupFile{}
+	for _, f := range prev.Files {
+		prevFiles[f.Name] = f
+	}
+
+	var next backupManifest
+	for _, seg := range segments {
+		files, err := seg.backup(target, prevFiles)
+		if err != nil {
+			return fmt.Errorf("backup %d: %w", seg.Offset, err)
+		}
+		next.Files = append(next.Files, files...)
+	}
+
+	if err := removeStaleBackup(target, next); err != nil {
+		return err
+	}
+	if err := writeBackupManifest(target, next); err != nil {
+		return err
+	}
+	if err := kdir.Sync(target); err != nil {
+		return fmt.Errorf("backup dir sync: %w", err)
+	}
+	return nil
+}
+
+func (s BackupSegment) backup(target string, prevFiles map[string]backupFile) ([]backupFile, error) {
+	// the index is sized first, so the log always contains the messages it references
+	indexSize, err := backupSize(s.Index, s.IndexSize)
+	if err != nil {
+		return nil, fmt.Errorf("backup index: %w", err)
+	}
+	logSize, err := backupSize(s.Log, s.LogSize)
+	if err != nil {
+		return nil, fmt.Errorf("backup log: %w", err)
+	}
+
+	logFile, err := backupFileTo(s.Log, target, logSize, prevFiles)
+	if err != nil {
+		return nil, fmt.Errorf("backup log: %w", err)
+	}
+	indexFile, err := backupFileTo(s.Index, target, indexSize, prevFiles)
+	if err != nil {
+		return nil, fmt.Errorf("backup index: %w", err)
+	}
+	return []backupFile{logFile, indexFile}, nil
+}
+
+func backupSize(path string, size int64) (int64, error) {
+	if size >= 0 {
+		return size, nil
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("stat: %w", err)
+	}
+	return stat.Size(), nil
+}
+
+// backupFileTo copies the first size bytes of src to the target dir, unless already there according to
+// the previous manifest. If src has only grown since then, just the new bytes are appended.
+// Changed files are replaced with a new copy, instead of rewriting the previous one.
+func backupFileTo(src, target string, size int64, prevFiles map[string]backupFile) (backupFile, error) {
+	name := filepath.Base(src)
+	dst := filepath.Join(target, name)
+
+	fsrc, err := os.Open(src)
+	if err != nil {
+		return backupFile{}, fmt.Errorf("src open: %w", err)
+	}
+	defer func() { _ = fsrc.Close() }()
+
+	stat, err := fsrc.Stat()
+	if err != nil {
+		return backupFile{}, fmt.Errorf("src stat: %w", err)
+	}
+	if stat.Size() < size {
+		return backupFile{}, fmt.Errorf("src size %d, expected at least %d", stat.Size(), size)
+	}
+
+	tailCRC, err := checksum(fsrc, max(0, size-backupTailSize), size)
+	if err != nil {
+		return backupFile{}, fmt.Errorf("src checksum: %w", err)
+	}
+	file := backupFile{Name: name, Size: size, ModTime: stat.ModTime(), TailCRC: tailCRC}
+
+	prev, ok := prevFiles[name]
+	var dstSize int64 = -1
+	if ok {
+		switch dstStat, err := os.Stat(dst); {
+		case errors.Is(err, os.ErrNotExist):
+			ok = false
+		case err != nil:
+			return backupFile{}, fmt.Errorf("dst stat: %w", err)
+		default:
+			dstSize = dstStat.Size()
+		}
+	}
+
+	switch {
+	case !ok:
+	case prev.Size == size && prev.TailCRC == tailCRC && dstSize == size:
+		if prev.ModTime.Equal(file.ModTime) {
+			return prev, nil
+		}
+		// modified, but maybe not changed
+		crc, err := checksum(fsrc, 0, size)
+		if err != nil {
+			return backupFile{}, fmt.Errorf("src checksum: %w", err)
+		}
+		if crc == prev.CRC {
+			file.CRC = crc
+			return file, nil
+		}
+	case prev.Size < size && dstSize == prev.Size:
+		// only grown if the whole previous content is unchanged, otherwise it is copied again
+		prevCRC, err := checksum(fsrc, 0, prev.Size)
+		if err != nil {
+			return backupFile{}, fmt.Errorf("src checksum: %w", err)
+		}
+		if prevCRC == prev.CRC {
+			file.CRC = prev.CRC
+			return backupAppend(fsrc, dst, prev.Size, file)
+		}
+	}
+
+	return backupCopy(fsrc, dst, file)
+}
+
+// backupAppend appends the bytes of src after from to the end of dst, which already contains the ones before it
+func backupAppend(fsrc *os.File, dst string, from int64, file backupFile) (backupFile, error) {
+	fdst, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return backupFile{}, fmt.Errorf("dst open: %w", err)
+	}
+	defer func() { _ = fdst.Close() }() // ignoring since its only applicable if an error has happened
+
+	return backupWrite(fsrc, fdst, dst, from, file)
+}
+
+// backupCopy copies src to a temporary file, replacing dst with it once complete. Existing files
+// are never changed in place, so an interrupted backup keeps the previous one intact.
+func backupCopy(fsrc *os.File, dst string, file backupFile) (backupFile, error) {
+	tmp := dst + backupTmpSuffix
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return backupFile{}, fmt.Errorf("dst tmp remove: %w", err)
+	}
+	fdst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return backupFile{}, fmt.Errorf("dst tmp open: %w", err)
+	}
+	defer func() { _ = fdst.Close() }() // ignoring since its only applicable if an error has happened
+
+	file.CRC = 0
+	file, err = backupWrite(fsrc, fdst, tmp, 0, file)
+	if err != nil {
+		return backupFile{}, err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return backupFile{}, fmt.Errorf("dst rename: %w", err)
+	}
+	return file, nil
+}
+
+// backupWrite writes the [from, file.Size) section of src to dst, continuing file.CRC, and syncs it
+func backupWrite(fsrc, fdst *os.File, dst string, from int64, file backupFile) (backupFile, error) {
+	crc := &crcWriter{crc: file.CRC}
+	switch n, err := io.Copy(io.MultiWriter(fdst, crc), io.NewSectionReader(fsrc, from, file.Size-from)); {
+	case err != nil:
+		return backupFile{}, fmt.Errorf("copy: %w", err)
+	case n < file.Size-from:
+		return backupFile{}, fmt.Errorf("partial copy (%d/%d)", n, file.Size-from)
+	}
+	file.CRC = crc.crc
+
+	if err := fdst.Sync(); err != nil {
+		return backupFile{}, fmt.Errorf("dst sync: %w", err)
+	}
+	if err := fdst.Close(); err != nil {
+		return backupFile{}, fmt.Errorf("dst close: %w", err)
+	}
+	if err := os.Chtimes(dst, file.ModTime, file.ModTime); err != nil {
+		return backupFile{}, fmt.Errorf("dst chtimes: %w", err)
+	}
+	return file, nil
+}
+
+// removeStaleBackup removes the segment files of the target, which are not part of the manifest
+func removeStaleBackup(target string, manifest backupManifest) error {
+	files := map[string]struct{}{}
+	for _, f := range manifest.Files {
+		files[f.Name] = struct{}{}
+	}
+
+	stale, err := findBackupStale(target, files)
+	if err != nil {
+		return err
+	}
+	for _, name := range stale {
+		if err := os.Remove(filepath.Join(target, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("backup remove stale: %w", err)
+		}
+	}
+
+	// copies left by an interrupted backup
+	tmps, err := filepath.Glob(filepath.Join(target, "*"+backupTmpSuffix))
+	if err != nil {
+		return fmt.Errorf("backup find tmp: %w", err)
+	}
+	for _, tmp := range tmps {
+		if !isSegmentFile(strings.TrimSuffix(filepath.Base(tmp), backupTmpSuffix)) {
+			continue
+		}
+		if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("backup remove tmp: %w", err)
+		}
+	}
+	return nil
+}
+
+func findBackupStale(target string, files map[string]struct{}) ([]string, error) {
+	entries, err := os.ReadDir(target)
+	if err != nil {
+		return nil, fmt.Errorf("backup read dir: %w", err)
+	}
+
+	var stale []string
+	for _, e := range entries {
+		if _, ok := files[e.Name()]; ok || !isSegmentFile(e.Name()) {
+			continue
+		}
+		stale = append(stale, e.Name())
+	}
+	return stale, nil
+}
+
+func isSegmentFile(name string) bool {
+	offsetStr, ok := strings.CutSuffix(name, ".log")
+	if !ok {
+		offsetStr, ok = strings.CutSuffix(name, ".index")
+	}
+	if !ok {
+		return false
+	}
+	_, err := strconv.ParseInt(offsetStr, 10, 64)
+	return err == nil
+}
+
+// VerifyBackupDir checks that the segment files of a backup directory match its manifest,
+// reading them whole. Returns [ErrBackupCorrupted] for missing, extra or changed files.
+func VerifyBackupDir(dir string) error {
+	manifest, err := readBackupManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	files := map[string]struct{}{}
+	for _, f := range manifest.Files {
+		files[f.Name] = struct{}{}
+		if err := verifyBackupFile(dir, f); err != nil {
+			return err
+		}
+	}
+
+	switch stale, err := findBackupStale(dir, files); {
+	case err != nil:
+		return err
+	case len(stale) > 0:
+		return fmt.Errorf("%w: %s not in manifest", ErrBackupCorrupted, stale[0])
+	}
+	return nil
+}
+
+func verifyBackupFile(dir string, file backupFile) error {
+	f, err := os.Open(filepath.Join(dir, file.Name))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("%w: %s missing", ErrBackupCorrupted, file.Name)
+	case err != nil:
+		return fmt.Errorf("verify open: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("verify stat: %w", err)
+	}
+	if stat.Size() != file.Size {
+		return fmt.Errorf("%w: %s size %d, expected %d", ErrBackupCorrupted, file.Name, stat.Size(), file.Size)
+	}
+
+	crc, err := checksum(f, 0, file.Size)
+	if err != nil {
+		return fmt.Errorf("verify checksum: %w", err)
+	}
+	if crc != file.CRC {
+		return fmt.Errorf("%w: %s checksum mismatch", ErrBackupCorrupted, file.Name)
+	}
+	return nil
+}
+
+func readBackupManifest(dir string) (backupManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, BackupManifest))
+	if err != nil {
+		return backupManifest{}, fmt.Errorf("backup manifest read: %w", err)
+	}
+
+	var manifest backupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return backupManifest{}, fmt.Errorf("%w: manifest: %w", ErrBackupCorrupted, err)
+	}
+	return manifest, nil
+}
+
+// writeBackupManifest replaces the manifest atomically, so it always describes a complete backup
+func writeBackupManifest(dir string, manifest backupManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("backup manifest marshal: %w", err)
+	}
+
+	path := filepath.Join(dir, BackupManifest)
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("backup manifest open: %w", err)
+	}
+	defer func() { _ = f.Close() }() // ignoring since its only applicable if an error has happened
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("backup manifest write: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("backup manifest sync: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("backup manifest close: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("backup manifest rename: %w", err)
+	}
+	return nil
+}
+
+// checksum returns the crc of the [from, to) section of a file
+func checksum(f *os.File, from, to int64) (uint32, error) {
+	crc := &crcWriter{}
+	if _, err := io.Copy(crc, io.NewSectionReader(f, from, to-from)); err != nil {
+		return 0, err
+	}
+	return crc.crc, nil
+}
+
+type crcWriter struct {
+	crc uint32
+}
+
+func (w *crcWriter) Write(p []byte) (int, error) {
+	w.crc = crc32.Update(w.crc, backupCRCTable, p)
+	return len(p), nil
+}
@@ -0,0 +1,147 @@
+package segment
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb/pkg/index"
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+func flipByte(t *testing.T, fn string, at int64) {
+	f, err := os.OpenFile(fn, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, at)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, at)
+	require.NoError(t, err)
+}
+
+func TestBackupSegments(t *testing.T) {
+	params := index.Params{Times: true, Keys: true}
+	msgs := message.Gen(4)
+
+	t.Run("Unchanged", func(t *testing.T) {
+		dir := t.TempDir()
+		seg0, seg2 := New(dir, 0, false), New(dir, 2, false)
+		writeMessages(t, seg0, params, msgs[0:2])
+		writeMessages(t, seg2, params, msgs[2:4])
+
+		target := t.TempDir()
+		require.NoError(t, BackupDir(dir, target))
+		require.NoError(t, VerifyBackupDir(target))
+
+		// unchanged files are not copied again, so the corruption stays until verified
+		flipByte(t, filepath.Join(target, filepath.Base(seg0.Log)), message.HeaderSize)
+		require.NoError(t, BackupDir(dir, target))
+		require.ErrorIs(t, VerifyBackupDir(target), ErrBackupCorrupted)
+	})
+
+	t.Run("Append", func(t *testing.T) {
+		dir := t.TempDir()
+		seg := New(dir, 0, false)
+		writeMessages(t, seg, params, msgs[0:2])
+
+		target := t.TempDir()
+		require.NoError(t, BackupDir(dir, target))
+
+		writeMessages(t, seg, params, msgs[2:4])
+		require.NoError(t, BackupDir(dir, target))
+		require.NoError(t, VerifyBackupDir(target))
+		assertMessages(t, New(target, 0, false), params, msgs)
+
+		// only the new messages are appended, the previous ones are not copied again
+		flipByte(t, filepath.Join(target, filepath.Base(seg.Log)), message.HeaderSize)
+		writeMessages(t, seg, params, message.Gen(5)[4:])
+		require.NoError(t, BackupDir(dir, target))
+		require.ErrorIs(t, VerifyBackupDir(target), ErrBackupCorrupted)
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		dir := t.TempDir()
+		seg := New(dir, 0, false)
+		writeMessages(t, seg, params, msgs[0:2])
+
+		logStat, err := os.Stat(seg.Log)
+		require.NoError(t, err)
+		indexStat, err := os.Stat(seg.Index)
+		require.NoError(t, err)
+		writeMessages(t, seg, params, msgs[2:4])
+
+		target := t.TempDir()
+		require.NoError(t, BackupSegments([]BackupSegment{{
+			Segment:   seg,
+			LogSize:   logStat.Size(),
+			IndexSize: indexStat.Size(),
+		}}, target))
+		require.NoError(t, VerifyBackupDir(target))
+		assertMessages(t, New(target, 0, false), params, msgs[0:2])
+	})
+
+	t.Run("Rewritten", func(t *testing.T) {
+		dir := t.TempDir()
+		seg := New(dir, 0, false)
+		writeMessages(t, seg, params, msgs[0:2])
+
+		target := t.TempDir()
+		require.NoError(t, BackupDir(dir, target))
+
+		// a link to the previous backup (e.g. a restore) keeps it, since changed files are replaced
+		linked := New(t.TempDir(), 0, false)
+		require.NoError(t, os.Link(filepath.Join(target, filepath.Base(seg.Log)), linked.Log))
+		require.NoError(t, os.Link(filepath.Join(target, filepath.Base(seg.Index)), linked.Index))
+
+		require.NoError(t, os.Remove(seg.Log))
+		require.NoError(t, os.Remove(seg.Index))
+		writeMessages(t, seg, params, msgs[1:2])
+
+		require.NoError(t, BackupDir(dir, target))
+		require.NoError(t, VerifyBackupDir(target))
+		assertMessages(t, New(target, 0, false), params, msgs[1:2])
+		assertMessages(t, linked, params, msgs[0:2])
+	})
+
+	t.Run("Removed", func(t *testing.T) {
+		dir := t.TempDir()
+		seg0, seg2 := New(dir, 0, false), New(dir, 2, false)
+		writeMessages(t, seg0, params, msgs[0:2])
+		writeMessages(t, seg2, params, msgs[2:4])
+
+		target := t.TempDir()
+		require.NoError(t, BackupDir(dir, target))
+		require.NoError(t, os.WriteFile(filepath.Join(target, "other"), nil, 0600))
+
+		require.NoError(t, Backup([]Segment{seg2}, target))
+		require.NoError(t, VerifyBackupDir(target))
+
+		segments, err := Find(target, false)
+		require.NoError(t, err)
+		require.Equal(t, []Segment{New(target, 2, false)}, segments)
+		require.FileExists(t, filepath.Join(target, "other"))
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		dir := t.TempDir()
+		seg := New(dir, 0, false)
+		writeMessages(t, seg, params, msgs[0:2])
+
+		target := t.TempDir()
+		require.ErrorIs(t, VerifyBackupDir(target), os.ErrNotExist)
+
+		require.NoError(t, BackupDir(dir, target))
+		require.NoError(t, VerifyBackupDir(target))
+
+		writeMessages(t, New(target, 2, false), params, msgs[2:4])
+		require.ErrorIs(t, VerifyBackupDir(target), ErrBackupCorrupted)
+
+		require.NoError(t, os.Remove(filepath.Join(target, filepath.Base(seg.Index))))
+		require.ErrorIs(t, VerifyBackupDir(target), ErrBackupCorrupted)
+	})
+}
@@ -0,0 +1,259 @@
+package segment
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klev-dev/klevdb/pkg/index"
+	"github.com/klev-dev/klevdb/pkg/kdir"
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+// ErrRestoreTarget is returned when restoring to a directory which already contains segments
+var ErrRestoreTarget = errors.New("restore target not empty")
+
+// RestoreLimit limits the messages restored by [RestoreDir]
+type RestoreLimit struct {
+	// UpToOffset restores only the messages before this offset, when positive
+	UpToOffset int64
+	// UpToTime restores only the messages before the first message at or after this time, when not zero
+	UpToTime time.Time
+}
+
+func (l RestoreLimit) limitsOffsets() bool {
+	return l.UpToOffset > 0
+}
+
+func (l RestoreLimit) limitsTimes() bool {
+	return !l.UpToTime.IsZero()
+}
+
+// stops returns true if the item, and all after it, are not restored. Expects items with times if limiting times
+func (l RestoreLimit) stops(item index.Item) bool {
+	return (l.limitsOffsets() && item.Offset >= l.UpToOffset) ||
+		(l.limitsTimes() && item.Timestamp >= l.UpToTime.UnixMicro())
+}
+
+// RestoreDir restores the segments of a backup directory to the target directory, up to the limit.
+// Segments before the limit are copied, so the restored log doesn't share files with the backup. The segment with
+// the limit is rewritten without the messages after it and reindexed. The restored segments are checked last.
+// If restoring fails, the restored segments (and the target directory, if created) are removed, so it can be retried.
+func RestoreDir(dir, target string, params index.Params, keys message.KeyProvider, limit RestoreLimit) (err error) {
+	segments, err := Find(dir, false)
+	if err != nil {
+		return err
+	}
+
+	createdDir := false
+	switch existing, err := Find(target, false); {
+	case errors.Is(err, os.ErrNotExist):
+		createdDir = true
+	case err != nil:
+		return err
+	case len(existing) > 0:
+		return fmt.Errorf("%w: %s", ErrRestoreTarget, target)
+	}
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return fmt.Errorf("restore dir create: %w", err)
+	}
+
+	var restored []Segment
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, restoreCleanup(target, restored, createdDir))
+		}
+	}()
+
+	if limit.limitsOffsets() {
+		// segments starting after the limit have nothing to restore, the first is kept (even if empty) for its offset
+		for len(segments) > 1 && segments[len(segments)-1].Offset >= limit.UpToOffset {
+			segments = segments[:len(segments)-1]
+		}
+	}
+
+	for _, seg := range segments {
+		seg.Keys = keys
+
+		items, err := seg.restoreItems(params, limit)
+		if err != nil {
+			return fmt.Errorf("restore %d: %w", seg.Offset, err)
+		}
+		cut := len(items)
+		for j, item := range items {
+			if limit.stops(item) {
+				cut = j
+				break
+			}
+		}
+
+		tseg := New(target, seg.Offset, false)
+		tseg.Keys = keys
+		restored = append(restored, tseg)
+		if cut < len(items) {
+			if err := seg.restoreRewrite(tseg, params, cut); err != nil {
+				return fmt.Errorf("restore %d: %w", seg.Offset, err)
+			}
+			break
+		}
+		if err := seg.restoreFiles(tseg); err != nil {
+			return fmt.Errorf("restore %d: %w", seg.Offset, err)
+		}
+	}
+
+	if err := kdir.Sync(target); err != nil {
+		return fmt.Errorf("restore dir sync: %w", err)
+	}
+	return CheckDirKeys(target, params, keys)
+}
+
+// restoreItems returns the index items of a backup segment, if needed with times to apply the limit
+func (s Segment) restoreItems(params index.Params, limit RestoreLimit) ([]index.Item, error) {
+	if !limit.limitsTimes() || params.Times {
+		switch items, err := index.Read(s.Index, s.Offset, params); {
+		case err == nil:
+			return items, nil
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, err
+		}
+	}
+
+	// no index or no times in it, scan the log itself (without writing to the backup)
+	log, err := message.OpenReaderKeys(s.Log, s.Offset, s.Keys)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = log.Close() }()
+
+	params.Times = params.Times || limit.limitsTimes()
+	var position = log.InitialPosition()
+	var indexTime int64
+	var items []index.Item
+	for {
+		msg, nextPosition, err := log.Read(position)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		item := params.NewItem(msg, position, indexTime)
+		items = append(items, item)
+
+		position = nextPosition
+		indexTime = item.Timestamp
+	}
+	return items, nil
+}
+
+// restoreCleanup removes the files of a failed restore
+func restoreCleanup(target string, restored []Segment, createdDir bool) error {
+	var errs []error
+	for _, seg := range restored {
+		for _, path := range []string{seg.Log, seg.Index} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, fmt.Errorf("restore cleanup: %w", err))
+			}
+		}
+	}
+	if createdDir {
+		if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("restore cleanup dir: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// restoreFiles copies the log and index (if any) of a segment to the target segment
+func (s Segment) restoreFiles(target Segment) error {
+	if err := restoreCopy(s.Log, target.Log); err != nil {
+		return fmt.Errorf("restore log: %w", err)
+	}
+	switch err := restoreCopy(s.Index, target.Index); {
+	case errors.Is(err, os.ErrNotExist):
+		return nil // rebuilt when the restored log is opened
+	case err != nil:
+		return fmt.Errorf("restore index: %w", err)
+	}
+	return nil
+}
+
+// restoreCopy copies src to dst, which must not exist, so a restore never overwrites existing files
+func restoreCopy(src, dst string) error {
+	fsrc, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("copy src open: %w", err)
+	}
+	defer func() { _ = fsrc.Close() }()
+
+	fdst, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("copy dst open: %w", err)
+	}
+	defer func() { _ = fdst.Close() }() // ignoring since its only applicable if an error has happened
+
+	if _, err := io.Copy(fdst, fsrc); err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+	if err := fdst.Sync(); err != nil {
+		return fmt.Errorf("copy dst sync: %w", err)
+	}
+	if err := fdst.Close(); err != nil {
+		return fmt.Errorf("copy dst close: %w", err)
+	}
+	return nil
+}
+
+// restoreRewrite restores only the first count messages of a segment to the target segment, with a new index
+func (s Segment) restoreRewrite(target Segment, params index.Params, count int) error {
+	log, err := message.OpenReaderKeys(s.Log, s.Offset, s.Keys)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = log.Close() }()
+
+	restore, err := message.OpenWriterKeys(target.Log, target.Offset, log.Version(), s.Keys)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = restore.Close() }() // ignoring since its only applicable if an error has happened
+
+	var position = log.InitialPosition()
+	var indexTime int64
+	var restoreIndex []index.Item
+	for range count {
+		msg, nextPosition, err := log.Read(position)
+		if err != nil {
+			return err
+		}
+
+		restorePosition, err := restore.Write(msg)
+		if err != nil {
+			return err
+		}
+
+		item := params.NewItem(msg, restorePosition, indexTime)
+		restoreIndex = append(restoreIndex, item)
+		indexTime = item.Timestamp
+
+		position = nextPosition
+	}
+
+	if err := restore.SyncAndClose(); err != nil {
+		return err
+	}
+
+	indexVersion, err := index.GetVersion(s.Index, s.Offset, params)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		indexVersion = index.VLast
+	case err != nil:
+		return err
+	}
+	if err := index.Write(target.Index, target.Offset, indexVersion, params, restoreIndex); err != nil {
+		return fmt.Errorf("restore index write: %w", err)
+	}
+	return nil
+}
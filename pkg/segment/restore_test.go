@@ -0,0 +1,153 @@
+package segment
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb/pkg/index"
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+func requireSameFile(t *testing.T, expected bool, a, b string) {
+	astat, err := os.Stat(a)
+	require.NoError(t, err)
+	bstat, err := os.Stat(b)
+	require.NoError(t, err)
+	require.Equal(t, expected, os.SameFile(astat, bstat))
+}
+
+func TestRestoreDir(t *testing.T) {
+	params := index.Params{Times: true, Keys: true}
+	msgs := message.Gen(6)
+	for i := range msgs {
+		msgs[i].Offset = int64(i)
+	}
+
+	backup := func(t *testing.T, params index.Params) (Segment, Segment, Segment) {
+		dir := t.TempDir()
+		seg0, seg2, seg4 := New(dir, 0, false), New(dir, 2, false), New(dir, 4, false)
+		writeMessages(t, seg0, params, msgs[0:2])
+		writeMessages(t, seg2, params, msgs[2:4])
+		writeMessages(t, seg4, params, msgs[4:6])
+		return seg0, seg2, seg4
+	}
+
+	t.Run("All", func(t *testing.T) {
+		seg0, seg2, seg4 := backup(t, params)
+
+		target := t.TempDir()
+		require.NoError(t, RestoreDir(seg0.Dir, target, params, nil, RestoreLimit{}))
+
+		assertMessages(t, New(target, 0, false), params, msgs[0:2])
+		assertMessages(t, New(target, 2, false), params, msgs[2:4])
+		assertMessages(t, New(target, 4, false), params, msgs[4:6])
+
+		// copied, so changes to the backup don't change the restored log
+		requireSameFile(t, false, seg0.Log, New(target, 0, false).Log)
+		requireSameFile(t, false, seg2.Index, New(target, 2, false).Index)
+		requireSameFile(t, false, seg4.Log, New(target, 4, false).Log)
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		seg0, _, seg4 := backup(t, params)
+		flipByte(t, seg4.Log, message.HeaderSize+4)
+
+		// the partly restored target is removed, so restoring can be retried
+		target := filepath.Join(t.TempDir(), "restore")
+		require.Error(t, RestoreDir(seg0.Dir, target, params, nil, RestoreLimit{}))
+		require.NoDirExists(t, target)
+
+		err := RestoreDir(seg0.Dir, target, params, nil, RestoreLimit{})
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ErrRestoreTarget)
+
+		// an existing target is kept, with only the restored segments removed
+		target = t.TempDir()
+		require.Error(t, RestoreDir(seg0.Dir, target, params, nil, RestoreLimit{UpToOffset: 5}))
+		require.DirExists(t, target)
+		segments, err := Find(target, false)
+		require.NoError(t, err)
+		require.Empty(t, segments)
+	})
+
+	t.Run("UpToOffset", func(t *testing.T) {
+		seg0, seg2, _ := backup(t, params)
+
+		target := t.TempDir()
+		require.NoError(t, RestoreDir(seg0.Dir, target, params, nil, RestoreLimit{UpToOffset: 3}))
+
+		segments, err := Find(target, false)
+		require.NoError(t, err)
+		require.Equal(t, []Segment{New(target, 0, false), New(target, 2, false)}, segments)
+
+		assertMessages(t, New(target, 0, false), params, msgs[0:2])
+		assertMessages(t, New(target, 2, false), params, msgs[2:3])
+		requireSameFile(t, false, seg2.Log, New(target, 2, false).Log)
+	})
+
+	t.Run("UpToOffsetSegment", func(t *testing.T) {
+		seg0, _, _ := backup(t, params)
+
+		target := t.TempDir()
+		require.NoError(t, RestoreDir(seg0.Dir, target, params, nil, RestoreLimit{UpToOffset: 4}))
+
+		segments, err := Find(target, false)
+		require.NoError(t, err)
+		require.Equal(t, []Segment{New(target, 0, false), New(target, 2, false)}, segments)
+
+		assertMessages(t, New(target, 2, false), params, msgs[2:4])
+		requireSameFile(t, false, New(seg0.Dir, 2, false).Log, New(target, 2, false).Log)
+	})
+
+	t.Run("UpToOffsetEmpty", func(t *testing.T) {
+		dir := t.TempDir()
+		seg := New(dir, 2, false)
+		writeMessages(t, seg, params, msgs[2:4])
+
+		target := t.TempDir()
+		require.NoError(t, RestoreDir(dir, target, params, nil, RestoreLimit{UpToOffset: 1}))
+
+		segments, err := Find(target, false)
+		require.NoError(t, err)
+		require.Equal(t, []Segment{New(target, 2, false)}, segments)
+		assertMessages(t, New(target, 2, false), params, nil)
+	})
+
+	t.Run("UpToTime", func(t *testing.T) {
+		seg0, _, _ := backup(t, params)
+
+		target := t.TempDir()
+		require.NoError(t, RestoreDir(seg0.Dir, target, params, nil, RestoreLimit{UpToTime: msgs[1].Time}))
+
+		segments, err := Find(target, false)
+		require.NoError(t, err)
+		require.Equal(t, []Segment{New(target, 0, false)}, segments)
+		assertMessages(t, New(target, 0, false), params, msgs[0:1])
+	})
+
+	t.Run("UpToTimeNoIndex", func(t *testing.T) {
+		params := index.Params{Keys: true}
+		seg0, _, _ := backup(t, params)
+
+		target := t.TempDir()
+		require.NoError(t, RestoreDir(seg0.Dir, target, params, nil, RestoreLimit{UpToTime: msgs[3].Time}))
+
+		segments, err := Find(target, false)
+		require.NoError(t, err)
+		require.Equal(t, []Segment{New(target, 0, false), New(target, 2, false)}, segments)
+
+		items, err := index.Read(New(target, 2, false).Index, 2, params)
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		require.Equal(t, int64(2), items[0].Offset)
+	})
+
+	t.Run("NotEmpty", func(t *testing.T) {
+		seg0, _, _ := backup(t, params)
+
+		require.ErrorIs(t, RestoreDir(seg0.Dir, seg0.Dir, params, nil, RestoreLimit{}), ErrRestoreTarget)
+	})
+}
@@ -21,6 +21,9 @@ type Segment struct {
 	Index string
 
 	AutoSync bool
+
+	// Keys used to encrypt and decrypt the messages of encrypted segments
+	Keys message.KeyProvider
 }
 
 func (s Segment) GetOffset() int64 {
@@ -40,17 +43,23 @@ func New(dir string, offset int64, autoSync bool) Segment {
 }
 
 func (s Segment) NewAt(offset int64) Segment {
-	return New(s.Dir, offset, s.AutoSync)
+	seg := New(s.Dir, offset, s.AutoSync)
+	seg.Keys = s.Keys
+	return seg
 }
 
 type Stats struct {
 	Segments int
 	Messages int
-	Size     int64
+	// Size is the on-disk size of the segments, including indexes
+	Size int64
+	// LogicalSize is the size of the segments before compression, including indexes.
+	// Equal to Size when segments are not compressed.
+	LogicalSize int64
 }
 
 func (s Segment) Stat(params index.Params) (Stats, error) {
-	dataStat, err := os.Stat(s.Log)
+	dataSize, dataLogicalSize, err := message.Stat(s.Log, s.Offset)
 	if err != nil {
 		return Stats{}, fmt.Errorf("stat log: %w", err)
 	}
@@ -61,14 +70,15 @@ func (s Segment) Stat(params index.Params) (Stats, error) {
 	}
 
 	return Stats{
-		Segments: 1,
-		Messages: indexMessages,
-		Size:     dataStat.Size() + indexSize,
+		Segments:    1,
+		Messages:    indexMessages,
+		Size:        dataSize + indexSize,
+		LogicalSize: dataLogicalSize + indexSize,
 	}, nil
 }
 
 func (s Segment) Check(params index.Params) error {
-	log, err := message.OpenReader(s.Log, s.Offset)
+	log, err := message.OpenReaderKeys(s.Log, s.Offset, s.Keys)
 	if err != nil {
 		return err
 	}
@@ -105,13 +115,13 @@ func (s Segment) Check(params index.Params) error {
 }
 
 func (s Segment) Recover(params index.Params) error {
-	log, err := message.OpenReader(s.Log, s.Offset)
+	log, err := message.OpenReaderKeys(s.Log, s.Offset, s.Keys)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = log.Close() }()
 
-	restore, err := message.OpenWriter(s.Log+".recover", s.Offset, log.Version())
+	restore, err := message.OpenWriterKeys(s.Log+".recover", s.Offset, log.Version(), s.Keys)
 	if err != nil {
 		return err
 	}
@@ -120,6 +130,8 @@ func (s Segment) Recover(params index.Params) error {
 	var position = log.InitialPosition()
 	var indexTime int64
 	var corrupted = false
+	var logIndex []index.Item
+	// positions in the restored log might differ from the original (e.g. when compressed blocks are regrouped)
 	var restoreIndex []index.Item
 	for {
 		msg, nextPosition, err := log.Read(position)
@@ -132,12 +144,14 @@ func (s Segment) Recover(params index.Params) error {
 			return err
 		}
 
-		if _, err := restore.Write(msg); err != nil {
+		restorePosition, err := restore.Write(msg)
+		if err != nil {
 			return err
 		}
 
 		item := params.NewItem(msg, position, indexTime)
-		restoreIndex = append(restoreIndex, item)
+		logIndex = append(logIndex, item)
+		restoreIndex = append(restoreIndex, params.NewItem(msg, restorePosition, indexTime))
 		indexTime = item.Timestamp
 
 		position = nextPosition
@@ -158,6 +172,7 @@ func (s Segment) Recover(params index.Params) error {
 		if err := os.Remove(restore.Path); err != nil {
 			return fmt.Errorf("restore log delete: %w", err)
 		}
+		restoreIndex = logIndex
 	}
 
 	var corruptedIndex = false
@@ -218,7 +233,7 @@ func (s Segment) ReindexAndReadIndex(params index.Params, version index.Version)
 }
 
 func (s Segment) Reindex(params index.Params, version index.Version) ([]index.Item, error) {
-	log, err := message.OpenReader(s.Log, s.Offset)
+	log, err := message.OpenReaderKeys(s.Log, s.Offset, s.Keys)
 	if err != nil {
 		return nil, err
 	}
@@ -252,34 +267,14 @@ func (s Segment) ReindexReader(params index.Params, log *message.Reader, version
 	return newIndex, nil
 }
 
+// Backup incrementally backups the files of this segment to the target directory, see [Backup].
+// The target is a backup of only this segment, use [Backup] to backup multiple segments to the same target.
 func (s Segment) Backup(targetDir string) error {
-	logName, err := filepath.Rel(s.Dir, s.Log)
-	if err != nil {
-		return fmt.Errorf("backup log rel: %w", err)
-	}
-	targetLog := filepath.Join(targetDir, logName)
-	if err := copyFile(s.Log, targetLog); err != nil {
-		return fmt.Errorf("backup log copy: %w", err)
-	}
-
-	indexName, err := filepath.Rel(s.Dir, s.Index)
-	if err != nil {
-		return fmt.Errorf("backup index rel: %w", err)
-	}
-	targetIndex := filepath.Join(targetDir, indexName)
-	if err := copyFile(s.Index, targetIndex); err != nil {
-		return fmt.Errorf("backup index copy: %w", err)
-	}
-
-	if err := s.syncDir(); err != nil {
-		return fmt.Errorf("backup sync dir: %w", err)
-	}
-
-	return nil
+	return Backup([]Segment{s}, targetDir)
 }
 
 func (s Segment) Migrate(mversion message.Version, iversion index.Version, params index.Params) error {
-	oldLog, err := message.OpenReader(s.Log, s.Offset)
+	oldLog, err := message.OpenReaderKeys(s.Log, s.Offset, s.Keys)
 	if err != nil {
 		return fmt.Errorf("migrate open reader: %w", err)
 	}
@@ -301,7 +296,7 @@ func (s Segment) Migrate(mversion message.Version, iversion index.Version, param
 	if err := os.Remove(migratedPath); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("migrate remove stale temp: %w", err)
 	}
-	migratedLog, err := message.OpenWriter(migratedPath, s.Offset, mversion)
+	migratedLog, err := message.OpenWriterKeys(migratedPath, s.Offset, mversion, s.Keys)
 	if err != nil {
 		return fmt.Errorf("migrate open writer: %w", err)
 	}
@@ -443,7 +438,7 @@ func (src Segment) Rewrite(dropOffsets map[int64]struct{}, params index.Params,
 		return nil, err
 	}
 
-	srcLog, err := message.OpenReader(src.Log, src.Offset)
+	srcLog, err := message.OpenReaderKeys(src.Log, src.Offset, src.Keys)
 	if err != nil {
 		return nil, err
 	}
@@ -451,11 +446,13 @@ func (src Segment) Rewrite(dropOffsets map[int64]struct{}, params index.Params,
 
 	srcVersion := srcLog.Version()
 
-	dstLog, err := message.OpenWriter(dst.Log, dst.Offset, mversion)
-	if err != nil {
-		return nil, err
-	}
-	defer func() { _ = dstLog.Close() }() // ignoring since its only applicable if an error has happened
+	// opened at the first surviving message, the offset of the rewritten segment, since encrypted blocks are bound to it
+	var dstLog *message.Writer
+	defer func() {
+		if dstLog != nil {
+			_ = dstLog.Close() // ignoring since its only applicable if an error has happened
+		}
+	}()
 
 	var srcPosition = srcLog.InitialPosition()
 	var indexTime int64
@@ -473,6 +470,11 @@ func (src Segment) Rewrite(dropOffsets map[int64]struct{}, params index.Params,
 			dst.DeletedMessages = append(dst.DeletedMessages, msg)
 			dst.DeletedSize += message.Size(msg, srcVersion) + params.Size()
 		} else {
+			if dstLog == nil {
+				if dstLog, err = message.OpenWriterKeys(dst.Log, msg.Offset, mversion, dst.Keys); err != nil {
+					return nil, err
+				}
+			}
 			dstPosition, err := dstLog.Write(msg)
 			if err != nil {
 				return nil, err
@@ -490,6 +492,11 @@ func (src Segment) Rewrite(dropOffsets map[int64]struct{}, params index.Params,
 	if err := srcLog.Close(); err != nil {
 		return nil, err
 	}
+	if dstLog == nil {
+		if dstLog, err = message.OpenWriterKeys(dst.Log, dst.Offset, mversion, dst.Keys); err != nil {
+			return nil, err
+		}
+	}
 	if err := dstLog.SyncAndClose(); err != nil {
 		return nil, err
 	}
@@ -327,6 +327,22 @@ func TestMigrate(t *testing.T) {
 
 		assertMessages(t, seg, params, msgs)
 	})
+
+	t.Run("V3", func(t *testing.T) {
+		dir := t.TempDir()
+		seg := New(dir, 0, false)
+		writeMessages(t, seg, params, msgs)
+
+		err := seg.Migrate(message.V3, index.V2, params)
+		require.NoError(t, err)
+
+		r, err := message.OpenReader(seg.Log, seg.Offset)
+		require.NoError(t, err)
+		require.Equal(t, message.V3, r.Version())
+		require.NoError(t, r.Close())
+
+		assertMessages(t, seg, params, msgs)
+	})
 }
 
 func writeMessages(t *testing.T, seg Segment, params index.Params, msgs []message.Message) {
@@ -376,3 +392,36 @@ func assertMessages(t *testing.T, seg Segment, params index.Params, expMsgs []me
 		require.Equal(t, expMsg.Value, actMsg.Value)
 	}
 }
+
+func TestRecoverBlocks(t *testing.T) {
+	params := index.Params{Times: true, Keys: true}
+	msgs := message.Gen(6)
+	for i := range msgs {
+		msgs[i].Offset = int64(i)
+	}
+	version := message.V3.WithCompression(message.CompressionFlate)
+
+	seg := New(t.TempDir(), 0, false)
+	lw, err := message.OpenWriter(seg.Log, seg.Offset, version)
+	require.NoError(t, err)
+	for i, msg := range msgs {
+		_, err := lw.Write(msg)
+		require.NoError(t, err)
+		if i%2 == 1 {
+			require.NoError(t, lw.Flush())
+		}
+	}
+	require.NoError(t, lw.SyncAndClose())
+
+	_, err = seg.Reindex(params, index.V2)
+	require.NoError(t, err)
+	require.NoError(t, seg.Check(params))
+
+	// corrupt the trailer of the last block
+	require.NoError(t, clearLastByte(seg.Log))
+	require.ErrorIs(t, seg.Check(params), message.ErrCorrupted)
+
+	require.NoError(t, seg.Recover(params))
+	require.NoError(t, seg.Check(params))
+	assertMessages(t, seg, params, msgs[:4])
+}
@@ -8,7 +8,6 @@ import (
 	"strings"
 
 	"github.com/klev-dev/klevdb/pkg/index"
-	"github.com/klev-dev/klevdb/pkg/kdir"
 	"github.com/klev-dev/klevdb/pkg/message"
 )
 
@@ -56,11 +55,17 @@ func Stat(segments []Segment, params index.Params) (Stats, error) {
 		total.Segments += segStat.Segments
 		total.Messages += segStat.Messages
 		total.Size += segStat.Size
+		total.LogicalSize += segStat.LogicalSize
 	}
 	return total, nil
 }
 
 func CheckDir(dir string, params index.Params) error {
+	return CheckDirKeys(dir, params, nil)
+}
+
+// CheckDirKeys checks the last segment, using keys to decrypt messages of encrypted logs
+func CheckDirKeys(dir string, params index.Params, keys message.KeyProvider) error {
 	switch segments, err := Find(dir, false); { // no need to autoSync for check
 	case errors.Is(err, os.ErrNotExist):
 		return nil
@@ -70,6 +75,7 @@ func CheckDir(dir string, params index.Params) error {
 		return nil
 	default:
 		seg := segments[len(segments)-1]
+		seg.Keys = keys
 		if err := seg.Check(params); err != nil {
 			return fmt.Errorf("check %d: %w", seg.Offset, err)
 		}
@@ -78,6 +84,11 @@ func CheckDir(dir string, params index.Params) error {
 }
 
 func RecoverDir(dir string, params index.Params) error {
+	return RecoverDirKeys(dir, params, nil)
+}
+
+// RecoverDirKeys recovers the last segment, using keys to decrypt messages of encrypted logs
+func RecoverDirKeys(dir string, params index.Params, keys message.KeyProvider) error {
 	switch segments, err := Find(dir, true); {
 	case errors.Is(err, os.ErrNotExist):
 		return nil
@@ -87,6 +98,7 @@ func RecoverDir(dir string, params index.Params) error {
 		return nil
 	default:
 		seg := segments[len(segments)-1]
+		seg.Keys = keys
 		if err := seg.Recover(params); err != nil {
 			return fmt.Errorf("recover %d: %w", seg.Offset, err)
 		}
@@ -95,6 +107,11 @@ func RecoverDir(dir string, params index.Params) error {
 }
 
 func MigrateDir(dir string, mversion message.Version, iversion index.Version, params index.Params) error {
+	return MigrateDirKeys(dir, mversion, iversion, params, nil)
+}
+
+// MigrateDirKeys migrates all segments, using keys to decrypt (and encrypt) messages of encrypted logs
+func MigrateDirKeys(dir string, mversion message.Version, iversion index.Version, params index.Params, keys message.KeyProvider) error {
 	switch segments, err := Find(dir, true); {
 	case errors.Is(err, os.ErrNotExist):
 		return nil
@@ -104,6 +121,7 @@ func MigrateDir(dir string, mversion message.Version, iversion index.Version, pa
 		return nil
 	default:
 		for _, seg := range segments {
+			seg.Keys = keys
 			if err := seg.Migrate(mversion, iversion, params); err != nil {
 				return err
 			}
@@ -119,24 +137,15 @@ func BackupDir(dir, target string) error {
 	case err != nil:
 		return err
 	default:
-		if err := os.MkdirAll(target, 0700); err != nil {
-			return fmt.Errorf("backup dir create: %w", err)
-		}
-
 		return Backup(segments, target)
 	}
 }
 
+// Backup incrementally backups the whole files of segments to the target directory, see [BackupSegments]
 func Backup(segments []Segment, target string) error {
-	for _, seg := range segments {
-		if err := seg.Backup(target); err != nil {
-			return fmt.Errorf("backup %d: %w", seg.Offset, err)
-		}
+	bsegments := make([]BackupSegment, len(segments))
+	for i, seg := range segments {
+		bsegments[i] = BackupSegment{Segment: seg, LogSize: -1, IndexSize: -1}
 	}
-
-	if err := kdir.Sync(target); err != nil {
-		return fmt.Errorf("backup dir sync: %w", err)
-	}
-
-	return nil
+	return BackupSegments(bsegments, target)
 }
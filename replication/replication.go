@@ -0,0 +1,389 @@
+// Package replication keeps a follower [klevdb.Log] in sync with a leader, e.g. to have a warm standby on another machine.
+//
+// The leader opens its log with [LeaderEvents] as [klevdb.Options.Events], wraps the log with [NewLeader],
+// and serves each follower connection with [Leader.Serve].
+// A follower calls [Follow] with its own log, which appends the messages of the leader keeping their
+// offsets and times (see [klevdb.Log.PublishAt]). On restart the follower resumes from its NextOffset.
+//
+// Deletes are mirrored in two ways:
+//   - deletes of the leader log are sent to the connected followers as they happen, however they
+//     are done (e.g. [klevdb.DeleteMulti], the trim functions or [klevdb.Options.Retention]).
+//     The leader learns about them from the [klevdb.MessagesDeleted] events of its log.
+//   - when a follower connects, the leader sends the offsets it no longer has in the range replicated
+//     by the follower, catching up with deletes while it was disconnected. This reads all the messages
+//     of the leader in that range.
+//
+// Both sides work over any [io.ReadWriter] (e.g. a [net.Conn]), with messages encoded by [encoding/gob].
+// If the transport is also an [io.Closer], it is closed when the context is done.
+// The follower log should not be published to by anything else, while following.
+package replication
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/klev-dev/klevdb"
+)
+
+// ErrDiverged error is returned when the follower has messages the leader never had,
+// e.g. it was following another leader or the leader was restored from a backup
+var ErrDiverged = errors.New("follower diverged from leader")
+
+type Options struct {
+	// MaxCount is the maximum number of messages sent in a single batch. Defaults to 1024.
+	MaxCount int64
+	// Events are the events the leader log was opened with, see [LeaderEvents].
+	// Without them only deletes through [Leader.Delete] are sent to the connected followers.
+	Events *LeaderEvents
+}
+
+// hello is the first thing a follower sends, describing what it has
+type hello struct {
+	// OldestOffset is the offset of the oldest message of the follower, or NextOffset if it has none
+	OldestOffset int64
+	NextOffset   int64
+}
+
+// gap is a range of offsets [From, To) the leader no longer has
+type gap struct {
+	From int64
+	To   int64
+}
+
+// frame is what the leader sends to followers
+type frame struct {
+	Messages []klevdb.Message
+	Deleted  []int64
+	Gaps     []gap
+	Err      string
+}
+
+// Leader is a [klevdb.BlockingLog] serving followers
+type Leader struct {
+	klevdb.BlockingLog
+	opts   Options
+	events *LeaderEvents
+}
+
+// LeaderEvents receives the events of the leader log, sending its deletes to the connected followers.
+// Set it as [klevdb.Options.Events] when opening the leader log, and pass it to [NewLeader] with [Options.Events].
+type LeaderEvents struct {
+	next klevdb.Events
+
+	mu        sync.Mutex
+	followers map[*followerConn]struct{}
+}
+
+// NewLeaderEvents returns the events of a leader log, passing all events on to next (if not nil)
+func NewLeaderEvents(next klevdb.Events) *LeaderEvents {
+	return &LeaderEvents{next: next, followers: map[*followerConn]struct{}{}}
+}
+
+func (e *LeaderEvents) Event(ev klevdb.Event) {
+	if deleted, ok := ev.(klevdb.MessagesDeleted); ok {
+		e.deleted(deleted.Offsets)
+	}
+	if e.next != nil {
+		e.next.Event(ev)
+	}
+}
+
+// deleted adds the offsets to the deletes of the connected followers. It only queues them,
+// since events are delivered while the log is locked
+func (e *LeaderEvents) deleted(offsets []int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for f := range e.followers {
+		f.add(offsets)
+	}
+}
+
+func (e *LeaderEvents) register(f *followerConn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.followers[f] = struct{}{}
+}
+
+func (e *LeaderEvents) unregister(f *followerConn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.followers, f)
+}
+
+// followerConn are the deletes not yet sent to a follower
+type followerConn struct {
+	mu      sync.Mutex
+	deleted []int64
+	notify  chan struct{}
+}
+
+func (f *followerConn) add(offsets []int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.deleted = append(f.deleted, offsets...)
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the deletes before offset, e.g. of messages already sent to the follower.
+// The rest are kept, since the messages might be in a batch which is not yet sent
+func (f *followerConn) take(offset int64) []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var taken []int64
+	f.deleted = slices.DeleteFunc(f.deleted, func(deleted int64) bool {
+		if deleted < offset {
+			taken = append(taken, deleted)
+			return true
+		}
+		return false
+	})
+	return taken
+}
+
+// NewLeader wraps a log, so it can serve followers. The log should be opened with opts.Events,
+// otherwise only deletes through [Leader.Delete] are sent to the connected followers.
+func NewLeader(l klevdb.BlockingLog, opts Options) *Leader {
+	if opts.MaxCount <= 0 {
+		opts.MaxCount = 1024
+	}
+	events := opts.Events
+	if events == nil {
+		events = NewLeaderEvents(nil)
+	}
+	return &Leader{BlockingLog: l, opts: opts, events: events}
+}
+
+// Delete deletes messages from the log (see [klevdb.Log.Delete]). When the log was not opened
+// with [Options.Events], it also sends the deleted offsets to the connected followers.
+func (ld *Leader) Delete(offsets map[int64]struct{}) ([]klevdb.Message, int64, error) {
+	deleted, size, err := ld.BlockingLog.Delete(offsets)
+	if err != nil || len(deleted) == 0 || ld.opts.Events != nil {
+		return deleted, size, err
+	}
+
+	deletedOffsets := make([]int64, len(deleted))
+	for i, msg := range deleted {
+		deletedOffsets[i] = msg.Offset
+	}
+	ld.events.deleted(deletedOffsets)
+	return deleted, size, nil
+}
+
+// Serve streams messages and deletes to a follower, until ctx is done or the transport fails
+func (ld *Leader) Serve(ctx context.Context, rw io.ReadWriter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if closer, ok := rw.(io.Closer); ok {
+		stop := context.AfterFunc(ctx, func() { closer.Close() })
+		defer stop()
+	}
+
+	var h hello
+	if err := gob.NewDecoder(rw).Decode(&h); err != nil {
+		return transportErr(ctx, fmt.Errorf("read hello: %w", err))
+	}
+
+	// register before looking for gaps, so deletes are not missed in between
+	f := &followerConn{notify: make(chan struct{}, 1)}
+	ld.events.register(f)
+	defer ld.events.unregister(f)
+
+	enc := gob.NewEncoder(rw)
+	send := func(fr frame) error {
+		if err := enc.Encode(fr); err != nil {
+			return transportErr(ctx, fmt.Errorf("send: %w", err))
+		}
+		return nil
+	}
+
+	nextOffset, err := ld.NextOffset()
+	if err != nil {
+		return err
+	}
+	if h.NextOffset > nextOffset {
+		diverged := fmt.Sprintf("follower next offset %d, leader %d", h.NextOffset, nextOffset)
+		return errors.Join(fmt.Errorf("%w: %s", ErrDiverged, diverged), send(frame{Err: diverged}))
+	}
+
+	gaps, err := ld.gaps(h)
+	if err != nil {
+		return err
+	}
+	if len(gaps) > 0 {
+		if err := send(frame{Gaps: gaps}); err != nil {
+			return err
+		}
+	}
+
+	type batch struct {
+		nextOffset int64
+		messages   []klevdb.Message
+		err        error
+	}
+	batches := make(chan batch)
+	go func() {
+		offset := h.NextOffset
+		for {
+			next, msgs, err := ld.ConsumeBlocking(ctx, offset, ld.opts.MaxCount)
+			select {
+			case batches <- batch{next, msgs, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+			offset = next
+		}
+	}()
+
+	sentOffset := h.NextOffset
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case b := <-batches:
+			if b.err != nil {
+				return transportErr(ctx, b.err)
+			}
+			if len(b.messages) > 0 {
+				if err := send(frame{Messages: b.messages}); err != nil {
+					return err
+				}
+			}
+			sentOffset = b.nextOffset
+		case <-f.notify:
+		}
+
+		if deleted := f.take(sentOffset); len(deleted) > 0 {
+			if err := send(frame{Deleted: deleted}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// gaps returns the ranges of offsets the follower has replicated, but the leader no longer has
+func (ld *Leader) gaps(h hello) ([]gap, error) {
+	var gaps []gap
+	expected, offset := h.OldestOffset, h.OldestOffset
+	for offset < h.NextOffset {
+		next, msgs, err := ld.Consume(offset, ld.opts.MaxCount)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if msg.Offset >= h.NextOffset {
+				break
+			}
+			if msg.Offset > expected {
+				gaps = append(gaps, gap{expected, msg.Offset})
+			}
+			expected = msg.Offset + 1
+		}
+		if next == offset {
+			break // caught up with the leader
+		}
+		offset = next
+	}
+	if expected < h.NextOffset {
+		gaps = append(gaps, gap{expected, h.NextOffset})
+	}
+	return gaps, nil
+}
+
+// Follow appends the messages of the leader to l, and mirrors its deletes.
+// It resumes from the NextOffset of l and runs until ctx is done, or the transport fails.
+// Callers would usually reconnect and call it again.
+func Follow(ctx context.Context, l klevdb.Log, rw io.ReadWriter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if closer, ok := rw.(io.Closer); ok {
+		stop := context.AfterFunc(ctx, func() { closer.Close() })
+		defer stop()
+	}
+
+	nextOffset, err := l.NextOffset()
+	if err != nil {
+		return err
+	}
+	h := hello{OldestOffset: nextOffset, NextOffset: nextOffset}
+	if _, msgs, err := l.Consume(klevdb.OffsetOldest, 1); err != nil {
+		return err
+	} else if len(msgs) > 0 {
+		h.OldestOffset = msgs[0].Offset
+	}
+
+	if err := gob.NewEncoder(rw).Encode(h); err != nil {
+		return transportErr(ctx, fmt.Errorf("send hello: %w", err))
+	}
+
+	dec := gob.NewDecoder(rw)
+	for {
+		var fr frame
+		if err := dec.Decode(&fr); err != nil {
+			return transportErr(ctx, fmt.Errorf("read: %w", err))
+		}
+
+		switch {
+		case fr.Err != "":
+			return fmt.Errorf("%w: %s", ErrDiverged, fr.Err)
+		case len(fr.Messages) > 0:
+			if _, err := l.PublishAt(fr.Messages); err != nil {
+				return fmt.Errorf("publish at %d: %w", fr.Messages[0].Offset, err)
+			}
+		case len(fr.Deleted) > 0:
+			offsets := make(map[int64]struct{}, len(fr.Deleted))
+			for _, offset := range fr.Deleted {
+				offsets[offset] = struct{}{}
+			}
+			if _, _, err := klevdb.DeleteMultiOffsets(ctx, l, offsets, klevdb.DeleteMultiWithWait(0)); err != nil {
+				return fmt.Errorf("delete: %w", err)
+			}
+		case len(fr.Gaps) > 0:
+			for _, g := range fr.Gaps {
+				if err := deleteRange(ctx, l, g); err != nil {
+					return fmt.Errorf("delete [%d, %d): %w", g.From, g.To, err)
+				}
+			}
+		}
+	}
+}
+
+// transportErr returns the error of the context, if the transport failed because it was closed
+func transportErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// deleteRange deletes the messages with offsets in the gap
+func deleteRange(ctx context.Context, l klevdb.Log, g gap) error {
+	offsets := map[int64]struct{}{}
+	for msg, err := range l.All(ctx, g.From) {
+		if err != nil {
+			return err
+		}
+		if msg.Offset >= g.To {
+			break
+		}
+		offsets[msg.Offset] = struct{}{}
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+	_, _, err := klevdb.DeleteMultiOffsets(ctx, l, offsets, klevdb.DeleteMultiWithWait(0))
+	return err
+}
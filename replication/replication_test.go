@@ -0,0 +1,163 @@
+package replication
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb"
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+func openLog(t *testing.T, dir string) klevdb.BlockingLog {
+	return openLogEvents(t, dir, nil)
+}
+
+func openLogEvents(t *testing.T, dir string, events klevdb.Events) klevdb.BlockingLog {
+	l, err := klevdb.OpenBlocking(dir, klevdb.Options{CreateDirs: true, KeyIndex: true, Rollover: 256, Events: events})
+	require.NoError(t, err)
+	return l
+}
+
+func allMessages(t *testing.T, l klevdb.Log) []klevdb.Message {
+	var msgs []klevdb.Message
+	for msg, err := range l.All(t.Context(), klevdb.OffsetOldest) {
+		require.NoError(t, err)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// follow runs a follower connected to the leader in the background, returning a func to stop it
+func follow(t *testing.T, leader *Leader, follower klevdb.Log) func() {
+	ctx, cancel := context.WithCancel(t.Context())
+	leaderConn, followerConn := net.Pipe()
+
+	serveErr, followErr := make(chan error, 1), make(chan error, 1)
+	go func() { serveErr <- leader.Serve(ctx, leaderConn) }()
+	go func() { followErr <- Follow(ctx, follower, followerConn) }()
+
+	return func() {
+		cancel()
+		require.ErrorIs(t, <-serveErr, context.Canceled)
+		require.ErrorIs(t, <-followErr, context.Canceled)
+	}
+}
+
+func requireReplicated(t *testing.T, leader, follower klevdb.Log) {
+	t.Helper()
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		require.Equal(c, allMessages(t, leader), allMessages(t, follower))
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestReplication(t *testing.T) {
+	leader := NewLeader(openLog(t, t.TempDir()), Options{MaxCount: 3})
+	defer leader.Close()
+	followerDir := t.TempDir()
+	follower := openLog(t, followerDir)
+
+	msgs := message.Gen(20)
+	_, err := leader.Publish(msgs[:10])
+	require.NoError(t, err)
+
+	stop := follow(t, leader, follower)
+
+	t.Run("Publish", func(t *testing.T) {
+		requireReplicated(t, leader, follower)
+
+		_, err := leader.Publish(msgs[10:12])
+		require.NoError(t, err)
+		requireReplicated(t, leader, follower)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		_, _, err := klevdb.DeleteMulti(t.Context(), leader, map[int64]struct{}{1: {}, 5: {}, 11: {}}, klevdb.DeleteMultiWithWait(0))
+		require.NoError(t, err)
+		requireReplicated(t, leader, follower)
+
+		_, err = follower.Get(5)
+		require.ErrorIs(t, err, klevdb.ErrNotFound)
+	})
+
+	stop()
+
+	t.Run("Resume", func(t *testing.T) {
+		// deletes while the follower is disconnected (e.g. not through the leader) are caught up on connect
+		_, _, err := klevdb.DeleteMulti(t.Context(), leader.BlockingLog, map[int64]struct{}{3: {}, 10: {}}, klevdb.DeleteMultiWithWait(0))
+		require.NoError(t, err)
+		_, _, err = klevdb.TrimByOffset(t.Context(), leader, 2)
+		require.NoError(t, err)
+		_, err = leader.Publish(msgs[12:15])
+		require.NoError(t, err)
+
+		require.NoError(t, follower.Close())
+		follower = openLog(t, followerDir)
+		defer follower.Close()
+
+		stop := follow(t, leader, follower)
+		defer stop()
+		requireReplicated(t, leader, follower)
+
+		_, err = leader.Publish(msgs[15:])
+		require.NoError(t, err)
+		requireReplicated(t, leader, follower)
+	})
+}
+
+func TestReplicationEvents(t *testing.T) {
+	var sealed atomic.Int64
+	events := NewLeaderEvents(klevdb.EventsFunc(func(ev klevdb.Event) {
+		if _, ok := ev.(klevdb.SegmentSealed); ok {
+			sealed.Add(1)
+		}
+	}))
+	leader := NewLeader(openLogEvents(t, t.TempDir(), events), Options{MaxCount: 3, Events: events})
+	defer leader.Close()
+	follower := openLog(t, t.TempDir())
+	defer follower.Close()
+
+	for _, msg := range message.Gen(20) {
+		_, err := leader.Publish([]klevdb.Message{msg})
+		require.NoError(t, err)
+	}
+	require.Positive(t, sealed.Load())
+
+	stop := follow(t, leader, follower)
+	defer stop()
+	requireReplicated(t, leader, follower)
+
+	// deletes not going through the leader are still sent to the follower
+	_, _, err := klevdb.DeleteMultiOffsets(t.Context(), leader.BlockingLog, map[int64]struct{}{1: {}, 5: {}, 11: {}}, klevdb.DeleteMultiWithWait(0))
+	require.NoError(t, err)
+	requireReplicated(t, leader, follower)
+
+	_, _, err = klevdb.TrimByOffset(t.Context(), leader.BlockingLog, 4)
+	require.NoError(t, err)
+	requireReplicated(t, leader, follower)
+
+	_, err = follower.Get(5)
+	require.ErrorIs(t, err, klevdb.ErrNotFound)
+}
+
+func TestReplicationDiverged(t *testing.T) {
+	leader := NewLeader(openLog(t, t.TempDir()), Options{})
+	defer leader.Close()
+	follower := openLog(t, t.TempDir())
+	defer follower.Close()
+
+	_, err := follower.Publish(message.Gen(2))
+	require.NoError(t, err)
+
+	leaderConn, followerConn := net.Pipe()
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- leader.Serve(t.Context(), leaderConn) }()
+
+	require.ErrorIs(t, Follow(t.Context(), follower, followerConn), ErrDiverged)
+	require.ErrorIs(t, <-serveErr, ErrDiverged)
+}
@@ -0,0 +1,163 @@
+package klevdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RetentionOptions configures the policies the log applies in the background, see [Options.Retention].
+// Zero values disable a policy, and the log doesn't run in the background if all policies are disabled.
+type RetentionOptions struct {
+	// MaxAge removes messages at the start of the log older than this, see [FindByAge]
+	MaxAge time.Duration
+	// MaxSize removes messages at the start of the log, until its logical (uncompressed) size is less than this, see [FindBySize]
+	MaxSize int64
+	// MaxCount removes messages at the start of the log, keeping at most this number of messages, see [FindByCount]
+	MaxCount int
+	// CompactAge compacts messages older than this, removing updates (see [FindUpdates]) and then deletes (see [FindDeletes])
+	CompactAge time.Duration
+	// Interval is how often the policies are applied, starting when the log is opened. Defaults to 1 minute.
+	Interval time.Duration
+	// Backoff is called between deleting from each segment, see [DeleteMulti]. Defaults to waiting 100ms.
+	Backoff DeleteMultiBackoff
+}
+
+func (o RetentionOptions) enabled() bool {
+	return o.MaxAge > 0 || o.MaxSize > 0 || o.MaxCount > 0 || o.CompactAge > 0
+}
+
+// RetentionStats are the stats of the last run of the retention policies, see [Options.Retention]
+type RetentionStats struct {
+	// LastRun is when the last run started, zero if the policies were not applied yet
+	LastRun time.Time
+	// Duration is how long the last run took
+	Duration time.Duration
+	// DeletedMessages is the number of messages deleted by the last run
+	DeletedMessages int
+	// DeletedSize is the amount of storage freed by the last run
+	DeletedSize int64
+	// Err is the error of the last run, which stops at the first failing policy
+	Err error
+}
+
+// retention runs the retention policies of a log in the background
+type retention struct {
+	opts   RetentionOptions
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	stats   RetentionStats
+	statsMu sync.Mutex
+}
+
+// startRetention starts applying the retention policies in the background, until stopRetention
+func (l *log) startRetention() {
+	opts := l.opts.Retention
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	if opts.Backoff == nil {
+		opts.Backoff = DeleteMultiWithWait(100 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l.retention = &retention{opts: opts, cancel: cancel, done: make(chan struct{})}
+	go l.retention.background(ctx, l)
+}
+
+// stopRetention stops the background retention and waits for it to return, before the log is closed
+func (l *log) stopRetention() {
+	if l.retention == nil {
+		return
+	}
+	l.retention.cancel()
+	<-l.retention.done
+}
+
+func (l *log) RetentionStats() RetentionStats {
+	if l.retention == nil {
+		return RetentionStats{}
+	}
+
+	l.retention.statsMu.Lock()
+	defer l.retention.statsMu.Unlock()
+	return l.retention.stats
+}
+
+func (r *retention) background(ctx context.Context, l Log) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		stats := r.run(ctx, l)
+		if ctx.Err() != nil {
+			return // stopped while running, the log is closing
+		}
+
+		r.statsMu.Lock()
+		r.stats = stats
+		r.statsMu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run applies each enabled policy in turn, deleting what it finds before the next one looks at the log
+func (r *retention) run(ctx context.Context, l Log) RetentionStats {
+	start := time.Now()
+	stats := RetentionStats{LastRun: start}
+
+	type policy struct {
+		name string
+		find func() (map[int64]struct{}, error)
+	}
+	var policies []policy
+	if r.opts.MaxAge > 0 {
+		policies = append(policies, policy{"age", func() (map[int64]struct{}, error) {
+			return FindByAge(ctx, l, start.Add(-r.opts.MaxAge))
+		}})
+	}
+	if r.opts.MaxCount > 0 {
+		policies = append(policies, policy{"count", func() (map[int64]struct{}, error) {
+			return FindByCount(ctx, l, r.opts.MaxCount)
+		}})
+	}
+	if r.opts.MaxSize > 0 {
+		policies = append(policies, policy{"size", func() (map[int64]struct{}, error) {
+			return FindBySize(ctx, l, r.opts.MaxSize)
+		}})
+	}
+	if r.opts.CompactAge > 0 {
+		policies = append(policies, policy{"compact updates", func() (map[int64]struct{}, error) {
+			return FindUpdates(ctx, l, start.Add(-r.opts.CompactAge))
+		}}, policy{"compact deletes", func() (map[int64]struct{}, error) {
+			return FindDeletes(ctx, l, start.Add(-r.opts.CompactAge))
+		}})
+	}
+
+	for _, p := range policies {
+		offsets, err := p.find()
+		if err == nil {
+			var deleted map[int64]struct{}
+			var size int64
+			deleted, size, err = DeleteMultiOffsets(ctx, l, offsets, r.opts.Backoff)
+			stats.DeletedMessages += len(deleted)
+			stats.DeletedSize += size
+		}
+		if err != nil {
+			stats.Err = fmt.Errorf("retention %s: %w", p.name, err)
+			break
+		}
+	}
+
+	stats.Duration = time.Since(start)
+	return stats
+}
@@ -0,0 +1,158 @@
+package klevdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+func TestRetention(t *testing.T) {
+	t.Run("MaxAge", testRetentionMaxAge)
+	t.Run("MaxCount", testRetentionMaxCount)
+	t.Run("Compact", testRetentionCompact)
+	t.Run("Close", testRetentionClose)
+	t.Run("Readonly", testRetentionReadonly)
+}
+
+func retentionNoBackoff(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func requireOldest(t *testing.T, l Log, offset int64) {
+	require.Eventually(t, func() bool {
+		msg, err := l.Get(OffsetOldest)
+		return err == nil && msg.Offset == offset
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func testRetentionMaxAge(t *testing.T) {
+	msgs := message.Gen(10)
+	for i := range msgs[5:] {
+		msgs[5+i].Time = time.Now()
+	}
+
+	l, err := Open(t.TempDir(), Options{
+		TimeIndex: true,
+		Rollover:  2 * message.Size(msgs[0], message.V2),
+		Retention: RetentionOptions{MaxAge: time.Hour, Interval: 10 * time.Millisecond, Backoff: retentionNoBackoff},
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	publishBatched(t, l, msgs, 1)
+	requireOldest(t, l, 5)
+
+	stats, err := l.Stat()
+	require.NoError(t, err)
+	require.Equal(t, 5, stats.Messages)
+
+	retention := l.RetentionStats()
+	require.False(t, retention.LastRun.IsZero())
+	require.NoError(t, retention.Err)
+}
+
+func testRetentionMaxCount(t *testing.T) {
+	msgs := message.Gen(10)
+
+	l, err := Open(t.TempDir(), Options{
+		Rollover:  2 * message.Size(msgs[0], message.V2),
+		Retention: RetentionOptions{MaxCount: 4, Interval: 10 * time.Millisecond, Backoff: retentionNoBackoff},
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	publishBatched(t, l, msgs, 1)
+	requireOldest(t, l, 6)
+
+	nextOffset, err := l.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, int64(10), nextOffset)
+}
+
+func testRetentionCompact(t *testing.T) {
+	msgs := message.Gen(4)
+	msgs[1].Key = msgs[0].Key // updates 0
+	msgs[2].Value = nil       // deletes its key
+	msgs[3].Key = msgs[0].Key // updates 1, but too new to compact it
+	msgs[3].Time = time.Now()
+
+	l, err := Open(t.TempDir(), Options{
+		KeyIndex:  true,
+		Retention: RetentionOptions{CompactAge: time.Hour, Interval: 10 * time.Millisecond, Backoff: retentionNoBackoff},
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = l.Publish(msgs)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		stats, err := l.Stat()
+		return err == nil && stats.Messages == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = l.Get(0)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = l.Get(2)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	msg, err := l.GetByKey(msgs[0].Key)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), msg.Offset)
+}
+
+func testRetentionClose(t *testing.T) {
+	msgs := message.Gen(6)
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{Rollover: 2 * message.Size(msgs[0], message.V2)})
+	require.NoError(t, err)
+	publishBatched(t, l, msgs, 1)
+	require.NoError(t, l.Close())
+
+	backoffs := make(chan error, 1)
+	l, err = Open(dir, Options{
+		Retention: RetentionOptions{MaxCount: 1, Backoff: func(ctx context.Context) error {
+			<-ctx.Done() // blocks after deleting from the first segment, until closed
+			backoffs <- ctx.Err()
+			return ctx.Err()
+		}},
+	})
+	require.NoError(t, err)
+
+	requireOldest(t, l, 2)
+	require.NoError(t, l.Close())
+	require.ErrorIs(t, <-backoffs, context.Canceled)
+
+	l, err = Open(dir, Options{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	stats, err := l.Stat()
+	require.NoError(t, err)
+	require.Equal(t, 4, stats.Messages)
+	require.Equal(t, RetentionStats{}, l.RetentionStats())
+}
+
+func testRetentionReadonly(t *testing.T) {
+	msgs := message.Gen(4)
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{})
+	require.NoError(t, err)
+	publishBatched(t, l, msgs, 1)
+	require.NoError(t, l.Close())
+
+	l, err = Open(dir, Options{Readonly: true, Retention: RetentionOptions{MaxCount: 1}})
+	require.NoError(t, err)
+	defer l.Close()
+	require.Nil(t, l.(*log).retention)
+
+	stats, err := l.Stat()
+	require.NoError(t, err)
+	require.Equal(t, 4, stats.Messages)
+}
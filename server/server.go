@@ -0,0 +1,411 @@
+// Package server exposes a [klevdb.BlockingLog] over HTTP, so it can be used by services not written in Go.
+//
+// All requests and responses are JSON, message keys and values are base64 encoded (as by encoding/json).
+// The endpoints are:
+//
+//	POST /publish                  publish {"messages": [...]}, returns {"next_offset": ...}
+//	GET  /consume                  consume from ?offset=, with optional ?max_count=, ?key= and ?poll= (long-poll duration)
+//	GET  /events                   stream messages from ?offset= (or Last-Event-ID), with optional ?key=, as Server-Sent Events
+//	GET  /messages/{offset}        get the message at an offset
+//	GET  /messages/by-key/{key}    get the last message with a key
+//	GET  /messages/by-time/{time}  get the first message at or after a time (RFC3339)
+//	POST /delete                   delete {"offsets": [...]}, returns {"deleted": [...], "deleted_size": ...}
+//	GET  /stat                     returns the stats of the log
+//	POST /sync                     syncs the log to disk, returns {"next_offset": ...}
+//
+// Errors are returned as {"error": "..."}, with a status code matching the error (e.g. 404 for [klevdb.ErrNotFound]).
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/klev-dev/klevdb"
+)
+
+type Options struct {
+	// MaxCount is the maximum number of messages returned by a single consume. Defaults to 1024.
+	MaxCount int64
+	// MaxPoll is the maximum duration a consume waits for new messages. Defaults to 30 seconds.
+	MaxPoll time.Duration
+	// MaxBodySize is the maximum size of publish and delete requests. Defaults to 64MB.
+	MaxBodySize int64
+}
+
+// Message is the JSON representation of a [klevdb.Message]
+type Message struct {
+	Offset  int64     `json:"offset"`
+	Time    time.Time `json:"time"`
+	Key     []byte    `json:"key,omitempty"`
+	Value   []byte    `json:"value"`
+	Headers []Header  `json:"headers,omitempty"`
+}
+
+// Header is the JSON representation of a [klevdb.Header]
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type PublishRequest struct {
+	// Messages to publish, their offsets are ignored. Messages without time use the current time.
+	Messages []Message `json:"messages"`
+}
+
+type PublishResponse struct {
+	NextOffset int64 `json:"next_offset"`
+}
+
+type ConsumeResponse struct {
+	NextOffset int64     `json:"next_offset"`
+	Messages   []Message `json:"messages"`
+}
+
+type DeleteRequest struct {
+	Offsets []int64 `json:"offsets"`
+}
+
+type DeleteResponse struct {
+	Deleted     []int64 `json:"deleted"`
+	DeletedSize int64   `json:"deleted_size"`
+}
+
+type SyncResponse struct {
+	NextOffset int64 `json:"next_offset"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+var errBadRequest = errors.New("bad request")
+
+type server struct {
+	log  klevdb.BlockingLog
+	opts Options
+}
+
+// New returns a handler exposing a log over HTTP. The log is not closed by the handler.
+func New(l klevdb.BlockingLog, opts Options) http.Handler {
+	if opts.MaxCount <= 0 {
+		opts.MaxCount = 1024
+	}
+	if opts.MaxPoll <= 0 {
+		opts.MaxPoll = 30 * time.Second
+	}
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = 64 * 1024 * 1024
+	}
+
+	s := &server{log: l, opts: opts}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /publish", s.publish)
+	mux.HandleFunc("GET /consume", s.consume)
+	mux.HandleFunc("GET /events", s.events)
+	mux.HandleFunc("GET /messages/{offset}", s.get)
+	mux.HandleFunc("GET /messages/by-key/{key}", s.getByKey)
+	mux.HandleFunc("GET /messages/by-time/{time}", s.getByTime)
+	mux.HandleFunc("POST /delete", s.delete)
+	mux.HandleFunc("GET /stat", s.stat)
+	mux.HandleFunc("POST /sync", s.sync)
+	return mux
+}
+
+func (s *server) publish(w http.ResponseWriter, r *http.Request) {
+	var req PublishRequest
+	if err := s.decode(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	msgs := make([]klevdb.Message, len(req.Messages))
+	for i, msg := range req.Messages {
+		msgs[i] = fromJSON(msg)
+	}
+
+	nextOffset, err := s.log.Publish(msgs)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, PublishResponse{NextOffset: nextOffset})
+}
+
+func (s *server) consume(w http.ResponseWriter, r *http.Request) {
+	offset, err := queryInt(r, "offset", klevdb.OffsetOldest)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	maxCount, err := queryInt(r, "max_count", s.opts.MaxCount)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	maxCount = min(max(maxCount, 1), s.opts.MaxCount)
+
+	var poll time.Duration
+	if q := r.URL.Query().Get("poll"); q != "" {
+		if poll, err = time.ParseDuration(q); err != nil {
+			writeError(w, fmt.Errorf("%w: poll: %w", errBadRequest, err))
+			return
+		}
+		poll = min(poll, s.opts.MaxPoll)
+	}
+
+	key, byKey := r.URL.Query()["key"]
+	consume := func(ctx context.Context, offset int64) (int64, []klevdb.Message, error) {
+		if byKey {
+			return s.log.ConsumeByKeyBlocking(ctx, []byte(key[0]), offset, maxCount)
+		}
+		return s.log.ConsumeBlocking(ctx, offset, maxCount)
+	}
+
+	if poll <= 0 {
+		if byKey {
+			offset, msgs, err := s.log.ConsumeByKey([]byte(key[0]), offset, maxCount)
+			writeConsume(w, offset, msgs, err)
+		} else {
+			offset, msgs, err := s.log.Consume(offset, maxCount)
+			writeConsume(w, offset, msgs, err)
+		}
+		return
+	}
+
+	if offset == klevdb.OffsetNewest {
+		if offset, err = s.log.NextOffset(); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), poll)
+	defer cancel()
+
+	for {
+		nextOffset, msgs, err := consume(ctx, offset)
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			// nothing was published while polling
+			writeConsume(w, offset, nil, nil)
+			return
+		case err != nil, len(msgs) > 0, nextOffset == offset:
+			writeConsume(w, nextOffset, msgs, err)
+			return
+		}
+		// nothing matched the key yet, wait for more messages
+		offset = nextOffset
+	}
+}
+
+func writeConsume(w http.ResponseWriter, nextOffset int64, msgs []klevdb.Message, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := ConsumeResponse{NextOffset: nextOffset, Messages: make([]Message, len(msgs))}
+	for i, msg := range msgs {
+		resp.Messages[i] = toJSON(msg)
+	}
+	writeJSON(w, resp)
+}
+
+// events streams messages as Server-Sent Events, with the offset of each message as its id,
+// so clients reconnecting with Last-Event-ID continue after the last message they received
+func (s *server) events(w http.ResponseWriter, r *http.Request) {
+	offset, err := queryInt(r, "offset", klevdb.OffsetOldest)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		lastOffset, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: Last-Event-ID: %w", errBadRequest, err))
+			return
+		}
+		offset = lastOffset + 1
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	seq := s.log.AllBlocking(r.Context(), offset)
+	if key, ok := r.URL.Query()["key"]; ok {
+		seq = s.log.ByKeyBlocking(r.Context(), []byte(key[0]), offset)
+	}
+
+	for msg, err := range seq {
+		if err != nil {
+			if r.Context().Err() == nil {
+				data, _ := json.Marshal(ErrorResponse{Error: err.Error()})
+				_, _ = fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+				_ = rc.Flush()
+			}
+			return
+		}
+
+		data, err := json.Marshal(toJSON(msg))
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", msg.Offset, data); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *server) get(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.ParseInt(r.PathValue("offset"), 10, 64)
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: offset: %w", errBadRequest, err))
+		return
+	}
+	msg, err := s.log.Get(offset)
+	writeMessage(w, msg, err)
+}
+
+func (s *server) getByKey(w http.ResponseWriter, r *http.Request) {
+	msg, err := s.log.GetByKey([]byte(r.PathValue("key")))
+	writeMessage(w, msg, err)
+}
+
+func (s *server) getByTime(w http.ResponseWriter, r *http.Request) {
+	start, err := time.Parse(time.RFC3339Nano, r.PathValue("time"))
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: time: %w", errBadRequest, err))
+		return
+	}
+	msg, err := s.log.GetByTime(start)
+	writeMessage(w, msg, err)
+}
+
+func writeMessage(w http.ResponseWriter, msg klevdb.Message, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, toJSON(msg))
+}
+
+func (s *server) delete(w http.ResponseWriter, r *http.Request) {
+	var req DeleteRequest
+	if err := s.decode(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	offsets := make(map[int64]struct{}, len(req.Offsets))
+	for _, offset := range req.Offsets {
+		offsets[offset] = struct{}{}
+	}
+	deleted, deletedSize, err := klevdb.DeleteMultiOffsets(r.Context(), s.log, offsets, klevdb.DeleteMultiWithWait(0))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, DeleteResponse{Deleted: slices.Sorted(maps.Keys(deleted)), DeletedSize: deletedSize})
+}
+
+func (s *server) stat(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.log.Stat()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+func (s *server) sync(w http.ResponseWriter, r *http.Request) {
+	nextOffset, err := s.log.Sync()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, SyncResponse{NextOffset: nextOffset})
+}
+
+func (s *server) decode(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.opts.MaxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			return fmt.Errorf("%w: %w", klevdb.ErrMessageTooBig, err)
+		}
+		return fmt.Errorf("%w: %w", errBadRequest, err)
+	}
+	return nil
+}
+
+func queryInt(r *http.Request, name string, def int64) (int64, error) {
+	q := r.URL.Query().Get(name)
+	if q == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseInt(q, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %w", errBadRequest, name, err)
+	}
+	return v, nil
+}
+
+func toJSON(msg klevdb.Message) Message {
+	jmsg := Message{Offset: msg.Offset, Time: msg.Time, Key: msg.Key, Value: msg.Value}
+	for _, h := range msg.Headers {
+		jmsg.Headers = append(jmsg.Headers, Header(h))
+	}
+	return jmsg
+}
+
+func fromJSON(jmsg Message) klevdb.Message {
+	msg := klevdb.Message{Time: jmsg.Time, Key: jmsg.Key, Value: jmsg.Value}
+	for _, h := range jmsg.Headers {
+		msg.Headers = append(msg.Headers, klevdb.Header(h))
+	}
+	return msg
+}
+
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, klevdb.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errBadRequest), errors.Is(err, klevdb.ErrInvalidOffset), errors.Is(err, klevdb.ErrNoIndex):
+		return http.StatusBadRequest
+	case errors.Is(err, klevdb.ErrMessageTooBig):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, klevdb.ErrReadonly):
+		return http.StatusForbidden
+	case errors.Is(err, klevdb.ErrOffsetMismatch):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusOf(err))
+	_ = json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
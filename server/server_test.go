@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb"
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+func newTestServer(t *testing.T, opts Options) (*httptest.Server, klevdb.BlockingLog) {
+	l, err := klevdb.OpenBlocking(t.TempDir(), klevdb.Options{KeyIndex: true, TimeIndex: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, l.Close()) })
+
+	srv := httptest.NewServer(New(l, opts))
+	t.Cleanup(srv.Close)
+	return srv, l
+}
+
+func doJSON(t *testing.T, method, url string, req any, expectedStatus int, resp any) {
+	t.Helper()
+
+	var body bytes.Buffer
+	if req != nil {
+		require.NoError(t, json.NewEncoder(&body).Encode(req))
+	}
+	hreq, err := http.NewRequest(method, url, &body)
+	require.NoError(t, err)
+	hresp, err := http.DefaultClient.Do(hreq)
+	require.NoError(t, err)
+	defer hresp.Body.Close()
+
+	require.Equal(t, expectedStatus, hresp.StatusCode)
+	if resp != nil {
+		require.NoError(t, json.NewDecoder(hresp.Body).Decode(resp))
+	}
+}
+
+func publish(t *testing.T, url string, msgs []klevdb.Message) int64 {
+	t.Helper()
+	req := PublishRequest{}
+	for _, msg := range msgs {
+		req.Messages = append(req.Messages, toJSON(msg))
+	}
+	var resp PublishResponse
+	doJSON(t, http.MethodPost, url+"/publish", req, http.StatusOK, &resp)
+	return resp.NextOffset
+}
+
+func TestServer(t *testing.T) {
+	srv, _ := newTestServer(t, Options{MaxCount: 3})
+	msgs := message.Gen(5)
+	for i := range msgs {
+		msgs[i].Offset = int64(i)
+	}
+
+	require.Equal(t, int64(5), publish(t, srv.URL, msgs))
+
+	t.Run("Consume", func(t *testing.T) {
+		var resp ConsumeResponse
+		doJSON(t, http.MethodGet, srv.URL+"/consume?offset=1", nil, http.StatusOK, &resp)
+		require.Equal(t, int64(4), resp.NextOffset)
+		require.Equal(t, []Message{toJSON(msgs[1]), toJSON(msgs[2]), toJSON(msgs[3])}, resp.Messages)
+
+		doJSON(t, http.MethodGet, srv.URL+"/consume?offset=4&max_count=10", nil, http.StatusOK, &resp)
+		require.Equal(t, int64(5), resp.NextOffset)
+		require.Equal(t, []Message{toJSON(msgs[4])}, resp.Messages)
+
+		doJSON(t, http.MethodGet, srv.URL+"/consume?offset=0&key="+url.QueryEscape(string(msgs[2].Key)), nil, http.StatusOK, &resp)
+		require.Equal(t, []Message{toJSON(msgs[2])}, resp.Messages)
+
+		doJSON(t, http.MethodGet, srv.URL+"/consume?offset=5", nil, http.StatusOK, &resp)
+		require.Equal(t, int64(5), resp.NextOffset)
+		require.Empty(t, resp.Messages)
+
+		doJSON(t, http.MethodGet, srv.URL+"/consume?offset=abc", nil, http.StatusBadRequest, nil)
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		var resp Message
+		doJSON(t, http.MethodGet, srv.URL+"/messages/2", nil, http.StatusOK, &resp)
+		require.Equal(t, toJSON(msgs[2]), resp)
+
+		doJSON(t, http.MethodGet, srv.URL+"/messages/by-key/"+url.PathEscape(string(msgs[3].Key)), nil, http.StatusOK, &resp)
+		require.Equal(t, toJSON(msgs[3]), resp)
+
+		doJSON(t, http.MethodGet, srv.URL+"/messages/by-time/"+msgs[1].Time.Format(time.RFC3339Nano), nil, http.StatusOK, &resp)
+		require.Equal(t, toJSON(msgs[1]), resp)
+
+		var errResp ErrorResponse
+		doJSON(t, http.MethodGet, srv.URL+"/messages/by-key/missing", nil, http.StatusNotFound, &errResp)
+		require.NotEmpty(t, errResp.Error)
+		doJSON(t, http.MethodGet, srv.URL+"/messages/10", nil, http.StatusBadRequest, nil)
+	})
+
+	t.Run("StatSync", func(t *testing.T) {
+		var stats klevdb.Stats
+		doJSON(t, http.MethodGet, srv.URL+"/stat", nil, http.StatusOK, &stats)
+		require.Equal(t, 5, stats.Messages)
+
+		var resp SyncResponse
+		doJSON(t, http.MethodPost, srv.URL+"/sync", nil, http.StatusOK, &resp)
+		require.Equal(t, int64(5), resp.NextOffset)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		var resp DeleteResponse
+		doJSON(t, http.MethodPost, srv.URL+"/delete", DeleteRequest{Offsets: []int64{3, 0}}, http.StatusOK, &resp)
+		require.Equal(t, []int64{0, 3}, resp.Deleted)
+		require.Positive(t, resp.DeletedSize)
+
+		doJSON(t, http.MethodGet, srv.URL+"/messages/0", nil, http.StatusNotFound, nil)
+		doJSON(t, http.MethodPost, srv.URL+"/delete", map[string]any{"unknown": 1}, http.StatusBadRequest, nil)
+	})
+}
+
+func TestServerPoll(t *testing.T) {
+	srv, l := newTestServer(t, Options{})
+	msgs := message.Gen(2)
+
+	t.Run("Timeout", func(t *testing.T) {
+		var resp ConsumeResponse
+		doJSON(t, http.MethodGet, srv.URL+"/consume?offset=0&poll=10ms", nil, http.StatusOK, &resp)
+		require.Equal(t, int64(0), resp.NextOffset)
+		require.Empty(t, resp.Messages)
+	})
+
+	t.Run("Published", func(t *testing.T) {
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			_, _ = l.Publish(msgs[:1])
+		}()
+
+		var resp ConsumeResponse
+		doJSON(t, http.MethodGet, srv.URL+"/consume?offset=-1&poll=10s", nil, http.StatusOK, &resp)
+		require.Equal(t, int64(1), resp.NextOffset)
+		require.Len(t, resp.Messages, 1)
+		require.Equal(t, msgs[0].Value, resp.Messages[0].Value)
+	})
+
+	t.Run("Key", func(t *testing.T) {
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			_, _ = l.Publish([]klevdb.Message{{Key: []byte("other")}})
+			time.Sleep(10 * time.Millisecond)
+			_, _ = l.Publish(msgs[1:])
+		}()
+
+		var resp ConsumeResponse
+		doJSON(t, http.MethodGet, srv.URL+"/consume?offset=1&poll=10s&key="+url.QueryEscape(string(msgs[1].Key)), nil, http.StatusOK, &resp)
+		require.Len(t, resp.Messages, 1)
+		require.Equal(t, int64(2), resp.Messages[0].Offset)
+	})
+}
+
+func TestServerEvents(t *testing.T) {
+	srv, l := newTestServer(t, Options{})
+	msgs := message.Gen(4)
+	_, err := l.Publish(msgs[:2])
+	require.NoError(t, err)
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	scanner := bufio.NewScanner(resp.Body)
+	readEvent := func() (string, Message) {
+		var id string
+		var msg Message
+		for scanner.Scan() {
+			switch line := scanner.Text(); {
+			case line == "":
+				return id, msg
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg))
+			}
+		}
+		require.NoError(t, scanner.Err())
+		return id, msg
+	}
+
+	id, msg := readEvent()
+	require.Equal(t, "1", id)
+	require.Equal(t, msgs[1].Value, msg.Value)
+
+	_, err = l.Publish(msgs[2:])
+	require.NoError(t, err)
+
+	id, msg = readEvent()
+	require.Equal(t, "2", id)
+	require.Equal(t, msgs[2].Value, msg.Value)
+	id, _ = readEvent()
+	require.Equal(t, "3", id)
+}
@@ -0,0 +1,378 @@
+package klevdb
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klev-dev/klevdb/pkg/kdir"
+)
+
+var (
+	errStoreName   = errors.New("invalid store log name")
+	errStoreClosed = errors.New("store closed")
+	// ErrLogInUse is returned when deleting or renaming a log of a store, which is still open
+	ErrLogInUse = errors.New("log in use")
+	// ErrLogExists is returned when renaming a log of a store to a name that already exists
+	ErrLogExists = errors.New("log already exists")
+)
+
+type StoreOptions struct {
+	// When set will try to create the root directory
+	CreateDirs bool
+	// LogOptions returns the options used to open a log of the store. Defaults to the zero Options.
+	// CreateDirs is always set, since the directories of logs are created lazily.
+	LogOptions func(name string) Options
+	// GCInterval is how often the store runs GC on its open logs and closes idle ones. Defaults to 1 minute.
+	GCInterval time.Duration
+	// GCUnusedFor is passed to GC of the open logs. Defaults to GCInterval.
+	GCUnusedFor time.Duration
+	// IdleTimeout closes logs which were not in use for this duration, e.g. opened, but then closed
+	// by all users. Defaults to 5 minutes, negative keeps logs open until the store is closed.
+	IdleTimeout time.Duration
+}
+
+// Store manages multiple named logs, each in its own directory under the store root
+type Store struct {
+	dir  string
+	opts StoreOptions
+
+	logs   map[string]*storeEntry
+	closed bool
+	mu     sync.Mutex
+	cond   *sync.Cond // signals entries no longer in use by Log or GC
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type storeEntry struct {
+	log      Log
+	refs     int
+	lastUsed time.Time
+	// opening, gc and closing are set while Log or GC use the log without holding the store lock
+	opening bool
+	gc      bool
+	closing bool
+}
+
+// OpenStore opens a store at the root directory. Logs are opened on demand by [Store.Log]
+func OpenStore(dir string, opts StoreOptions) (*Store, error) {
+	if opts.LogOptions == nil {
+		opts.LogOptions = func(string) Options { return Options{} }
+	}
+	if opts.GCInterval <= 0 {
+		opts.GCInterval = time.Minute
+	}
+	if opts.GCUnusedFor <= 0 {
+		opts.GCUnusedFor = opts.GCInterval
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = 5 * time.Minute
+	}
+
+	if opts.CreateDirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("store create dirs: %w", err)
+		}
+	}
+	if _, err := os.ReadDir(dir); err != nil {
+		return nil, fmt.Errorf("store read dir: %w", err)
+	}
+
+	s := &Store{
+		dir:  dir,
+		opts: opts,
+		logs: map[string]*storeEntry{},
+
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.background()
+	return s, nil
+}
+
+// Log opens (creating if needed) the named log. The log is shared by all its users and
+// should be closed when no longer used. It stays open until it is idle (see [StoreOptions.IdleTimeout])
+func (s *Store) Log(name string) (Log, error) {
+	if !nameRe.MatchString(name) {
+		return nil, fmt.Errorf("%w: %q", errStoreName, name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entry(name, false)
+	if s.closed {
+		return nil, errStoreClosed
+	}
+	if !ok {
+		// opened without the store lock, others wait for the entry while opening
+		e = &storeEntry{opening: true}
+		s.logs[name] = e
+		s.mu.Unlock()
+
+		opts := s.opts.LogOptions(name)
+		opts.CreateDirs = true
+		l, err := Open(filepath.Join(s.dir, name), opts)
+
+		s.mu.Lock()
+		e.log, e.opening = l, false
+		s.cond.Broadcast()
+		if err != nil {
+			delete(s.logs, name)
+			return nil, err
+		}
+		if s.closed {
+			return nil, errStoreClosed // closed by Close, once it is done waiting for it
+		}
+	}
+
+	e.refs++
+	e.lastUsed = time.Now()
+	return &storeLog{Log: e.log, store: s, entry: e}, nil
+}
+
+// List returns the names of all logs in the store, open or not
+func (s *Store) List() ([]string, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("store list: %w", err)
+	}
+
+	var names []string
+	for _, f := range files {
+		if f.IsDir() && nameRe.MatchString(f.Name()) {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+// Exists returns whether the named log exists, checking the open logs before the store directory
+func (s *Store) Exists(name string) (bool, error) {
+	if !nameRe.MatchString(name) {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	e, ok := s.logs[name]
+	open := ok && !e.opening
+	s.mu.Unlock()
+	if open {
+		return true, nil
+	}
+
+	switch fi, err := os.Stat(filepath.Join(s.dir, name)); {
+	case err == nil:
+		return fi.IsDir(), nil
+	case errors.Is(err, os.ErrNotExist):
+		return false, nil
+	default:
+		return false, fmt.Errorf("store exists: %w", err)
+	}
+}
+
+// Delete deletes a log with all its data. Returns ErrLogInUse if the log is still open
+func (s *Store) Delete(name string) error {
+	if !nameRe.MatchString(name) {
+		return fmt.Errorf("%w: %q", errStoreName, name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.closeUnused(name); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(s.dir, name)
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("store delete: %w", err)
+	}
+	return kdir.SyncParent(dir)
+}
+
+// Rename renames a log. Returns ErrLogInUse if the log is still open, or ErrLogExists if the new name is taken
+func (s *Store) Rename(oldName, newName string) error {
+	for _, name := range []string{oldName, newName} {
+		if !nameRe.MatchString(name) {
+			return fmt.Errorf("%w: %q", errStoreName, name)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.closeUnused(oldName); err != nil {
+		return err
+	}
+	if _, ok := s.logs[newName]; ok {
+		return fmt.Errorf("%w: %q", ErrLogExists, newName)
+	}
+
+	oldDir, newDir := filepath.Join(s.dir, oldName), filepath.Join(s.dir, newName)
+	switch _, err := os.Stat(newDir); {
+	case err == nil:
+		return fmt.Errorf("%w: %q", ErrLogExists, newName)
+	case !errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("store rename: %w", err)
+	}
+
+	if err := os.Rename(oldDir, newDir); err != nil {
+		return fmt.Errorf("store rename: %w", err)
+	}
+	return kdir.Sync(s.dir)
+}
+
+// Close stops the background GC and closes all open logs, even if still in use
+func (s *Store) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.stop)
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(s.logs)) {
+		e, ok := s.entry(name, true)
+		if !ok {
+			continue
+		}
+		if err := e.log.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("store close %s: %w", name, err))
+		}
+		delete(s.logs, name)
+	}
+	return errors.Join(errs...)
+}
+
+// entry returns the entry of an open log, waiting while Log opens it or GC closes it, or also while
+// GC runs on it with forClose. Expects mu to be held
+func (s *Store) entry(name string, forClose bool) (*storeEntry, bool) {
+	for {
+		e, ok := s.logs[name]
+		if !ok || !(e.opening || e.closing || (forClose && e.gc)) {
+			return e, ok
+		}
+		s.cond.Wait()
+	}
+}
+
+// closeUnused closes a log before changing its directory. Expects mu to be held
+func (s *Store) closeUnused(name string) error {
+	e, ok := s.entry(name, true)
+	switch {
+	case !ok:
+		return nil
+	case e.refs > 0:
+		return fmt.Errorf("%w: %q", ErrLogInUse, name)
+	}
+
+	delete(s.logs, name)
+	return e.log.Close()
+}
+
+func (s *Store) release(e *storeEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.refs--
+	e.lastUsed = time.Now()
+}
+
+func (s *Store) background() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.opts.GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			_ = s.GC()
+		}
+	}
+}
+
+// GC runs GC on all open logs and closes the idle ones. It is called periodically
+// in the background (see [StoreOptions.GCInterval]), but can also be called manually.
+// The store is only locked while collecting the logs, so it can be used during GC.
+func (s *Store) GC() error {
+	s.mu.Lock()
+	idleBefore := time.Now().Add(-s.opts.IdleTimeout)
+	var idle, live []string
+	for _, name := range slices.Sorted(maps.Keys(s.logs)) {
+		e := s.logs[name]
+		switch {
+		case e.opening || e.gc || e.closing:
+			// still opening, or used by another GC
+		case s.opts.IdleTimeout > 0 && e.refs == 0 && e.lastUsed.Before(idleBefore):
+			e.closing = true
+			idle = append(idle, name)
+		default:
+			e.gc = true
+			live = append(live, name)
+		}
+	}
+	entries := maps.Clone(s.logs)
+	s.mu.Unlock()
+
+	var errs []error
+	for _, name := range idle {
+		err := entries[name].log.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("store close %s: %w", name, err))
+		}
+
+		s.mu.Lock()
+		delete(s.logs, name)
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+
+	for _, name := range live {
+		e := entries[name]
+		if err := e.log.GC(s.opts.GCUnusedFor); err != nil {
+			errs = append(errs, fmt.Errorf("store gc %s: %w", name, err))
+		}
+
+		s.mu.Lock()
+		e.gc = false
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// storeLog is a handle to a log of a store, closing it releases the log
+type storeLog struct {
+	Log
+	store  *Store
+	entry  *storeEntry
+	closed atomic.Bool
+}
+
+func (l *storeLog) Close() error {
+	if l.closed.CompareAndSwap(false, true) {
+		l.store.release(l.entry)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package klevdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/klev-dev/klevdb/pkg/message"
+)
+
+func TestStore(t *testing.T) {
+	msgs := message.Gen(10)
+	dir := filepath.Join(t.TempDir(), "store")
+
+	s, err := OpenStore(dir, StoreOptions{
+		CreateDirs: true,
+		LogOptions: func(name string) Options {
+			return Options{KeyIndex: name == "keyed"}
+		},
+		IdleTimeout: -1,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	a, err := s.Log("tenant-a")
+	require.NoError(t, err)
+	publishBatched(t, a, msgs[:5], 5)
+
+	keyed, err := s.Log("keyed")
+	require.NoError(t, err)
+	publishBatched(t, keyed, msgs, 5)
+	_, err = keyed.GetByKey(msgs[0].Key)
+	require.NoError(t, err)
+	_, err = a.GetByKey(msgs[0].Key)
+	require.ErrorIs(t, err, ErrNoIndex)
+
+	// shared by all users
+	a2, err := s.Log("tenant-a")
+	require.NoError(t, err)
+	next, err := a2.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, int64(5), next)
+
+	names, err := s.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{"keyed", "tenant-a"}, names)
+
+	_, err = s.Log("../escape")
+	require.ErrorIs(t, err, errStoreName)
+
+	t.Run("InUse", func(t *testing.T) {
+		require.ErrorIs(t, s.Delete("tenant-a"), ErrLogInUse)
+		require.ErrorIs(t, s.Rename("tenant-a", "tenant-b"), ErrLogInUse)
+
+		require.NoError(t, a.Close())
+		require.NoError(t, a.Close()) // only released once
+		require.ErrorIs(t, s.Delete("tenant-a"), ErrLogInUse)
+		require.NoError(t, a2.Close())
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		require.ErrorIs(t, s.Rename("tenant-a", "keyed"), ErrLogExists)
+		require.NoError(t, s.Rename("tenant-a", "tenant-b"))
+
+		b, err := s.Log("tenant-b")
+		require.NoError(t, err)
+		next, err := b.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, int64(5), next)
+		require.NoError(t, b.Close())
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		require.NoError(t, s.Delete("tenant-b"))
+		names, err := s.List()
+		require.NoError(t, err)
+		require.Equal(t, []string{"keyed"}, names)
+	})
+
+	t.Run("Exists", func(t *testing.T) {
+		for name, expected := range map[string]bool{
+			"keyed":     true, // open
+			"tenant-b":  false,
+			"../escape": false,
+		} {
+			exists, err := s.Exists(name)
+			require.NoError(t, err)
+			require.Equal(t, expected, exists, name)
+		}
+
+		// not opened by the store yet
+		require.NoError(t, os.Mkdir(filepath.Join(s.dir, "closed"), 0700))
+		exists, err := s.Exists("closed")
+		require.NoError(t, err)
+		require.True(t, exists)
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		s, err := OpenStore(t.TempDir(), StoreOptions{IdleTimeout: time.Millisecond})
+		require.NoError(t, err)
+		defer s.Close()
+
+		l, err := s.Log("idle")
+		require.NoError(t, err)
+		publishBatched(t, l, msgs, 5)
+
+		time.Sleep(5 * time.Millisecond)
+		require.NoError(t, s.GC())
+		require.Len(t, s.logs, 1) // still in use
+
+		require.NoError(t, l.Close())
+		time.Sleep(5 * time.Millisecond)
+		require.NoError(t, s.GC())
+		require.Empty(t, s.logs)
+
+		// reopened on demand
+		l, err = s.Log("idle")
+		require.NoError(t, err)
+		defer l.Close()
+		next, err := l.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, int64(len(msgs)), next)
+	})
+
+	t.Run("Opening", func(t *testing.T) {
+		openStarted, openRelease := make(chan struct{}), make(chan struct{})
+		s, err := OpenStore(t.TempDir(), StoreOptions{
+			LogOptions: func(name string) Options {
+				if name == "slow" {
+					close(openStarted)
+					<-openRelease
+				}
+				return Options{}
+			},
+			IdleTimeout: -1,
+		})
+		require.NoError(t, err)
+		defer s.Close()
+
+		other, err := s.Log("other")
+		require.NoError(t, err)
+
+		opened := make(chan Log)
+		go func() {
+			l, err := s.Log("slow")
+			assert.NoError(t, err)
+			opened <- l
+		}()
+		<-openStarted
+
+		// the store can be used while a log is opening
+		require.NoError(t, other.Close())
+		exists, err := s.Exists("other")
+		require.NoError(t, err)
+		require.True(t, exists)
+		require.NoError(t, s.GC())
+
+		// but deleting the log waits for it to be opened
+		deleted := make(chan error)
+		go func() { deleted <- s.Delete("slow") }()
+		select {
+		case <-deleted:
+			t.Fatal("deleted while opening")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		close(openRelease)
+		l := <-opened
+		require.ErrorIs(t, <-deleted, ErrLogInUse)
+		require.NoError(t, l.Close())
+		require.NoError(t, s.Delete("slow"))
+	})
+
+	t.Run("Unlocked", func(t *testing.T) {
+		gcStarted, gcRelease := make(chan struct{}), make(chan struct{})
+		s, err := OpenStore(t.TempDir(), StoreOptions{
+			LogOptions: func(name string) Options {
+				return Options{
+					Rollover: message.Size(msgs[0], message.V2),
+					Events: EventsFunc(func(ev Event) {
+						if _, ok := ev.(IndexUnloaded); ok && name == "slow" {
+							close(gcStarted)
+							<-gcRelease
+						}
+					}),
+				}
+			},
+			GCUnusedFor: time.Nanosecond,
+			IdleTimeout: -1,
+		})
+		require.NoError(t, err)
+		defer s.Close()
+
+		l, err := s.Log("slow")
+		require.NoError(t, err)
+		publishBatched(t, l, msgs[:2], 1)
+		require.NoError(t, l.Close())
+
+		gcDone := make(chan error)
+		go func() { gcDone <- s.GC() }()
+		<-gcStarted
+
+		// the store can be used while a log is in GC
+		other, err := s.Log("other")
+		require.NoError(t, err)
+		require.NoError(t, other.Close())
+		names, err := s.List()
+		require.NoError(t, err)
+		require.Equal(t, []string{"other", "slow"}, names)
+
+		// but the log in GC is deleted only after it
+		deleted := make(chan error)
+		go func() { deleted <- s.Delete("slow") }()
+		select {
+		case <-deleted:
+			t.Fatal("deleted during gc")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		close(gcRelease)
+		require.NoError(t, <-gcDone)
+		require.NoError(t, <-deleted)
+	})
+
+	require.NoError(t, keyed.Close())
+	require.NoError(t, s.Close())
+	_, err = s.Log("keyed")
+	require.ErrorIs(t, err, errStoreClosed)
+}
@@ -22,24 +22,19 @@ func FindByCount(ctx context.Context, l Log, max int) (map[int64]struct{}, error
 	var offsets = map[int64]struct{}{}
 
 	toRemove := stats.Messages - max
-	for offset := OffsetOldest; offset < maxOffset && toRemove > 0; {
-		nextOffset, msgs, err := l.Consume(offset, 32)
+	for msg, err := range l.All(ctx, OffsetOldest) {
 		if err != nil {
 			return nil, err
 		}
-		offset = nextOffset
-
-		for _, msg := range msgs {
-			offsets[msg.Offset] = struct{}{}
-			toRemove--
-
-			if toRemove <= 0 {
-				break
-			}
+		if msg.Offset >= maxOffset {
+			break
 		}
 
-		if err := ctx.Err(); err != nil {
-			return nil, err
+		offsets[msg.Offset] = struct{}{}
+		toRemove--
+
+		if toRemove <= 0 {
+			break
 		}
 	}
 
@@ -23,23 +23,14 @@ func FindByOffset(ctx context.Context, l Log, before int64) (map[int64]struct{},
 	}
 
 	var offsets = map[int64]struct{}{}
-	for offset := OffsetOldest; offset < maxOffset; {
-		nextOffset, msgs, err := l.Consume(offset, 32)
+	for msg, err := range l.All(ctx, OffsetOldest) {
 		if err != nil {
 			return nil, err
 		}
-		offset = nextOffset
-
-		for _, msg := range msgs {
-			if msg.Offset >= before {
-				break
-			}
-			offsets[msg.Offset] = struct{}{}
-		}
-
-		if err := ctx.Err(); err != nil {
-			return nil, err
+		if msg.Offset >= maxOffset {
+			break
 		}
+		offsets[msg.Offset] = struct{}{}
 	}
 
 	if err := ctx.Err(); err != nil {
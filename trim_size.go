@@ -4,13 +4,14 @@ import (
 	"context"
 )
 
-// FindBySize returns a set of offsets for messages that if deleted will decrease the log size to sz
+// FindBySize returns a set of offsets for messages that if deleted will decrease the log size to sz.
+// The size is the logical size of the log (see Stats.LogicalSize), before compression, same as [Log.Size]
 func FindBySize(ctx context.Context, l Log, sz int64) (map[int64]struct{}, error) {
 	stats, err := l.Stat()
 	switch {
 	case err != nil:
 		return nil, err
-	case stats.Size < sz:
+	case stats.LogicalSize < sz:
 		return nil, nil
 	}
 
@@ -21,25 +22,20 @@ func FindBySize(ctx context.Context, l Log, sz int64) (map[int64]struct{}, error
 
 	var offsets = map[int64]struct{}{}
 
-	total := stats.Size
-	for offset := OffsetOldest; offset < maxOffset && total >= sz; {
-		nextOffset, msgs, err := l.Consume(offset, 32)
+	total := stats.LogicalSize
+	for msg, err := range l.All(ctx, OffsetOldest) {
 		if err != nil {
 			return nil, err
 		}
-		offset = nextOffset
-
-		for _, msg := range msgs {
-			offsets[msg.Offset] = struct{}{}
-			total -= l.Size(msg)
-
-			if total < sz {
-				break
-			}
+		if msg.Offset >= maxOffset {
+			break
 		}
 
-		if err := ctx.Err(); err != nil {
-			return nil, err
+		offsets[msg.Offset] = struct{}{}
+		total -= l.Size(msg)
+
+		if total < sz {
+			break
 		}
 	}
 
@@ -50,7 +46,7 @@ func FindBySize(ctx context.Context, l Log, sz int64) (map[int64]struct{}, error
 	return offsets, nil
 }
 
-// TrimBySize tries to remove messages until log size is less than sz
+// TrimBySize tries to remove messages until the logical log size is less than sz, see [FindBySize]
 //
 // returns the messages it deleted and the amount of storage freed
 func TrimBySize(ctx context.Context, l Log, sz int64) ([]Message, int64, error) {
@@ -58,4 +58,26 @@ func TestTrimBySize(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, int64(10), msg.Offset)
 	})
+
+	t.Run("Compressed", func(t *testing.T) {
+		l, err := Open(t.TempDir(), Options{Compression: CompressionFlate})
+		require.NoError(t, err)
+		defer l.Close()
+
+		_, err = l.Publish(msgs)
+		require.NoError(t, err)
+
+		stat, err := l.Stat()
+		require.NoError(t, err)
+		require.Less(t, stat.Size, stat.LogicalSize)
+
+		// the size is logical, so it counts the same messages as uncompressed
+		off, err := FindBySize(context.TODO(), l, stat.LogicalSize-l.Size(msgs[0])*10+1)
+		require.NoError(t, err)
+		require.Len(t, off, 10)
+
+		off, err = FindBySize(context.TODO(), l, stat.LogicalSize+1)
+		require.NoError(t, err)
+		require.Empty(t, off)
+	})
 }
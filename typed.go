@@ -1,6 +1,10 @@
 package klevdb
 
-import "time"
+import (
+	"context"
+	"iter"
+	"time"
+)
 
 // TMessage represents a typed [Message]
 type TMessage[K any, V any] struct {
@@ -10,6 +14,7 @@ type TMessage[K any, V any] struct {
 	KeyEmpty   bool
 	Value      V
 	ValueEmpty bool
+	Headers    []Header
 }
 
 // TLog is a typed [Log] which encodes/decodes keys and values to bytes.
@@ -17,15 +22,36 @@ type TLog[K any, V any] interface {
 	// Publish see [Log.Publish]
 	Publish(messages []TMessage[K, V]) (nextOffset int64, err error)
 
+	// PublishIf see [Log.PublishIf]
+	PublishIf(expectedNextOffset int64, messages []TMessage[K, V]) (nextOffset int64, err error)
+
+	// PublishIfKey see [Log.PublishIfKey], the key is the one of the message
+	PublishIfKey(expectedOffset int64, message TMessage[K, V]) (nextOffset int64, err error)
+
+	// PublishIdempotent see [Log.PublishIdempotent]
+	PublishIdempotent(producerID string, sequence int64, messages []TMessage[K, V]) (nextOffset int64, err error)
+
 	// NextOffset see [Log.NextOffset]
 	NextOffset() (nextOffset int64, err error)
 
 	// Consume see [Log.Consume]
 	Consume(offset int64, maxCount int64) (nextOffset int64, messages []TMessage[K, V], err error)
 
+	// ConsumeBackward see [Log.ConsumeBackward]
+	ConsumeBackward(offset int64, maxCount int64) (nextOffset int64, messages []TMessage[K, V], err error)
+
 	// ConsumeByKey see [Log.ConsumeByKey]
 	ConsumeByKey(key K, empty bool, offset int64, maxCount int64) (nextOffset int64, messages []TMessage[K, V], err error)
 
+	// All see [Log.All]
+	All(ctx context.Context, from int64) iter.Seq2[TMessage[K, V], error]
+
+	// ByKey see [Log.ByKey]
+	ByKey(ctx context.Context, key K, empty bool, from int64) iter.Seq2[TMessage[K, V], error]
+
+	// ByTimeRange see [Log.ByTimeRange]
+	ByTimeRange(ctx context.Context, start, end time.Time) iter.Seq2[TMessage[K, V], error]
+
 	// Get see [Log.Get]
 	Get(offset int64) (message TMessage[K, V], err error)
 
@@ -50,6 +76,12 @@ type TLog[K any, V any] interface {
 	// Stat see [Log.Stat]
 	Stat() (Stats, error)
 
+	// RetentionStats see [Log.RetentionStats]
+	RetentionStats() RetentionStats
+
+	// Dir see [Log.Dir]
+	Dir() string
+
 	// Backup see [Log.Backup]
 	Backup(dir string) error
 
@@ -88,18 +120,41 @@ type tlog[K any, V any] struct {
 }
 
 func (l *tlog[K, V]) Publish(tmessages []TMessage[K, V]) (int64, error) {
-	var err error
-	messages := make([]Message, len(tmessages))
-	for i, tmsg := range tmessages {
-		messages[i], err = l.encode(tmsg)
-		if err != nil {
-			return OffsetInvalid, err
-		}
+	messages, err := l.encodeAll(tmessages)
+	if err != nil {
+		return OffsetInvalid, err
 	}
 
 	return l.Log.Publish(messages)
 }
 
+func (l *tlog[K, V]) PublishIf(expectedNextOffset int64, tmessages []TMessage[K, V]) (int64, error) {
+	messages, err := l.encodeAll(tmessages)
+	if err != nil {
+		return OffsetInvalid, err
+	}
+
+	return l.Log.PublishIf(expectedNextOffset, messages)
+}
+
+func (l *tlog[K, V]) PublishIfKey(expectedOffset int64, tmessage TMessage[K, V]) (int64, error) {
+	message, err := l.encode(tmessage)
+	if err != nil {
+		return OffsetInvalid, err
+	}
+
+	return l.Log.PublishIfKey(message.Key, expectedOffset, message)
+}
+
+func (l *tlog[K, V]) PublishIdempotent(producerID string, sequence int64, tmessages []TMessage[K, V]) (int64, error) {
+	messages, err := l.encodeAll(tmessages)
+	if err != nil {
+		return OffsetInvalid, err
+	}
+
+	return l.Log.PublishIdempotent(producerID, sequence, messages)
+}
+
 func (l *tlog[K, V]) Consume(offset int64, maxCount int64) (int64, []TMessage[K, V], error) {
 	nextOffset, messages, err := l.Log.Consume(offset, maxCount)
 	if err != nil {
@@ -119,6 +174,25 @@ func (l *tlog[K, V]) Consume(offset int64, maxCount int64) (int64, []TMessage[K,
 	return nextOffset, tmessages, nil
 }
 
+func (l *tlog[K, V]) ConsumeBackward(offset int64, maxCount int64) (int64, []TMessage[K, V], error) {
+	nextOffset, messages, err := l.Log.ConsumeBackward(offset, maxCount)
+	if err != nil {
+		return OffsetInvalid, nil, err
+	}
+	if len(messages) == 0 {
+		return nextOffset, nil, nil
+	}
+
+	tmessages := make([]TMessage[K, V], len(messages))
+	for i, msg := range messages {
+		tmessages[i], err = l.decode(msg)
+		if err != nil {
+			return OffsetInvalid, nil, err
+		}
+	}
+	return nextOffset, tmessages, nil
+}
+
 func (l *tlog[K, V]) ConsumeByKey(key K, empty bool, offset int64, maxCount int64) (int64, []TMessage[K, V], error) {
 	kbytes, err := l.keyCodec.Encode(key, empty)
 	if err != nil {
@@ -143,6 +217,35 @@ func (l *tlog[K, V]) ConsumeByKey(key K, empty bool, offset int64, maxCount int6
 	return nextOffset, tmessages, nil
 }
 
+func (l *tlog[K, V]) All(ctx context.Context, from int64) iter.Seq2[TMessage[K, V], error] {
+	return consumeSeq(ctx, from, false, TMessage[K, V]{Offset: OffsetInvalid}, l.Consume)
+}
+
+func (l *tlog[K, V]) ByKey(ctx context.Context, key K, empty bool, from int64) iter.Seq2[TMessage[K, V], error] {
+	return consumeSeq(ctx, from, false, TMessage[K, V]{Offset: OffsetInvalid}, func(offset int64, maxCount int64) (int64, []TMessage[K, V], error) {
+		return l.ConsumeByKey(key, empty, offset, maxCount)
+	})
+}
+
+func (l *tlog[K, V]) ByTimeRange(ctx context.Context, start, end time.Time) iter.Seq2[TMessage[K, V], error] {
+	return func(yield func(TMessage[K, V], error) bool) {
+		for msg, err := range l.Log.ByTimeRange(ctx, start, end) {
+			if err != nil {
+				yield(TMessage[K, V]{Offset: OffsetInvalid}, err)
+				return
+			}
+			tmsg, err := l.decode(msg)
+			if err != nil {
+				yield(TMessage[K, V]{Offset: OffsetInvalid}, err)
+				return
+			}
+			if !yield(tmsg, nil) {
+				return
+			}
+		}
+	}
+}
+
 func (l *tlog[K, V]) Get(offset int64) (TMessage[K, V], error) {
 	msg, err := l.Log.Get(offset)
 	if err != nil {
@@ -202,6 +305,7 @@ func (l *tlog[K, V]) Raw() Log {
 func (l *tlog[K, V]) encode(tmsg TMessage[K, V]) (msg Message, err error) {
 	msg.Offset = tmsg.Offset
 	msg.Time = tmsg.Time
+	msg.Headers = tmsg.Headers
 
 	msg.Key, err = l.keyCodec.Encode(tmsg.Key, tmsg.KeyEmpty)
 	if err != nil {
@@ -216,9 +320,22 @@ func (l *tlog[K, V]) encode(tmsg TMessage[K, V]) (msg Message, err error) {
 	return msg, nil
 }
 
+func (l *tlog[K, V]) encodeAll(tmessages []TMessage[K, V]) ([]Message, error) {
+	var err error
+	messages := make([]Message, len(tmessages))
+	for i, tmsg := range tmessages {
+		messages[i], err = l.encode(tmsg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
 func (l *tlog[K, V]) decode(msg Message) (tmsg TMessage[K, V], err error) {
 	tmsg.Offset = msg.Offset
 	tmsg.Time = msg.Time
+	tmsg.Headers = msg.Headers
 
 	tmsg.Key, tmsg.KeyEmpty, err = l.keyCodec.Decode(msg.Key)
 	if err != nil {
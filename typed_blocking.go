@@ -2,6 +2,7 @@ package klevdb
 
 import (
 	"context"
+	"iter"
 
 	"github.com/klev-dev/klevdb/pkg/notify"
 )
@@ -15,6 +16,12 @@ type TBlockingLog[K any, V any] interface {
 
 	// ConsumeByKeyBlocking see [BlockingLog.ConsumeByKeyBlocking]
 	ConsumeByKeyBlocking(ctx context.Context, key K, empty bool, offset int64, maxCount int64) (nextOffset int64, messages []TMessage[K, V], err error)
+
+	// AllBlocking see [BlockingLog.AllBlocking]
+	AllBlocking(ctx context.Context, from int64) iter.Seq2[TMessage[K, V], error]
+
+	// ByKeyBlocking see [BlockingLog.ByKeyBlocking]
+	ByKeyBlocking(ctx context.Context, key K, empty bool, from int64) iter.Seq2[TMessage[K, V], error]
 }
 
 // OpenTBlocking opens a [TLog] and wraps it with support for blocking consume
@@ -50,6 +57,36 @@ func (l *tlogBlocking[K, V]) Publish(tmessages []TMessage[K, V]) (int64, error)
 	return nextOffset, nil
 }
 
+func (l *tlogBlocking[K, V]) PublishIf(expectedNextOffset int64, tmessages []TMessage[K, V]) (int64, error) {
+	nextOffset, err := l.TLog.PublishIf(expectedNextOffset, tmessages)
+	if err != nil {
+		return OffsetInvalid, err
+	}
+
+	l.notify.Set(nextOffset)
+	return nextOffset, nil
+}
+
+func (l *tlogBlocking[K, V]) PublishIfKey(expectedOffset int64, tmessage TMessage[K, V]) (int64, error) {
+	nextOffset, err := l.TLog.PublishIfKey(expectedOffset, tmessage)
+	if err != nil {
+		return OffsetInvalid, err
+	}
+
+	l.notify.Set(nextOffset)
+	return nextOffset, nil
+}
+
+func (l *tlogBlocking[K, V]) PublishIdempotent(producerID string, sequence int64, tmessages []TMessage[K, V]) (int64, error) {
+	nextOffset, err := l.TLog.PublishIdempotent(producerID, sequence, tmessages)
+	if err != nil {
+		return OffsetInvalid, err
+	}
+
+	l.notify.Set(nextOffset)
+	return nextOffset, nil
+}
+
 func (l *tlogBlocking[K, V]) ConsumeBlocking(ctx context.Context, offset int64, maxCount int64) (int64, []TMessage[K, V], error) {
 	if err := l.notify.Wait(ctx, offset); err != nil {
 		return 0, nil, err
@@ -64,6 +101,18 @@ func (l *tlogBlocking[K, V]) ConsumeByKeyBlocking(ctx context.Context, key K, em
 	return l.ConsumeByKey(key, empty, offset, maxCount)
 }
 
+func (l *tlogBlocking[K, V]) AllBlocking(ctx context.Context, from int64) iter.Seq2[TMessage[K, V], error] {
+	return consumeSeq(ctx, from, true, TMessage[K, V]{Offset: OffsetInvalid}, func(offset int64, maxCount int64) (int64, []TMessage[K, V], error) {
+		return l.ConsumeBlocking(ctx, offset, maxCount)
+	})
+}
+
+func (l *tlogBlocking[K, V]) ByKeyBlocking(ctx context.Context, key K, empty bool, from int64) iter.Seq2[TMessage[K, V], error] {
+	return consumeSeq(ctx, from, true, TMessage[K, V]{Offset: OffsetInvalid}, func(offset int64, maxCount int64) (int64, []TMessage[K, V], error) {
+		return l.ConsumeByKeyBlocking(ctx, key, empty, offset, maxCount)
+	})
+}
+
 func (l *tlogBlocking[K, V]) Close() error {
 	if err := l.notify.Close(); err != nil {
 		return err
@@ -1,7 +1,10 @@
 package klevdb
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -62,3 +65,152 @@ func TestKV(t *testing.T) {
 	require.Equal(t, tobj{""}, msgs[3].Value)
 	require.True(t, msgs[3].ValueEmpty)
 }
+
+func TestKVHeaders(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenT[tobj, tobj](dir, Options{Version: VersionOptions{NewSegmentsVersion: V3}}, JsonCodec[tobj]{}, JsonCodec[tobj]{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	headers := []Header{{Key: "content-type", Value: []byte("application/json")}}
+	_, err = l.Publish([]TMessage[tobj, tobj]{
+		{
+			Key:     tobj{"hello"},
+			Value:   tobj{"world"},
+			Headers: headers,
+		},
+	})
+	require.NoError(t, err)
+
+	msg, err := l.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, headers, msg.Headers)
+}
+
+func TestKVIter(t *testing.T) {
+	l, err := OpenTBlocking[string, tobj](t.TempDir(), Options{KeyIndex: true, TimeIndex: true}, StringCodec, JsonCodec[tobj]{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var tmsgs []TMessage[string, tobj]
+	for i := range 10 {
+		tmsgs = append(tmsgs, TMessage[string, tobj]{
+			Offset: int64(i),
+			Time:   start.Add(time.Duration(i) * time.Second),
+			Key:    fmt.Sprintf("k%d", i%2),
+			Value:  tobj{fmt.Sprintf("v%d", i)},
+		})
+	}
+	_, err = l.Publish(tmsgs)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	var actual []TMessage[string, tobj]
+	for msg, err := range l.All(ctx, OffsetOldest) {
+		require.NoError(t, err)
+		actual = append(actual, msg)
+	}
+	require.Equal(t, tmsgs, actual)
+
+	actual = nil
+	for msg, err := range l.ByKey(ctx, "k1", false, OffsetOldest) {
+		require.NoError(t, err)
+		actual = append(actual, msg)
+	}
+	require.Equal(t, []TMessage[string, tobj]{tmsgs[1], tmsgs[3], tmsgs[5], tmsgs[7], tmsgs[9]}, actual)
+
+	actual = nil
+	for msg, err := range l.ByTimeRange(ctx, tmsgs[2].Time, tmsgs[5].Time) {
+		require.NoError(t, err)
+		actual = append(actual, msg)
+	}
+	require.Equal(t, tmsgs[2:5], actual)
+
+	actual = nil
+	for msg, err := range l.AllBlocking(ctx, 8) {
+		require.NoError(t, err)
+		actual = append(actual, msg)
+		if len(actual) == 2 {
+			break
+		}
+	}
+	require.Equal(t, tmsgs[8:], actual)
+}
+
+func TestKVConsumeBackward(t *testing.T) {
+	l, err := OpenT[string, string](t.TempDir(), Options{}, StringCodec, StringCodec)
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = l.Publish([]TMessage[string, string]{
+		{Key: "a", Value: "1"},
+		{Key: "b", Value: "2"},
+		{Key: "c", Value: "3"},
+	})
+	require.NoError(t, err)
+
+	next, msgs, err := l.ConsumeBackward(OffsetNewest, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), next)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "c", msgs[0].Key)
+	require.Equal(t, "b", msgs[1].Key)
+}
+
+func TestKVPublishIf(t *testing.T) {
+	l, err := OpenTBlocking[string, string](t.TempDir(), Options{}, StringCodec, StringCodec)
+	require.NoError(t, err)
+	defer l.Close()
+
+	next, err := l.PublishIf(0, []TMessage[string, string]{{Key: "a", Value: "1"}})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), next)
+
+	_, err = l.PublishIf(0, []TMessage[string, string]{{Key: "b", Value: "2"}})
+	require.ErrorIs(t, err, ErrOffsetMismatch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	next, msgs, err := l.ConsumeBlocking(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), next)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "a", msgs[0].Key)
+}
+
+func TestKVPublishIfKey(t *testing.T) {
+	l, err := OpenT[string, string](t.TempDir(), Options{KeyIndex: true}, StringCodec, StringCodec)
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = l.PublishIfKey(OffsetInvalid, TMessage[string, string]{Key: "a", Value: "1"})
+	require.NoError(t, err)
+
+	_, err = l.PublishIfKey(OffsetInvalid, TMessage[string, string]{Key: "a", Value: "2"})
+	require.ErrorIs(t, err, ErrOffsetMismatch)
+
+	_, err = l.PublishIfKey(0, TMessage[string, string]{Key: "a", Value: "2"})
+	require.NoError(t, err)
+
+	msg, err := l.GetByKey("a", false)
+	require.NoError(t, err)
+	require.Equal(t, "2", msg.Value)
+}
+
+func TestKVPublishIdempotent(t *testing.T) {
+	l, err := OpenT[string, string](t.TempDir(), Options{Idempotent: true}, StringCodec, StringCodec)
+	require.NoError(t, err)
+	defer l.Close()
+
+	batch := []TMessage[string, string]{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}
+	for range 2 {
+		next, err := l.PublishIdempotent("p", 0, batch)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), next)
+	}
+
+	next, err := l.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), next)
+}